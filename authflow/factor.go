@@ -0,0 +1,111 @@
+package authflow
+
+import (
+	"fmt"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// Factor is one step of a login. Factors are checked in the order they were
+// registered, and the first one the user still has to complete is next.
+type Factor interface {
+	// Name identifies the factor, e.g. utils.FactorTOTP
+	Name() string
+	// Path is the page where the user completes the factor
+	Path() string
+	// Required reports whether the user has to complete the factor. An error
+	// means it couldn't be decided, and the login must not go on.
+	Required(user *models.User) (bool, error)
+	// Satisfied reports whether the authentication state shows the factor was completed
+	Satisfied(state *utils.AuthState) bool
+}
+
+// factors holds the registered factors in login order
+var factors []Factor
+
+// Register adds a factor to the end of the login order
+func Register(factor Factor) {
+	factors = append(factors, factor)
+}
+
+// Factors returns the registered factors in login order
+func Factors() []Factor {
+	return append([]Factor(nil), factors...)
+}
+
+// Pending returns the first factor the user still has to complete, or nil if
+// the authentication state satisfies every required factor
+func Pending(user *models.User, state *utils.AuthState) (Factor, error) {
+	for _, factor := range factors {
+		required, err := factor.Required(user)
+		if err != nil {
+			return nil, err
+		}
+		if required && !factor.Satisfied(state) {
+			return factor, nil
+		}
+	}
+	return nil, nil
+}
+
+func init() {
+	Register(primaryFactor{})
+	Register(totpFactor{})
+	Register(webAuthnFactor{})
+	Register(faceFactor{})
+	Register(enrollmentStep{})
+}
+
+// primaryFactor is the password or OAuth sign-in that starts every login
+type primaryFactor struct{}
+
+func (primaryFactor) Name() string                             { return utils.FactorPassword }
+func (primaryFactor) Path() string                             { return "/login" }
+func (primaryFactor) Required(user *models.User) (bool, error) { return true, nil }
+func (primaryFactor) Satisfied(state *utils.AuthState) bool    { return state.HasPrimaryFactor() }
+
+// totpFactor is a one-time password from an authenticator app, HOTP token, email or SMS, or a recovery code in its place
+type totpFactor struct{}
+
+func (totpFactor) Name() string                             { return utils.FactorTOTP }
+func (totpFactor) Path() string                             { return "/verify-2fa" }
+func (totpFactor) Required(user *models.User) (bool, error) { return user.TwoFAEnabled, nil }
+func (totpFactor) Satisfied(state *utils.AuthState) bool    { return state.HasTwoFactor() }
+
+// webAuthnFactor is a registered security key
+type webAuthnFactor struct{}
+
+func (webAuthnFactor) Name() string                             { return utils.FactorWebAuthn }
+func (webAuthnFactor) Path() string                             { return "/verify-webauthn" }
+func (webAuthnFactor) Required(user *models.User) (bool, error) { return user.WebAuthnEnabled, nil }
+func (webAuthnFactor) Satisfied(state *utils.AuthState) bool {
+	return state.Has(utils.FactorWebAuthn)
+}
+
+// faceFactor is a match against the enrolled face
+type faceFactor struct{}
+
+func (faceFactor) Name() string                             { return utils.FactorFace }
+func (faceFactor) Path() string                             { return "/verify-face" }
+func (faceFactor) Required(user *models.User) (bool, error) { return user.FaceAuthEnabled, nil }
+func (faceFactor) Satisfied(state *utils.AuthState) bool    { return state.Has(utils.FactorFace) }
+
+// EnrollmentStep names the last login step, where a user who doesn't meet an
+// enforced MFA policy enrolls the factors it requires before being signed in
+const EnrollmentStep = "mfa_enrollment"
+
+// enrollmentStep is not a factor the user proves but one they must set up. It
+// is never satisfied; it stops being required once the user meets every policy.
+type enrollmentStep struct{}
+
+func (enrollmentStep) Name() string                          { return EnrollmentStep }
+func (enrollmentStep) Path() string                          { return "/setup-2fa" }
+func (enrollmentStep) Satisfied(state *utils.AuthState) bool { return false }
+func (enrollmentStep) Required(user *models.User) (bool, error) {
+	violation, err := models.CheckMFACompliance(user)
+	if err != nil {
+		return false, fmt.Errorf("failed to check MFA policies for user %d: %v", user.ID, err)
+	}
+	return violation != nil && violation.Enforced(), nil
+}
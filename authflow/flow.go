@@ -0,0 +1,230 @@
+package authflow
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// FlowTTL is how long a user has to complete the remaining factors after the first one
+const FlowTTL = 10 * time.Minute
+
+// sessionKey is the session key holding the ID of the login in progress
+const sessionKey = "auth_flow_id"
+
+// ErrNoFlow is returned when the session has no login in progress, or it has expired
+var ErrNoFlow = errors.New("no login in progress")
+
+// ErrWrongFactor is returned when completing a factor that is not the next step
+var ErrWrongFactor = errors.New("factor is not the next login step")
+
+// Flow is a login in progress. Its state lives in the database and the
+// session only refers to it by ID.
+type Flow struct {
+	ID        string
+	User      *models.User
+	State     *utils.AuthState
+	ExpiresAt time.Time
+}
+
+// Start begins a login flow for a user who passed a primary factor and attaches it to the session.
+// Any earlier flow of the session is discarded. The session still has to be saved.
+func Start(session *sessions.Session, user *models.User, primary string) (*Flow, error) {
+	Abandon(session)
+
+	// Opportunistically drop flows nobody finished
+	if _, err := database.DB.Exec(`DELETE FROM auth_flows WHERE expires_at < ?`, time.Now()); err != nil {
+		log.Printf("Error cleaning up expired login flows: %v", err)
+	}
+
+	id, err := utils.GenerateSecureToken()
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &Flow{
+		ID:        id,
+		User:      user,
+		State:     utils.NewAuthState(user.ID, primary),
+		ExpiresAt: time.Now().Add(FlowTTL),
+	}
+
+	encoded, err := json.Marshal(flow.State)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = database.DB.Exec(
+		`INSERT INTO auth_flows (id, user_id, state, expires_at) VALUES (?, ?, ?, ?)`,
+		flow.ID, user.ID, string(encoded), flow.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	session.Values[sessionKey] = flow.ID
+	return flow, nil
+}
+
+// Current loads the login flow attached to the session. The user is read
+// from the database so factors enabled in the meantime are taken into account.
+func Current(session *sessions.Session) (*Flow, error) {
+	id, ok := session.Values[sessionKey].(string)
+	if !ok || id == "" {
+		return nil, ErrNoFlow
+	}
+
+	var userID int
+	var encoded string
+	var expiresAt time.Time
+	err := database.DB.QueryRow(
+		`SELECT user_id, state, expires_at FROM auth_flows WHERE id = ? AND expires_at > ?`,
+		id, time.Now(),
+	).Scan(&userID, &encoded, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoFlow
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &utils.AuthState{}
+	if err := json.Unmarshal([]byte(encoded), state); err != nil {
+		return nil, err
+	}
+
+	user, err := models.GetUserByIDSafe(userID)
+	if err != nil {
+		return nil, ErrNoFlow
+	}
+
+	return &Flow{ID: id, User: user, State: state, ExpiresAt: expiresAt}, nil
+}
+
+// Next returns the factor the user has to complete next, or nil if the login is complete
+func (f *Flow) Next() (Factor, error) {
+	return Pending(f.User, f.State)
+}
+
+// Complete verifies the next factor and records that it was satisfied. verify
+// runs in the same transaction as the update, so a one-time code or a key's
+// sign count is only used up when the login records it, and two requests can't
+// both complete the step. verify may be nil for a factor that was checked
+// beforehand and has nothing to use up. used is the factor recorded in the
+// authentication state, e.g. utils.FactorRecoveryCode for the TOTP step.
+// It returns whether verify accepted the factor.
+func (f *Flow) Complete(factor string, used string, verify func(tx *sql.Tx) (bool, error)) (bool, error) {
+	next, err := f.Next()
+	if err != nil {
+		return false, err
+	}
+	if next == nil || next.Name() != factor {
+		return false, ErrWrongFactor
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Read the state again inside the transaction; a concurrent request may have completed the step
+	var encoded string
+	err = tx.QueryRow(
+		`SELECT state FROM auth_flows WHERE id = ? AND expires_at > ?`, f.ID, time.Now(),
+	).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return false, ErrNoFlow
+	}
+	if err != nil {
+		return false, err
+	}
+	state := &utils.AuthState{}
+	if err := json.Unmarshal([]byte(encoded), state); err != nil {
+		return false, err
+	}
+	next, err = Pending(f.User, state)
+	if err != nil {
+		return false, err
+	}
+	if next == nil || next.Name() != factor {
+		return false, ErrWrongFactor
+	}
+
+	if verify != nil {
+		valid, err := verify(tx)
+		if err != nil {
+			return false, err
+		}
+		if !valid {
+			// Keep what a failed check records, such as an attempt at an emailed code
+			return false, tx.Commit()
+		}
+	}
+
+	state.MarkFactor(used)
+	if err := updateState(tx, f.ID, state); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	f.State = state
+	return true, nil
+}
+
+// Enrolled records a factor the user set up at the enrollment step. Setting it
+// up proved the user has it, so it isn't asked for again in this login, but it
+// doesn't count as a verification for step-up checks.
+func (f *Flow) Enrolled(factor string) error {
+	f.State.MarkEnrolled(factor)
+	return updateState(database.DB, f.ID, f.State)
+}
+
+// updateState stores the authentication state of a flow
+func updateState(db database.Executor, id string, state *utils.AuthState) error {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE auth_flows SET state = ? WHERE id = ?`, string(encoded), id)
+	return err
+}
+
+// Finish moves the authentication state of a completed flow into the session
+// and deletes the flow. The session still has to be saved.
+func Finish(session *sessions.Session, f *Flow) error {
+	next, err := f.Next()
+	if err != nil {
+		return err
+	}
+	if next != nil {
+		return ErrWrongFactor
+	}
+
+	utils.SaveAuthState(session, f.State)
+	Abandon(session)
+	return nil
+}
+
+// Abandon deletes the login flow attached to the session, if any. The session still has to be saved.
+func Abandon(session *sessions.Session) {
+	id, ok := session.Values[sessionKey].(string)
+	if !ok {
+		return
+	}
+	delete(session.Values, sessionKey)
+
+	if _, err := database.DB.Exec(`DELETE FROM auth_flows WHERE id = ?`, id); err != nil {
+		log.Printf("Error deleting login flow: %v", err)
+	}
+}
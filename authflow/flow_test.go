@@ -0,0 +1,233 @@
+package authflow
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// setupTestDB opens and migrates an empty database in a temporary directory
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("ENCRYPTION_KEYS", "test:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err := utils.InitEncryptionKeys(); err != nil {
+		t.Fatalf("InitEncryptionKeys: %v", err)
+	}
+
+	if err := database.OpenDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+
+	if err := database.MigrateDB(); err != nil {
+		t.Fatalf("MigrateDB: %v", err)
+	}
+}
+
+// startTestFlow creates a user and starts a login flow for them after the password
+func startTestFlow(t *testing.T, user *models.User) (*sessions.Session, *Flow) {
+	t.Helper()
+
+	if err := models.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	session := sessions.NewSession(nil, "test")
+	flow, err := Start(session, user, utils.FactorPassword)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return session, flow
+}
+
+func TestPending(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    models.User
+		factors []string
+		want    string
+	}{
+		{"no primary factor", models.User{}, nil, utils.FactorPassword},
+		{"password only", models.User{}, []string{utils.FactorPassword}, ""},
+		{"TOTP pending", models.User{TwoFAEnabled: true}, []string{utils.FactorPassword}, utils.FactorTOTP},
+		{"recovery code satisfies TOTP", models.User{TwoFAEnabled: true}, []string{utils.FactorPassword, utils.FactorRecoveryCode}, ""},
+		{"security key after TOTP", models.User{TwoFAEnabled: true, WebAuthnEnabled: true}, []string{utils.FactorOAuth, utils.FactorTOTP}, utils.FactorWebAuthn},
+		{"face last", models.User{WebAuthnEnabled: true, FaceAuthEnabled: true}, []string{utils.FactorPassword, utils.FactorWebAuthn}, utils.FactorFace},
+		{"all factors", models.User{TwoFAEnabled: true, FaceAuthEnabled: true}, []string{utils.FactorPassword, utils.FactorTOTP, utils.FactorFace}, ""},
+	}
+
+	setupTestDB(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := tt.user
+			state := &utils.AuthState{}
+			for _, factor := range tt.factors {
+				state.MarkFactor(factor)
+			}
+
+			next, err := Pending(&user, state)
+			if err != nil {
+				t.Fatalf("Pending: %v", err)
+			}
+			got := ""
+			if next != nil {
+				got = next.Name()
+			}
+			if got != tt.want {
+				t.Errorf("Pending = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlowComplete(t *testing.T) {
+	setupTestDB(t)
+	session, flow := startTestFlow(t, &models.User{Email: "user@example.com", TwoFAEnabled: true, FaceAuthEnabled: true})
+
+	accept := func(tx *sql.Tx) (bool, error) { return true, nil }
+	reject := func(tx *sql.Tx) (bool, error) { return false, nil }
+
+	// The steps run in order against the same flow
+	tests := []struct {
+		name     string
+		factor   string
+		used     string
+		verify   func(tx *sql.Tx) (bool, error)
+		want     bool
+		wantErr  error
+		wantNext string
+	}{
+		{"factor out of order", utils.FactorFace, utils.FactorFace, accept, false, ErrWrongFactor, utils.FactorTOTP},
+		{"rejected code", utils.FactorTOTP, utils.FactorTOTP, reject, false, nil, utils.FactorTOTP},
+		{"recovery code", utils.FactorTOTP, utils.FactorRecoveryCode, accept, true, nil, utils.FactorFace},
+		{"completed step again", utils.FactorTOTP, utils.FactorTOTP, accept, false, ErrWrongFactor, utils.FactorFace},
+		{"checked beforehand", utils.FactorFace, utils.FactorFace, nil, true, nil, ""},
+	}
+
+	for _, tt := range tests {
+		valid, err := flow.Complete(tt.factor, tt.used, tt.verify)
+		if err != tt.wantErr || valid != tt.want {
+			t.Fatalf("%s: Complete = (%v, %v), want (%v, %v)", tt.name, valid, err, tt.want, tt.wantErr)
+		}
+
+		// The state is stored, not only kept on the flow
+		stored, err := Current(session)
+		if err != nil {
+			t.Fatalf("%s: Current: %v", tt.name, err)
+		}
+		next, err := stored.Next()
+		if err != nil {
+			t.Fatalf("%s: Next: %v", tt.name, err)
+		}
+		got := ""
+		if next != nil {
+			got = next.Name()
+		}
+		if got != tt.wantNext {
+			t.Errorf("%s: next step is %q, want %q", tt.name, got, tt.wantNext)
+		}
+	}
+
+	if !flow.State.Has(utils.FactorRecoveryCode) || flow.State.Has(utils.FactorTOTP) {
+		t.Errorf("state records %v, want the recovery code instead of TOTP", flow.State.Factors)
+	}
+
+	if err := Finish(session, flow); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if _, err := Current(session); err != ErrNoFlow {
+		t.Errorf("Current after Finish = %v, want %v", err, ErrNoFlow)
+	}
+	if state := utils.GetAuthState(session); state.UserID != flow.User.ID || !state.Has(utils.FactorFace) {
+		t.Errorf("session auth state %+v doesn't match the finished flow", state)
+	}
+}
+
+func TestFlowCompleteConcurrent(t *testing.T) {
+	setupTestDB(t)
+	_, flow := startTestFlow(t, &models.User{Email: "user@example.com", TwoFAEnabled: true})
+
+	// A second request loaded the same flow before the first one completed it
+	other := &Flow{ID: flow.ID, User: flow.User, State: flow.State}
+
+	if valid, err := flow.Complete(utils.FactorTOTP, utils.FactorTOTP, nil); err != nil || !valid {
+		t.Fatalf("first Complete = (%v, %v), want (true, nil)", valid, err)
+	}
+
+	verified := false
+	valid, err := other.Complete(utils.FactorTOTP, utils.FactorTOTP, func(tx *sql.Tx) (bool, error) {
+		verified = true
+		return true, nil
+	})
+	if err != ErrWrongFactor || valid {
+		t.Errorf("second Complete = (%v, %v), want (false, %v)", valid, err, ErrWrongFactor)
+	}
+	if verified {
+		t.Error("second Complete ran its check after the step was completed")
+	}
+}
+
+func TestEnrollmentStep(t *testing.T) {
+	setupTestDB(t)
+
+	err := models.CreateMFAPolicy(&models.MFAPolicy{Role: models.RoleUser, RequireSecondFactor: true, Enabled: true})
+	if err != nil {
+		t.Fatalf("CreateMFAPolicy: %v", err)
+	}
+
+	session, flow := startTestFlow(t, &models.User{Email: "user@example.com"})
+	if next, err := flow.Next(); err != nil || next == nil || next.Name() != EnrollmentStep {
+		t.Fatalf("next step is %v, want %q", next, EnrollmentStep)
+	}
+
+	// Finishing early doesn't skip the step
+	if err := Finish(session, flow); err != ErrWrongFactor {
+		t.Fatalf("Finish before enrolling = %v, want %v", err, ErrWrongFactor)
+	}
+
+	// Enrolling a factor meets the policy and counts for this login
+	flow.User.TwoFAEnabled = true
+	if err := models.UpdateUser(flow.User); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if err := flow.Enrolled(utils.FactorTOTP); err != nil {
+		t.Fatalf("Enrolled: %v", err)
+	}
+
+	stored, err := Current(session)
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	if next, err := stored.Next(); err != nil || next != nil {
+		t.Errorf("next step after enrolling is %v (%v), want none", next, err)
+	}
+	if err := Finish(session, stored); err != nil {
+		t.Errorf("Finish after enrolling: %v", err)
+	}
+}
+
+func TestEnrollmentStepPolicyError(t *testing.T) {
+	setupTestDB(t)
+	session, flow := startTestFlow(t, &models.User{Email: "user@example.com"})
+
+	// The policies can't be read, so nobody can tell whether the user must enroll
+	if _, err := database.DB.Exec(`DROP TABLE mfa_policies`); err != nil {
+		t.Fatalf("drop mfa_policies: %v", err)
+	}
+
+	if next, err := flow.Next(); err == nil {
+		t.Errorf("Next = (%v, nil), want an error", next)
+	}
+	if err := Finish(session, flow); err == nil {
+		t.Error("Finish signed the user in without checking the MFA policies")
+	}
+	if state := utils.GetAuthState(session); state.UserID != 0 {
+		t.Errorf("session auth state %+v after a failed policy check", state)
+	}
+}
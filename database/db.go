@@ -12,6 +12,14 @@ import (
 
 var DB *sql.DB
 
+// Executor runs statements. Both *sql.DB and *sql.Tx implement it, so model
+// functions can run on their own or as part of a caller's transaction.
+type Executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // InitDB initializes the database connection
 func InitDB() error {
 	// Create data directory if it doesn't exist
@@ -22,10 +30,17 @@ func InitDB() error {
 		}
 	}
 
-	// Open database connection
-	dbPath := filepath.Join(dataDir, "users.db")
+	return OpenDB(filepath.Join(dataDir, "users.db"))
+}
+
+// OpenDB opens the database at dbPath and makes it the shared connection
+func OpenDB(dbPath string) error {
+	// SQLite only enforces foreign keys, including ON DELETE CASCADE, when each
+	// connection turns them on. Transactions take the write lock when they
+	// begin, so two of them that read before writing wait for each other
+	// instead of failing with "database is locked".
 	var err error
-	DB, err = sql.Open("sqlite3", dbPath)
+	DB, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_txlock=immediate")
 	if err != nil {
 		return err
 	}
@@ -35,53 +50,11 @@ func InitDB() error {
 	DB.SetMaxIdleConns(5)
 	DB.SetConnMaxLifetime(time.Hour)
 
-	// Create tables if they don't exist
-	err = createTables()
-	if err != nil {
-		return err
-	}
-
+	// Tables are created and upgraded separately by MigrateDB
 	log.Println("Database initialized successfully")
 	return nil
 }
 
-// createTables creates the necessary tables if they don't exist
-func createTables() error {
-	// Create users table
-	usersTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT,
-		nickname TEXT,
-		email TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		google_id TEXT,
-		github_id TEXT,
-		profile_image TEXT,
-		twofa_secret TEXT,
-		twofa_enabled BOOLEAN DEFAULT 0,
-		face_auth_enabled BOOLEAN DEFAULT 0,
-		role TEXT DEFAULT 'user',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-
-	_, err := DB.Exec(usersTable)
-	if err != nil {
-		return err
-	}
-
-	// Create email index
-	emailIndex := `CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);`
-	_, err = DB.Exec(emailIndex)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // CloseDB closes the database connection
 func CloseDB() error {
 	if DB != nil {
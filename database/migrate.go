@@ -1,114 +1,266 @@
 package database
 
 import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
 	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// MigrateDB handles database schema migrations
-func MigrateDB() error {
-	log.Println("Running database migrations...")
+// migrationFiles holds the numbered SQL migrations, named NNNN_description.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a single numbered schema change
+type Migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
 
-	// Check if nickname column exists in users table
-	var count int
-	err := DB.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('users') WHERE name='nickname'`).Scan(&count)
+// LoadMigrations reads and sorts the embedded migrations
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// If nickname column doesn't exist, add it
-	if count == 0 {
-		log.Println("Adding nickname column to users table...")
-		_, err := DB.Exec(`ALTER TABLE users ADD COLUMN nickname TEXT;`)
+	migrations := make([]Migration, 0, len(entries))
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		// Parse the version number from the file name
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("duplicate migration version %d in %q and %q", version, other, entry.Name())
+		}
+		seen[version] = entry.Name()
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
 		if err != nil {
-			log.Printf("Error adding nickname column: %v", err)
-			return err
+			return nil, err
 		}
-		log.Println("Successfully added nickname column to users table")
-	} else {
-		log.Println("Nickname column already exists in users table")
+
+		sum := sha256.Sum256(content)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     parts[1],
+			SQL:      string(content),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
 	}
 
-	// Check if username column is NOT NULL
-	var notNull int
-	err = DB.QueryRow(`SELECT "notnull" FROM pragma_table_info('users') WHERE name='username'`).Scan(&notNull)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates the schema_migrations table if it doesn't exist
+func ensureMigrationsTable() error {
+	_, err := DB.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+// appliedMigrations returns the applied migrations keyed by version
+func appliedMigrations() (map[int]MigrationStatus, error) {
+	applied := make(map[int]MigrationStatus)
+
+	// A dry run must not create the table, so treat a missing one as empty
+	var exists int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_migrations'`).Scan(&exists)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if exists == 0 {
+		return applied, nil
 	}
 
-	// If username is NOT NULL, we need to modify it to allow NULL values
-	if notNull == 1 {
-		log.Println("Modifying username column to allow NULL values...")
-		
-		// SQLite doesn't support ALTER COLUMN, so we need to recreate the table
-		// First, create a backup of the current table
-		_, err := DB.Exec(`
-			CREATE TABLE users_backup AS SELECT * FROM users;
-		`)
-		if err != nil {
-			log.Printf("Error creating backup table: %v", err)
-			return err
+	rows, err := DB.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status MigrationStatus
+		if err := rows.Scan(&status.Version, &status.Name, &status.Checksum, &status.AppliedAt); err != nil {
+			return nil, err
 		}
+		status.Applied = true
+		applied[status.Version] = status
+	}
 
-		// Drop the original table
-		_, err = DB.Exec(`DROP TABLE users;`)
-		if err != nil {
-			log.Printf("Error dropping original table: %v", err)
-			return err
+	return applied, rows.Err()
+}
+
+// GetMigrationStatus verifies the checksums of applied migrations and
+// returns every known migration with whether it has been applied
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]bool)
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		status := MigrationStatus{Migration: migration}
+
+		if record, ok := applied[migration.Version]; ok {
+			// An applied migration must never be edited afterwards
+			if record.Checksum != migration.Checksum {
+				return nil, fmt.Errorf("checksum mismatch for migration %04d_%s: database has %s, file has %s",
+					migration.Version, migration.Name, record.Checksum, migration.Checksum)
+			}
+			status.Applied = true
+			status.AppliedAt = record.AppliedAt
 		}
 
-		// Recreate the table with the updated schema
-		_, err = DB.Exec(`
-		CREATE TABLE users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT,
-			nickname TEXT,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			google_id TEXT,
-			github_id TEXT,
-			profile_image TEXT,
-			twofa_secret TEXT,
-			twofa_enabled BOOLEAN DEFAULT 0,
-			face_auth_enabled BOOLEAN DEFAULT 0,
-			role TEXT DEFAULT 'user',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-		`)
-		if err != nil {
-			log.Printf("Error recreating table: %v", err)
-			return err
+		statuses = append(statuses, status)
+	}
+
+	// The database may have been migrated by a newer build
+	for version, record := range applied {
+		if !known[version] {
+			return nil, fmt.Errorf("database has unknown migration %04d_%s applied", version, record.Name)
 		}
+	}
 
-		// Copy data from backup table
-		_, err = DB.Exec(`
-			INSERT INTO users 
-			SELECT 
-				id, username, NULL as nickname, email, password_hash, 
-				google_id, github_id, profile_image, twofa_secret, 
-				twofa_enabled, face_auth_enabled, role, created_at, updated_at 
-			FROM users_backup;
-		`)
-		if err != nil {
-			log.Printf("Error copying data from backup: %v", err)
-			return err
+	return statuses, nil
+}
+
+// PendingMigrations returns the migrations that MigrateDB would apply, without applying them
+func PendingMigrations() ([]Migration, error) {
+	statuses, err := GetMigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
 		}
+	}
+	return pending, nil
+}
 
-		// Drop backup table
-		_, err = DB.Exec(`DROP TABLE users_backup;`)
-		if err != nil {
-			log.Printf("Error dropping backup table: %v", err)
+// applyMigration runs a single migration and records it in one transaction
+func applyMigration(migration Migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`,
+		migration.Version, migration.Name, migration.Checksum, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isLegacyDatabase reports whether the database has a users table that was
+// created before schema_migrations existed
+func isLegacyDatabase() (bool, error) {
+	var migrated int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&migrated); err != nil {
+		return false, err
+	}
+	if migrated > 0 {
+		return false, nil
+	}
+
+	var usersTable int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='users'`).Scan(&usersTable)
+	if err != nil {
+		return false, err
+	}
+	return usersTable > 0, nil
+}
+
+// MigrateDB applies all pending migrations in version order
+func MigrateDB() error {
+	log.Println("Running database migrations...")
+
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	legacy, err := isLegacyDatabase()
+	if err != nil {
+		return err
+	}
+	if legacy {
+		if err := upgradeLegacySchema(); err != nil {
 			return err
 		}
+	}
 
-		// Recreate email index
-		_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);`)
-		if err != nil {
-			log.Printf("Error recreating email index: %v", err)
-			return err
+	pending, err := PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		log.Printf("Applying migration %04d_%s...", migration.Version, migration.Name)
+		if err := applyMigration(migration); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %v", migration.Version, migration.Name, err)
 		}
+	}
 
-		log.Println("Successfully modified username column to allow NULL values")
+	if len(pending) == 0 {
+		log.Println("Database schema is up to date")
 	}
 
 	log.Println("Database migrations completed successfully")
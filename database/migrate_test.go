@@ -0,0 +1,123 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB opens an empty database in a temporary directory
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if err := OpenDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { CloseDB() })
+}
+
+func TestLoadMigrationsOrdered(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d has version %d, want %d", i, migration.Version, i+1)
+		}
+		if migration.Checksum == "" || strings.TrimSpace(migration.SQL) == "" {
+			t.Errorf("migration %04d_%s is empty", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	openTestDB(t)
+
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		t.Fatalf("PendingMigrations before migrating: %v", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Fatalf("got %d pending migrations on an empty database, want %d", len(pending), len(migrations))
+	}
+
+	// Running the migrations twice must leave the schema unchanged
+	for run := 1; run <= 2; run++ {
+		if err := MigrateDB(); err != nil {
+			t.Fatalf("MigrateDB run %d: %v", run, err)
+		}
+
+		var applied int
+		if err := DB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+			t.Fatalf("count applied migrations: %v", err)
+		}
+		if applied != len(migrations) {
+			t.Fatalf("run %d: %d migrations recorded, want %d", run, applied, len(migrations))
+		}
+	}
+
+	statuses, err := GetMigrationStatus()
+	if err != nil {
+		t.Fatalf("GetMigrationStatus: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("migration %04d_%s not applied", status.Version, status.Name)
+		}
+	}
+
+	pending, err = PendingMigrations()
+	if err != nil {
+		t.Fatalf("PendingMigrations after migrating: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("got %d pending migrations after migrating, want 0", len(pending))
+	}
+}
+
+func TestMigrationStatusDetectsDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  string
+		wantErr string
+	}{
+		{
+			name:    "edited migration",
+			tamper:  `UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1`,
+			wantErr: "checksum mismatch",
+		},
+		{
+			name:    "migration from a newer build",
+			tamper:  `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (9999, 'future', 'x', CURRENT_TIMESTAMP)`,
+			wantErr: "unknown migration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			if err := MigrateDB(); err != nil {
+				t.Fatalf("MigrateDB: %v", err)
+			}
+			if _, err := DB.Exec(tt.tamper); err != nil {
+				t.Fatalf("tamper: %v", err)
+			}
+
+			if _, err := GetMigrationStatus(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("GetMigrationStatus error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			if err := MigrateDB(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("MigrateDB error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+-- Users table and email index
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT,
+	nickname TEXT,
+	email TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	google_id TEXT,
+	github_id TEXT,
+	profile_image TEXT,
+	twofa_secret TEXT,
+	twofa_enabled BOOLEAN DEFAULT 0,
+	twofa_last_step INTEGER DEFAULT 0,
+	face_auth_enabled BOOLEAN DEFAULT 0,
+	role TEXT DEFAULT 'user',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
@@ -0,0 +1,9 @@
+-- Per-account and per-IP failed authentication counters
+CREATE TABLE IF NOT EXISTS auth_failures (
+	scope TEXT NOT NULL,
+	key TEXT NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure TIMESTAMP,
+	locked_until TIMESTAMP,
+	PRIMARY KEY (scope, key)
+);
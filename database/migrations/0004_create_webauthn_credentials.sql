@@ -0,0 +1,16 @@
+-- WebAuthn (security key / passkey) credentials
+ALTER TABLE users ADD COLUMN webauthn_enabled BOOLEAN DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	credential_id BLOB UNIQUE NOT NULL,
+	name TEXT,
+	credential TEXT NOT NULL,
+	sign_count INTEGER DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
@@ -0,0 +1,6 @@
+-- Email verification; pending_email holds a new address until it is confirmed
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN DEFAULT 0;
+ALTER TABLE users ADD COLUMN pending_email TEXT;
+
+-- Accounts that existed before verification was introduced are trusted as-is
+UPDATE users SET email_verified = 1;
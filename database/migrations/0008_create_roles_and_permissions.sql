@@ -0,0 +1,38 @@
+-- Role-based access control; users.role holds the name of a role
+CREATE TABLE IF NOT EXISTS roles (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id INTEGER NOT NULL,
+	permission_id INTEGER NOT NULL,
+	PRIMARY KEY (role_id, permission_id),
+	FOREIGN KEY (role_id) REFERENCES roles(id),
+	FOREIGN KEY (permission_id) REFERENCES permissions(id)
+);
+
+INSERT OR IGNORE INTO roles (name, description) VALUES
+	('admin', 'Full access to administration pages'),
+	('user', 'Regular account');
+
+INSERT OR IGNORE INTO permissions (name, description) VALUES
+	('users.view', 'View the user list'),
+	('users.manage', 'Delete and unlock users'),
+	('roles.assign', 'Change the role of a user');
+
+INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions WHERE roles.name = 'admin';
+
+-- Keep any free-form roles already in use, without permissions
+INSERT OR IGNORE INTO roles (name)
+	SELECT DISTINCT role FROM users WHERE role IS NOT NULL AND role != '';
+
+UPDATE users SET role = 'user' WHERE role IS NULL OR role = '';
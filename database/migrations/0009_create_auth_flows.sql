@@ -0,0 +1,12 @@
+-- Logins in progress; the session only holds the flow ID and the satisfied
+-- factors are kept here until every required factor is complete
+CREATE TABLE IF NOT EXISTS auth_flows (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	state TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_flows_expires_at ON auth_flows(expires_at);
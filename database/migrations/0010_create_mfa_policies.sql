@@ -0,0 +1,19 @@
+-- MFA enforcement policies set by admins; an empty role applies to every user
+CREATE TABLE IF NOT EXISTS mfa_policies (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	role TEXT NOT NULL DEFAULT '',
+	require_second_factor BOOLEAN NOT NULL DEFAULT 0,
+	require_totp BOOLEAN NOT NULL DEFAULT 0,
+	face_only_as_addition BOOLEAN NOT NULL DEFAULT 0,
+	grace_period_days INTEGER NOT NULL DEFAULT 0,
+	enabled BOOLEAN NOT NULL DEFAULT 1,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT OR IGNORE INTO permissions (name, description) VALUES
+	('mfa.manage', 'Edit MFA enforcement policies');
+
+INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions
+	WHERE roles.name = 'admin' AND permissions.name = 'mfa.manage';
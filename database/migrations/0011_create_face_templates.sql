@@ -0,0 +1,10 @@
+-- Enrolled face images, encrypted under a per-row data key. The data key is
+-- stored wrapped by one of the ENCRYPTION_KEYS, whose ID is part of wrapped_key.
+CREATE TABLE IF NOT EXISTS face_templates (
+	user_id INTEGER PRIMARY KEY,
+	wrapped_key TEXT NOT NULL,
+	ciphertext BLOB NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
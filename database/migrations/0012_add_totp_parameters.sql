@@ -0,0 +1,9 @@
+-- Parameters each authenticator app was enrolled with, so existing
+-- enrollments keep working when the configured defaults change
+ALTER TABLE users ADD COLUMN twofa_algorithm TEXT;
+ALTER TABLE users ADD COLUMN twofa_digits INTEGER;
+ALTER TABLE users ADD COLUMN twofa_period INTEGER;
+
+-- Enrollments made so far all used SHA1, six digits and a 30 second period
+UPDATE users SET twofa_algorithm = 'SHA1', twofa_digits = 6, twofa_period = 30
+WHERE COALESCE(twofa_secret, '') != '';
@@ -0,0 +1,4 @@
+-- Whether a user's one-time passwords come from an authenticator app (totp)
+-- or a counter-based token (hotp). For hotp, twofa_last_step holds the last
+-- counter value that was used.
+ALTER TABLE users ADD COLUMN twofa_type TEXT DEFAULT 'totp';
@@ -0,0 +1,15 @@
+-- Phone number that SMS one-time codes are sent to
+ALTER TABLE users ADD COLUMN phone_number TEXT;
+
+-- One-time codes delivered by email or SMS; only the hash of the code is stored.
+-- Each user has at most one active code per purpose (login or setup).
+CREATE TABLE IF NOT EXISTS otp_codes (
+	user_id INTEGER NOT NULL,
+	purpose TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, purpose),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,23 @@
+-- Security audit log of authentication and account events. User IDs are kept
+-- without foreign keys so events outlive the accounts they refer to.
+CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP NOT NULL,
+	actor_user_id INTEGER,
+	target_user_id INTEGER,
+	event_type TEXT NOT NULL,
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	outcome TEXT NOT NULL,
+	details TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target_user_id, created_at);
+
+INSERT OR IGNORE INTO permissions (name, description) VALUES
+	('audit.view', 'View and export the security audit log');
+
+INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions
+	WHERE roles.name = 'admin' AND permissions.name = 'audit.view';
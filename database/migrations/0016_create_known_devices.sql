@@ -0,0 +1,13 @@
+-- Devices each user has signed in from, to alert them about logins from new ones.
+-- The fingerprint is a hash of the device cookie and user agent.
+CREATE TABLE IF NOT EXISTS known_devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	fingerprint TEXT NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip_address TEXT NOT NULL DEFAULT '',
+	first_seen_at TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	UNIQUE (user_id, fingerprint),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
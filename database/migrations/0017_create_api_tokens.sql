@@ -0,0 +1,21 @@
+-- Tokens for the JSON management API. Requests made with a token act with the
+-- permissions of the admin who created it; only the hash of the token is stored.
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	user_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+INSERT OR IGNORE INTO permissions (name, description) VALUES
+	('api_tokens.manage', 'Create and revoke API tokens for the management API');
+
+INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions
+	WHERE roles.name = 'admin' AND permissions.name = 'api_tokens.manage';
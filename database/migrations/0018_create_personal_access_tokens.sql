@@ -0,0 +1,17 @@
+-- Personal access tokens let a user call the API without a browser session.
+-- Only the hash of a token is stored; scopes are a space-separated list.
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	last_used_ip TEXT NOT NULL DEFAULT '',
+	revoked_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
@@ -0,0 +1,54 @@
+-- Applications that delegate login to this service over OpenID Connect.
+-- Redirect URIs are newline-separated; public clients have no secret and rely on PKCE.
+CREATE TABLE IF NOT EXISTS oidc_clients (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_id TEXT NOT NULL UNIQUE,
+	client_secret_hash TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	redirect_uris TEXT NOT NULL,
+	public INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL
+);
+
+-- Authorization codes waiting to be exchanged at the token endpoint
+CREATE TABLE IF NOT EXISTS oidc_auth_codes (
+	code_hash TEXT PRIMARY KEY,
+	client_id TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	redirect_uri TEXT NOT NULL,
+	scope TEXT NOT NULL,
+	nonce TEXT NOT NULL DEFAULT '',
+	code_challenge TEXT NOT NULL,
+	amr TEXT NOT NULL DEFAULT '',
+	auth_time TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Access tokens for the userinfo endpoint
+CREATE TABLE IF NOT EXISTS oidc_access_tokens (
+	token_hash TEXT PRIMARY KEY,
+	client_id TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	scope TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_auth_codes_expires_at ON oidc_auth_codes(expires_at);
+CREATE INDEX IF NOT EXISTS idx_oidc_access_tokens_expires_at ON oidc_access_tokens(expires_at);
+
+-- RSA keys that sign ID tokens. Private keys are stored encrypted like other secrets.
+CREATE TABLE IF NOT EXISTS oidc_signing_keys (
+	kid TEXT PRIMARY KEY,
+	private_key TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+INSERT OR IGNORE INTO permissions (name, description) VALUES
+	('oidc.manage', 'Register and remove OpenID Connect client applications');
+
+INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+	SELECT roles.id, permissions.id FROM roles, permissions
+	WHERE roles.name = 'admin' AND permissions.name = 'oidc.manage';
@@ -0,0 +1,15 @@
+-- Foreign keys were not enforced before, so accounts deleted partway could
+-- leave rows behind. Remove rows whose user no longer exists so the database
+-- is consistent now that they are.
+DELETE FROM recovery_codes WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM webauthn_credentials WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM password_reset_tokens WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM face_templates WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM otp_codes WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM known_devices WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM auth_flows WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM api_tokens WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM personal_access_tokens WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM oidc_auth_codes WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM oidc_access_tokens WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM sessions WHERE user_id IS NOT NULL AND user_id NOT IN (SELECT id FROM users);
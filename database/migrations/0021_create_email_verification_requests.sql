@@ -0,0 +1,11 @@
+-- Verification emails sent on request, used to limit how often they can be resent
+CREATE TABLE IF NOT EXISTS email_verification_requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	ip_address TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_requests_user_id ON email_verification_requests(user_id);
+CREATE INDEX IF NOT EXISTS idx_email_verification_requests_ip_address ON email_verification_requests(ip_address);
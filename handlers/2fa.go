@@ -1,12 +1,25 @@
 package handlers
 
 import (
+	"fmt"
 	"html/template"
+	"log"
 	"net/http"
+	"strings"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
 )
 
+// pendingTwoFASecretKey is the session key holding the encrypted secret of a
+// 2FA enrollment in progress
+const pendingTwoFASecretKey = "temp_2fa_secret"
+
 // Helper function to render 2FA verification page
-func render2FAPage(w http.ResponseWriter, errorMsg string, isSetup bool) {
+func render2FAPage(w http.ResponseWriter, errorMsg string, isSetup bool, otpType, destination string) {
 	var templateFile string
 	if isSetup {
 		templateFile = "templates/setup-2fa.html"
@@ -21,8 +34,177 @@ func render2FAPage(w http.ResponseWriter, errorMsg string, isSetup bool) {
 	}
 	
 	data := map[string]interface{}{
-		"Error": errorMsg,
+		"Error":       errorMsg,
+		"HOTP":        otpType == models.TwoFATypeHOTP,
+		"OutOfBand":   isOutOfBandOTP(otpType),
+		"SMS":         otpType == models.TwoFATypeSMS,
+		"Destination": maskDestination(destination),
 	}
 	
 	tmpl.Execute(w, data)
 }
+
+// Helper function to render the one-time recovery codes page
+func renderRecoveryCodesPage(w http.ResponseWriter, codes []string, continueURL string) {
+	tmpl, err := template.ParseFiles("templates/recovery-codes.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"RecoveryCodes": codes,
+		"ContinueURL":   continueURL,
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// Helper function to verify a one-time password for a user and mark its
+// time-step or counter value as used. Codes delivered by email or SMS are
+// checked against the stored code instead. db is database.DB, or the
+// transaction that completes a login step.
+func verifyOTPCode(db database.Executor, user *models.User, code string) (bool, error) {
+	if isOutOfBandOTP(user.TwoFAType) {
+		return models.VerifyOTPCode(db, user.ID, models.OTPPurposeLogin, strings.TrimSpace(code))
+	}
+	if user.TwoFASecret == "" {
+		return false, nil
+	}
+
+	lastStep, err := models.GetTwoFALastStep(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// Codes are checked with the parameters the user enrolled with, not the current defaults
+	var step int64
+	var valid bool
+	if user.TwoFAType == models.TwoFATypeHOTP {
+		step, valid, err = utils.ValidateHOTP(user.TOTPParams(), user.TwoFASecret, code, lastStep, utils.HOTPLookAhead())
+	} else {
+		step, valid, err = utils.Validate2FAStep(user.TOTPParams(), user.TwoFASecret, code, lastStep)
+	}
+	if err != nil || !valid {
+		return false, err
+	}
+
+	// Record the step atomically so a concurrent request with the same code fails
+	return models.ConsumeTwoFAStep(db, user.ID, step)
+}
+
+// Helper function to resynchronise a user's HOTP token from two consecutive codes
+func resyncHOTPToken(db database.Executor, user *models.User, firstCode, secondCode string) (bool, error) {
+	if user.TwoFAType != models.TwoFATypeHOTP || user.TwoFASecret == "" {
+		return false, nil
+	}
+
+	lastStep, err := models.GetTwoFALastStep(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	counter, valid, err := utils.ResyncHOTP(user.TOTPParams(), user.TwoFASecret, firstCode, secondCode, lastStep, utils.HOTPResyncWindow())
+	if err != nil || !valid {
+		return false, err
+	}
+
+	return models.ConsumeTwoFAStep(db, user.ID, counter)
+}
+
+// Helper function to get the authentication factor a user's one-time passwords satisfy
+func otpFactor(user *models.User) string {
+	switch user.TwoFAType {
+	case models.TwoFATypeHOTP:
+		return utils.FactorHOTP
+	case models.TwoFATypeEmail:
+		return utils.FactorEmailOTP
+	case models.TwoFATypeSMS:
+		return utils.FactorSMSOTP
+	}
+	return utils.FactorTOTP
+}
+
+// Helper function to keep the secret of a 2FA enrollment that hasn't been
+// confirmed yet. Sessions are stored in the database, so the secret is encrypted
+// and bound to the user like an enrolled one.
+func setPendingTwoFASecret(session *sessions.Session, userID int, secret string) error {
+	encrypted, err := utils.EncryptSecretFor(secret, pendingTwoFASecretContext(userID))
+	if err != nil {
+		return err
+	}
+	session.Values[pendingTwoFASecretKey] = encrypted
+	return nil
+}
+
+// Helper function to get the secret of the 2FA enrollment in progress, or an
+// empty string if there is none
+func pendingTwoFASecret(session *sessions.Session, userID int) string {
+	stored, _ := session.Values[pendingTwoFASecretKey].(string)
+	if !utils.IsEncryptedSecret(stored) {
+		return ""
+	}
+	secret, err := utils.DecryptSecretFor(stored, pendingTwoFASecretContext(userID))
+	if err != nil {
+		log.Printf("Error decrypting pending 2FA secret for user %d: %v", userID, err)
+		return ""
+	}
+	return secret
+}
+
+// Helper function to get the context a pending 2FA secret is bound to
+func pendingTwoFASecretContext(userID int) string {
+	return fmt.Sprintf("pending_twofa_secret:%d", userID)
+}
+
+// Helper function to save a verified 2FA enrollment, issue fresh recovery codes
+// and show them. The user's factor type and details must already be set, and
+// step is the time-step or counter value the setup code used. flow is the login
+// waiting at the MFA enrollment step, or nil for a signed-in user.
+func finishTwoFASetup(w http.ResponseWriter, r *http.Request, session *sessions.Session, flow *authflow.Flow, user *models.User, step int64) {
+	user.TwoFAEnabled = true
+	if err := models.UpdateUser(user); err != nil {
+		http.Error(w, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	recordUserAudit(r, models.AuditFactorEnrolled, user, map[string]interface{}{"factor": otpFactor(user)})
+
+	// Record the step used for setup so the same code cannot be used to log in
+	if err := models.ResetTwoFAStep(user.ID, step); err != nil {
+		log.Printf("Error recording 2FA step for user %d: %v", user.ID, err)
+	}
+
+	// Issue a fresh set of recovery codes
+	recoveryCodes, err := models.ReplaceRecoveryCodes(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A new second factor invalidates every other signed-in session
+	revokeOtherSessions(session, user.ID, "2FA reset")
+
+	delete(session.Values, pendingTwoFASecretKey)
+	delete(session.Values, "temp_2fa_type")
+	delete(session.Values, "temp_2fa_email")
+
+	// The code just entered satisfies the new factor, without counting as a re-authentication
+	continueURL := "/home?2fa_setup=success"
+	if flow != nil {
+		// Sign in now, or move on if a policy still isn't met
+		continueURL, err = finishEnrollment(w, r, session, flow, otpFactor(user))
+		if err != nil {
+			log.Printf("Error advancing login for user %d: %v", user.ID, err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		session.Values["twofa_enabled"] = true
+		utils.MarkEnrolledFactor(session, otpFactor(user))
+	}
+	session.Save(r, w)
+
+	// Show the recovery codes once; they cannot be retrieved later
+	renderRecoveryCodesPage(w, recoveryCodes, continueURL)
+}
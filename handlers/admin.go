@@ -11,6 +11,17 @@ import (
 	"github.com/aungh/login-form/utils"
 )
 
+// adminPermissionFlags maps the permissions checked on the users page to the
+// template flags that show the matching actions and links
+var adminPermissionFlags = map[string]string{
+	models.PermissionManageUsers: "CanManageUsers",
+	models.PermissionAssignRoles: "CanAssignRoles",
+	models.PermissionManageMFA:   "CanManageMFA",
+	models.PermissionViewAudit:   "CanViewAudit",
+	models.PermissionManageAPI:   "CanManageAPI",
+	models.PermissionManageOIDC:  "CanManageOIDC",
+}
+
 // AdminUsersHandler displays all users and provides management options
 func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
@@ -36,19 +47,63 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Check if user has admin role
-	if currentUser.Role != "admin" {
-		log.Printf("User %d attempted to access admin area but has role %s", currentUser.ID, currentUser.Role)
-		http.Error(w, "Unauthorized - Admin access required", http.StatusForbidden)
-		return
+	// Access to this page is checked by middleware.RequirePermission; the
+	// actions below and the links on the page need further permissions
+	can := make(map[string]bool)
+	for permission := range adminPermissionFlags {
+		allowed, err := models.HasPermission(currentUser.Role, permission)
+		if err != nil {
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		can[permission] = allowed
 	}
-	
-	log.Printf("Admin access granted to user %d with role %s", currentUser.ID, currentUser.Role)
+	canManageUsers := can[models.PermissionManageUsers]
+	canAssignRoles := can[models.PermissionAssignRoles]
 	
 	// Handle user deletion
 	if r.Method == "POST" {
 		action := r.FormValue("action")
 		
+		if (action == "delete" || action == "unlock") && !canManageUsers {
+			http.Error(w, "Forbidden - missing permission "+models.PermissionManageUsers, http.StatusForbidden)
+			return
+		}
+		
+		if action == "assign_role" {
+			if !canAssignRoles {
+				http.Error(w, "Forbidden - missing permission "+models.PermissionAssignRoles, http.StatusForbidden)
+				return
+			}
+			
+			userIDToChange, err := strconv.Atoi(r.FormValue("user_id"))
+			if err != nil {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			
+			// Don't allow changing your own role, so the last admin can't lock everyone out
+			if userIDToChange == userID {
+				http.Error(w, "Cannot change your own role", http.StatusBadRequest)
+				return
+			}
+			
+			role := r.FormValue("role")
+			if err := models.AssignRole(userIDToChange, role); err != nil {
+				if err == models.ErrUnknownRole {
+					http.Error(w, "Unknown role", http.StatusBadRequest)
+					return
+				}
+				http.Error(w, fmt.Sprintf("Failed to assign role: %v", err), http.StatusInternalServerError)
+				return
+			}
+			
+			log.Printf("Admin %d assigned role %s to user %d", currentUser.ID, role, userIDToChange)
+			recordAudit(r, models.AuditRoleChanged, models.AuditSuccess, currentUser.ID, userIDToChange, map[string]interface{}{"role": role})
+			http.Redirect(w, r, "/admin/users?role_assigned=true", http.StatusSeeOther)
+			return
+		}
+		
 		if action == "delete" {
 			userIDToDelete, err := strconv.Atoi(r.FormValue("user_id"))
 			if err != nil {
@@ -63,7 +118,7 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			
 			// Check if user exists before deletion
-			_, err = models.GetUserByIDSafe(userIDToDelete)
+			userToDelete, err := models.GetUserByIDSafe(userIDToDelete)
 			if err != nil {
 				http.Error(w, "User not found", http.StatusNotFound)
 				return
@@ -72,23 +127,42 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 			// Delete the user
 			err = models.DeleteUser(userIDToDelete)
 			if err != nil {
-				// Check if we need to delete face auth data
-				if err.Error() == "face_auth_data_needs_deletion" {
-					// Delete face authentication data
-					if err := utils.DeleteFaceData(userIDToDelete); err != nil {
-						http.Error(w, fmt.Sprintf("Failed to delete face data: %v", err), http.StatusInternalServerError)
-						return
-					}
-				} else {
-					http.Error(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
-					return
-				}
+				http.Error(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
+				return
 			}
+
+			// Keep the address in the log since the account itself is gone
+			recordAudit(r, models.AuditUserDeleted, models.AuditSuccess, currentUser.ID, userIDToDelete, map[string]interface{}{"email": userToDelete.Email})
 			
 			// Redirect to refresh the page
 			http.Redirect(w, r, "/admin/users?deleted=true", http.StatusSeeOther)
 			return
 		}
+		
+		if action == "unlock" {
+			userIDToUnlock, err := strconv.Atoi(r.FormValue("user_id"))
+			if err != nil {
+				http.Error(w, "Invalid user ID", http.StatusBadRequest)
+				return
+			}
+			
+			userToUnlock, err := models.GetUserByIDSafe(userIDToUnlock)
+			if err != nil {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			
+			// Clear the account's failure counter and lockout
+			if err := models.UnlockAccount(userToUnlock.Email); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to unlock user: %v", err), http.StatusInternalServerError)
+				return
+			}
+			
+			log.Printf("Admin %d unlocked user %d", currentUser.ID, userToUnlock.ID)
+			recordAudit(r, models.AuditAccountUnlocked, models.AuditSuccess, currentUser.ID, userToUnlock.ID, map[string]interface{}{"email": userToUnlock.Email})
+			http.Redirect(w, r, "/admin/users?unlocked=true", http.StatusSeeOther)
+			return
+		}
 	}
 	
 	// Get all users - use the safe version that handles NULL values
@@ -99,6 +173,24 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	// Find out which accounts are currently locked out
+	lockedAccounts, err := models.GetLockedAccounts()
+	if err != nil {
+		log.Printf("Failed to get locked accounts: %v", err)
+	}
+	lockedUsers := make(map[int]bool)
+	for _, user := range users {
+		if models.IsAccountLocked(lockedAccounts, user.Email) {
+			lockedUsers[user.ID] = true
+		}
+	}
+	
+	// Roles that can be assigned
+	roles, err := models.GetRoles()
+	if err != nil {
+		log.Printf("Failed to get roles: %v", err)
+	}
+	
 	// Render the admin users page
 	tmpl, err := template.ParseFiles("templates/admin-users.html")
 	if err != nil {
@@ -107,9 +199,16 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	data := map[string]interface{}{
-		"Users":       users,
-		"CurrentUser": currentUser,
-		"Deleted":     r.URL.Query().Get("deleted") == "true",
+		"Users":          users,
+		"CurrentUser":    currentUser,
+		"Deleted":        r.URL.Query().Get("deleted") == "true",
+		"Unlocked":       r.URL.Query().Get("unlocked") == "true",
+		"LockedUsers":    lockedUsers,
+		"Roles":          roles,
+		"RoleAssigned":   r.URL.Query().Get("role_assigned") == "true",
+	}
+	for permission, flag := range adminPermissionFlags {
+		data[flag] = can[permission]
 	}
 	
 	tmpl.Execute(w, data)
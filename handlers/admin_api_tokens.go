@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// maxAPITokenName is the longest name an API token can be given
+const maxAPITokenName = 100
+
+// AdminAPITokensHandler lists the tokens for the JSON management API and lets
+// admins create and revoke them
+func AdminAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	// Access to this page is checked by middleware.RequirePermission
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		http.Error(w, "User ID not found in session", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" || len(name) > maxAPITokenName {
+				renderAdminAPITokensPage(w, r, fmt.Sprintf("Give the token a name of at most %d characters", maxAPITokenName), "")
+				return
+			}
+
+			token, apiToken, err := models.CreateAPIToken(userID, name)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to create API token: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d created API token %d", userID, apiToken.ID)
+			recordAudit(r, models.AuditAPITokenCreated, models.AuditSuccess, userID, userID, map[string]interface{}{"api_token_id": apiToken.ID, "name": name})
+
+			// The token is only shown this once
+			renderAdminAPITokensPage(w, r, "", token)
+			return
+
+		case "revoke":
+			id, err := strconv.Atoi(r.FormValue("token_id"))
+			if err != nil {
+				http.Error(w, "Invalid token ID", http.StatusBadRequest)
+				return
+			}
+			if err := models.RevokeAPIToken(id); err != nil {
+				if err == models.ErrAPITokenNotFound {
+					http.Error(w, "Token not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, fmt.Sprintf("Failed to revoke API token: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d revoked API token %d", userID, id)
+			recordAudit(r, models.AuditAPITokenRevoked, models.AuditSuccess, userID, 0, map[string]interface{}{"api_token_id": id})
+			http.Redirect(w, r, "/admin/api-tokens?revoked=true", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderAdminAPITokensPage(w, r, "", "")
+}
+
+// Helper function to render the API tokens page, showing a newly created token if there is one
+func renderAdminAPITokensPage(w http.ResponseWriter, r *http.Request, errorMsg, newToken string) {
+	tokens, err := models.GetAPITokens()
+	if err != nil {
+		http.Error(w, "Failed to get API tokens: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin-api-tokens.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Tokens":     tokens,
+		"UserEmails": auditUserEmails(),
+		"NewToken":   newToken,
+		"Error":      errorMsg,
+		"Revoked":    r.URL.Query().Get("revoked") == "true",
+	}
+
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// AdminMFAPoliciesHandler displays the MFA enforcement policies and lets admins edit them
+func AdminMFAPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	// Access to this page is checked by middleware.RequirePermission
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		http.Error(w, "User ID not found in session", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		action := r.FormValue("action")
+
+		switch action {
+		case "create", "update":
+			policy := policyFromForm(r)
+			if action == "create" {
+				if err := models.CreateMFAPolicy(policy); err != nil {
+					renderAdminMFAPoliciesPage(w, r, policyErrorMessage(err))
+					return
+				}
+			} else {
+				id, err := strconv.Atoi(r.FormValue("policy_id"))
+				if err != nil {
+					http.Error(w, "Invalid policy ID", http.StatusBadRequest)
+					return
+				}
+				policy.ID = id
+				if err := models.UpdateMFAPolicy(policy); err != nil {
+					renderAdminMFAPoliciesPage(w, r, policyErrorMessage(err))
+					return
+				}
+			}
+
+			log.Printf("Admin %d saved MFA policy %d", userID, policy.ID)
+			http.Redirect(w, r, "/admin/mfa-policies?saved=true", http.StatusSeeOther)
+			return
+
+		case "delete":
+			id, err := strconv.Atoi(r.FormValue("policy_id"))
+			if err != nil {
+				http.Error(w, "Invalid policy ID", http.StatusBadRequest)
+				return
+			}
+			if err := models.DeleteMFAPolicy(id); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to delete policy: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d deleted MFA policy %d", userID, id)
+			http.Redirect(w, r, "/admin/mfa-policies?deleted=true", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderAdminMFAPoliciesPage(w, r, "")
+}
+
+// Helper function to read a policy from the submitted form
+func policyFromForm(r *http.Request) *models.MFAPolicy {
+	graceDays, _ := strconv.Atoi(r.FormValue("grace_period_days"))
+
+	return &models.MFAPolicy{
+		Role:                r.FormValue("role"),
+		RequireSecondFactor: r.FormValue("require_second_factor") == "on",
+		RequireTOTP:         r.FormValue("require_totp") == "on",
+		FaceOnlyAsAddition:  r.FormValue("face_only_as_addition") == "on",
+		GracePeriodDays:     graceDays,
+		Enabled:             r.FormValue("enabled") == "on",
+	}
+}
+
+// Helper function to turn a policy validation error into a message for the admin
+func policyErrorMessage(err error) string {
+	switch err {
+	case models.ErrEmptyPolicy:
+		return "Choose at least one rule for the policy"
+	case models.ErrUnknownRole:
+		return "Unknown role"
+	default:
+		return "Failed to save policy: " + err.Error()
+	}
+}
+
+// Helper function to render the MFA policies page
+func renderAdminMFAPoliciesPage(w http.ResponseWriter, r *http.Request, errorMsg string) {
+	policies, err := models.GetMFAPolicies()
+	if err != nil {
+		http.Error(w, "Failed to get policies: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := models.GetRoles()
+	if err != nil {
+		log.Printf("Failed to get roles: %v", err)
+	}
+
+	// Count the users each policy currently flags
+	users, err := models.GetAllUsersSafe()
+	if err != nil {
+		log.Printf("Failed to get users: %v", err)
+	}
+	nonCompliant := make(map[int]int)
+	for _, policy := range policies {
+		for _, user := range users {
+			if policy.AppliesTo(user) && policy.Violation(user) != "" {
+				nonCompliant[policy.ID]++
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin-mfa-policies.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Policies":     policies,
+		"Roles":        roles,
+		"NonCompliant": nonCompliant,
+		"Error":        errorMsg,
+		"Saved":        r.URL.Query().Get("saved") == "true",
+		"Deleted":      r.URL.Query().Get("deleted") == "true",
+	}
+
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// maxOIDCClientName is the longest name an OIDC client can be given
+const maxOIDCClientName = 100
+
+// AdminOIDCClientsHandler lists the applications that can sign users in through
+// this service and lets admins register, update and remove them
+func AdminOIDCClientsHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	// Access to this page is checked by middleware.RequirePermission
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		http.Error(w, "User ID not found in session", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" || len(name) > maxOIDCClientName {
+				renderAdminOIDCClientsPage(w, r, fmt.Sprintf("Give the client a name of at most %d characters", maxOIDCClientName), nil, "")
+				return
+			}
+			redirectURIs, err := parseRedirectURIs(r.FormValue("redirect_uris"))
+			if err != nil {
+				renderAdminOIDCClientsPage(w, r, err.Error(), nil, "")
+				return
+			}
+
+			secret, client, err := models.CreateOIDCClient(name, redirectURIs, r.FormValue("public") == "on")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to create OIDC client: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d registered OIDC client %d (%s)", userID, client.ID, name)
+			recordAudit(r, models.AuditOIDCClientCreated, models.AuditSuccess, userID, 0, map[string]interface{}{
+				"client_id":     client.ClientID,
+				"name":          name,
+				"redirect_uris": redirectURIs,
+				"public":        client.Public,
+			})
+
+			// The client secret is only shown this once
+			renderAdminOIDCClientsPage(w, r, "", client, secret)
+			return
+
+		case "update":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				http.Error(w, "Invalid client ID", http.StatusBadRequest)
+				return
+			}
+			redirectURIs, err := parseRedirectURIs(r.FormValue("redirect_uris"))
+			if err != nil {
+				renderAdminOIDCClientsPage(w, r, err.Error(), nil, "")
+				return
+			}
+
+			if err := models.UpdateOIDCClientRedirectURIs(id, redirectURIs); err != nil {
+				if err == models.ErrOIDCClientNotFound {
+					http.Error(w, "Client not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, fmt.Sprintf("Failed to update OIDC client: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d updated the redirect URIs of OIDC client %d", userID, id)
+			recordAudit(r, models.AuditOIDCClientUpdated, models.AuditSuccess, userID, 0, map[string]interface{}{
+				"id":            id,
+				"redirect_uris": redirectURIs,
+			})
+			http.Redirect(w, r, "/admin/oidc-clients?updated=true", http.StatusSeeOther)
+			return
+
+		case "delete":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				http.Error(w, "Invalid client ID", http.StatusBadRequest)
+				return
+			}
+			if err := models.DeleteOIDCClient(id); err != nil {
+				if err == models.ErrOIDCClientNotFound {
+					http.Error(w, "Client not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, fmt.Sprintf("Failed to delete OIDC client: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Admin %d deleted OIDC client %d", userID, id)
+			recordAudit(r, models.AuditOIDCClientDeleted, models.AuditSuccess, userID, 0, map[string]interface{}{"id": id})
+			http.Redirect(w, r, "/admin/oidc-clients?deleted=true", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderAdminOIDCClientsPage(w, r, "", nil, "")
+}
+
+// Helper function to parse redirect URIs entered one per line. They must be
+// absolute HTTPS URLs without a fragment; plain HTTP is allowed for local development.
+func parseRedirectURIs(text string) ([]string, error) {
+	uris := strings.Fields(text)
+	if len(uris) == 0 {
+		return nil, errors.New("Enter at least one redirect URI")
+	}
+
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+			return nil, fmt.Errorf("%s is not a valid redirect URI", uri)
+		}
+
+		switch parsed.Scheme {
+		case "https":
+		case "http":
+			host := parsed.Hostname()
+			if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				return nil, fmt.Errorf("%s must use HTTPS", uri)
+			}
+		default:
+			return nil, fmt.Errorf("%s must use HTTPS", uri)
+		}
+	}
+
+	return uris, nil
+}
+
+// Helper function to render the OIDC clients page, showing a newly registered client if there is one
+func renderAdminOIDCClientsPage(w http.ResponseWriter, r *http.Request, errorMsg string, newClient *models.OIDCClient, newSecret string) {
+	clients, err := models.GetOIDCClients()
+	if err != nil {
+		http.Error(w, "Failed to get OIDC clients: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin-oidc-clients.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Clients":   clients,
+		"NewClient": newClient,
+		"NewSecret": newSecret,
+		"Issuer":    oidcIssuer(),
+		"Error":     errorMsg,
+		"Updated":   r.URL.Query().Get("updated") == "true",
+		"Deleted":   r.URL.Query().Get("deleted") == "true",
+	}
+
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,494 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/middleware"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/mux"
+)
+
+// Page sizes for listing users through the API
+const (
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 200
+)
+
+// maxAPIRequestBody is the largest JSON body accepted by the API
+const maxAPIRequestBody = 64 << 10
+
+// apiUser is the JSON representation of a user in the management API
+type apiUser struct {
+	ID              int       `json:"id"`
+	Username        string    `json:"username"`
+	Nickname        string    `json:"nickname"`
+	Email           string    `json:"email"`
+	EmailVerified   bool      `json:"email_verified"`
+	PendingEmail    string    `json:"pending_email,omitempty"`
+	Role            string    `json:"role"`
+	TwoFAEnabled    bool      `json:"twofa_enabled"`
+	TwoFAType       string    `json:"twofa_type,omitempty"`
+	FaceAuthEnabled bool      `json:"face_auth_enabled"`
+	WebAuthnEnabled bool      `json:"webauthn_enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// apiCreateUserRequest is the body of a request to create a user
+type apiCreateUserRequest struct {
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// apiUpdateUserRequest is the body of a request to update a user. Fields that
+// are left out are not changed.
+type apiUpdateUserRequest struct {
+	Nickname *string `json:"nickname"`
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+}
+
+// APIListUsersHandler lists users, optionally filtered by role, email or a
+// search term, a page at a time
+func APIListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, perPage := 1, apiDefaultPerPage
+	if value := query.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			sendJSONError(w, "page must be a positive number", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if value := query.Get("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > apiMaxPerPage {
+			sendJSONError(w, fmt.Sprintf("per_page must be between 1 and %d", apiMaxPerPage), http.StatusBadRequest)
+			return
+		}
+		perPage = n
+	}
+
+	users, err := models.GetAllUsersSafe()
+	if err != nil {
+		log.Printf("Failed to get users: %v", err)
+		sendJSONError(w, "Failed to get users", http.StatusInternalServerError)
+		return
+	}
+
+	role := query.Get("role")
+	email := strings.ToLower(strings.TrimSpace(query.Get("email")))
+	search := strings.ToLower(strings.TrimSpace(query.Get("q")))
+
+	matched := make([]apiUser, 0)
+	for _, user := range users {
+		if role != "" && user.Role != role {
+			continue
+		}
+		if email != "" && !strings.Contains(strings.ToLower(user.Email), email) {
+			continue
+		}
+		if search != "" && !userMatchesSearch(user, search) {
+			continue
+		}
+		matched = append(matched, newAPIUser(user))
+	}
+
+	total := len(matched)
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"users":    matched[start:end],
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// APIGetUserHandler returns one user
+func APIGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := apiTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"user": newAPIUser(user)})
+}
+
+// APICreateUserHandler creates a user with a password. The new user is asked to
+// verify their email address as after signing up.
+func APICreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := middleware.APIUser(r)
+
+	var req apiCreateUserRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || !strings.Contains(req.Email, "@") {
+		sendJSONError(w, "A valid email is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if !utils.IsStrongPassword(req.Password) {
+		sendJSONError(w, "Password must be at least 8 characters long and contain uppercase, lowercase, number, and special character", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Role != "" && req.Role != models.RoleUser && !apiCheckRole(w, admin, req.Role) {
+		return
+	}
+
+	exists, err := models.EmailExists(req.Email)
+	if err != nil {
+		sendJSONError(w, "Failed to check email", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		sendJSONError(w, "Email already registered", http.StatusConflict)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		sendJSONError(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	username := strings.TrimSpace(req.Username)
+	if username == "" {
+		username = req.Email[:strings.Index(req.Email, "@")]
+	}
+
+	user := models.User{
+		Username:     username,
+		Nickname:     strings.TrimSpace(req.Nickname),
+		Email:        req.Email,
+		PasswordHash: hashedPassword,
+		Role:         req.Role,
+		CreatedAt:    time.Now(),
+	}
+	if err := models.CreateUser(&user); err != nil {
+		sendJSONError(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d created user %d through the API", admin.ID, user.ID)
+	recordAPIAudit(r, models.AuditUserCreated, user.ID, map[string]interface{}{"email": user.Email, "role": user.Role})
+	sendVerificationEmail(r, &user, user.Email)
+
+	sendJSON(w, http.StatusCreated, map[string]interface{}{"user": newAPIUser(&user)})
+}
+
+// APIUpdateUserHandler changes a user's nickname, email or role
+func APIUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := middleware.APIUser(r)
+	user := apiTargetUser(w, r)
+	if user == nil || !apiCheckTarget(w, admin, user) {
+		return
+	}
+
+	var req apiUpdateUserRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+
+	// Check everything before changing anything
+	if req.Role != nil {
+		if user.ID == admin.ID {
+			sendJSONError(w, "Cannot change your own role", http.StatusBadRequest)
+			return
+		}
+		if !apiCheckRole(w, admin, *req.Role) {
+			return
+		}
+	}
+
+	oldEmail := user.Email
+	if req.Email != nil {
+		newEmail := strings.TrimSpace(*req.Email)
+		if newEmail == "" || !strings.Contains(newEmail, "@") {
+			sendJSONError(w, "A valid email is required", http.StatusUnprocessableEntity)
+			return
+		}
+		if strings.EqualFold(newEmail, user.Email) {
+			req.Email = nil
+		} else {
+			exists, err := models.EmailExists(newEmail)
+			if err != nil {
+				sendJSONError(w, "Failed to check email", http.StatusInternalServerError)
+				return
+			}
+			if exists {
+				sendJSONError(w, "Email is already in use", http.StatusConflict)
+				return
+			}
+
+			// The new address has to be confirmed again
+			user.Email = newEmail
+			user.EmailVerified = false
+			user.PendingEmail = ""
+		}
+	}
+
+	if req.Nickname != nil {
+		user.Nickname = strings.TrimSpace(*req.Nickname)
+	}
+	if req.Role != nil {
+		user.Role = *req.Role
+	}
+
+	if err := models.UpdateUser(user); err != nil {
+		sendJSONError(w, fmt.Sprintf("Failed to update user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d updated user %d through the API", admin.ID, user.ID)
+	if req.Role != nil {
+		recordAPIAudit(r, models.AuditRoleChanged, user.ID, map[string]interface{}{"role": user.Role})
+	}
+	if req.Email != nil {
+		// Sessions signed in under the old address must not outlive it
+		if _, err := models.RevokeUserSessions(user.ID, ""); err != nil {
+			log.Printf("Error revoking sessions for user %d after email change: %v", user.ID, err)
+		}
+		recordAPIAudit(r, models.AuditEmailChanged, user.ID, map[string]interface{}{"old_email": oldEmail, "new_email": user.Email})
+		sendVerificationEmail(r, user, user.Email)
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"user": newAPIUser(user)})
+}
+
+// APIDeleteUserHandler deletes a user
+func APIDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := middleware.APIUser(r)
+	user := apiTargetUser(w, r)
+	if user == nil || !apiCheckTarget(w, admin, user) {
+		return
+	}
+
+	// Don't allow deleting yourself
+	if user.ID == admin.ID {
+		sendJSONError(w, "Cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.DeleteUser(user.ID); err != nil {
+		sendJSONError(w, fmt.Sprintf("Failed to delete user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d deleted user %d through the API", admin.ID, user.ID)
+	recordAPIAudit(r, models.AuditUserDeleted, user.ID, map[string]interface{}{"email": user.Email})
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"deleted": user.ID})
+}
+
+// APIResetTwoFAHandler turns off a user's one-time password second factor, for
+// example after they lost their device. The secret and recovery codes are
+// deleted and the user is signed out everywhere.
+func APIResetTwoFAHandler(w http.ResponseWriter, r *http.Request) {
+	admin := middleware.APIUser(r)
+	user := apiTargetUser(w, r)
+	if user == nil || !apiCheckTarget(w, admin, user) {
+		return
+	}
+
+	if !user.TwoFAEnabled {
+		sendJSONError(w, "Two-factor authentication is not enabled for this user", http.StatusConflict)
+		return
+	}
+
+	removedFactor := otpFactor(user)
+	user.TwoFAEnabled = false
+	user.TwoFASecret = ""
+	user.TwoFAAlgorithm = ""
+	user.TwoFADigits = 0
+	user.TwoFAPeriod = 0
+	if err := models.UpdateUser(user); err != nil {
+		sendJSONError(w, fmt.Sprintf("Failed to reset 2FA: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := models.DeleteRecoveryCodes(user.ID); err != nil {
+		log.Printf("Error deleting recovery codes for user %d: %v", user.ID, err)
+	}
+	if err := models.DeleteOTPCodes(user.ID); err != nil {
+		log.Printf("Error deleting one-time codes for user %d: %v", user.ID, err)
+	}
+	if _, err := models.RevokeUserSessions(user.ID, ""); err != nil {
+		log.Printf("Error revoking sessions for user %d after 2FA reset: %v", user.ID, err)
+	}
+
+	log.Printf("Admin %d reset 2FA for user %d through the API", admin.ID, user.ID)
+	recordAPIAudit(r, models.AuditTwoFAReset, user.ID, map[string]interface{}{"factor": removedFactor})
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"user": newAPIUser(user)})
+}
+
+// APIDisableFaceAuthHandler turns off face authentication for a user and deletes the enrolled face
+func APIDisableFaceAuthHandler(w http.ResponseWriter, r *http.Request) {
+	admin := middleware.APIUser(r)
+	user := apiTargetUser(w, r)
+	if user == nil || !apiCheckTarget(w, admin, user) {
+		return
+	}
+
+	if !user.FaceAuthEnabled {
+		sendJSONError(w, "Face authentication is not enabled for this user", http.StatusConflict)
+		return
+	}
+
+	if err := models.DisableFaceAuth(user); err != nil {
+		sendJSONError(w, fmt.Sprintf("Failed to disable face authentication: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d disabled face authentication for user %d through the API", admin.ID, user.ID)
+	recordAPIAudit(r, models.AuditFactorRemoved, user.ID, map[string]interface{}{"factor": utils.FactorFace})
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"user": newAPIUser(user)})
+}
+
+// Helper function to convert a user to its API representation
+func newAPIUser(user *models.User) apiUser {
+	result := apiUser{
+		ID:              user.ID,
+		Username:        user.Username,
+		Nickname:        user.Nickname,
+		Email:           user.Email,
+		EmailVerified:   user.EmailVerified,
+		PendingEmail:    user.PendingEmail,
+		Role:            user.Role,
+		TwoFAEnabled:    user.TwoFAEnabled,
+		FaceAuthEnabled: user.FaceAuthEnabled,
+		WebAuthnEnabled: user.WebAuthnEnabled,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	}
+	if user.TwoFAEnabled {
+		result.TwoFAType = user.TwoFAType
+	}
+	return result
+}
+
+// Helper function to check whether a user's username, nickname or email contains a lowercase search term
+func userMatchesSearch(user *models.User, search string) bool {
+	for _, field := range []string{user.Username, user.Nickname, user.Email} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to load the user named in the URL. It writes an error
+// response and returns nil if there is none.
+func apiTargetUser(w http.ResponseWriter, r *http.Request) *models.User {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		sendJSONError(w, "Invalid user ID", http.StatusBadRequest)
+		return nil
+	}
+
+	user, err := models.GetUserByIDSafe(id)
+	if err != nil {
+		sendJSONError(w, "User not found", http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+// Helper function to check that a role exists and the admin may assign it. It
+// writes an error response and returns false otherwise.
+func apiCheckRole(w http.ResponseWriter, admin *models.User, role string) bool {
+	allowed, err := models.HasPermission(admin.Role, models.PermissionAssignRoles)
+	if err != nil {
+		sendJSONError(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		sendJSONError(w, "Forbidden - missing permission "+models.PermissionAssignRoles, http.StatusForbidden)
+		return false
+	}
+
+	exists, err := models.RoleExists(role)
+	if err != nil {
+		sendJSONError(w, "Failed to check role", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		sendJSONError(w, "Unknown role", http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+// Helper function to check that the admin may act on a user. A user whose role
+// grants permissions the admin doesn't have can only be changed by an admin who
+// could assign that role. It writes an error response and returns false otherwise.
+func apiCheckTarget(w http.ResponseWriter, admin *models.User, user *models.User) bool {
+	if user.ID == admin.ID {
+		return true
+	}
+
+	exceeds, err := models.RoleExceeds(user.Role, admin.Role)
+	if err != nil {
+		sendJSONError(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !exceeds {
+		return true
+	}
+	return apiCheckRole(w, admin, user.Role)
+}
+
+// Helper function to decode a JSON request body. It writes an error response
+// and returns false if the body isn't valid.
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		sendJSONError(w, fmt.Sprintf("Invalid JSON body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Helper function to record an action taken through the API in the audit log
+func recordAPIAudit(r *http.Request, eventType string, targetID int, details map[string]interface{}) {
+	details["via"] = "api"
+	if token := middleware.APIToken(r); token != nil {
+		details["api_token_id"] = token.ID
+	}
+	if token := middleware.PersonalToken(r); token != nil {
+		details["personal_token_id"] = token.ID
+	}
+	recordAudit(r, eventType, models.AuditSuccess, middleware.APIUser(r).ID, targetID, details)
+}
+
+// Helper function to send a successful JSON response in the same envelope as sendJSONError
+func sendJSON(w http.ResponseWriter, statusCode int, data map[string]interface{}) {
+	data["success"] = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/middleware"
+	"github.com/aungh/login-form/models"
+	"github.com/gorilla/mux"
+)
+
+// newAPIUsersRouter routes the user management API like main.go does
+func newAPIUsersRouter() *mux.Router {
+	api := func(permission string, handler http.HandlerFunc) http.Handler {
+		return middleware.RequireAPIToken(middleware.RequireAPIPermission(permission)(handler))
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/api/v1/users/{id:[0-9]+}", api(models.PermissionManageUsers, APIUpdateUserHandler)).Methods("PATCH")
+	r.Handle("/api/v1/users/{id:[0-9]+}", api(models.PermissionManageUsers, APIDeleteUserHandler)).Methods("DELETE")
+	r.Handle("/api/v1/users/{id:[0-9]+}/reset-2fa", api(models.PermissionManageUsers, APIResetTwoFAHandler)).Methods("POST")
+	return r
+}
+
+// createTestAPIToken creates a user with a role and an API token for them
+func createTestAPIToken(t *testing.T, email, role string) (*models.User, string) {
+	t.Helper()
+
+	user := createTestUser(t, email)
+	if err := models.AssignRole(user.ID, role); err != nil {
+		t.Fatalf("AssignRole: %v", err)
+	}
+	user.Role = role
+
+	token, _, err := models.CreateAPIToken(user.ID, "test")
+	if err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	return user, token
+}
+
+func TestAPIUsersTargetRole(t *testing.T) {
+	setupTestDB(t)
+
+	// A support role may manage users but not assign roles
+	_, err := database.DB.Exec(`
+	INSERT INTO roles (name) VALUES ('support');
+	INSERT INTO role_permissions (role_id, permission_id)
+		SELECT roles.id, permissions.id FROM roles, permissions
+		WHERE roles.name = 'support' AND permissions.name IN ('users.view', 'users.manage');`)
+	if err != nil {
+		t.Fatalf("create support role: %v", err)
+	}
+
+	admin, adminToken := createTestAPIToken(t, "admin@example.com", models.RoleAdmin)
+	_, supportToken := createTestAPIToken(t, "support@example.com", "support")
+
+	tests := []struct {
+		name       string
+		token      string
+		targetRole string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"support edits a user", supportToken, models.RoleUser, "PATCH", "", `{"nickname":"n"}`, http.StatusOK},
+		{"support changes a user's email", supportToken, models.RoleUser, "PATCH", "", `{"email":"new@example.com"}`, http.StatusOK},
+		{"support changes an admin's email", supportToken, models.RoleAdmin, "PATCH", "", `{"email":"new@example.com"}`, http.StatusForbidden},
+		{"support edits an admin", supportToken, models.RoleAdmin, "PATCH", "", `{"nickname":"n"}`, http.StatusForbidden},
+		{"support resets an admin's 2FA", supportToken, models.RoleAdmin, "POST", "/reset-2fa", "", http.StatusForbidden},
+		{"support deletes an admin", supportToken, models.RoleAdmin, "DELETE", "", "", http.StatusForbidden},
+		{"support deletes a user", supportToken, models.RoleUser, "DELETE", "", "", http.StatusOK},
+		{"admin changes an admin's email", adminToken, models.RoleAdmin, "PATCH", "", `{"email":"new@example.com"}`, http.StatusOK},
+	}
+
+	router := newAPIUsersRouter()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := createTestUser(t, "target"+strconv.Itoa(i)+"@example.com")
+			target.Role = tt.targetRole
+			target.TwoFAEnabled = true
+			if err := models.UpdateUser(target); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+
+			body := strings.ReplaceAll(tt.body, "new@", "new"+strconv.Itoa(i)+"@")
+			r := httptest.NewRequest(tt.method, "/api/v1/users/"+strconv.Itoa(target.ID)+tt.path, strings.NewReader(body))
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			r.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			if tt.wantStatus == http.StatusForbidden {
+				stored, err := models.GetUserByID(target.ID)
+				if err != nil {
+					t.Fatalf("GetUserByID: %v", err)
+				}
+				if stored.Email != target.Email || !stored.TwoFAEnabled {
+					t.Errorf("refused request changed the user: %+v", stored)
+				}
+			}
+		})
+	}
+
+	if _, err := models.GetUserByID(admin.ID); err != nil {
+		t.Errorf("admin account is gone: %v", err)
+	}
+}
+
+func TestAPIUpdateUserEmailRevokesSessions(t *testing.T) {
+	setupTestDB(t)
+	_, adminToken := createTestAPIToken(t, "admin@example.com", models.RoleAdmin)
+	target := createTestUser(t, "user@example.com")
+
+	_, err := database.DB.Exec(
+		`INSERT INTO sessions (id, user_id, data, expires_at) VALUES ('s1', ?, '', datetime('now', '+1 day'))`, target.ID,
+	)
+	if err != nil {
+		t.Fatalf("insert session: %v", err)
+	}
+
+	tests := []struct {
+		body         string
+		wantSessions int
+	}{
+		{`{"nickname":"n"}`, 1},
+		{`{"email":"user@example.com"}`, 1},
+		{`{"email":"new@example.com"}`, 0},
+	}
+
+	router := newAPIUsersRouter()
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/api/v1/users/"+strconv.Itoa(target.ID), strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tt.body, rec.Code, rec.Body.String())
+		}
+
+		var sessions int
+		if err := database.DB.QueryRow(`SELECT COUNT(*) FROM sessions WHERE user_id = ?`, target.ID).Scan(&sessions); err != nil {
+			t.Fatalf("count sessions: %v", err)
+		}
+		if sessions != tt.wantSessions {
+			t.Errorf("%s: %d sessions left, want %d", tt.body, sessions, tt.wantSessions)
+		}
+	}
+}
+
+func TestAPIUsersRefusesPersonalTokens(t *testing.T) {
+	setupTestDB(t)
+	admin, _ := createTestAPIToken(t, "admin@example.com", models.RoleAdmin)
+	target := createTestUser(t, "user@example.com")
+
+	// The user management API is not a scope a personal token can be granted
+	if _, _, err := models.CreatePersonalAccessToken(admin.ID, "api", []string{"users:api"}, time.Hour); err != models.ErrUnknownScope {
+		t.Fatalf("CreatePersonalAccessToken with users:api = %v, want %v", err, models.ErrUnknownScope)
+	}
+
+	personalToken, _, err := models.CreatePersonalAccessToken(admin.ID, "profile", []string{models.ScopeProfileRead, models.ScopeHistoryRead}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PATCH", "", `{"email":"new@example.com"}`},
+		{"POST", "/reset-2fa", ""},
+		{"DELETE", "", ""},
+	}
+
+	router := newAPIUsersRouter()
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1/users/"+strconv.Itoa(target.ID)+tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer "+personalToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s with a personal token: status = %d, want %d", tt.method, tt.path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if _, err := models.GetUserByID(target.ID); err != nil {
+		t.Errorf("user was deleted with a personal token: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// auditPageSize is the number of events shown per page of the audit log
+const auditPageSize = 50
+
+// maxAuditUserAgent is the longest user agent stored with an audit event
+const maxAuditUserAgent = 512
+
+// Helper function to write an event to the audit log. A user ID of 0 means
+// the user is unknown. Failures are only logged so they never block the request.
+func recordAudit(r *http.Request, eventType, outcome string, actorID, targetID int, details map[string]interface{}) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxAuditUserAgent {
+		userAgent = userAgent[:maxAuditUserAgent]
+	}
+
+	event := &models.AuditEvent{
+		ActorUserID:  actorID,
+		TargetUserID: targetID,
+		EventType:    eventType,
+		IPAddress:    utils.ClientIP(r),
+		UserAgent:    userAgent,
+		Outcome:      outcome,
+		Details:      details,
+	}
+	if err := models.RecordAuditEvent(event); err != nil {
+		log.Printf("Error recording %s audit event for user %d: %v", eventType, targetID, err)
+	}
+}
+
+// Helper function to record an event a user performed on their own account
+func recordUserAudit(r *http.Request, eventType string, user *models.User, details map[string]interface{}) {
+	recordAudit(r, eventType, models.AuditSuccess, user.ID, user.ID, details)
+}
+
+// AdminAuditHandler shows the security audit log with filters, and exports it
+// as CSV or JSON when a format is requested
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	// Access to this page is checked by middleware.RequirePermission
+	filter, errorMsg := auditFilterFromQuery(r.URL.Query())
+
+	switch r.URL.Query().Get("format") {
+	case "csv", "json":
+		exportAuditEvents(w, r, filter)
+		return
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	filter.Limit = auditPageSize
+	filter.Offset = (page - 1) * auditPageSize
+
+	events, err := models.GetAuditEvents(filter)
+	if err != nil {
+		http.Error(w, "Failed to get audit events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total, err := models.CountAuditEvents(filter)
+	if err != nil {
+		http.Error(w, "Failed to count audit events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/admin-audit.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the filters in the pagination and export links; Encode already escapes them
+	query := r.URL.Query()
+	query.Del("page")
+	query.Del("format")
+
+	data := map[string]interface{}{
+		"Events":     events,
+		"UserEmails": auditUserEmails(),
+		"EventTypes": models.AuditEventTypes,
+		"Query":      r.URL.Query(),
+		"Filters":    template.URL(query.Encode()),
+		"Total":      total,
+		"Page":       page,
+		"PrevPage":   page - 1,
+		"NextPage":   nextAuditPage(page, total),
+		"Error":      errorMsg,
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// Helper function to read the audit log filters from the query string. It
+// returns a message for filters that couldn't be understood.
+func auditFilterFromQuery(query url.Values) (models.AuditFilter, string) {
+	filter := models.AuditFilter{
+		EventType: query.Get("type"),
+		Outcome:   query.Get("outcome"),
+		IPAddress: strings.TrimSpace(query.Get("ip")),
+	}
+	var problems []string
+
+	// The user can be given by ID or email address
+	if user := strings.TrimSpace(query.Get("user")); user != "" {
+		if id, err := strconv.Atoi(user); err == nil {
+			filter.UserID = id
+		} else if found, err := models.GetUserByEmailSafe(user); err == nil {
+			filter.UserID = found.ID
+		} else {
+			problems = append(problems, "unknown user "+user)
+		}
+	}
+
+	// Dates are whole days; "to" includes the day given
+	if from := query.Get("from"); from != "" {
+		since, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			problems = append(problems, "invalid start date")
+		}
+		filter.Since = since
+	}
+	if to := query.Get("to"); to != "" {
+		until, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			problems = append(problems, "invalid end date")
+		} else {
+			filter.Until = until.AddDate(0, 0, 1)
+		}
+	}
+
+	if len(problems) > 0 {
+		return filter, "Some filters were ignored: " + strings.Join(problems, ", ")
+	}
+	return filter, ""
+}
+
+// Helper function to write the events matching a filter as a CSV or JSON download
+func exportAuditEvents(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	events, err := models.GetAuditEvents(filter)
+	if err != nil {
+		http.Error(w, "Failed to get audit events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405")
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		json.NewEncoder(w).Encode(events)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "created_at", "actor_user_id", "target_user_id", "event_type", "ip", "user_agent", "outcome", "details"})
+	for _, event := range events {
+		writer.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			strconv.Itoa(event.ActorUserID),
+			strconv.Itoa(event.TargetUserID),
+			event.EventType,
+			event.IPAddress,
+			event.UserAgent,
+			event.Outcome,
+			event.DetailsJSON(),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing audit export: %v", err)
+	}
+}
+
+// Helper function to map user IDs to email addresses for display
+func auditUserEmails() map[int]string {
+	emails := make(map[int]string)
+
+	users, err := models.GetAllUsersSafe()
+	if err != nil {
+		log.Printf("Failed to get users: %v", err)
+		return emails
+	}
+	for _, user := range users {
+		emails[user.ID] = user.Email
+	}
+	return emails
+}
+
+// Helper function to get the next page of the audit log, or 0 if this is the last one
+func nextAuditPage(page, total int) int {
+	if page*auditPageSize >= total {
+		return 0
+	}
+	return page + 1
+}
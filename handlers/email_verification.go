@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// resendVerificationMessage is shown whether or not a verification email was sent,
+// so the form can't be used to find out which addresses are registered
+const resendVerificationMessage = "If that account still needs verification, a new link has been sent."
+
+// VerifyEmailHandler confirms an email address from a signed verification link
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	userID, err := utils.EmailVerificationTokenUserID(token)
+	if err != nil {
+		renderLoginPage(w, "The verification link is invalid or has expired. Please request a new one.")
+		return
+	}
+
+	user, err := models.GetUserByIDSafe(userID)
+	if err != nil {
+		renderLoginPage(w, "The verification link is invalid or has expired. Please request a new one.")
+		return
+	}
+
+	// Links are signed for the address the account had when they were sent
+	email, err := utils.VerifyEmailVerificationToken(token, user.Email)
+	if err != nil {
+		renderLoginPage(w, "The verification link is invalid or has expired. Please request a new one.")
+		return
+	}
+
+	oldEmail := user.Email
+	switch {
+	case user.PendingEmail != "" && strings.EqualFold(email, user.PendingEmail):
+		// Confirming a change of address; the old one worked until now
+		exists, _ := models.EmailExists(email)
+		if exists {
+			renderLoginPage(w, "That email address is already in use by another account.")
+			return
+		}
+		user.Email = user.PendingEmail
+		user.PendingEmail = ""
+		user.EmailVerified = true
+
+	case strings.EqualFold(email, user.Email):
+		// Confirming the address used at signup
+		user.EmailVerified = true
+
+	default:
+		// The address has changed since the link was sent
+		renderLoginPage(w, "The verification link is invalid or has expired. Please request a new one.")
+		return
+	}
+
+	if err := models.UpdateUser(user); err != nil {
+		http.Error(w, "Failed to verify email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Email %s verified for user %d", user.Email, user.ID)
+	if user.Email != oldEmail {
+		recordUserAudit(r, models.AuditEmailChanged, user, map[string]interface{}{"old_email": oldEmail, "new_email": user.Email})
+	}
+
+	// Keep a signed-in session in step with the confirmed address
+	session, _ := utils.GetSession(r)
+	if auth, _ := session.Values["authenticated"].(bool); auth {
+		if sessionUserID, _ := session.Values["user_id"].(int); sessionUserID == user.ID {
+			session.Values["email"] = user.Email
+			session.Save(r, w)
+			http.Redirect(w, r, "/user/settings?msg=email_verified", http.StatusSeeOther)
+			return
+		}
+	}
+
+	http.Redirect(w, r, "/login?msg=email_verified", http.StatusSeeOther)
+}
+
+// ResendVerificationHandler sends a new verification link for an unverified account
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	user, err := models.GetUserByEmailSafe(email)
+	if err == nil && !user.EmailVerified {
+		resendVerificationEmail(r, user, user.Email)
+	}
+
+	http.Redirect(w, r, "/login?msg=verification_sent", http.StatusSeeOther)
+}
+
+// Helper function to send another verification link on request, unless one was
+// requested too recently or too often for the account or from the client's IP address
+func resendVerificationEmail(r *http.Request, user *models.User, email string) bool {
+	err := models.RecordVerificationEmailRequest(user.ID, utils.ClientIP(r))
+	if err == models.ErrVerificationTooSoon {
+		log.Printf("Verification email for user %d requested again too soon from %s", user.ID, utils.ClientIP(r))
+		return false
+	}
+	if err != nil {
+		log.Printf("Error recording verification email request for user %d: %v", user.ID, err)
+		return false
+	}
+
+	sendVerificationEmail(r, user, email)
+	return true
+}
+
+// Helper function to email a verification link for the given address
+func sendVerificationEmail(r *http.Request, user *models.User, email string) {
+	token := utils.SignEmailVerification(user.ID, user.Email, email)
+	link := absoluteURL("/verify-email?token=" + url.QueryEscape(token))
+
+	msg := utils.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Please confirm this email address for your account by opening this link:\n\n"+
+			"%s\n\n"+
+			"The link expires in %d hours. If you didn't request this, you can ignore this email.\n",
+			user.Username, link, int(utils.EmailVerificationTTL.Hours())),
+	}
+	if err := utils.SendMail(msg); err != nil {
+		log.Printf("Error sending verification email to user %d: %v", user.ID, err)
+	}
+}
@@ -2,40 +2,44 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"log"
 	"net/http"
 
 	"github.com/aungh/login-form/models"
 	"github.com/aungh/login-form/utils"
-	"github.com/gorilla/sessions"
 )
 
+// maxFaceRequestBody is the largest request accepted with a face image. Base64
+// and form encoding make the image up to about half as large again.
+const maxFaceRequestBody = 2 * utils.MaxFaceImageBytes
+
 // SetupFaceHandler handles face authentication setup
 func SetupFaceHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
-	// Check if user is authenticated
-	auth, ok := session.Values["authenticated"].(bool)
-	if !ok || !auth {
+	// The user is signed in, or their login waits for them to meet an MFA policy
+	user, flow, err := enrollingUser(session)
+	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	userID, ok := session.Values["user_id"].(int)
-	if !ok {
-		http.Error(w, "User ID not found in session", http.StatusInternalServerError)
-		return
-	}
-
-	user, err := models.GetUserByIDSafe(userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusInternalServerError)
+	// Enrolling a face while signed in needs a recent verification, even the
+	// first one; one an MFA policy forces during login doesn't
+	if flow == nil && !requireRecentAuth(w, r, session, r.URL.RequestURI()) {
 		return
 	}
 
 	// Process form submission
 	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFaceRequestBody)
+		if err := r.ParseForm(); err != nil {
+			renderFacePage(w, "The image is too large. Please try again.", true)
+			return
+		}
 		faceData := r.FormValue("face_data")
 
 		// Validate input
@@ -44,17 +48,44 @@ func SetupFaceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Make sure the snapshot is a decodable image before enrolling it
+		if _, err := utils.DecodeFaceImage(faceData); err != nil {
+			if errors.Is(err, utils.ErrFaceImageTooLarge) {
+				renderFacePage(w, "The image is too large. Please try again.", true)
+				return
+			}
+			renderFacePage(w, "Invalid face image. Please try again.", true)
+			return
+		}
+
 		// Enable face auth and save face data
 		if err := enableFaceAuth(user, faceData); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Update session
+		recordUserAudit(r, models.AuditFactorEnrolled, user, map[string]interface{}{"factor": utils.FactorFace})
+
+		// Sign in now, or move on if a policy still isn't met
+		if flow != nil {
+			next, err := finishEnrollment(w, r, session, flow, utils.FactorFace)
+			if err != nil {
+				log.Printf("Error advancing login for user %d: %v", user.ID, err)
+				http.Error(w, "Session error", http.StatusInternalServerError)
+				return
+			}
+			session.Save(r, w)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		// Update session; the enrolled face satisfies the new factor, but
+		// enrolling it is not a re-authentication
 		session.Values["face_auth_enabled"] = true
+		utils.MarkEnrolledFactor(session, utils.FactorFace)
 		session.Save(r, w)
 
-		http.Redirect(w, r, "/?face_setup=success", http.StatusSeeOther)
+		http.Redirect(w, r, "/user/settings?msg=face_enrolled", http.StatusSeeOther)
 		return
 	}
 
@@ -66,23 +97,22 @@ func SetupFaceHandler(w http.ResponseWriter, r *http.Request) {
 func VerifyFaceHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
-	// Debug session values
-	fmt.Printf("DEBUG: Face verification handler - session values: %+v\n", session.Values)
-
-	// Check if there's a pending authentication
-	email, ok := session.Values["pending_auth_email"].(string)
-	fmt.Printf("DEBUG: Face verification - pending_auth_email: %s (valid: %v)\n", email, ok)
-	if !ok || email == "" {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	// Check that face verification is next in a login in progress
+	flow, redirect := loginStep(session, utils.FactorFace)
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
 		return
 	}
-	
-	// Check if 2FA was completed before face verification
-	twoFACompleted, _ := session.Values["twofa_completed"].(bool)
-	fmt.Printf("DEBUG: Face verification - 2FA completed: %v\n", twoFACompleted)
+	user := flow.User
+	email := user.Email
 
 	// Process form submission
 	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFaceRequestBody)
+		if err := r.ParseForm(); err != nil {
+			renderFacePage(w, "The image is too large. Please try again.", false)
+			return
+		}
 		faceData := r.FormValue("face_data")
 
 		// Validate input
@@ -91,26 +121,27 @@ func VerifyFaceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Get user - use the safe version that handles NULL values
-		user, err := models.GetUserByEmailSafe(email)
-		if err != nil {
-			http.Error(w, "User not found: "+err.Error(), http.StatusInternalServerError)
+		// Refuse the attempt if the account or IP address is throttled
+		if msg := authThrottleMessage(r, email); msg != "" {
+			renderFacePage(w, msg, false)
 			return
 		}
 
-		// If user doesn't have face auth enabled yet, enable it and save the face data
-		if !user.FaceAuthEnabled {
-			if err := enableFaceAuth(user, faceData); err != nil {
-				// Just log the error but continue with authentication
-				fmt.Printf("Warning: %v\n", err)
-			}
+		// Compare the submitted face with the enrolled template
+		if errMsg := matchFace(user, faceData); errMsg != "" {
+			recordAuthFailure(r, models.AuditLogin, email, utils.FactorFace)
+			renderFacePage(w, errMsg, false)
+			return
 		}
+		releaseAuthAttempt(r, email)
 
-		// Set session values for authentication
-		setAuthSessionValues(session, user, false)
-		session.Save(r, w)
+		if _, err := flow.Complete(utils.FactorFace, utils.FactorFace, nil); err != nil {
+			log.Printf("Error completing face step for user %d: %v", user.ID, err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
 
-		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		continueLogin(w, r, session, flow)
 		return
 	}
 
@@ -122,44 +153,58 @@ func VerifyFaceHandler(w http.ResponseWriter, r *http.Request) {
 func APIVerifyFaceHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
-	// Check if there's a pending authentication
-	email, ok := session.Values["pending_auth_email"].(string)
-	if !ok || email == "" {
+	// Check that face verification is next in a login in progress
+	flow, redirect := loginStep(session, utils.FactorFace)
+	if redirect == "/login" {
 		sendJSONError(w, "No pending authentication", http.StatusBadRequest)
 		return
+	} else if redirect != "" {
+		// Earlier steps come first and must not be skipped
+		sendJSONError(w, "Complete the previous verification step first", http.StatusForbidden)
+		return
 	}
+	user := flow.User
+	email := user.Email
 
 	// Parse request body
 	var requestData struct {
 		FaceData string `json:"face_data"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFaceRequestBody)).Decode(&requestData); err != nil {
 		sendJSONError(w, "Invalid request data", http.StatusBadRequest)
 		return
 	}
 
-	// Get user - use the safe version that handles NULL values
-	user, err := models.GetUserByEmailSafe(email)
-	if err != nil {
-		sendJSONError(w, "User not found: "+err.Error(), http.StatusInternalServerError)
+	// Refuse the attempt if the account or IP address is throttled
+	if msg := authThrottleMessage(r, email); msg != "" {
+		sendJSONError(w, msg, http.StatusTooManyRequests)
 		return
 	}
 
-	// If face auth is not enabled for this user, we'll enable it
-	if !user.FaceAuthEnabled {
-		// Enable face auth and save the face data
-		if err := enableFaceAuth(user, requestData.FaceData); err != nil {
-			// Just log the error but continue with authentication
-			fmt.Printf("Warning: %v\n", err)
-		}
+	// Compare the submitted face with the enrolled template
+	if errMsg := matchFace(user, requestData.FaceData); errMsg != "" {
+		recordAuthFailure(r, models.AuditLogin, email, utils.FactorFace)
+		sendJSONError(w, errMsg, http.StatusUnauthorized)
+		return
 	}
+	releaseAuthAttempt(r, email)
 
-	// Set session values for complete authentication
-	setAuthSessionValues(session, user, true)
+	if _, err := flow.Complete(utils.FactorFace, utils.FactorFace, nil); err != nil {
+		log.Printf("Error completing face step for user %d: %v", user.ID, err)
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+
+	// Finish the login, or continue with a factor registered after face
+	next, err := advanceLogin(w, r, session, flow)
+	if err != nil {
+		log.Printf("Error advancing login for user %d: %v", user.ID, err)
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
 
-	// Log successful authentication
-	fmt.Println("Face verification successful, authentication complete")
+	log.Printf("Face verification succeeded for user %d", user.ID)
 
 	session.Save(r, w)
 
@@ -168,89 +213,54 @@ func APIVerifyFaceHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":  true,
 		"message":  "Face verification successful",
-		"redirect": "/home",
+		"redirect": next,
 	})
 }
 
 // Helper function to enable face authentication for a user
 func enableFaceAuth(user *models.User, faceData string) error {
-	// Update user with face auth enabled
-	user.FaceAuthEnabled = true
-	err := models.UpdateUser(user)
+	faceImage, err := utils.FaceImageBytes(faceData)
 	if err != nil {
-		return fmt.Errorf("failed to update user: %v", err)
+		return err
 	}
 
-	// Save face data
-	err = utils.SaveFaceData(user.ID, faceData)
-	if err != nil {
+	// Store the face and the flag together so one can't exist without the other
+	if err := models.EnableFaceAuth(user, faceImage); err != nil {
 		return fmt.Errorf("failed to save face data: %v", err)
 	}
 
 	return nil
 }
 
-// Helper function to set authentication session values
-func setAuthSessionValues(session *sessions.Session, user *models.User, isAPI bool) {
-	fmt.Printf("DEBUG: setAuthSessionValues called with isAPI=%v, user=%+v\n", isAPI, user)
-	fmt.Printf("DEBUG: Session values before update: %+v\n", session.Values)
-	
-	// Check if we're coming from 2FA verification
-	twoFACompleted, wasTwoFACompleted := session.Values["twofa_completed"].(bool)
-	
-	// Set common session values
-	session.Values["authenticated"] = true
-	
-	// If we have temp user data from 2FA, use it
-	if wasTwoFACompleted && twoFACompleted {
-		// Use the user ID from the session if available
-		if tempUserID, ok := session.Values["temp_user_id"].(int); ok && tempUserID > 0 {
-			session.Values["user_id"] = tempUserID
-		} else {
-			session.Values["user_id"] = user.ID
-		}
-		
-		// Use the username from the session if available
-		if tempUsername, ok := session.Values["temp_username"].(string); ok && tempUsername != "" {
-			session.Values["username"] = tempUsername
-		} else {
-			session.Values["username"] = user.Username
+// Helper function to match submitted face data against the user's enrolled face.
+// It returns an empty string on success, or a message to show to the user.
+func matchFace(user *models.User, faceData string) string {
+	if !user.FaceAuthEnabled {
+		return "Face authentication is not enabled for this account"
+	}
+
+	enrolled, err := models.GetFaceTemplate(user.ID)
+	if err != nil {
+		if errors.Is(err, utils.ErrNoFaceTemplate) {
+			log.Printf("Face verification rejected for user %d: no enrolled face", user.ID)
+			return "No enrolled face found for this account"
 		}
-		
-		// Always set 2FA as enabled since it was completed
-		session.Values["twofa_enabled"] = true
-		fmt.Println("DEBUG: Using session data from 2FA completion")
-	} else {
-		// Use the user data from the database
-		session.Values["user_id"] = user.ID
-		session.Values["username"] = user.Username
-		session.Values["twofa_enabled"] = user.TwoFAEnabled
+		log.Printf("Error loading face template for user %d: %v", user.ID, err)
+		return "Face verification failed"
+	}
+
+	score, matched, err := utils.VerifyFace(enrolled, faceData)
+	if err != nil {
+		log.Printf("Face verification error for user %d: %v", user.ID, err)
+		return "Face verification failed"
+	}
+
+	log.Printf("Face verification for user %d: score=%.3f, matched=%v", user.ID, score, matched)
+	if !matched {
+		return "Face does not match the enrolled face"
 	}
-	
-	// Always set these values
-	session.Values["email"] = user.Email
-	session.Values["face_auth_enabled"] = true
-
-	// Clean up temporary session data
-	cleanupSessionData(session)
-	
-	// Log final session state
-	fmt.Printf("DEBUG: Session values after update: %+v\n", session.Values)
-}
 
-// Helper function to clean up temporary session data
-func cleanupSessionData(session *sessions.Session) {
-	// Clean up all temporary and pending auth data
-	delete(session.Values, "pending_auth_email")
-	delete(session.Values, "pending_auth_user_id")
-	delete(session.Values, "pending_auth_username")
-	delete(session.Values, "pending_auth_mfa_enabled")
-	delete(session.Values, "pending_auth_face_enabled")
-	delete(session.Values, "pending_face_after_2fa")
-	delete(session.Values, "twofa_verified")
-	delete(session.Values, "twofa_completed")
-	delete(session.Values, "temp_user_id")
-	delete(session.Values, "temp_username")
+	return ""
 }
 
 // Helper function to send JSON error responses
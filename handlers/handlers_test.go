@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// setupTestDB opens and migrates an empty database in a temporary directory
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("ENCRYPTION_KEYS", "test:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err := utils.InitEncryptionKeys(); err != nil {
+		t.Fatalf("InitEncryptionKeys: %v", err)
+	}
+
+	if err := database.OpenDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+
+	if err := database.MigrateDB(); err != nil {
+		t.Fatalf("MigrateDB: %v", err)
+	}
+}
+
+// createTestUser creates a user with the given email
+func createTestUser(t *testing.T, email string) *models.User {
+	t.Helper()
+
+	user := &models.User{Username: email, Email: email, EmailVerified: true}
+	if err := models.CreateUser(user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
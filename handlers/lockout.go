@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// Helper function to reserve an authentication attempt before verifying it.
+// It returns an empty string if the attempt may go ahead, or a message to show
+// to the user. The attempt counts as a failure until releaseAuthAttempt gives
+// it back, so concurrent guesses can't all get past the check.
+func authThrottleMessage(r *http.Request, email string) string {
+	err := models.ReserveLoginAttempt(email, utils.ClientIP(r))
+	if err == nil {
+		return ""
+	}
+
+	var throttled *models.LoginThrottledError
+	if errors.As(err, &throttled) {
+		log.Printf("Authentication attempt for %s from %s throttled (%s)", email, utils.ClientIP(r), throttled.ScopeKey)
+		return throttled.Error()
+	}
+
+	// Don't lock everybody out if the counters can't be read
+	log.Printf("Error checking login throttle for %s: %v", email, err)
+	return ""
+}
+
+// Helper function to record that a reserved password or factor attempt failed,
+// both for throttling and in the audit log as an event of eventType
+func recordAuthFailure(r *http.Request, eventType, email, factor string) {
+	if err := models.RecordLoginFailure(email, utils.ClientIP(r)); err != nil {
+		log.Printf("Error recording authentication failure for %s: %v", email, err)
+	}
+
+	// The attempt may be for an address that has no account
+	targetID := 0
+	if user, err := models.GetUserByEmailSafe(email); err == nil {
+		targetID = user.ID
+	}
+	recordAudit(r, eventType, models.AuditFailure, 0, targetID, map[string]interface{}{
+		"email":  email,
+		"factor": factor,
+	})
+}
+
+// Helper function to give back a reserved attempt once it was verified
+func releaseAuthAttempt(r *http.Request, email string) {
+	if err := models.ReleaseLoginAttempt(email, utils.ClientIP(r)); err != nil {
+		log.Printf("Error releasing authentication attempt for %s: %v", email, err)
+	}
+}
+
+// Helper function to reset failure counters after a complete authentication
+func resetAuthFailures(r *http.Request, email string) {
+	if err := models.ResetLoginFailures(email, utils.ClientIP(r)); err != nil {
+		log.Printf("Error resetting authentication failures for %s: %v", email, err)
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/models"
+	"github.com/gorilla/sessions"
+)
+
+// loginNextKey is the session key holding the page to return to once a login
+// is finished, such as an OpenID Connect authorization request
+const loginNextKey = "login_next"
+
+// Helper function to load the login flow for a verification page. It returns
+// the page to send the user to instead if this factor is not the next step.
+func loginStep(session *sessions.Session, factor string) (*authflow.Flow, string) {
+	flow, err := authflow.Current(session)
+	if err != nil {
+		if err != authflow.ErrNoFlow {
+			log.Printf("Error loading login flow: %v", err)
+		}
+		return nil, "/login"
+	}
+
+	next, err := flow.Next()
+	if err != nil {
+		log.Printf("Error finding the next login step: %v", err)
+		return nil, "/login"
+	}
+	if next == nil {
+		return nil, "/login"
+	}
+	if next.Name() != factor {
+		return nil, next.Path()
+	}
+
+	return flow, ""
+}
+
+// Helper function to move a login to its next step. It signs the user in
+// when no step is left, checking for a new device, and returns the page to continue on.
+// A user who doesn't meet an enforced MFA policy stays signed out at the
+// enrollment step until they have set up what it requires.
+func advanceLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, flow *authflow.Flow) (string, error) {
+	step, err := flow.Next()
+	if err != nil {
+		return "", err
+	}
+	if step != nil {
+		return step.Path(), nil
+	}
+
+	user := flow.User
+	if err := authflow.Finish(session, flow); err != nil {
+		return "", err
+	}
+
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = user.ID
+	session.Values["username"] = user.Username
+	session.Values["nickname"] = user.Nickname
+	session.Values["email"] = user.Email
+	session.Values["role"] = user.Role
+	session.Values["twofa_enabled"] = user.TwoFAEnabled
+	session.Values["webauthn_enabled"] = user.WebAuthnEnabled
+	session.Values["face_auth_enabled"] = user.FaceAuthEnabled
+	delete(session.Values, webAuthnLoginKey)
+
+	// All factors passed, so clear the failure counters
+	resetAuthFailures(r, user.Email)
+
+	log.Printf("User %d completed login with factors %v", user.ID, flowFactorNames(flow))
+	newDevice := checkLoginDevice(w, r, user)
+	recordUserAudit(r, models.AuditLogin, user, map[string]interface{}{
+		"method":     loginMethod(flow),
+		"factors":    flowFactorNames(flow),
+		"new_device": newDevice,
+	})
+
+	next, _ := session.Values[loginNextKey].(string)
+	delete(session.Values, loginNextKey)
+
+	return safeRedirectPath(next, "/home"), nil
+}
+
+// Helper function to find the user a factor is being set up for: the user whose
+// login waits at the MFA enrollment step, or else the signed-in user. The flow
+// is nil for a signed-in user.
+func enrollingUser(session *sessions.Session) (*models.User, *authflow.Flow, error) {
+	if flow, err := authflow.Current(session); err == nil {
+		next, err := flow.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if next != nil && next.Name() == authflow.EnrollmentStep {
+			return flow.User, flow, nil
+		}
+	}
+
+	user, err := currentSessionUser(session)
+	return user, nil, err
+}
+
+// Helper function to continue a login that waited at the MFA enrollment step
+// once the user has set up a factor. Setting it up satisfies it for this login.
+// It returns the page to continue on, which is the enrollment step again if a
+// policy still isn't met.
+func finishEnrollment(w http.ResponseWriter, r *http.Request, session *sessions.Session, flow *authflow.Flow, factor string) (string, error) {
+	if err := flow.Enrolled(factor); err != nil {
+		return "", err
+	}
+	return advanceLogin(w, r, session, flow)
+}
+
+// Helper function to find the MFA policy a user doesn't meet, if any. The
+// error is logged; callers must not treat it as compliance.
+func mfaPolicyViolation(user *models.User) (*models.MFAViolation, error) {
+	violation, err := models.CheckMFACompliance(user)
+	if err != nil {
+		log.Printf("Error checking MFA policies for user %d: %v", user.ID, err)
+	}
+	return violation, err
+}
+
+// Helper function to describe an MFA policy violation that is still within its grace period
+func mfaGraceNotice(violation *models.MFAViolation) string {
+	return fmt.Sprintf("A security policy requires this by %s: %s.", violation.Deadline.Format("January 2, 2006"), violation.Reason)
+}
+
+// Helper function to list the factors satisfied or set up in a flow for logging
+func flowFactorNames(flow *authflow.Flow) []string {
+	names := make([]string, 0, len(flow.State.Factors)+len(flow.State.Enrolled))
+	for name := range flow.State.Factors {
+		names = append(names, name)
+	}
+	for name := range flow.State.Enrolled {
+		if _, verified := flow.State.Factors[name]; !verified {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Helper function to continue a login from a page handler
+func continueLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, flow *authflow.Flow) {
+	path, err := advanceLogin(w, r, session, flow)
+	if err != nil {
+		log.Printf("Error advancing login for user %d: %v", flow.User.ID, err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.Save(r, w); err != nil {
+		log.Printf("Error saving session: %v", err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
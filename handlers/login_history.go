@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// loginHistoryLimit is the number of logins shown on the settings page
+const loginHistoryLimit = 20
+
+// Helper function to remember the device a login came from. It returns true
+// and emails the user when the device hasn't been used for the account before.
+func checkLoginDevice(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	deviceID, err := utils.EnsureDeviceID(w, r)
+	if err != nil {
+		log.Printf("Error issuing device ID for user %d: %v", user.ID, err)
+		return false
+	}
+
+	// The first device on record is where the account started being tracked, not a surprise
+	known, err := models.CountKnownDevices(user.ID)
+	if err != nil {
+		log.Printf("Error counting known devices for user %d: %v", user.ID, err)
+		return false
+	}
+
+	fingerprint := utils.DeviceFingerprint(deviceID, r.UserAgent())
+	isNew, err := models.TouchKnownDevice(user.ID, fingerprint, r.UserAgent(), utils.ClientIP(r))
+	if err != nil {
+		log.Printf("Error recording device for user %d: %v", user.ID, err)
+		return false
+	}
+	if !isNew || known == 0 {
+		return false
+	}
+
+	log.Printf("User %d signed in from a new device", user.ID)
+	sendNewDeviceAlert(r, user)
+	return true
+}
+
+// Helper function to tell a user about a login from a new device
+func sendNewDeviceAlert(r *http.Request, user *models.User) {
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		userAgent = "Unknown device"
+	}
+
+	msg := utils.Message{
+		To:      user.Email,
+		Subject: "New sign-in to your account",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Your account was just signed in to from a device we haven't seen before:\n\n"+
+			"Time: %s\n"+
+			"IP address: %s\n"+
+			"Device: %s\n\n"+
+			"If this was you, you can ignore this email. If not, change your password and "+
+			"sign out the other sessions from your account settings:\n\n%s\n",
+			user.Username, time.Now().UTC().Format("Jan 2, 2006 15:04 MST"), utils.ClientIP(r), userAgent,
+			absoluteURL("/user/settings")),
+	}
+	if err := utils.SendMail(msg); err != nil {
+		log.Printf("Error sending new device alert to user %d: %v", user.ID, err)
+	}
+}
+
+// Helper function to get the first factor a login started with
+func loginMethod(flow *authflow.Flow) string {
+	if flow.State.Has(utils.FactorOAuth) {
+		return utils.FactorOAuth
+	}
+	return utils.FactorPassword
+}
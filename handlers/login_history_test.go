@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aungh/login-form/utils"
+)
+
+// recordingMailer keeps the messages it is asked to send
+type recordingMailer struct {
+	sent []utils.Message
+}
+
+func (m *recordingMailer) Send(msg utils.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestCheckLoginDevice(t *testing.T) {
+	setupTestDB(t)
+
+	mailer := &recordingMailer{}
+	utils.SetMailer(mailer)
+	t.Cleanup(func() { utils.SetMailer(nil) })
+
+	user := createTestUser(t, "user@example.com")
+	const laptop = "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0"
+	const phone = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Safari/604.1"
+
+	// The steps run in order, signing in from the browser they name
+	tests := []struct {
+		name      string
+		userAgent string
+		// deviceID is the cookie the browser sends, "laptop" for the one the
+		// first login issued, or empty for none
+		deviceID string
+		wantNew  bool
+	}{
+		{"first device on record", laptop, "", false},
+		{"same browser again", laptop, "laptop", false},
+		{"cookie copied to another browser", phone, "laptop", true},
+		{"browser without a cookie", laptop, "", true},
+		{"malformed cookie", laptop, "not-a-device-id", true},
+	}
+
+	var laptopID string
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		switch tt.deviceID {
+		case "":
+		case "laptop":
+			r.AddCookie(&http.Cookie{Name: utils.DeviceCookieName, Value: laptopID})
+		default:
+			r.AddCookie(&http.Cookie{Name: utils.DeviceCookieName, Value: tt.deviceID})
+		}
+
+		sentBefore := len(mailer.sent)
+		rec := httptest.NewRecorder()
+		if got := checkLoginDevice(rec, r, user); got != tt.wantNew {
+			t.Errorf("%s: checkLoginDevice = %v, want %v", tt.name, got, tt.wantNew)
+		}
+
+		issued := ""
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == utils.DeviceCookieName {
+				issued = cookie.Value
+			}
+		}
+		if (issued != "") != (tt.deviceID != "laptop") {
+			t.Errorf("%s: issued device ID %q", tt.name, issued)
+		}
+		if laptopID == "" {
+			laptopID = issued
+		}
+
+		alerts := mailer.sent[sentBefore:]
+		if tt.wantNew != (len(alerts) == 1) {
+			t.Errorf("%s: sent %d alerts", tt.name, len(alerts))
+		}
+		for _, msg := range alerts {
+			if msg.To != user.Email || msg.Subject != "New sign-in to your account" {
+				t.Errorf("%s: sent %q to %q", tt.name, msg.Subject, msg.To)
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/aungh/login-form/authflow"
 	"github.com/aungh/login-form/models"
 	"github.com/aungh/login-form/utils"
 )
@@ -94,14 +95,16 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 		return
 	}
 
-	// Log the session state before completing auth
-	log.Printf("Session before CompleteUserAuth: %+v", session.Values)
-
 	// Complete the auth process using our custom function
-	log.Printf("About to complete %s auth with session: %+v", provider, session.Values)
+	log.Printf("About to complete %s auth", provider)
 	gothUser, err := utils.CustomCompleteUserAuth(w, r, provider)
 	if err != nil {
 		log.Printf("Error completing %s auth: %v", provider, err)
+		recordAudit(r, models.AuditLogin, models.AuditFailure, 0, 0, map[string]interface{}{
+			"factor":   utils.FactorOAuth,
+			"provider": provider,
+			"error":    err.Error(),
+		})
 		http.Error(w, "Authentication failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -130,6 +133,7 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 			FaceAuthEnabled: false,
 			Role:            "user",
 			ProfileImage:    gothUser.AvatarURL,
+			EmailVerified:   true, // The provider has confirmed the address
 			CreatedAt:       time.Now(),
 			UpdatedAt:       time.Now(),
 		}
@@ -174,20 +178,32 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 	} else {
 		log.Printf("User found with email %s (ID: %d)", gothUser.Email, user.ID)
 
+		// Signing in with the provider proves ownership of the address
+		if !user.EmailVerified {
+			user.EmailVerified = true
+			if err := models.UpdateUser(user); err != nil {
+				log.Printf("Failed to mark email as verified: %s", err.Error())
+			}
+		}
+
 		// Update provider ID if needed
 		if provider == "google" && user.GoogleID == "" {
 			user.GoogleID = gothUser.UserID
 			err = models.UpdateUser(user)
 			if err != nil {
 				log.Printf("Failed to update Google ID: %s", err.Error())
+			} else {
+				recordUserAudit(r, models.AuditOAuthLinked, user, map[string]interface{}{"provider": provider})
 			}
 		} else if provider == "github" {
 			updateNeeded := false
 
 			// Update GitHub ID if needed
+			linked := false
 			if user.GithubID == "" {
 				user.GithubID = gothUser.UserID
 				updateNeeded = true
+				linked = true
 			}
 
 			// Log GitHub user data
@@ -210,6 +226,8 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 				err = models.UpdateUser(user)
 				if err != nil {
 					log.Printf("Failed to update GitHub user data: %s", err.Error())
+				} else if linked {
+					recordUserAudit(r, models.AuditOAuthLinked, user, map[string]interface{}{"provider": provider})
 				}
 			}
 		}
@@ -217,72 +235,25 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 
 	// Already have the session from earlier, no need to get it again
 
-	// Check if 2FA is required
-	if user.TwoFAEnabled {
-		log.Printf("2FA is enabled for user %s, redirecting to 2FA verification", user.Email)
-		
-		// Store pending auth info in session
-		session.Values["pending_auth"] = true
-		session.Values["pending_auth_user_id"] = user.ID
-		session.Values["pending_auth_username"] = user.Username
-		session.Values["pending_auth_nickname"] = user.Nickname
-		session.Values["pending_auth_email"] = user.Email
-		session.Values["pending_auth_twofa_enabled"] = true
-		session.Values["pending_auth_role"] = user.Role
-		
-		// If user also has face auth enabled, set up the flag for face auth after 2FA
-		if user.FaceAuthEnabled {
-			log.Printf("User %s has both 2FA and face auth enabled, setting up face auth after 2FA", user.Email)
-			session.Values["pending_face_after_2fa"] = true
-			session.Values["pending_auth_face_enabled"] = true
-		}
-
-		err = utils.SaveSession(session, w, r)
-		if err != nil {
-			log.Printf("Error saving session before 2FA redirect: %v", err)
-			http.Error(w, "Session error", http.StatusInternalServerError)
-			return
-		}
-
-		// Redirect to 2FA verification
-		http.Redirect(w, r, "/verify-2fa", http.StatusSeeOther)
+	// Confirming identity for a sensitive change rather than logging in
+	if completeOAuthReauth(w, r, session, user) {
 		return
 	}
 
-	// Check if face auth is required (and 2FA is not enabled)
-	if user.FaceAuthEnabled && !user.TwoFAEnabled {
-		log.Printf("Only face auth is enabled for user %s, redirecting to face verification", user.Email)
-
-		// Store pending auth info in session
-		session.Values["pending_auth"] = true
-		session.Values["pending_auth_user_id"] = user.ID
-		session.Values["pending_auth_username"] = user.Username
-		session.Values["pending_auth_nickname"] = user.Nickname
-		session.Values["pending_auth_email"] = user.Email
-		session.Values["pending_auth_face_enabled"] = true
-		session.Values["pending_auth_role"] = user.Role
-
-		err = utils.SaveSession(session, w, r)
-		if err != nil {
-			log.Printf("Error saving session before face verification redirect: %v", err)
-			http.Error(w, "Session error", http.StatusInternalServerError)
-			return
-		}
-
-		// Redirect to face verification
-		http.Redirect(w, r, "/verify-face", http.StatusSeeOther)
+	// Start the login flow; the engine decides which factors come next
+	flow, err := authflow.Start(session, user, utils.FactorOAuth)
+	if err != nil {
+		log.Printf("Error starting login flow for user %d: %v", user.ID, err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
 		return
 	}
 
-	// If no additional auth required, create full session
-	session.Values["authenticated"] = true
-	session.Values["user_id"] = user.ID
-	session.Values["username"] = user.Username
-	session.Values["nickname"] = user.Nickname
-	session.Values["email"] = user.Email
-	session.Values["twofa_enabled"] = user.TwoFAEnabled
-	session.Values["face_auth_enabled"] = user.FaceAuthEnabled
-	session.Values["role"] = user.Role
+	next, err := advanceLogin(w, r, session, flow)
+	if err != nil {
+		log.Printf("Error advancing login for user %d: %v", user.ID, err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return
+	}
 
 	err = utils.SaveSession(session, w, r)
 	if err != nil {
@@ -291,6 +262,12 @@ func handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string
 		return
 	}
 
+	if next != "/home" {
+		log.Printf("User %s needs further verification after %s OAuth, redirecting to %s", user.Email, provider, next)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
 	log.Printf("User %s successfully authenticated via %s OAuth", user.Email, provider)
 
 	// Redirect to home page
@@ -0,0 +1,457 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/middleware"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// oidcIDTokenTTL is how long an ID token is valid
+const oidcIDTokenTTL = time.Hour
+
+// oidcScopes are the scopes the provider understands, in the order they are reported
+var oidcScopes = []string{"openid", "profile", "email"}
+
+// OIDCDiscoveryHandler serves the OpenID Connect discovery document
+func OIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	issuer := oidcIssuer()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth2/authorize",
+		"token_endpoint":                        issuer + "/oauth2/token",
+		"userinfo_endpoint":                     issuer + "/oauth2/userinfo",
+		"jwks_uri":                              issuer + "/oauth2/jwks",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      oidcScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr",
+			"name", "preferred_username", "nickname", "picture", "updated_at", "email", "email_verified",
+		},
+	})
+}
+
+// OIDCJWKSHandler publishes the public keys that verify ID tokens
+func OIDCJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := models.GetOIDCSigningKeys()
+	if err != nil {
+		log.Printf("Error loading OIDC signing keys: %v", err)
+		http.Error(w, "Failed to load signing keys", http.StatusInternalServerError)
+		return
+	}
+
+	jwks := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		jwks = append(jwks, utils.PublicJWK(&key.Key.PublicKey, key.KID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+}
+
+// OIDCAuthorizeHandler starts an authorization code login for a client. Users
+// who aren't signed in go through the full login flow, including every factor
+// they have enabled, and come back here afterwards.
+func OIDCAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	params := r.Form
+
+	// Without a known client and redirect URI there is nowhere safe to send errors
+	client, err := models.GetOIDCClient(params.Get("client_id"))
+	if err != nil {
+		if err != models.ErrOIDCClientNotFound {
+			log.Printf("Error loading OIDC client: %v", err)
+		}
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !client.AllowsRedirect(redirectURI) {
+		http.Error(w, "The redirect URI is not registered for this client", http.StatusBadRequest)
+		return
+	}
+	state := params.Get("state")
+
+	if params.Get("response_type") != "code" {
+		redirectOIDCError(w, r, redirectURI, state, "unsupported_response_type", "Only the authorization code flow is supported")
+		return
+	}
+	scope := oidcRequestedScope(params.Get("scope"))
+	if !strings.Contains(" "+scope+" ", " openid ") {
+		redirectOIDCError(w, r, redirectURI, state, "invalid_scope", "The openid scope is required")
+		return
+	}
+	if params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256" {
+		redirectOIDCError(w, r, redirectURI, state, "invalid_request", "PKCE with code_challenge_method S256 is required")
+		return
+	}
+
+	session, _ := utils.GetSession(r)
+	prompt := " " + params.Get("prompt") + " "
+
+	user := oidcSignedInUser(session)
+	if user == nil {
+		if strings.Contains(prompt, " none ") {
+			redirectOIDCError(w, r, redirectURI, state, "login_required", "The user is not signed in")
+			return
+		}
+
+		// Come back to this request once the login flow is finished
+		session.Values[loginNextKey] = "/oauth2/authorize?" + params.Encode()
+		if err := utils.SaveSession(session, w, r); err != nil {
+			http.Error(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Accounts that don't meet an MFA policy must enroll before signing in anywhere else
+	violation, err := mfaPolicyViolation(user)
+	if err != nil {
+		redirectOIDCError(w, r, redirectURI, state, "server_error", "Failed to check MFA policies")
+		return
+	}
+	if violation != nil && violation.Enforced() {
+		if strings.Contains(prompt, " none ") {
+			redirectOIDCError(w, r, redirectURI, state, "interaction_required", "The user must enroll a second factor")
+			return
+		}
+		http.Redirect(w, r, "/setup-2fa", http.StatusSeeOther)
+		return
+	}
+
+	// Ask the user to confirm their identity again if the client wants a recent login
+	authState := utils.GetAuthState(session)
+	authTime := authState.LastVerifiedAt()
+	if strings.Contains(prompt, " login ") || oidcMaxAgeExceeded(params.Get("max_age"), authTime) {
+		if strings.Contains(prompt, " none ") {
+			redirectOIDCError(w, r, redirectURI, state, "login_required", "The user must sign in again")
+			return
+		}
+
+		// The request is repeated without these once the user has re-authenticated
+		params.Del("prompt")
+		params.Del("max_age")
+		next := "/oauth2/authorize?" + params.Encode()
+		http.Redirect(w, r, "/reauth?next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	amr := utils.AMR(authState)
+	code, err := models.CreateOIDCAuthCode(&models.OIDCAuthCode{
+		ClientID:      client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   redirectURI,
+		Scope:         scope,
+		Nonce:         params.Get("nonce"),
+		CodeChallenge: params.Get("code_challenge"),
+		AMR:           amr,
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		log.Printf("Error creating authorization code for user %d: %v", user.ID, err)
+		redirectOIDCError(w, r, redirectURI, state, "server_error", "Failed to create authorization code")
+		return
+	}
+
+	log.Printf("User %d signed in to OIDC client %s with %v", user.ID, client.Name, amr)
+	recordUserAudit(r, models.AuditOIDCAuthorized, user, map[string]interface{}{
+		"client_id": client.ClientID,
+		"client":    client.Name,
+		"amr":       amr,
+	})
+
+	redirectOIDC(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+}
+
+// OIDCTokenHandler exchanges an authorization code for an ID token and an access token
+func OIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		sendOAuthError(w, "invalid_request", "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		sendOAuthError(w, "unsupported_grant_type", "Only the authorization_code grant is supported", http.StatusBadRequest)
+		return
+	}
+
+	// Confidential clients authenticate with HTTP Basic or form fields; public clients only send their ID
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := models.GetOIDCClient(clientID)
+	if err == nil && !client.Public && !client.CheckSecret(secret) {
+		err = models.ErrOIDCClientNotFound
+	}
+	if err != nil {
+		if err != models.ErrOIDCClientNotFound {
+			log.Printf("Error loading OIDC client: %v", err)
+		}
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth2"`)
+		}
+		sendOAuthError(w, "invalid_client", "Client authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	code, err := models.ConsumeOIDCAuthCode(r.PostForm.Get("code"), client.ClientID)
+	if err != nil {
+		if err != models.ErrInvalidOIDCGrant {
+			log.Printf("Error exchanging authorization code for client %s: %v", client.Name, err)
+		}
+		sendOAuthError(w, "invalid_grant", "The authorization code is invalid, expired or already used", http.StatusBadRequest)
+		return
+	}
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		sendOAuthError(w, "invalid_grant", "The redirect URI doesn't match the authorization request", http.StatusBadRequest)
+		return
+	}
+	if !utils.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		sendOAuthError(w, "invalid_grant", "The PKCE code verifier is invalid", http.StatusBadRequest)
+		return
+	}
+
+	user, err := models.GetUserByIDSafe(code.UserID)
+	if err != nil {
+		sendOAuthError(w, "invalid_grant", "The user no longer exists", http.StatusBadRequest)
+		return
+	}
+
+	accessToken, token, err := models.CreateOIDCAccessToken(client.ClientID, user.ID, code.Scope)
+	if err != nil {
+		log.Printf("Error creating access token for user %d: %v", user.ID, err)
+		sendOAuthError(w, "server_error", "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, err := signIDToken(client, user, code)
+	if err != nil {
+		log.Printf("Error signing ID token for user %d: %v", user.ID, err)
+		sendOAuthError(w, "server_error", "Failed to issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(token.ExpiresAt).Seconds()),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+}
+
+// OIDCUserInfoHandler returns the claims about the user an access token was issued for
+func OIDCUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	value := middleware.BearerToken(r)
+	if value == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth2"`)
+		sendOAuthError(w, "invalid_token", "Missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := models.GetOIDCAccessToken(value)
+	if err != nil {
+		if err != models.ErrInvalidOIDCGrant {
+			log.Printf("Error checking OIDC access token: %v", err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth2", error="invalid_token"`)
+		sendOAuthError(w, "invalid_token", "The access token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if !token.HasScope("openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth2", error="insufficient_scope"`)
+		sendOAuthError(w, "insufficient_scope", "The access token wasn't issued for OpenID Connect", http.StatusForbidden)
+		return
+	}
+
+	user, err := models.GetUserByIDSafe(token.UserID)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth2", error="invalid_token"`)
+		sendOAuthError(w, "invalid_token", "The user no longer exists", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(oidcUserClaims(user, token.Scope))
+}
+
+// Helper function to get the issuer identifier, which prefixes every endpoint URL.
+// Like links in emails it is configured, never taken from the Host header.
+func oidcIssuer() string {
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		return strings.TrimSuffix(issuer, "/")
+	}
+	return utils.BaseURL()
+}
+
+// Helper function to get the user a session has fully signed in, or nil if
+// the login isn't complete
+func oidcSignedInUser(session *sessions.Session) *models.User {
+	user, err := currentSessionUser(session)
+	if err != nil {
+		return nil
+	}
+
+	state := utils.GetAuthState(session)
+	if state.UserID != user.ID || !state.HasPrimaryFactor() {
+		return nil
+	}
+	if pending, err := authflow.Pending(user, state); err != nil || pending != nil {
+		if err != nil {
+			log.Printf("Error checking the login of user %d: %v", user.ID, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// Helper function to keep the scopes the provider understands from a requested scope
+func oidcRequestedScope(requested string) string {
+	fields := strings.Fields(requested)
+	granted := make([]string, 0, len(oidcScopes))
+	for _, scope := range oidcScopes {
+		for _, field := range fields {
+			if field == scope {
+				granted = append(granted, scope)
+				break
+			}
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+// Helper function to check whether the last authentication is older than a client's max_age in seconds
+func oidcMaxAgeExceeded(maxAge string, authTime time.Time) bool {
+	if maxAge == "" {
+		return false
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds < 0 {
+		return false
+	}
+	return time.Since(authTime) > time.Duration(seconds)*time.Second
+}
+
+// Helper function to get the claims about a user that a scope allows
+func oidcUserClaims(user *models.User, scope string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": strconv.Itoa(user.ID)}
+	scopes := " " + scope + " "
+
+	if strings.Contains(scopes, " profile ") {
+		name := user.Nickname
+		if name == "" {
+			name = user.Username
+		}
+		claims["name"] = name
+		claims["preferred_username"] = user.Username
+		if user.Nickname != "" {
+			claims["nickname"] = user.Nickname
+		}
+		if user.ProfileImage != "" {
+			claims["picture"] = user.ProfileImage
+		}
+		if !user.UpdatedAt.IsZero() {
+			claims["updated_at"] = user.UpdatedAt.Unix()
+		}
+	}
+	if strings.Contains(scopes, " email ") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	return claims
+}
+
+// Helper function to sign the ID token for an exchanged authorization code
+func signIDToken(client *models.OIDCClient, user *models.User, code *models.OIDCAuthCode) (string, error) {
+	key, err := models.GetOIDCSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := oidcUserClaims(user, code.Scope)
+	claims["iss"] = oidcIssuer()
+	claims["aud"] = client.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(oidcIDTokenTTL).Unix()
+	claims["auth_time"] = code.AuthTime.Unix()
+	if len(code.AMR) > 0 {
+		claims["amr"] = code.AMR
+	}
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+
+	return utils.SignIDToken(key.Key, key.KID, claims)
+}
+
+// Helper function to send the user back to a client with the given query parameters
+func redirectOIDC(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+
+	query := target.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// Helper function to send an authorization error back to a client
+func redirectOIDCError(w http.ResponseWriter, r *http.Request, redirectURI, state, errorCode, description string) {
+	redirectOIDC(w, r, redirectURI, url.Values{
+		"error":             {errorCode},
+		"error_description": {description},
+		"state":             {state},
+	})
+}
+
+// Helper function to send an error from the token or userinfo endpoint in the OAuth 2.0 format
+func sendOAuthError(w http.ResponseWriter, errorCode, description string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             errorCode,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/models"
+)
+
+func TestOIDCRequestedScope(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      string
+	}{
+		{"openid", "openid"},
+		{"email openid", "openid email"},
+		{"openid profile email", "openid profile email"},
+		{"openid offline_access admin", "openid"},
+		{"openid openid", "openid"},
+		{"", ""},
+		{"OPENID", ""},
+	}
+
+	for _, tt := range tests {
+		if got := oidcRequestedScope(tt.requested); got != tt.want {
+			t.Errorf("oidcRequestedScope(%q) = %q, want %q", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCUserClaims(t *testing.T) {
+	user := &models.User{ID: 7, Username: "user", Nickname: "Nick", Email: "user@example.com", EmailVerified: true}
+
+	tests := []struct {
+		scope      string
+		wantClaims []string
+		noClaims   []string
+	}{
+		{"openid", []string{"sub"}, []string{"name", "email"}},
+		{"openid profile", []string{"sub", "name", "preferred_username", "nickname"}, []string{"email"}},
+		{"openid email", []string{"sub", "email", "email_verified"}, []string{"name"}},
+		{"openid emails", []string{"sub"}, []string{"email"}},
+	}
+
+	for _, tt := range tests {
+		claims := oidcUserClaims(user, tt.scope)
+		for _, claim := range tt.wantClaims {
+			if _, ok := claims[claim]; !ok {
+				t.Errorf("scope %q: missing claim %q", tt.scope, claim)
+			}
+		}
+		for _, claim := range tt.noClaims {
+			if _, ok := claims[claim]; ok {
+				t.Errorf("scope %q: unexpected claim %q", tt.scope, claim)
+			}
+		}
+	}
+}
+
+func TestParseRedirectURIs(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    int
+		wantErr bool
+	}{
+		{"https://app.example.com/callback", 1, false},
+		{"https://app.example.com/a\nhttps://app.example.com/b", 2, false},
+		{"http://localhost:3000/callback", 1, false},
+		{"http://127.0.0.1/callback", 1, false},
+		{"", 0, true},
+		{"http://app.example.com/callback", 0, true},
+		{"https://app.example.com/callback#fragment", 0, true},
+		{"/callback", 0, true},
+		{"javascript:alert(1)", 0, true},
+		{"https://app.example.com/ok\nftp://app.example.com/", 0, true},
+	}
+
+	for _, tt := range tests {
+		uris, err := parseRedirectURIs(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRedirectURIs(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if len(uris) != tt.want {
+			t.Errorf("parseRedirectURIs(%q) returned %d URIs, want %d", tt.text, len(uris), tt.want)
+		}
+	}
+}
+
+func TestOIDCMaxAgeExceeded(t *testing.T) {
+	authTime := time.Now().Add(-10 * time.Minute)
+
+	tests := []struct {
+		maxAge string
+		want   bool
+	}{
+		{"", false},
+		{"3600", false},
+		{"60", true},
+		{"0", true},
+		{"-1", false},
+		{"soon", false},
+	}
+
+	for _, tt := range tests {
+		if got := oidcMaxAgeExceeded(tt.maxAge, authTime); got != tt.want {
+			t.Errorf("oidcMaxAgeExceeded(%q) = %v, want %v", tt.maxAge, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCTokenHandler(t *testing.T) {
+	// The example from RFC 7636 appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	const redirectURI = "https://app.example.com/callback"
+
+	tests := []struct {
+		name        string
+		public      bool
+		secret      string
+		verifier    string
+		redirectURI string
+		exchanges   int
+		wantStatus  int
+		wantError   string
+	}{
+		{"confidential client", false, "", verifier, redirectURI, 1, http.StatusOK, ""},
+		{"public client", true, "", verifier, redirectURI, 1, http.StatusOK, ""},
+		{"code used twice", true, "", verifier, redirectURI, 2, http.StatusBadRequest, "invalid_grant"},
+		{"wrong code verifier", true, "", strings.Repeat("a", 43), redirectURI, 1, http.StatusBadRequest, "invalid_grant"},
+		{"missing code verifier", true, "", "", redirectURI, 1, http.StatusBadRequest, "invalid_grant"},
+		{"different redirect URI", true, "", verifier, "https://app.example.com/other", 1, http.StatusBadRequest, "invalid_grant"},
+		{"wrong client secret", false, "wrong", verifier, redirectURI, 1, http.StatusUnauthorized, "invalid_client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com")
+			if _, err := models.EnsureOIDCSigningKey(); err != nil {
+				t.Fatalf("EnsureOIDCSigningKey: %v", err)
+			}
+
+			secret, client, err := models.CreateOIDCClient("App", []string{redirectURI}, tt.public)
+			if err != nil {
+				t.Fatalf("CreateOIDCClient: %v", err)
+			}
+			if tt.secret != "" {
+				secret = tt.secret
+			}
+
+			code, err := models.CreateOIDCAuthCode(&models.OIDCAuthCode{
+				ClientID:      client.ClientID,
+				UserID:        user.ID,
+				RedirectURI:   redirectURI,
+				Scope:         "openid email",
+				CodeChallenge: challenge,
+				AMR:           []string{"pwd"},
+				AuthTime:      time.Now(),
+			})
+			if err != nil {
+				t.Fatalf("CreateOIDCAuthCode: %v", err)
+			}
+
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {code},
+				"redirect_uri":  {tt.redirectURI},
+				"code_verifier": {tt.verifier},
+				"client_id":     {client.ClientID},
+			}
+			if !tt.public {
+				form.Set("client_secret", secret)
+			}
+
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < tt.exchanges; i++ {
+				r := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				rec = httptest.NewRecorder()
+				OIDCTokenHandler(rec, r)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if tt.wantError != "" {
+				if body["error"] != tt.wantError {
+					t.Errorf("error = %v, want %q", body["error"], tt.wantError)
+				}
+				return
+			}
+
+			if body["scope"] != "openid email" || body["id_token"] == "" {
+				t.Errorf("unexpected token response %v", body)
+			}
+			accessToken, _ := body["access_token"].(string)
+			token, err := models.GetOIDCAccessToken(accessToken)
+			if err != nil {
+				t.Fatalf("GetOIDCAccessToken: %v", err)
+			}
+			if token.UserID != user.ID || !token.HasScope("openid") || token.HasScope("profile") {
+				t.Errorf("access token %+v doesn't match the authorization code", token)
+			}
+		})
+	}
+}
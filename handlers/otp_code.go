@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// Helper function to check whether a second factor type has its codes delivered by email or SMS
+func isOutOfBandOTP(otpType string) bool {
+	return otpType == models.TwoFATypeEmail || otpType == models.TwoFATypeSMS
+}
+
+// Helper function to get where a user's one-time codes are delivered
+func otpDestination(user *models.User) string {
+	switch user.TwoFAType {
+	case models.TwoFATypeEmail:
+		return user.Email
+	case models.TwoFATypeSMS:
+		return user.PhoneNumber
+	}
+	return ""
+}
+
+// Helper function to partly hide an email address or phone number before showing it
+func maskDestination(destination string) string {
+	if at := strings.Index(destination, "@"); at > 0 {
+		return destination[:1] + strings.Repeat("*", at-1) + destination[at:]
+	}
+	if len(destination) > 4 {
+		return strings.Repeat("*", len(destination)-4) + destination[len(destination)-4:]
+	}
+	return destination
+}
+
+// Helper function to issue a one-time code and deliver it through the channel for otpType
+func sendOTPCode(userID int, purpose, otpType, destination string) error {
+	sender, err := utils.GetOTPSender(otpType)
+	if err != nil {
+		return err
+	}
+
+	code, err := models.CreateOTPCode(userID, purpose)
+	if err != nil {
+		return err
+	}
+
+	if err := sender.SendCode(destination, code); err != nil {
+		// Don't leave a code behind that the user never received
+		if err := models.DeleteOTPCode(userID, purpose); err != nil {
+			log.Printf("Error deleting undelivered one-time code for user %d: %v", userID, err)
+		}
+		return err
+	}
+
+	log.Printf("Sent %s one-time code to user %d", otpType, userID)
+	return nil
+}
+
+// Helper function to describe an error from sendOTPCode to the user
+func otpSendErrorMessage(userID int, err error) string {
+	if err == models.ErrOTPTooSoon {
+		return "A code was sent a moment ago. Please wait before requesting another one."
+	}
+	if err == models.ErrOTPAttemptsExhausted {
+		return "Too many wrong codes were entered. Please wait a few minutes before requesting another one."
+	}
+	log.Printf("Error sending one-time code to user %d: %v", userID, err)
+	return "We couldn't send your code. Please try again shortly."
+}
+
+// Helper function to send a login code on the verification page, unless an
+// earlier one can still be used. It returns an error message to show, if any.
+func ensureLoginOTPCode(user *models.User) string {
+	active, err := models.HasActiveOTPCode(user.ID, models.OTPPurposeLogin)
+	if err != nil {
+		log.Printf("Error checking one-time code for user %d: %v", user.ID, err)
+	}
+	if active {
+		return ""
+	}
+
+	if err := sendOTPCode(user.ID, models.OTPPurposeLogin, user.TwoFAType, otpDestination(user)); err != nil {
+		return otpSendErrorMessage(user.ID, err)
+	}
+	return ""
+}
+
+// Helper function to enroll email or SMS codes as the user's second factor. The
+// destination is confirmed with a code sent to it before it is saved.
+func setupOutOfBandOTP(w http.ResponseWriter, r *http.Request, session *sessions.Session, flow *authflow.Flow, user *models.User, otpType string) {
+	var destination string
+	if otpType == models.TwoFATypeEmail {
+		// Codes must only go to an address the user has proved they own
+		if !user.EmailVerified {
+			render2FAPage(w, "Verify your email address before using it for sign-in codes.", true, otpType, "")
+			return
+		}
+		destination = user.Email
+	} else {
+		// The phone number was entered on the settings page
+		destination, _ = session.Values["temp_2fa_phone"].(string)
+		if destination == "" {
+			http.Redirect(w, r, "/user/settings", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if r.Method == "POST" {
+		// Only a code sent to the destination being enrolled can confirm it
+		if session.Values["temp_2fa_type"] != otpType || session.Values["temp_2fa_destination"] != destination {
+			http.Error(w, "Session expired or invalid. Please try again.", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("resend") != "" {
+			msg := ""
+			if err := sendOTPCode(user.ID, models.OTPPurposeSetup, otpType, destination); err != nil {
+				msg = otpSendErrorMessage(user.ID, err)
+			}
+			render2FAPage(w, msg, true, otpType, destination)
+			return
+		}
+
+		code := strings.TrimSpace(r.FormValue("2fa_code"))
+		if code == "" {
+			render2FAPage(w, "2FA code is required", true, otpType, destination)
+			return
+		}
+
+		valid, err := models.VerifyOTPCode(database.DB, user.ID, models.OTPPurposeSetup, code)
+		if err != nil {
+			log.Printf("Error verifying setup code for user %d: %v", user.ID, err)
+		}
+		if !valid {
+			render2FAPage(w, "Invalid or expired code. Please try again or request a new one.", true, otpType, destination)
+			return
+		}
+
+		// Delivered codes replace any authenticator app enrollment
+		user.TwoFASecret = ""
+		user.TwoFAAlgorithm = ""
+		user.TwoFADigits = 0
+		user.TwoFAPeriod = 0
+		user.TwoFAType = otpType
+		if otpType == models.TwoFATypeSMS {
+			user.PhoneNumber = destination
+		}
+		delete(session.Values, "temp_2fa_phone")
+		delete(session.Values, "temp_2fa_destination")
+
+		finishTwoFASetup(w, r, session, flow, user, 0)
+		return
+	}
+
+	// A code sent to a different destination must not confirm this one
+	if session.Values["temp_2fa_destination"] != destination {
+		if err := models.DeleteOTPCode(user.ID, models.OTPPurposeSetup); err != nil {
+			log.Printf("Error deleting setup code for user %d: %v", user.ID, err)
+		}
+	}
+
+	session.Values["temp_2fa_type"] = otpType
+	session.Values["temp_2fa_destination"] = destination
+	delete(session.Values, pendingTwoFASecretKey)
+	session.Save(r, w)
+
+	// Reloading the page within the cooldown keeps the code that was already sent
+	msg := ""
+	if err := sendOTPCode(user.ID, models.OTPPurposeSetup, otpType, destination); err != nil && err != models.ErrOTPTooSoon {
+		msg = otpSendErrorMessage(user.ID, err)
+	}
+	render2FAPage(w, msg, true, otpType, destination)
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// forgotPasswordSentMessage is shown whether or not the email belongs to an account,
+// so the form can't be used to find out which addresses are registered
+const forgotPasswordSentMessage = "If an account exists for that email, a password reset link has been sent."
+
+// ForgotPasswordHandler handles the forgot password page and form submission
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		renderForgotPasswordPage(w, "", "")
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		renderForgotPasswordPage(w, "Email is required", "")
+		return
+	}
+
+	user, err := models.GetUserByEmailSafe(email)
+	if err != nil {
+		log.Printf("Password reset requested for unknown email %s", email)
+		renderForgotPasswordPage(w, "", forgotPasswordSentMessage)
+		return
+	}
+
+	token, err := models.CreatePasswordResetToken(user.ID)
+	if err == models.ErrResetTooSoon {
+		log.Printf("Password reset for user %d requested again within the cooldown", user.ID)
+		renderForgotPasswordPage(w, "", forgotPasswordSentMessage)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating password reset token for user %d: %v", user.ID, err)
+		renderForgotPasswordPage(w, "Failed to start password reset. Please try again later.", "")
+		return
+	}
+
+	link := absoluteURL("/reset-password?token=" + url.QueryEscape(token))
+	msg := utils.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone asked to reset the password for your account. To choose a new password, open this link:\n\n"+
+			"%s\n\n"+
+			"The link expires in %d minutes and can only be used once. "+
+			"If you didn't ask for this, you can ignore this email.\n",
+			user.Username, link, int(models.PasswordResetTokenTTL.Minutes())),
+	}
+	if err := utils.SendMail(msg); err != nil {
+		log.Printf("Error sending password reset email to user %d: %v", user.ID, err)
+	}
+
+	renderForgotPasswordPage(w, "", forgotPasswordSentMessage)
+}
+
+// ResetPasswordHandler lets a user choose a new password with a reset token
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		renderForgotPasswordPage(w, "The password reset link is invalid or has expired. Please request a new one.", "")
+		return
+	}
+
+	if r.Method != "POST" {
+		if _, err := models.ValidatePasswordResetToken(token); err != nil {
+			renderForgotPasswordPage(w, "The password reset link is invalid or has expired. Please request a new one.", "")
+			return
+		}
+		renderResetPasswordPage(w, token, "")
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+	confirmPassword := r.FormValue("confirm_password")
+
+	if newPassword != confirmPassword {
+		renderResetPasswordPage(w, token, "Passwords do not match")
+		return
+	}
+
+	if !utils.IsStrongPassword(newPassword) {
+		renderResetPasswordPage(w, token, "Password must be at least 8 characters long and contain uppercase, lowercase, number, and special character")
+		return
+	}
+
+	// Use up the token before changing anything
+	userID, err := models.ConsumePasswordResetToken(token)
+	if err != nil {
+		renderForgotPasswordPage(w, "The password reset link is invalid or has expired. Please request a new one.", "")
+		return
+	}
+
+	user, err := models.GetUserByIDSafe(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(newPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	user.PasswordHash = hashedPassword
+	if err := models.UpdateUser(user); err != nil {
+		http.Error(w, "Failed to update password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Sign out everywhere and lift any lockout caused by the forgotten password
+	if _, err := models.RevokeUserSessions(user.ID, ""); err != nil {
+		log.Printf("Error revoking sessions for user %d after password reset: %v", user.ID, err)
+	}
+	if err := models.UnlockAccount(user.Email); err != nil {
+		log.Printf("Error unlocking account for user %d after password reset: %v", user.ID, err)
+	}
+
+	log.Printf("Password reset completed for user %d", user.ID)
+	recordUserAudit(r, models.AuditPasswordChanged, user, map[string]interface{}{"method": "reset_link"})
+	http.Redirect(w, r, "/login?msg=password_reset", http.StatusSeeOther)
+}
+
+// Helper function to build an absolute URL for links in emails. The host comes
+// from APP_BASE_URL, never from the request, so a forged Host header can't
+// redirect a link to another site.
+func absoluteURL(path string) string {
+	return utils.BaseURL() + path
+}
+
+// Helper function to render the forgot password page
+func renderForgotPasswordPage(w http.ResponseWriter, errorMsg, successMsg string) {
+	tmpl, err := template.ParseFiles("templates/forgot-password.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Error":   errorMsg,
+		"Success": successMsg,
+	}
+
+	tmpl.Execute(w, data)
+}
+
+// Helper function to render the reset password page
+func renderResetPasswordPage(w http.ResponseWriter, token, errorMsg string) {
+	tmpl, err := template.ParseFiles("templates/reset-password.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Token": token,
+		"Error": errorMsg,
+	}
+
+	tmpl.Execute(w, data)
+}
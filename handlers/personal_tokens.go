@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/middleware"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// maxPersonalTokenName is the longest name a personal access token can be given
+const maxPersonalTokenName = 100
+
+// personalTokenExpiryDays are the lifetimes offered for a new personal access token
+var personalTokenExpiryDays = []int{7, 30, 90, 365}
+
+// APIMeHandler returns the signed-in user's profile. It accepts a personal
+// access token with the profile:read scope instead of a session.
+func APIMeHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(w, r)
+	if user == nil {
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"user": newAPIUser(user)})
+}
+
+// APIMyLoginsHandler returns the signed-in user's recent logins. It accepts a
+// personal access token with the history:read scope instead of a session.
+func APIMyLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(w, r)
+	if user == nil {
+		return
+	}
+
+	logins, err := models.GetLoginHistory(user.ID, loginHistoryLimit)
+	if err != nil {
+		sendJSONError(w, "Failed to get login history", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{"logins": logins})
+}
+
+// Helper function to get the user a request was authenticated as, either by a
+// bearer token or by the session. It writes an error response and returns nil
+// if there is none.
+func requestUser(w http.ResponseWriter, r *http.Request) *models.User {
+	if user := middleware.APIUser(r); user != nil {
+		return user
+	}
+
+	session, _ := utils.GetSession(r)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		sendJSONError(w, "Not signed in", http.StatusUnauthorized)
+		return nil
+	}
+
+	user, err := models.GetUserByIDSafe(userID)
+	if err != nil {
+		sendJSONError(w, "User not found", http.StatusUnauthorized)
+		return nil
+	}
+	return user
+}
+
+// Helper function to create a personal access token from the settings form.
+// The token is added to the page data so it is shown once.
+func createPersonalToken(r *http.Request, user *models.User, data map[string]interface{}) {
+	name := strings.TrimSpace(r.FormValue("token_name"))
+	if name == "" || len(name) > maxPersonalTokenName {
+		data["Error"] = fmt.Sprintf("Give the token a name of at most %d characters", maxPersonalTokenName)
+		return
+	}
+
+	scopes := r.Form["token_scopes"]
+	if len(scopes) == 0 {
+		data["Error"] = "Choose at least one scope for the token"
+		return
+	}
+
+	days, _ := strconv.Atoi(r.FormValue("token_expiry_days"))
+	if !validPersonalTokenExpiry(days) {
+		data["Error"] = "Choose when the token expires"
+		return
+	}
+
+	token, pat, err := models.CreatePersonalAccessToken(user.ID, name, scopes, time.Duration(days)*24*time.Hour)
+	if err == models.ErrUnknownScope {
+		data["Error"] = "Unknown scope"
+		return
+	}
+	if err != nil {
+		data["Error"] = "Failed to create token: " + err.Error()
+		return
+	}
+
+	log.Printf("User %d created personal access token %d", user.ID, pat.ID)
+	recordUserAudit(r, models.AuditPersonalTokenCreated, user, map[string]interface{}{
+		"personal_token_id": pat.ID,
+		"name":              name,
+		"scopes":            scopes,
+		"expires_at":        pat.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+
+	data["NewPersonalToken"] = token
+	data["Success"] = "Token created. Copy it now, it won't be shown again."
+	loadPersonalTokens(user, data)
+}
+
+// Helper function to revoke a personal access token from the settings form
+func revokePersonalToken(r *http.Request, user *models.User, data map[string]interface{}) {
+	id, err := strconv.Atoi(r.FormValue("token_id"))
+	if err != nil {
+		data["Error"] = "Invalid token"
+		return
+	}
+
+	if err := models.RevokePersonalAccessToken(user.ID, id); err != nil {
+		if err == models.ErrPersonalTokenNotFound {
+			data["Error"] = "Token not found"
+			return
+		}
+		data["Error"] = "Failed to revoke token: " + err.Error()
+		return
+	}
+
+	log.Printf("User %d revoked personal access token %d", user.ID, id)
+	recordUserAudit(r, models.AuditPersonalTokenRevoked, user, map[string]interface{}{"personal_token_id": id})
+	data["Success"] = "Token revoked"
+	loadPersonalTokens(user, data)
+}
+
+// Helper function to add a user's personal access tokens and the choices for a new one to the settings page
+func loadPersonalTokens(user *models.User, data map[string]interface{}) {
+	tokens, err := models.GetPersonalAccessTokens(user.ID)
+	if err != nil {
+		log.Printf("Error getting personal access tokens for user %d: %v", user.ID, err)
+	}
+	data["PersonalTokens"] = tokens
+	data["TokenScopes"] = models.PersonalTokenScopes
+	data["TokenExpiryDays"] = personalTokenExpiryDays
+}
+
+// Helper function to check that a token lifetime is one of the offered choices
+func validPersonalTokenExpiry(days int) bool {
+	for _, d := range personalTokenExpiryDays {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// reauthNextKey is the session key holding the page to return to after
+// re-authenticating with an OAuth provider
+const reauthNextKey = "reauth_next"
+
+// ReauthHandler asks a signed-in user to confirm their identity again before a sensitive change
+func ReauthHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	user, err := currentSessionUser(session)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	next := safeRedirectPath(r.FormValue("next"), "/user/settings")
+
+	if r.Method == "POST" {
+		method := r.FormValue("method")
+
+		// Refuse a password or code if the account or IP address is throttled
+		if method == "password" || method == "totp" {
+			if msg := authThrottleMessage(r, user.Email); msg != "" {
+				renderReauthPage(w, user, next, msg)
+				return
+			}
+		}
+
+		switch method {
+		case "password":
+			if !utils.CheckPasswordHash(r.FormValue("password"), user.PasswordHash) {
+				recordAuthFailure(r, models.AuditReauth, user.Email, utils.FactorPassword)
+				renderReauthPage(w, user, next, "Incorrect password")
+				return
+			}
+			utils.MarkAuthFactor(session, utils.FactorPassword)
+
+		case "totp":
+			valid, err := verifyOTPCode(database.DB, user, r.FormValue("2fa_code"))
+			if err != nil {
+				log.Printf("Error validating 2FA code for user %d: %v", user.ID, err)
+			}
+			if !user.TwoFAEnabled || isOutOfBandOTP(user.TwoFAType) || !valid {
+				recordAuthFailure(r, models.AuditReauth, user.Email, otpFactor(user))
+				renderReauthPage(w, user, next, "Invalid 2FA code")
+				return
+			}
+			utils.MarkAuthFactor(session, otpFactor(user))
+
+		case "google", "github":
+			// The callback returns to the next page once the provider confirms the account
+			session.Values[reauthNextKey] = next
+			session.Save(r, w)
+			http.Redirect(w, r, "/auth/"+method, http.StatusSeeOther)
+			return
+
+		default:
+			renderReauthPage(w, user, next, "Choose a way to confirm your identity")
+			return
+		}
+		releaseAuthAttempt(r, user.Email)
+
+		session.Save(r, w)
+		log.Printf("User %d re-authenticated with %s", user.ID, method)
+		recordUserAudit(r, models.AuditReauth, user, map[string]interface{}{"method": method})
+
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	renderReauthPage(w, user, next, "")
+}
+
+// Helper function to send the user to re-authenticate when their last verification
+// is older than the step-up window. It returns false if it has redirected.
+func requireRecentAuth(w http.ResponseWriter, r *http.Request, session *sessions.Session, next string) bool {
+	if utils.RecentlyAuthenticated(session) {
+		return true
+	}
+
+	http.Redirect(w, r, "/reauth?next="+url.QueryEscape(next), http.StatusSeeOther)
+	return false
+}
+
+// Helper function to finish an OAuth re-authentication started from the re-auth page.
+// It returns false if the callback is part of a normal login instead.
+func completeOAuthReauth(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *models.User) bool {
+	next, ok := session.Values[reauthNextKey].(string)
+	if !ok {
+		return false
+	}
+	delete(session.Values, reauthNextKey)
+
+	// Only a signed-in session of the same account can be refreshed this way
+	auth, _ := session.Values["authenticated"].(bool)
+	userID, _ := session.Values["user_id"].(int)
+	if !auth || userID != user.ID {
+		return false
+	}
+
+	utils.MarkAuthFactor(session, utils.FactorOAuth)
+	if err := utils.SaveSession(session, w, r); err != nil {
+		log.Printf("Error saving session after OAuth re-authentication: %v", err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return true
+	}
+
+	log.Printf("User %d re-authenticated with OAuth", user.ID)
+	recordUserAudit(r, models.AuditReauth, user, map[string]interface{}{"method": utils.FactorOAuth})
+	http.Redirect(w, r, safeRedirectPath(next, "/user/settings"), http.StatusSeeOther)
+	return true
+}
+
+// Helper function to accept only local redirect targets. Browsers drop control
+// characters and treat backslashes as slashes, so paths containing either are
+// refused rather than risk them turning into "//other-site".
+func safeRedirectPath(path, fallback string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsRune(path, '\\') {
+		return fallback
+	}
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f {
+			return fallback
+		}
+	}
+
+	parsed, err := url.Parse(path)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" {
+		return fallback
+	}
+	return path
+}
+
+// Helper function to render the re-authentication page
+func renderReauthPage(w http.ResponseWriter, user *models.User, next, errorMsg string) {
+	tmpl, err := template.ParseFiles("templates/reauth.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Error":        errorMsg,
+		"Next":         next,
+		"TwoFAEnabled": user.TwoFAEnabled && !isOutOfBandOTP(user.TwoFAType),
+		"GoogleLinked": user.GoogleID != "",
+		"GithubLinked": user.GithubID != "",
+		"WindowMins":   int(utils.StepUpWindow().Minutes()),
+	}
+
+	tmpl.Execute(w, data)
+}
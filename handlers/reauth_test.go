@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
+)
+
+// signedInCookie stores a signed-in session for a user whose factors were
+// verified the given time ago, and returns its cookie
+func signedInCookie(t *testing.T, user *models.User, verifiedAgo time.Duration, enrolled ...string) *http.Cookie {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := utils.GetSession(r)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = user.ID
+	utils.SaveAuthState(session, &utils.AuthState{
+		UserID:  user.ID,
+		Factors: map[string]time.Time{utils.FactorPassword: time.Now().Add(-verifiedAgo)},
+	})
+	for _, factor := range enrolled {
+		utils.MarkEnrolledFactor(session, factor)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := utils.SaveSession(session, rec, r); err != nil {
+		t.Fatalf("SaveSession: %v", err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	t.Setenv("STEP_UP_WINDOW_MINUTES", "10")
+
+	tests := []struct {
+		name        string
+		verifiedAgo time.Duration
+		enrolled    []string
+		want        bool
+	}{
+		{"inside the window", 5 * time.Minute, nil, true},
+		{"past the window", 15 * time.Minute, nil, false},
+		{"past the window after enrolling TOTP", 15 * time.Minute, []string{utils.FactorTOTP}, false},
+		{"past the window after enrolling a key", 15 * time.Minute, []string{utils.FactorWebAuthn}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := sessions.NewSession(nil, "test")
+			utils.SaveAuthState(session, &utils.AuthState{
+				UserID:  1,
+				Factors: map[string]time.Time{utils.FactorPassword: time.Now().Add(-tt.verifiedAgo)},
+			})
+			for _, factor := range tt.enrolled {
+				utils.MarkEnrolledFactor(session, factor)
+			}
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/settings", nil)
+			if got := requireRecentAuth(rec, r, session, "/setup-2fa?type=totp"); got != tt.want {
+				t.Fatalf("requireRecentAuth = %v, want %v", got, tt.want)
+			}
+
+			wantLocation := ""
+			if !tt.want {
+				wantLocation = "/reauth?next=%2Fsetup-2fa%3Ftype%3Dtotp"
+			}
+			if location := rec.Header().Get("Location"); location != wantLocation {
+				t.Errorf("Location = %q, want %q", location, wantLocation)
+			}
+		})
+	}
+}
+
+func TestEnrollmentRequiresRecentAuth(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("STEP_UP_WINDOW_MINUTES", "10")
+	t.Chdir("..")
+
+	handlers := []struct {
+		name    string
+		method  string
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"authenticator app", "GET", "/setup-2fa", Setup2FAHandler},
+		{"face", "GET", "/setup-face", SetupFaceHandler},
+		{"security key page", "GET", "/setup-webauthn", SetupWebAuthnHandler},
+		{"security key registration", "POST", "/webauthn/register/begin", WebAuthnRegisterBeginHandler},
+	}
+
+	states := []struct {
+		name        string
+		verifiedAgo time.Duration
+		enrolled    []string
+		wantAllowed bool
+	}{
+		{"recent password", time.Minute, nil, true},
+		{"old password", time.Hour, nil, false},
+		{"old password, just enrolled a key", time.Hour, []string{utils.FactorWebAuthn}, false},
+		{"old password, just enrolled TOTP", time.Hour, []string{utils.FactorTOTP}, false},
+	}
+
+	user := createTestUser(t, "user@example.com")
+	for _, h := range handlers {
+		for _, state := range states {
+			t.Run(h.name+"/"+state.name, func(t *testing.T) {
+				r := httptest.NewRequest(h.method, h.path, nil)
+				r.AddCookie(signedInCookie(t, user, state.verifiedAgo, state.enrolled...))
+				rec := httptest.NewRecorder()
+				h.handler(rec, r)
+
+				allowed := rec.Code == http.StatusOK
+				refused := rec.Code == http.StatusForbidden ||
+					strings.HasPrefix(rec.Header().Get("Location"), "/reauth")
+				if allowed != state.wantAllowed || refused == state.wantAllowed {
+					t.Errorf("status %d, Location %q, want allowed = %v",
+						rec.Code, rec.Header().Get("Location"), state.wantAllowed)
+				}
+			})
+		}
+	}
+}
+
+func TestSettingsActionNeedsPassword(t *testing.T) {
+	tests := []struct {
+		action      string
+		isOAuthUser bool
+		want        bool
+	}{
+		{"change_email", false, true},
+		{"change_email", true, true},
+		{"change_password", false, true},
+		{"change_password", true, false},
+		{"regenerate_recovery_codes", false, true},
+		{"regenerate_recovery_codes", true, false},
+		{"toggle_2fa", false, false},
+		{"toggle_webauthn", false, false},
+		{"revoke_other_sessions", false, false},
+		{"create_token", false, false},
+		{"delete_account", false, true},
+		{"", false, true},
+	}
+
+	for _, tt := range tests {
+		if got := settingsActionNeedsPassword(tt.action, tt.isOAuthUser); got != tt.want {
+			t.Errorf("settingsActionNeedsPassword(%q, %v) = %v, want %v", tt.action, tt.isOAuthUser, got, tt.want)
+		}
+	}
+}
+
+func TestSensitiveSettingsAction(t *testing.T) {
+	enrolled := &models.User{TwoFAEnabled: true, FaceAuthEnabled: true, WebAuthnEnabled: true}
+	none := &models.User{}
+
+	tests := []struct {
+		action string
+		user   *models.User
+		want   bool
+	}{
+		{"change_email", none, true},
+		{"change_password", none, true},
+		{"create_token", none, true},
+		{"toggle_2fa", enrolled, true},
+		{"toggle_2fa", none, false},
+		{"toggle_face_auth", enrolled, true},
+		{"toggle_webauthn", enrolled, true},
+		{"toggle_webauthn", none, false},
+		{"revoke_session", enrolled, false},
+	}
+
+	for _, tt := range tests {
+		if got := sensitiveSettingsAction(tt.action, tt.user); got != tt.want {
+			t.Errorf("sensitiveSettingsAction(%q, %+v) = %v, want %v", tt.action, tt.user, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"fmt"
+	"database/sql"
 	"html/template"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/aungh/login-form/authflow"
 	"github.com/aungh/login-form/models"
 	"github.com/aungh/login-form/utils"
 	"github.com/gorilla/sessions"
@@ -29,9 +30,6 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Debug session values
-	log.Printf("Session values in HomeHandler: %+v", session.Values)
-
 	// Check if user is authenticated
 	auth, ok := session.Values["authenticated"].(bool)
 	log.Printf("Authentication check in HomeHandler: auth=%v, ok=%v", auth, ok)
@@ -51,9 +49,6 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// Get basic info from session
 	username := session.Values["username"]
 	email := session.Values["email"]
-	
-	// Debug session values
-	fmt.Printf("DEBUG: Home handler - session values: %+v\n", session.Values)
 
 	// Get user ID from session
 	userID, ok := session.Values["user_id"].(int)
@@ -78,7 +73,7 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user has admin role
-	isAdmin := user.Role == "admin"
+	isAdmin, _ := models.HasPermission(user.Role, models.PermissionViewUsers)
 
 	// Use the authentication status directly from the database
 	// This ensures we're always showing the correct status
@@ -90,9 +85,11 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		"IsAdmin":         isAdmin,
 		"Role":            user.Role,
 	}
-	
-	// Log the authentication status for debugging
-	fmt.Printf("DEBUG: User authentication status - 2FA: %v, Face: %v\n", user.TwoFAEnabled, user.FaceAuthEnabled)
+
+	// Warn about an MFA policy that will be enforced after its grace period
+	if violation, _ := mfaPolicyViolation(user); violation != nil {
+		data["MFAWarning"] = mfaGraceNotice(violation)
+	}
 
 	tmpl.Execute(w, data)
 }
@@ -119,11 +116,17 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Refuse the attempt if the account or IP address is throttled
+		if msg := authThrottleMessage(r, email); msg != "" {
+			renderLoginPage(w, msg)
+			return
+		}
+
 		// Check if user exists - use the safe version that handles NULL values
 		user, err := models.GetUserByEmailSafe(email)
 		if err != nil {
-			// For demo purposes, create a user if not exists
-			if password == "password" {
+			// For demo purposes, create a user if not exists (development mode only)
+			if utils.IsDevelopment() && password == utils.DemoPassword {
 				hashedPassword, _ := utils.HashPassword(password)
 				user = &models.User{
 					Username:     email[:strings.Index(email, "@")],
@@ -132,72 +135,44 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 					CreatedAt:    time.Now(),
 				}
 				models.CreateUser(user)
+				releaseAuthAttempt(r, email)
 			} else {
+				recordAuthFailure(r, models.AuditLogin, email, utils.FactorPassword)
 				renderLoginPage(w, "Invalid email or password")
 				return
 			}
 		} else {
 			// Verify password
-			// Special case for admin user (testing@sample.com) to ensure reliable login
-			if email == "testing@sample.com" && password == "password" {
+			// Special case for admin user (testing@sample.com) to ensure reliable login (development mode only)
+			if utils.IsDevelopment() && email == utils.DemoAdminEmail && password == utils.DemoPassword {
 				// Allow admin login with default password
 				log.Printf("Admin user logged in with default password")
 			} else if !utils.CheckPasswordHash(password, user.PasswordHash) {
 				log.Printf("Password verification failed for user %s", email)
+				recordAuthFailure(r, models.AuditLogin, email, utils.FactorPassword)
 				renderLoginPage(w, "Invalid email or password")
 				return
 			}
+			releaseAuthAttempt(r, email)
 		}
 
-		// Store authentication state in session
-		session.Values["pending_auth_email"] = email
-		session.Values["pending_auth_user_id"] = user.ID
-		session.Values["pending_auth_username"] = user.Username
-		session.Values["pending_auth_twofa_enabled"] = user.TwoFAEnabled
-		session.Values["pending_auth_face_enabled"] = user.FaceAuthEnabled
-
-		// Log authentication methods
-		fmt.Printf("User %s has 2FA: %v, Face: %v\n", user.Username, user.TwoFAEnabled, user.FaceAuthEnabled)
-		
-		// Debug session values before auth flow
-		fmt.Printf("DEBUG: Session values before auth flow: %+v\n", session.Values)
-
-		// Check authentication methods - first 2FA, then face
-		if user.TwoFAEnabled {
-			// Store that we need to do face auth after 2FA (if enabled)
-			if user.FaceAuthEnabled {
-				session.Values["pending_face_after_2fa"] = true
-			}
-			session.Save(r, w)
-			http.Redirect(w, r, "/verify-2fa", http.StatusSeeOther)
-			return
-		} else if user.FaceAuthEnabled {
-			// Only face auth is enabled
-			session.Save(r, w)
-			http.Redirect(w, r, "/verify-face", http.StatusSeeOther)
+		// Unverified accounts may be blocked by policy
+		if !user.EmailVerified && utils.RequireEmailVerification() {
+			renderUnverifiedLoginPage(w, user.Email)
 			return
 		}
 
-		// Set session values
-		session.Values["authenticated"] = true
-		session.Values["user_id"] = user.ID
-		session.Values["username"] = user.Username
-		session.Values["email"] = user.Email
-		session.Values["twofa_enabled"] = user.TwoFAEnabled
-		session.Values["face_auth_enabled"] = user.FaceAuthEnabled
-
-		// Log session values for debugging
-		log.Printf("Setting session values: user_id=%d, username=%s, email=%s",
-			user.ID, user.Username, user.Email)
-
-		err = session.Save(r, w)
+		// Start the login flow; the engine decides which factors come next
+		flow, err := authflow.Start(session, user, utils.FactorPassword)
 		if err != nil {
-			log.Printf("Error saving session: %v", err)
+			log.Printf("Error starting login flow for user %d: %v", user.ID, err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
 
-		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		log.Printf("User %d started login with 2FA: %v, WebAuthn: %v, Face: %v", user.ID, user.TwoFAEnabled, user.WebAuthnEnabled, user.FaceAuthEnabled)
+
+		continueLogin(w, r, session, flow)
 		return
 	}
 
@@ -207,6 +182,16 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	if msg == "password_changed" {
 		successMsg = "Password changed successfully. Please log in with your new password."
+	} else if msg == "password_reset" {
+		successMsg = "Your password has been reset. Please log in with your new password."
+	} else if msg == "email_verified" {
+		successMsg = "Your email address has been verified."
+	} else if msg == "verification_sent" {
+		successMsg = resendVerificationMessage
+	} else if msg == "reauth" {
+		successMsg = "Your sign-in methods have changed. Please log in again."
+	} else if r.URL.Query().Get("registered") == "true" {
+		successMsg = "Account created. Check your email for a link to verify your address."
 	}
 
 	// Display login page
@@ -238,6 +223,22 @@ func renderLoginPage(w http.ResponseWriter, errorMsg string) {
 	tmpl.Execute(w, data)
 }
 
+// Helper function to render the login page for an account whose email is not verified yet
+func renderUnverifiedLoginPage(w http.ResponseWriter, email string) {
+	tmpl, err := template.ParseFiles("templates/login.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Error":           "Please verify your email address before logging in.",
+		"UnverifiedEmail": email,
+	}
+
+	tmpl.Execute(w, data)
+}
+
 // SignupHandler handles the signup page and form submission
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := GetSession(r)
@@ -311,6 +312,9 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Ask the user to confirm the address
+		sendVerificationEmail(r, &user, user.Email)
+
 		// Redirect to login page
 		http.Redirect(w, r, "/login?registered=true", http.StatusSeeOther)
 		return
@@ -364,6 +368,8 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	delete(session.Values, "user_id")
 	delete(session.Values, "username")
 	delete(session.Values, "email")
+	utils.ClearAuthState(session)
+	authflow.Abandon(session)
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -376,16 +382,25 @@ func QRCodeHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
 	// Get the secret and email from the session
-	secret, ok1 := session.Values["temp_2fa_secret"].(string)
-	email, ok2 := session.Values["temp_2fa_email"].(string)
+	user, _, err := enrollingUser(session)
+	if err != nil {
+		http.Error(w, "Invalid session data for QR code generation", http.StatusBadRequest)
+		return
+	}
+	secret := pendingTwoFASecret(session, user.ID)
+	email, ok := session.Values["temp_2fa_email"].(string)
 
-	if !ok1 || !ok2 || secret == "" || email == "" {
+	if !ok || secret == "" || email == "" {
 		http.Error(w, "Invalid session data for QR code generation", http.StatusBadRequest)
 		return
 	}
 
-	// Generate the QR code
-	pngBytes, err := utils.GenerateQRCodePNG(secret, email)
+	// Generate the QR code; counter-based tokens start at counter 0
+	uri := utils.TOTPURI(utils.GetTOTPConfig(), secret, email)
+	if session.Values["temp_2fa_type"] == models.TwoFATypeHOTP {
+		uri = utils.HOTPURI(utils.GetTOTPConfig(), secret, email, 0)
+	}
+	pngBytes, err := utils.QRCodePNG(uri)
 	if err != nil {
 		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
 		return
@@ -405,130 +420,138 @@ func QRCodeHandler(w http.ResponseWriter, r *http.Request) {
 func Verify2FAHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
-	// Check if there's a pending authentication
-	email, ok := session.Values["pending_auth_email"].(string)
-	if !ok || email == "" {
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	// Check that the TOTP step is next in a login in progress
+	flow, redirect := loginStep(session, utils.FactorTOTP)
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
 		return
 	}
+	user := flow.User
+	email := user.Email
 
-	// For debugging
-	fmt.Printf("Verifying 2FA for email: %s\n", email)
+	// Codes delivered by email or SMS are sent to the user's address or phone
+	otpType := user.TwoFAType
+	destination := otpDestination(user)
 
 	// Process form submission
 	if r.Method == "POST" {
 		code := r.FormValue("2fa_code")
+		recoveryCode := r.FormValue("recovery_code")
+		resyncFirst := r.FormValue("resync_code_1")
+		resyncSecond := r.FormValue("resync_code_2")
+		resync := resyncFirst != "" || resyncSecond != ""
+
+		// Send a new code when the earlier one didn't arrive or expired
+		if r.FormValue("resend") != "" && isOutOfBandOTP(otpType) {
+			msg := ""
+			if err := sendOTPCode(user.ID, models.OTPPurposeLogin, otpType, destination); err != nil {
+				msg = otpSendErrorMessage(user.ID, err)
+			}
+			render2FAPage(w, msg, false, otpType, destination)
+			return
+		}
 
 		// Validate input
-		if code == "" {
-			render2FAPage(w, "2FA code is required", false)
+		if code == "" && recoveryCode == "" && !resync {
+			render2FAPage(w, "2FA code is required", false, otpType, destination)
 			return
 		}
 
-		// Get user
-		user, err := models.GetUserByEmail(email)
-		if err != nil {
-			http.Error(w, "User not found", http.StatusInternalServerError)
+		// Refuse the attempt if the account or IP address is throttled
+		if msg := authThrottleMessage(r, email); msg != "" {
+			render2FAPage(w, msg, false, otpType, destination)
 			return
 		}
 
-		// For demo purposes, accept any 6-digit code
-		valid := len(code) == 6 && code != ""
-
-		// Log verification attempt
-		fmt.Printf("2FA code verification: code=%s, valid=%v\n", code, valid)
+		// Record which second factor was used
+		used := otpFactor(user)
+		failure := "Invalid 2FA code"
+		var verify func(tx *sql.Tx) (bool, error)
+		if recoveryCode != "" {
+			// A recovery code replaces the TOTP code and can only be used once
+			used = utils.FactorRecoveryCode
+			failure = "Invalid recovery code"
+			verify = func(tx *sql.Tx) (bool, error) {
+				return models.UseRecoveryCode(tx, user.ID, recoveryCode)
+			}
+		} else if resync {
+			// Two consecutive codes move the stored counter to a token that drifted too far ahead
+			failure = "Those codes could not be matched. Enter two codes your token shows one after the other."
+			verify = func(tx *sql.Tx) (bool, error) {
+				return resyncHOTPToken(tx, user, resyncFirst, resyncSecond)
+			}
+		} else {
+			// Validate the code against the stored secret
+			verify = func(tx *sql.Tx) (bool, error) {
+				return verifyOTPCode(tx, user, code)
+			}
+		}
 
-		if !valid {
-			render2FAPage(w, "Invalid 2FA code", false)
+		// The code is used up in the same transaction that completes the step
+		valid, err := flow.Complete(utils.FactorTOTP, used, verify)
+		if err != nil {
+			log.Printf("Error completing 2FA step for user %d: %v", user.ID, err)
+			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
+		log.Printf("2FA verification for user %d with %s: valid=%v", user.ID, used, valid)
 
-		// Check if we need to do face authentication next
-		faceAfter2FA, ok := session.Values["pending_face_after_2fa"].(bool)
-		fmt.Printf("DEBUG: Face after 2FA check: %v (valid: %v)\n", faceAfter2FA, ok)
-		fmt.Printf("DEBUG: Session values in 2FA handler: %+v\n", session.Values)
-
-		if faceAfter2FA {
-			// For face auth after 2FA, we need to maintain both the pending auth email and 2FA status
-			// We'll keep the pending_auth_email but remove the pending_face_after_2fa flag
-			delete(session.Values, "pending_face_after_2fa")
-			
-			// Store the fact that 2FA has been verified
-			session.Values["twofa_completed"] = true
-			session.Values["twofa_enabled"] = true
-			
-			// Store user data that we'll need for face verification
-			session.Values["temp_user_id"] = user.ID
-			session.Values["temp_username"] = user.Username
-			
-			session.Save(r, w)
-
-			// Redirect to face verification
-			fmt.Println("2FA verified, redirecting to face verification")
-			http.Redirect(w, r, "/verify-face", http.StatusSeeOther)
+		if !valid {
+			recordAuthFailure(r, models.AuditLogin, email, used)
+			render2FAPage(w, failure, false, otpType, destination)
 			return
 		}
+		releaseAuthAttempt(r, email)
 
-		// Set session values for complete authentication
-		session.Values["authenticated"] = true
-		session.Values["user_id"] = user.ID
-		session.Values["username"] = user.Username
-		session.Values["email"] = user.Email
-		session.Values["twofa_enabled"] = true
-		session.Values["face_auth_enabled"] = user.FaceAuthEnabled
-
-		// Clean up pending auth data
-		delete(session.Values, "pending_auth_email")
-		delete(session.Values, "pending_auth_user_id")
-		delete(session.Values, "pending_auth_username")
-		delete(session.Values, "pending_auth_twofa_enabled")
-		delete(session.Values, "pending_auth_face_enabled")
-
-		session.Save(r, w)
-
-		fmt.Println("2FA verified, authentication complete")
-		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		continueLogin(w, r, session, flow)
 		return
 	}
 
+	// Send a code when the page is shown, unless one is already on its way
+	msg := ""
+	if isOutOfBandOTP(otpType) {
+		msg = ensureLoginOTPCode(user)
+	}
+
 	// Display 2FA page
-	render2FAPage(w, "", false)
+	render2FAPage(w, msg, false, otpType, destination)
 }
 
 // Setup2FAHandler handles 2FA setup
 func Setup2FAHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := utils.GetSession(r)
 
-	// Check if user is authenticated
-	auth, ok := session.Values["authenticated"].(bool)
-	if !ok || !auth {
+	// The user is signed in, or their login waits for them to meet an MFA policy
+	user, flow, err := enrollingUser(session)
+	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	userID, ok := session.Values["user_id"].(int)
-	if !ok || userID <= 0 {
-		http.Error(w, "User ID not found in session", http.StatusInternalServerError)
+	// Enrolling a second factor while signed in needs a recent verification,
+	// even the first one; one an MFA policy forces during login doesn't
+	if flow == nil && !requireRecentAuth(w, r, session, r.URL.RequestURI()) {
 		return
 	}
 
-	user, err := models.GetUserByIDSafe(userID)
-	if err != nil {
-		http.Error(w, "User not found: "+err.Error(), http.StatusInternalServerError)
+	// Codes delivered by email or SMS are enrolled without a secret
+	requestedType := r.URL.Query().Get("type")
+	if r.Method == "POST" {
+		requestedType, _ = session.Values["temp_2fa_type"].(string)
+	}
+	if isOutOfBandOTP(requestedType) {
+		setupOutOfBandOTP(w, r, session, flow, user, requestedType)
 		return
 	}
 
-	// For debugging
-	fmt.Printf("Setting up 2FA for user ID: %d, Email: %s\n", userID, user.Email)
-
 	// Process form submission
 	if r.Method == "POST" {
 		code := r.FormValue("2fa_code")
 
 		// Get the secret from the session, not from the form
 		// This ensures we're validating against the same secret that was used to generate the QR code
-		secret, ok := session.Values["temp_2fa_secret"].(string)
-		if !ok || secret == "" {
+		secret := pendingTwoFASecret(session, user.ID)
+		if secret == "" {
 			http.Error(w, "Session expired or invalid. Please try again.", http.StatusBadRequest)
 			return
 		}
@@ -539,52 +562,57 @@ func Setup2FAHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Log the verification attempt
-		fmt.Printf("Verifying 2FA setup code: %s with secret: %s\n", code, secret)
-
-		// Validate the code against the secret
-		valid, err := utils.Validate2FA(secret, code)
-		if err != nil || !valid {
-			// For demo purposes, also accept any 6-digit code
-			if len(code) == 6 && code != "" {
-				valid = true
-			} else {
-				render2FAPage(w, "Invalid 2FA code. Please try again.", true)
-				return
-			}
+		// Log the verification attempt without the code or secret
+		log.Printf("Verifying 2FA setup for user %d", user.ID)
+
+		// Validate the code against the secret with the parameters it was generated for
+		otpType, _ := session.Values["temp_2fa_type"].(string)
+		params := utils.GetTOTPConfig().TOTPParams
+		var step int64
+		var valid bool
+		if otpType == models.TwoFATypeHOTP {
+			// The token's first codes are for counter 0 onwards
+			step, valid, err = utils.ValidateHOTP(params, secret, code, -1, utils.HOTPLookAhead())
+		} else {
+			otpType = models.TwoFATypeTOTP
+			step, valid, err = utils.Validate2FAStep(params, secret, code, 0)
 		}
-
-		// Update user with 2FA secret
-		user.TwoFASecret = secret
-		user.TwoFAEnabled = true
-		err = models.UpdateUser(user)
-		if err != nil {
-			http.Error(w, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
+		if err != nil || !valid {
+			render2FAPage(w, "Invalid 2FA code. Please try again.", true, otpType, "")
 			return
 		}
 
-		// Update session
-		session.Values["twofa_enabled"] = true
-		session.Save(r, w)
-
-		http.Redirect(w, r, "/home?2fa_setup=success", http.StatusSeeOther)
+		// Save the secret and the parameters it was enrolled with
+		user.TwoFASecret = secret
+		user.TwoFAAlgorithm = params.Algorithm
+		user.TwoFADigits = params.Digits
+		user.TwoFAPeriod = params.Period
+		user.TwoFAType = otpType
+		finishTwoFASetup(w, r, session, flow, user, step)
 		return
 	}
 
 	// Always generate a new 2FA secret on each page load
 	// This ensures the QR code changes after every reload
-	secret, err := utils.Generate2FASecret()
+	secret, err := utils.Generate2FASecret(utils.GetTOTPConfig())
 	if err != nil {
 		http.Error(w, "Failed to generate 2FA secret", http.StatusInternalServerError)
 		return
 	}
 
-	// Store the newly generated secret in the session for temporary use
-	// We don't save it to the user record until they verify it
-	session.Values["temp_new_2fa_secret"] = secret
+	// Offer a counter-based (HOTP) token instead of an authenticator app when asked for
+	otpType := models.TwoFATypeTOTP
+	if r.URL.Query().Get("type") == models.TwoFATypeHOTP {
+		otpType = models.TwoFATypeHOTP
+	}
 
 	// Store the secret in the session for the QR code endpoint to use
-	session.Values["temp_2fa_secret"] = secret
+	// We don't save it to the user record until they verify it
+	if err := setPendingTwoFASecret(session, user.ID, secret); err != nil {
+		http.Error(w, "Failed to store 2FA secret", http.StatusInternalServerError)
+		return
+	}
+	session.Values["temp_2fa_type"] = otpType
 	session.Values["temp_2fa_email"] = user.Email
 	session.Save(r, w)
 
@@ -601,6 +629,17 @@ func Setup2FAHandler(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
 		"Secret":    secret,
 		"Timestamp": timestamp,
+		"HOTP":      otpType == models.TwoFATypeHOTP,
+		"Enrolling": flow != nil,
+	}
+
+	// Explain why enrollment is required when a policy forces it
+	if violation, _ := mfaPolicyViolation(user); violation != nil {
+		if violation.Enforced() {
+			data["PolicyNotice"] = "Your account must be updated to meet a security policy: " + violation.Reason + ". Set up an authenticator app to continue."
+		} else {
+			data["PolicyNotice"] = mfaGraceNotice(violation)
+		}
 	}
 
 	tmpl.Execute(w, data)
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"fmt"
 	"html/template"
+	"log"
 	"net/http"
 	"strings"
 	
 	"github.com/aungh/login-form/models"
 	"github.com/aungh/login-form/utils"
+	"github.com/gorilla/sessions"
 )
 
 // UserSettingsHandler handles the user settings page
@@ -38,6 +41,46 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		"CurrentUser": currentUser,
 	}
 
+	switch r.URL.Query().Get("msg") {
+	case "email_verified":
+		data["Success"] = "Your email address has been verified."
+	case "reauthenticated":
+		data["Success"] = "Identity confirmed. You can now make the change."
+	case "face_enrolled":
+		data["Success"] = "Face authentication has been set up."
+	}
+
+	// Show how many recovery codes are left
+	if currentUser.TwoFAEnabled {
+		remaining, err := models.CountUnusedRecoveryCodes(currentUser.ID)
+		if err == nil {
+			data["RecoveryCodesRemaining"] = remaining
+		}
+	}
+
+	// List the signed-in sessions
+	activeSessions, err := models.GetActiveSessions(currentUser.ID, session.ID)
+	if err == nil {
+		data["ActiveSessions"] = activeSessions
+	}
+
+	// List the recent logins
+	loginHistory, err := models.GetLoginHistory(currentUser.ID, loginHistoryLimit)
+	if err == nil {
+		data["LoginHistory"] = loginHistory
+	}
+
+	// List the personal access tokens
+	loadPersonalTokens(currentUser, data)
+
+	// List the registered security keys
+	if currentUser.WebAuthnEnabled {
+		keys, err := models.GetWebAuthnCredentialsByUserID(currentUser.ID)
+		if err == nil {
+			data["SecurityKeys"] = keys
+		}
+	}
+
 	// Handle form submissions
 	if r.Method == "POST" {
 		action := r.FormValue("action")
@@ -46,16 +89,29 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		// Check if this is an OAuth user (has GoogleID or GithubID)
 		isOAuthUser := currentUser.GoogleID != "" || currentUser.GithubID != ""
 
-		// Verify current password for sensitive actions
-		// Skip password verification for OAuth users when changing password
-		if action != "toggle_2fa" && action != "toggle_face_auth" && 
-		   !(isOAuthUser && action == "change_password") && 
-		   !utils.CheckPasswordHash(currentPassword, currentUser.PasswordHash) {
-			data["Error"] = "Current password is incorrect"
-			renderUserSettingsTemplate(w, data)
+		// Disabling a factor or changing credentials needs a recent verification,
+		// which only /reauth grants
+		if sensitiveSettingsAction(action, currentUser) && !requireRecentAuth(w, r, session, "/user/settings?msg=reauthenticated") {
 			return
 		}
 
+		// Verify current password for sensitive actions. Wrong guesses count
+		// towards the same lockout as the login and re-auth pages.
+		if settingsActionNeedsPassword(action, isOAuthUser) {
+			if msg := authThrottleMessage(r, currentUser.Email); msg != "" {
+				data["Error"] = msg
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+			if currentPassword == "" || !utils.CheckPasswordHash(currentPassword, currentUser.PasswordHash) {
+				recordAuthFailure(r, models.AuditReauth, currentUser.Email, utils.FactorPassword)
+				data["Error"] = "Current password is incorrect"
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+			releaseAuthAttempt(r, currentUser.Email)
+		}
+
 		switch action {
 		case "change_email":
 			newEmail := strings.TrimSpace(r.FormValue("new_email"))
@@ -65,16 +121,22 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if strings.EqualFold(newEmail, currentUser.Email) {
+				data["Error"] = "That is already your email address"
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
 			// Check if email is already in use by another user
 			exists, _ := models.EmailExists(newEmail)
-			if exists && newEmail != currentUser.Email {
+			if exists {
 				data["Error"] = "Email is already in use"
 				renderUserSettingsTemplate(w, data)
 				return
 			}
 
-			// Update email
-			currentUser.Email = newEmail
+			// The current address keeps working until the new one is confirmed
+			currentUser.PendingEmail = newEmail
 			err = models.UpdateUser(currentUser)
 			if err != nil {
 				data["Error"] = "Failed to update email: " + err.Error()
@@ -82,11 +144,33 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Update session
-			session.Values["email"] = newEmail
-			session.Save(r, w)
+			sendVerificationEmail(r, currentUser, newEmail)
+
+			data["Success"] = "We sent a verification link to " + newEmail + ". Your email will change once you confirm it."
+
+		case "resend_verification":
+			email := currentUser.PendingEmail
+			if email == "" && !currentUser.EmailVerified {
+				email = currentUser.Email
+			}
+			if email != "" {
+				if !resendVerificationEmail(r, currentUser, email) {
+					data["Error"] = "A verification link was sent recently. Please wait a minute before requesting another."
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+				data["Success"] = "Verification link sent to " + email
+			}
+
+		case "cancel_email_change":
+			currentUser.PendingEmail = ""
+			if err := models.UpdateUser(currentUser); err != nil {
+				data["Error"] = "Failed to cancel email change: " + err.Error()
+				renderUserSettingsTemplate(w, data)
+				return
+			}
 
-			data["Success"] = "Email updated successfully"
+			data["Success"] = "Email change cancelled"
 
 		case "change_password":
 			newPassword := r.FormValue("new_password")
@@ -121,16 +205,13 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Force logout after password change
-			// Clear the session authentication
-			session.Values["authenticated"] = false
-			delete(session.Values, "user_id")
-			delete(session.Values, "username")
-			delete(session.Values, "email")
-			delete(session.Values, "twofa_enabled")
-			delete(session.Values, "twofa_verified")
-			delete(session.Values, "face_auth_enabled")
-			delete(session.Values, "face_auth_verified")
+			recordUserAudit(r, models.AuditPasswordChanged, currentUser, map[string]interface{}{"method": "settings"})
+
+			// Force logout everywhere after password change, including this session
+			if _, err := models.RevokeUserSessions(currentUser.ID, ""); err != nil {
+				log.Printf("Error revoking sessions for user %d after password change: %v", currentUser.ID, err)
+			}
+			session.Options.MaxAge = -1
 			session.Save(r, w)
 
 			// Redirect to login page with success message
@@ -140,7 +221,14 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 		case "toggle_2fa":
 			// Toggle 2FA status
 			if currentUser.TwoFAEnabled {
+				if msg := mfaPolicyBlocksChange(currentUser, func(u *models.User) { u.TwoFAEnabled = false }); msg != "" {
+					data["Error"] = msg
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+
 				// Disable 2FA
+				removedFactor := otpFactor(currentUser)
 				currentUser.TwoFAEnabled = false
 				
 				// We keep the secret in case the user wants to re-enable 2FA later
@@ -152,7 +240,18 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 					renderUserSettingsTemplate(w, data)
 					return
 				}
+
+				recordUserAudit(r, models.AuditFactorRemoved, currentUser, map[string]interface{}{"factor": removedFactor})
+
+				// Recovery codes are only meaningful while 2FA is enabled
+				if err := models.DeleteRecoveryCodes(currentUser.ID); err != nil {
+					data["Warning"] = "2FA disabled, but there was an error deleting recovery codes: " + err.Error()
+				}
+				delete(data, "RecoveryCodesRemaining")
 				
+				// Sign out everywhere else now that the second factor is gone
+				revokeOtherSessions(session, currentUser.ID, "2FA reset")
+
 				// Update session
 				session.Values["twofa_enabled"] = false
 				session.Save(r, w)
@@ -164,31 +263,136 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			
+		case "choose_2fa_method":
+			method := r.FormValue("method")
+			switch method {
+			case models.TwoFATypeTOTP, models.TwoFATypeHOTP, models.TwoFATypeEmail:
+			case models.TwoFATypeSMS:
+				// The number is confirmed with a code before it is saved
+				phone, err := utils.NormalizePhoneNumber(r.FormValue("phone_number"))
+				if err != nil {
+					data["Error"] = "Enter your phone number in international format, such as +15551234567"
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+				session.Values["temp_2fa_phone"] = phone
+				session.Save(r, w)
+			default:
+				data["Error"] = "Choose a two-factor authentication method"
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
+			http.Redirect(w, r, "/setup-2fa?type="+method, http.StatusSeeOther)
+			return
+
+		case "regenerate_recovery_codes":
+			if !currentUser.TwoFAEnabled {
+				data["Error"] = "Enable two-factor authentication before generating recovery codes"
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
+			// Replace all existing codes; old ones stop working immediately
+			codes, err := models.ReplaceRecoveryCodes(currentUser.ID)
+			if err != nil {
+				data["Error"] = "Failed to generate recovery codes: " + err.Error()
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
+			data["RecoveryCodes"] = codes
+			data["RecoveryCodesRemaining"] = len(codes)
+			data["Success"] = "New recovery codes generated. Your previous codes no longer work."
+
+		case "revoke_session":
+			handle := r.FormValue("session")
+			if err := models.RevokeSession(currentUser.ID, handle); err != nil {
+				data["Error"] = "Failed to sign out session: " + err.Error()
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
+			data["Success"] = "Session signed out"
+
+		case "revoke_other_sessions":
+			revoked, err := models.RevokeUserSessions(currentUser.ID, session.ID)
+			if err != nil {
+				data["Error"] = "Failed to sign out other sessions: " + err.Error()
+				renderUserSettingsTemplate(w, data)
+				return
+			}
+
+			data["Success"] = fmt.Sprintf("Signed out of %d other session(s)", revoked)
+
+		case "create_token":
+			createPersonalToken(r, currentUser, data)
+
+		case "revoke_token":
+			revokePersonalToken(r, currentUser, data)
+
+		case "toggle_webauthn":
+			// Toggle security key authentication status
+			if currentUser.WebAuthnEnabled {
+				if msg := mfaPolicyBlocksChange(currentUser, func(u *models.User) { u.WebAuthnEnabled = false }); msg != "" {
+					data["Error"] = msg
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+
+				// Disable security key authentication
+				currentUser.WebAuthnEnabled = false
+
+				err = models.UpdateUser(currentUser)
+				if err != nil {
+					data["Error"] = "Failed to disable security keys: " + err.Error()
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+
+				recordUserAudit(r, models.AuditFactorRemoved, currentUser, map[string]interface{}{"factor": utils.FactorWebAuthn})
+
+				// Update session
+				session.Values["webauthn_enabled"] = false
+				session.Save(r, w)
+
+				// Also forget the registered keys
+				delete(data, "SecurityKeys")
+				if err := models.DeleteWebAuthnCredentials(currentUser.ID); err != nil {
+					data["Warning"] = "Security keys disabled, but there was an error deleting them: " + err.Error()
+				} else {
+					data["Success"] = "Security key authentication has been disabled"
+				}
+			} else {
+				// To enable security keys, redirect to the setup page
+				http.Redirect(w, r, "/setup-webauthn", http.StatusSeeOther)
+				return
+			}
+
 		case "toggle_face_auth":
 			// Toggle face authentication status
 			if currentUser.FaceAuthEnabled {
-				// Disable face authentication
-				currentUser.FaceAuthEnabled = false
-				
-				err = models.UpdateUser(currentUser)
+				if msg := mfaPolicyBlocksChange(currentUser, func(u *models.User) { u.FaceAuthEnabled = false }); msg != "" {
+					data["Error"] = msg
+					renderUserSettingsTemplate(w, data)
+					return
+				}
+
+				// Disable face authentication and delete the enrolled face
+				err = models.DisableFaceAuth(currentUser)
 				if err != nil {
 					data["Error"] = "Failed to disable face authentication: " + err.Error()
 					renderUserSettingsTemplate(w, data)
 					return
 				}
 				
+				recordUserAudit(r, models.AuditFactorRemoved, currentUser, map[string]interface{}{"factor": utils.FactorFace})
+
 				// Update session
 				session.Values["face_auth_enabled"] = false
 				session.Save(r, w)
 				
-				// Also delete face data
-				if err := utils.DeleteFaceData(currentUser.ID); err != nil {
-					// Just log the error, don't stop the process
-					// The face auth is already disabled in the database
-					data["Warning"] = "Face authentication disabled, but there was an error deleting face data: " + err.Error()
-				} else {
-					data["Success"] = "Face authentication has been disabled"
-				}
+				data["Success"] = "Face authentication has been disabled"
 			} else {
 				// To enable face authentication, redirect to the setup page
 				http.Redirect(w, r, "/setup-face", http.StatusSeeOther)
@@ -200,6 +404,62 @@ func UserSettingsHandler(w http.ResponseWriter, r *http.Request) {
 	renderUserSettingsTemplate(w, data)
 }
 
+// Helper function to check whether a settings action needs the current password
+func settingsActionNeedsPassword(action string, isOAuthUser bool) bool {
+	switch action {
+	case "toggle_2fa", "toggle_face_auth", "toggle_webauthn",
+		"revoke_session", "revoke_other_sessions",
+		"resend_verification", "cancel_email_change", "choose_2fa_method",
+		"create_token", "revoke_token":
+		return false
+	case "change_password", "regenerate_recovery_codes":
+		// OAuth users may not have a password to confirm
+		return !isOAuthUser
+	}
+	return true
+}
+
+// Helper function to check whether a settings action needs a recent verification
+func sensitiveSettingsAction(action string, user *models.User) bool {
+	switch action {
+	case "change_email", "change_password", "regenerate_recovery_codes", "create_token":
+		return true
+	case "toggle_2fa", "choose_2fa_method":
+		return user.TwoFAEnabled
+	case "toggle_face_auth":
+		return user.FaceAuthEnabled
+	case "toggle_webauthn":
+		return user.WebAuthnEnabled
+	}
+	return false
+}
+
+// Helper function to check whether disabling a factor would break an enforced MFA policy.
+// It returns a message to show, or an empty string if the change is allowed.
+func mfaPolicyBlocksChange(user *models.User, change func(*models.User)) string {
+	changed := *user
+	change(&changed)
+
+	violation, err := mfaPolicyViolation(&changed)
+	if err != nil {
+		return "This change can't be made right now because the security policies couldn't be checked"
+	}
+	if violation != nil && violation.Enforced() {
+		return "This change isn't allowed by a security policy: " + violation.Reason
+	}
+	return ""
+}
+
+// Helper function to sign out every session of a user except the current one
+func revokeOtherSessions(session *sessions.Session, userID int, reason string) {
+	revoked, err := models.RevokeUserSessions(userID, session.ID)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %d after %s: %v", userID, reason, err)
+		return
+	}
+	log.Printf("Revoked %d other session(s) for user %d after %s", revoked, userID, reason)
+}
+
 func renderUserSettingsTemplate(w http.ResponseWriter, data map[string]interface{}) {
 	tmpl, err := template.ParseFiles("templates/user-settings.html")
 	if err != nil {
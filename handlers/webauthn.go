@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+)
+
+// Session keys holding the in-progress WebAuthn ceremony data
+const (
+	webAuthnRegistrationKey = "webauthn_registration_session"
+	webAuthnLoginKey        = "webauthn_login_session"
+)
+
+// errNotAuthenticated is returned when the session has no fully authenticated user
+var errNotAuthenticated = errors.New("not authenticated")
+
+// SetupWebAuthnHandler displays the security key registration page
+func SetupWebAuthnHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	// The user is signed in, or their login waits for them to meet an MFA policy
+	_, flow, err := enrollingUser(session)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// A security key is a lasting way to sign in, so a signed-in user must
+	// have verified themselves recently to add one
+	if flow == nil && !requireRecentAuth(w, r, session, r.URL.RequestURI()) {
+		return
+	}
+
+	renderWebAuthnPage(w, "", true)
+}
+
+// WebAuthnRegisterBeginHandler starts a registration ceremony for the current user
+func WebAuthnRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	user, flow, err := enrollingUser(session)
+	if err != nil {
+		sendJSONError(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if flow == nil && !utils.RecentlyAuthenticated(session) {
+		sendJSONError(w, "Please confirm your identity again before adding a security key", http.StatusForbidden)
+		return
+	}
+
+	waUser, err := models.GetWebAuthnUser(user)
+	if err != nil {
+		sendJSONError(w, "Failed to load security keys", http.StatusInternalServerError)
+		return
+	}
+
+	// Don't let the same authenticator be registered twice
+	exclusions := webauthn.Credentials(waUser.Credentials).CredentialDescriptors()
+
+	options, sessionData, err := utils.GetWebAuthn().BeginRegistration(waUser, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		log.Printf("Error beginning WebAuthn registration for user %d: %v", user.ID, err)
+		sendJSONError(w, "Failed to start registration", http.StatusInternalServerError)
+		return
+	}
+
+	if err := storeWebAuthnSession(session, webAuthnRegistrationKey, sessionData); err != nil {
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+	session.Save(r, w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// WebAuthnRegisterFinishHandler verifies the authenticator response and stores the credential
+func WebAuthnRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	user, flow, err := enrollingUser(session)
+	if err != nil {
+		sendJSONError(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if flow == nil && !utils.RecentlyAuthenticated(session) {
+		sendJSONError(w, "Please confirm your identity again before adding a security key", http.StatusForbidden)
+		return
+	}
+
+	sessionData, err := loadWebAuthnSession(session, webAuthnRegistrationKey)
+	if err != nil {
+		sendJSONError(w, "No registration in progress", http.StatusBadRequest)
+		return
+	}
+
+	waUser, err := models.GetWebAuthnUser(user)
+	if err != nil {
+		sendJSONError(w, "Failed to load security keys", http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := utils.GetWebAuthn().FinishRegistration(waUser, *sessionData, r)
+	if err != nil {
+		log.Printf("Error finishing WebAuthn registration for user %d: %v", user.ID, err)
+		sendJSONError(w, "Security key registration failed", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Security key"
+	}
+
+	if err := models.CreateWebAuthnCredential(user.ID, name, credential); err != nil {
+		log.Printf("Error storing WebAuthn credential for user %d: %v", user.ID, err)
+		sendJSONError(w, "Failed to save security key", http.StatusInternalServerError)
+		return
+	}
+
+	// Enable WebAuthn as a login factor
+	if !user.WebAuthnEnabled {
+		user.WebAuthnEnabled = true
+		if err := models.UpdateUser(user); err != nil {
+			sendJSONError(w, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("Registered WebAuthn credential %q for user %d", name, user.ID)
+	recordUserAudit(r, models.AuditFactorEnrolled, user, map[string]interface{}{"factor": utils.FactorWebAuthn, "name": name})
+
+	// Registering the key satisfies it for this session, without counting as a re-authentication
+	delete(session.Values, webAuthnRegistrationKey)
+	redirect := "/user/settings"
+	if flow != nil {
+		// Sign in now, or move on if a policy still isn't met
+		redirect, err = finishEnrollment(w, r, session, flow, utils.FactorWebAuthn)
+		if err != nil {
+			log.Printf("Error advancing login for user %d: %v", user.ID, err)
+			sendJSONError(w, "Session error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		session.Values["webauthn_enabled"] = true
+		utils.MarkEnrolledFactor(session, utils.FactorWebAuthn)
+	}
+	session.Save(r, w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Security key registered",
+		"redirect": redirect,
+	})
+}
+
+// VerifyWebAuthnHandler displays the security key verification page during login
+func VerifyWebAuthnHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	if _, redirect := loginStep(session, utils.FactorWebAuthn); redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	renderWebAuthnPage(w, "", false)
+}
+
+// WebAuthnLoginBeginHandler starts an assertion ceremony for the pending login
+func WebAuthnLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	flow, redirect := loginStep(session, utils.FactorWebAuthn)
+	if redirect != "" {
+		sendJSONError(w, "No pending authentication", http.StatusBadRequest)
+		return
+	}
+	user := flow.User
+
+	// Refuse the attempt if the account or IP address is throttled
+	if msg := authThrottleMessage(r, user.Email); msg != "" {
+		sendJSONError(w, msg, http.StatusTooManyRequests)
+		return
+	}
+
+	waUser, err := models.GetWebAuthnUser(user)
+	if err != nil || len(waUser.Credentials) == 0 {
+		sendJSONError(w, "No security keys registered", http.StatusBadRequest)
+		return
+	}
+
+	options, sessionData, err := utils.GetWebAuthn().BeginLogin(waUser)
+	if err != nil {
+		log.Printf("Error beginning WebAuthn login for user %d: %v", user.ID, err)
+		sendJSONError(w, "Failed to start verification", http.StatusInternalServerError)
+		return
+	}
+
+	if err := storeWebAuthnSession(session, webAuthnLoginKey, sessionData); err != nil {
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+	session.Save(r, w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// WebAuthnLoginFinishHandler verifies the assertion and continues the login flow
+func WebAuthnLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := utils.GetSession(r)
+
+	flow, redirect := loginStep(session, utils.FactorWebAuthn)
+	if redirect != "" {
+		sendJSONError(w, "No pending authentication", http.StatusBadRequest)
+		return
+	}
+	user := flow.User
+
+	sessionData, err := loadWebAuthnSession(session, webAuthnLoginKey)
+	if err != nil {
+		sendJSONError(w, "No verification in progress", http.StatusBadRequest)
+		return
+	}
+	// A challenge can only be answered once
+	delete(session.Values, webAuthnLoginKey)
+
+	waUser, err := models.GetWebAuthnUser(user)
+	if err != nil {
+		sendJSONError(w, "Failed to load security keys", http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := utils.GetWebAuthn().FinishLogin(waUser, *sessionData, r)
+	if err != nil {
+		log.Printf("WebAuthn verification failed for user %d: %v", user.ID, err)
+		recordAuthFailure(r, models.AuditLogin, user.Email, utils.FactorWebAuthn)
+		session.Save(r, w)
+		sendJSONError(w, "Security key verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	// A sign count that didn't increase means the key may have been cloned. The
+	// stored count is left alone so the original key keeps being compared against it.
+	if credential.Authenticator.CloneWarning {
+		log.Printf("Warning: sign count for a WebAuthn credential of user %d did not increase, rejecting a possibly cloned authenticator", user.ID)
+		if err := models.RecordLoginFailure(user.Email, utils.ClientIP(r)); err != nil {
+			log.Printf("Error recording authentication failure for %s: %v", user.Email, err)
+		}
+		recordAudit(r, models.AuditLogin, models.AuditFailure, 0, user.ID, map[string]interface{}{
+			"email":  user.Email,
+			"factor": utils.FactorWebAuthn,
+			"reason": "cloned_authenticator",
+		})
+		session.Save(r, w)
+		sendJSONError(w, "Security key verification failed", http.StatusUnauthorized)
+		return
+	}
+
+	releaseAuthAttempt(r, user.Email)
+
+	// Track the sign count so a cloned authenticator can be detected next time,
+	// in the same transaction that completes the step
+	_, err = flow.Complete(utils.FactorWebAuthn, utils.FactorWebAuthn, func(tx *sql.Tx) (bool, error) {
+		return true, models.UpdateWebAuthnCredentialUsage(tx, user.ID, credential)
+	})
+	if err != nil {
+		log.Printf("Error completing security key step for user %d: %v", user.ID, err)
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+
+	// Continue with the next factor, or finish the login
+	next, err := advanceLogin(w, r, session, flow)
+	if err != nil {
+		log.Printf("Error advancing login for user %d: %v", user.ID, err)
+		sendJSONError(w, "Session error", http.StatusInternalServerError)
+		return
+	}
+	session.Save(r, w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"message":  "Security key verified",
+		"redirect": next,
+	})
+}
+
+// Helper function to get the fully authenticated user from the session
+func currentSessionUser(session *sessions.Session) (*models.User, error) {
+	auth, ok := session.Values["authenticated"].(bool)
+	if !ok || !auth {
+		return nil, errNotAuthenticated
+	}
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		return nil, errNotAuthenticated
+	}
+
+	return models.GetUserByIDSafe(userID)
+}
+
+// Helper function to store WebAuthn ceremony data in the session
+func storeWebAuthnSession(session *sessions.Session, key string, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	session.Values[key] = string(encoded)
+	return nil
+}
+
+// Helper function to load WebAuthn ceremony data from the session
+func loadWebAuthnSession(session *sessions.Session, key string) (*webauthn.SessionData, error) {
+	encoded, ok := session.Values[key].(string)
+	if !ok || encoded == "" {
+		return nil, errors.New("missing WebAuthn session data")
+	}
+
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Helper function to render WebAuthn setup/verification page
+func renderWebAuthnPage(w http.ResponseWriter, errorMsg string, isSetup bool) {
+	var templateFile string
+	if isSetup {
+		templateFile = "templates/setup-webauthn.html"
+	} else {
+		templateFile = "templates/verify-webauthn.html"
+	}
+
+	tmpl, err := template.ParseFiles(templateFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Error": errorMsg,
+	}
+
+	tmpl.Execute(w, data)
+}
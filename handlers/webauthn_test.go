@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// testAuthenticator is a software security key with a P-256 key pair
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	return &testAuthenticator{t: t, key: key, credentialID: credentialID}
+}
+
+// clientData returns the client data the browser would send for a ceremony
+func (a *testAuthenticator) clientData(ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      string(ceremony),
+		"challenge": challenge.String(),
+		"origin":    utils.GetWebAuthn().Config.RPOrigins[0],
+	})
+	if err != nil {
+		a.t.Fatalf("marshal client data: %v", err)
+	}
+	return data
+}
+
+// authData returns authenticator data for the relying party with the given flags
+func (a *testAuthenticator) authData(flags protocol.AuthenticatorFlags, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(utils.GetWebAuthn().Config.RPID))
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+// register answers a registration challenge with a "none" attestation
+func (a *testAuthenticator) register(options protocol.CredentialCreation) []byte {
+	a.t.Helper()
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal public key: %v", err)
+	}
+
+	// AAGUID, credential ID length and ID, then the public key
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	flags := protocol.FlagUserPresent | protocol.FlagUserVerified | protocol.FlagAttestedCredentialData
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(flags, attested),
+	})
+	if err != nil {
+		a.t.Fatalf("marshal attestation: %v", err)
+	}
+
+	return a.response(map[string]string{
+		"clientDataJSON":    encodeURL(a.clientData(protocol.CreateCeremony, options.Response.Challenge)),
+		"attestationObject": encodeURL(attestation),
+	})
+}
+
+// assert answers a login challenge, signing with the given sign count
+func (a *testAuthenticator) assert(options protocol.CredentialAssertion, signCount uint32) []byte {
+	a.t.Helper()
+
+	a.signCount = signCount
+	clientData := a.clientData(protocol.AssertCeremony, options.Response.Challenge)
+	authData := a.authData(protocol.FlagUserPresent|protocol.FlagUserVerified, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatalf("SignASN1: %v", err)
+	}
+
+	return a.response(map[string]string{
+		"clientDataJSON":    encodeURL(clientData),
+		"authenticatorData": encodeURL(authData),
+		"signature":         encodeURL(signature),
+	})
+}
+
+// response wraps an authenticator response in the credential the browser posts
+func (a *testAuthenticator) response(response map[string]string) []byte {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":       encodeURL(a.credentialID),
+		"rawId":    encodeURL(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		a.t.Fatalf("marshal credential: %v", err)
+	}
+	return body
+}
+
+func encodeURL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// webAuthnRequest calls a handler with the session cookie and JSON body,
+// replacing the cookie if the handler issued a new one
+func webAuthnRequest(t *testing.T, handler http.HandlerFunc, cookie **http.Cookie, path string, body []byte, out interface{}) int {
+	t.Helper()
+
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(*cookie)
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == (*cookie).Name {
+			*cookie = c
+		}
+	}
+	if out != nil && rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s response: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+// pendingLoginCookie starts a login for a user after their password and returns its session cookie
+func pendingLoginCookie(t *testing.T, user *models.User) *http.Cookie {
+	t.Helper()
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	session, err := utils.GetSession(r)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if _, err := authflow.Start(session, user, utils.FactorPassword); err != nil {
+		t.Fatalf("authflow.Start: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := utils.SaveSession(session, rec, r); err != nil {
+		t.Fatalf("SaveSession: %v", err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+// loginWithKey runs a login ceremony with the key and returns the finish status
+func loginWithKey(t *testing.T, user *models.User, key *testAuthenticator, signCount uint32) int {
+	t.Helper()
+
+	cookie := pendingLoginCookie(t, user)
+	var options protocol.CredentialAssertion
+	if code := webAuthnRequest(t, WebAuthnLoginBeginHandler, &cookie, "/webauthn/login/begin", nil, &options); code != http.StatusOK {
+		t.Fatalf("login begin status %d", code)
+	}
+	return webAuthnRequest(t, WebAuthnLoginFinishHandler, &cookie, "/webauthn/login/finish", key.assert(options, signCount), nil)
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	setupTestDB(t)
+
+	user := createTestUser(t, "user@example.com")
+	key := newTestAuthenticator(t)
+	cookie := signedInCookie(t, user, time.Minute)
+
+	var options protocol.CredentialCreation
+	if code := webAuthnRequest(t, WebAuthnRegisterBeginHandler, &cookie, "/webauthn/register/begin", nil, &options); code != http.StatusOK {
+		t.Fatalf("register begin status %d", code)
+	}
+	body := key.register(options)
+
+	var result map[string]interface{}
+	if code := webAuthnRequest(t, WebAuthnRegisterFinishHandler, &cookie, "/webauthn/register/finish?name=Laptop", body, &result); code != http.StatusOK {
+		t.Fatalf("register finish status %d", code)
+	}
+	if result["success"] != true {
+		t.Errorf("register finish = %v", result)
+	}
+
+	credentials, err := models.GetWebAuthnCredentialsByUserID(user.ID)
+	if err != nil || len(credentials) != 1 {
+		t.Fatalf("GetWebAuthnCredentialsByUserID = (%d credentials, %v), want 1", len(credentials), err)
+	}
+	if credentials[0].Name != "Laptop" || !bytes.Equal(credentials[0].Credential.ID, key.credentialID) {
+		t.Errorf("stored credential %q with ID %x", credentials[0].Name, credentials[0].Credential.ID)
+	}
+	if stored, _ := models.GetUserByID(user.ID); !stored.WebAuthnEnabled {
+		t.Error("WebAuthn was not enabled for the user")
+	}
+
+	// The challenge was used up, so the same response can't register again
+	if code := webAuthnRequest(t, WebAuthnRegisterFinishHandler, &cookie, "/webauthn/register/finish", body, nil); code != http.StatusBadRequest {
+		t.Errorf("replayed registration status %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	setupTestDB(t)
+
+	user := createTestUser(t, "user@example.com")
+	key := newTestAuthenticator(t)
+	if err := models.CreateWebAuthnCredential(user.ID, "Laptop", storedTestCredential(t, user, key)); err != nil {
+		t.Fatalf("CreateWebAuthnCredential: %v", err)
+	}
+	user.WebAuthnEnabled = true
+	if err := models.UpdateUser(user); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+
+	// The steps run in order against the same stored credential
+	tests := []struct {
+		name          string
+		key           *testAuthenticator
+		signCount     uint32
+		wantStatus    int
+		wantSignCount uint32
+	}{
+		{"first use", key, 5, http.StatusOK, 5},
+		{"sign count increased", key, 6, http.StatusOK, 6},
+		{"sign count repeated by a clone", key, 6, http.StatusUnauthorized, 6},
+		{"sign count went back", key, 2, http.StatusUnauthorized, 6},
+		{"original key again", key, 7, http.StatusOK, 7},
+		{"unregistered key", newTestAuthenticator(t), 8, http.StatusUnauthorized, 7},
+	}
+
+	for _, tt := range tests {
+		// Wait out the progressive delay after the failures before
+		if _, err := database.DB.Exec(`UPDATE auth_failures SET last_failure = datetime('now', '-1 hour')`); err != nil {
+			t.Fatalf("backdate failures: %v", err)
+		}
+		if code := loginWithKey(t, user, tt.key, tt.signCount); code != tt.wantStatus {
+			t.Errorf("%s: login finish status %d, want %d", tt.name, code, tt.wantStatus)
+		}
+
+		credentials, err := models.GetWebAuthnCredentialsByUserID(user.ID)
+		if err != nil || len(credentials) != 1 {
+			t.Fatalf("%s: GetWebAuthnCredentialsByUserID = (%d credentials, %v)", tt.name, len(credentials), err)
+		}
+		if credentials[0].SignCount != tt.wantSignCount {
+			t.Errorf("%s: stored sign count %d, want %d", tt.name, credentials[0].SignCount, tt.wantSignCount)
+		}
+	}
+
+	// Rejected clones are recorded in the audit log
+	events, err := models.GetAuditEvents(models.AuditFilter{EventType: models.AuditLogin, Outcome: models.AuditFailure, UserID: user.ID})
+	if err != nil {
+		t.Fatalf("GetAuditEvents: %v", err)
+	}
+	clones := 0
+	for _, event := range events {
+		if event.Details["reason"] == "cloned_authenticator" {
+			clones++
+		}
+	}
+	if clones != 2 {
+		t.Errorf("%d cloned authenticator failures recorded, want 2", clones)
+	}
+}
+
+// storedTestCredential registers a key directly with the relying party, as
+// a completed registration ceremony would have stored it
+func storedTestCredential(t *testing.T, user *models.User, key *testAuthenticator) *webauthn.Credential {
+	t.Helper()
+
+	waUser := &utils.WebAuthnUser{ID: user.ID, Name: user.Email}
+	options, sessionData, err := utils.GetWebAuthn().BeginRegistration(waUser)
+	if err != nil {
+		t.Fatalf("BeginRegistration: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/webauthn/register/finish", bytes.NewReader(key.register(*options)))
+	r.Header.Set("Content-Type", "application/json")
+
+	parsed, err := protocol.ParseCredentialCreationResponse(r)
+	if err != nil {
+		t.Fatalf("ParseCredentialCreationResponse: %v", err)
+	}
+	credential, err := utils.GetWebAuthn().CreateCredential(waUser, *sessionData, parsed)
+	if err != nil {
+		t.Fatalf("CreateCredential: %v", err)
+	}
+	return credential
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/aungh/login-form/authflow"
 	"github.com/aungh/login-form/database"
 	"github.com/aungh/login-form/handlers"
 	"github.com/aungh/login-form/middleware"
@@ -16,6 +19,55 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// checkProductionSafety refuses to run in production with demo credentials left in the database
+func checkProductionSafety() error {
+	if utils.IsDevelopment() {
+		return nil
+	}
+
+	demoUser, err := models.GetUserByEmailSafe(utils.DemoAdminEmail)
+	if err == nil && utils.CheckPasswordHash(utils.DemoPassword, demoUser.PasswordHash) {
+		return fmt.Errorf("demo account %s still uses the default password; change or delete it, or set APP_ENV=%s",
+			utils.DemoAdminEmail, utils.EnvDevelopment)
+	}
+
+	if err := utils.ValidateBaseURL(); err != nil {
+		return err
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" && !strings.HasPrefix(issuer, "https://") {
+		return fmt.Errorf("OIDC_ISSUER %q must be an https URL", issuer)
+	}
+	if err := utils.ValidateMailDriver(); err != nil {
+		return err
+	}
+	if err := utils.ValidateEmailVerificationKey(); err != nil {
+		return err
+	}
+
+	if os.Getenv("SESSION_KEY") == "" {
+		return fmt.Errorf("SESSION_KEY must be set; without it sessions are signed with a well-known default key")
+	}
+
+	return nil
+}
+
+// printEnvironmentBanner logs the environment and any demo behaviors that are active
+func printEnvironmentBanner() {
+	behaviors := utils.DemoBehaviors()
+	if len(behaviors) == 0 {
+		log.Printf("Running in %s mode", utils.AppEnv())
+		return
+	}
+
+	log.Println("==============================================================")
+	log.Printf("Running in %s mode. These demo behaviors are active:", utils.AppEnv())
+	for _, behavior := range behaviors {
+		log.Printf("  - %s", behavior)
+	}
+	log.Println("Never use development mode in production.")
+	log.Println("==============================================================")
+}
+
 // createDemoUserIfNeeded creates a demo user if no users exist
 func createDemoUserIfNeeded() error {
 	// Check if we already have users
@@ -30,7 +82,7 @@ func createDemoUserIfNeeded() error {
 	}
 
 	// Create a demo user
-	hashedPassword, err := utils.HashPassword("password")
+	hashedPassword, err := utils.HashPassword(utils.DemoPassword)
 	if err != nil {
 		return err
 	}
@@ -38,53 +90,217 @@ func createDemoUserIfNeeded() error {
 	demoUser := models.User{
 		Username:        "Tester",
 		Nickname:        "DemoUser",
-		Email:           "testing@sample.com",
-		Role: 			 "admin",
+		Email:           utils.DemoAdminEmail,
+		Role:            models.RoleAdmin,
 		PasswordHash:    hashedPassword,
 		TwoFAEnabled:    false,
 		FaceAuthEnabled: false,
+		EmailVerified:   true,
 		CreatedAt:       time.Now(),
 	}
 
 	return models.CreateUser(&demoUser)
 }
 
+// testSocialUserHandler creates a test user for social login
+func testSocialUserHandler(w http.ResponseWriter, r *http.Request) {
+	// Create a test user for social login
+	hashedPassword, err := utils.HashPassword("test_password")
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	testUser := &models.User{
+		Username:        "Social Test User",
+		Nickname:        "SocialTester",
+		Email:           "social_test@example.com",
+		PasswordHash:    hashedPassword,
+		GoogleID:        "test_google_id",
+		GithubID:        "",
+		ProfileImage:    "",
+		TwoFASecret:     "",
+		TwoFAEnabled:    false,
+		FaceAuthEnabled: false,
+		Role:            "user",
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	// Try to create the user directly using database package
+	query := `
+	INSERT INTO users (
+		username, nickname, email, password_hash, google_id, github_id, 
+		profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
+		role, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := database.DB.Exec(
+		query,
+		testUser.Username,
+		testUser.Nickname,
+		testUser.Email,
+		testUser.PasswordHash,
+		testUser.GoogleID,
+		testUser.GithubID,
+		testUser.ProfileImage,
+		testUser.TwoFASecret,
+		testUser.TwoFAEnabled,
+		testUser.FaceAuthEnabled,
+		testUser.Role,
+		testUser.CreatedAt,
+		testUser.UpdatedAt,
+	)
+
+	if err != nil {
+		http.Error(w, "Failed to create test user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the user ID
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Failed to get last insert ID: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Test social login user created successfully with ID: %d", id)
+}
+
 func main() {
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "list pending database migrations and exit")
+	reencryptSecrets := flag.Bool("reencrypt-secrets", false, "re-encrypt stored secrets under the active encryption key and exit")
+	flag.Parse()
+
 	// Load environment variables from .env file
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Warning: .env file not found, using default configuration")
 	}
 
+	// Demo behaviors are only available in development mode
+	if err := utils.ValidateAppEnv(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	// Initialize SQLite database
 	if err := database.InitDB(); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.CloseDB()
 	log.Println("SQLite database initialized successfully")
-	
+
+	// List pending migrations without applying them
+	if *migrateDryRun {
+		statuses, err := database.GetMigrationStatus()
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+		return
+	}
+
 	// Run database migrations
 	if err := database.MigrateDB(); err != nil {
 		log.Fatalf("Failed to run database migrations: %v", err)
 	}
 	log.Println("Database migrations completed successfully")
 
-	// Initialize face storage
-	if err := utils.InitFaceStorage(); err != nil {
-		log.Printf("Warning: Failed to initialize face storage: %v", err)
+	// Load the keys that encrypt secrets at rest
+	if err := utils.InitEncryptionKeys(); err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+
+	// Rotate to the active key after a new one was added to ENCRYPTION_KEYS
+	if *reencryptSecrets {
+		count, err := models.ReencryptTOTPSecrets()
+		if err != nil {
+			log.Fatalf("Failed to re-encrypt 2FA secrets: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d 2FA secrets under key %q\n", count, utils.ActiveEncryptionKeyID())
+
+		count, err = models.RewrapFaceTemplateKeys()
+		if err != nil {
+			log.Fatalf("Failed to re-encrypt face template keys: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d face template keys under key %q\n", count, utils.ActiveEncryptionKeyID())
+
+		count, err = models.ReencryptOIDCSigningKeys()
+		if err != nil {
+			log.Fatalf("Failed to re-encrypt OIDC signing keys: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d OIDC signing keys under key %q\n", count, utils.ActiveEncryptionKeyID())
+		return
+	}
+
+	// Encrypt 2FA secrets left in plaintext by older versions
+	count, err := models.EncryptTOTPSecrets()
+	if err != nil {
+		log.Fatalf("Failed to encrypt 2FA secrets: %v", err)
+	}
+	if count > 0 {
+		log.Printf("Encrypted %d 2FA secrets that were stored in plaintext", count)
+	}
+
+	// Move face images from the old JSON files into the database. The import
+	// is retried at the next start, so a failure doesn't stop the server.
+	imported, err := models.ImportLegacyFaceData()
+	if err != nil {
+		log.Printf("Error importing face data files: %v", err)
+	}
+	if imported > 0 {
+		log.Printf("Imported %d face templates from %s", imported, utils.LegacyFaceDataDir)
+	}
+
+	// Create the key that signs ID tokens for OpenID Connect clients
+	created, err := models.EnsureOIDCSigningKey()
+	if err != nil {
+		log.Fatalf("Failed to create OIDC signing key: %v", err)
+	}
+	if created {
+		log.Println("Created a new OIDC signing key")
+	}
+
+	// Initialize face matcher
+	utils.InitFaceMatcher()
+
+	// Initialize mailer
+	utils.InitMailer()
+
+	// Initialize delivery of one-time codes by email and SMS
+	utils.InitOTPSenders()
+
+	// Initialize WebAuthn relying party
+	if err := utils.InitWebAuthn(); err != nil {
+		log.Fatalf("Failed to initialize WebAuthn: %v", err)
 	}
 
 	// Initialize session store
 	utils.InitSessionStore()
-	
+
 	// Initialize OAuth with Goth
 	utils.InitGothOAuth()
 
 	// Create a demo user if none exists
-	if err := createDemoUserIfNeeded(); err != nil {
-		log.Printf("Warning: Failed to create demo user: %v", err)
+	if utils.IsDevelopment() {
+		if err := createDemoUserIfNeeded(); err != nil {
+			log.Printf("Warning: Failed to create demo user: %v", err)
+		}
 	}
 
+	// Refuse to serve production traffic with demo credentials in place
+	if err := checkProductionSafety(); err != nil {
+		log.Fatalf("Refusing to start in %s mode: %v", utils.AppEnv(), err)
+	}
+	printEnvironmentBanner()
+
 	// Initialize router
 	r := mux.NewRouter()
 
@@ -102,82 +318,27 @@ func main() {
 			delete(session.Values, "user_id")
 			delete(session.Values, "username")
 			delete(session.Values, "email")
+			utils.ClearAuthState(session)
+			authflow.Abandon(session)
 			session.Save(r, w)
 		}
 
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	})
 
-	// Test route to create a social login user
-	r.HandleFunc("/test-social-user", func(w http.ResponseWriter, r *http.Request) {
-		// Create a test user for social login
-		hashedPassword, err := utils.HashPassword("test_password")
-		if err != nil {
-			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
-			return
-		}
-
-		testUser := &models.User{
-			Username:        "Social Test User",
-			Nickname:        "SocialTester",
-			Email:           "social_test@example.com",
-			PasswordHash:    hashedPassword,
-			GoogleID:        "test_google_id",
-			GithubID:        "",
-			ProfileImage:    "",
-			TwoFASecret:     "",
-			TwoFAEnabled:    false,
-			FaceAuthEnabled: false,
-			Role:            "user",
-			CreatedAt:       time.Now(),
-			UpdatedAt:       time.Now(),
-		}
-
-		// Try to create the user directly using database package
-		query := `
-		INSERT INTO users (
-			username, nickname, email, password_hash, google_id, github_id, 
-			profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-			role, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`
-
-		result, err := database.DB.Exec(
-			query,
-			testUser.Username,
-			testUser.Nickname,
-			testUser.Email,
-			testUser.PasswordHash,
-			testUser.GoogleID,
-			testUser.GithubID,
-			testUser.ProfileImage,
-			testUser.TwoFASecret,
-			testUser.TwoFAEnabled,
-			testUser.FaceAuthEnabled,
-			testUser.Role,
-			testUser.CreatedAt,
-			testUser.UpdatedAt,
-		)
-
-		if err != nil {
-			http.Error(w, "Failed to create test user: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Get the user ID
-		id, err := result.LastInsertId()
-		if err != nil {
-			http.Error(w, "Failed to get last insert ID: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		fmt.Fprintf(w, "Test social login user created successfully with ID: %d", id)
-	})
+	// Test route to create a social login user (development mode only)
+	if utils.IsDevelopment() {
+		r.HandleFunc("/test-social-user", testSocialUserHandler)
+	}
 
 	// Public routes (no authentication required)
 	r.HandleFunc("/login", handlers.LoginHandler)
 	r.HandleFunc("/signup", handlers.SignupHandler)
 	r.HandleFunc("/logout", handlers.LogoutHandler)
+	r.HandleFunc("/forgot-password", handlers.ForgotPasswordHandler)
+	r.HandleFunc("/reset-password", handlers.ResetPasswordHandler)
+	r.HandleFunc("/verify-email", handlers.VerifyEmailHandler)
+	r.HandleFunc("/resend-verification", handlers.ResendVerificationHandler)
 	r.HandleFunc("/auth/google", handlers.GoogleAuthHandler)
 	r.HandleFunc("/auth/github", handlers.GithubAuthHandler)
 	// Add explicit callback routes for all possible callback URLs
@@ -185,35 +346,68 @@ func main() {
 	r.HandleFunc("/auth/github/callback", handlers.GithubCallbackHandler)
 
 	// Routes that require basic authentication
-	r.Handle("/home", middleware.RequireAuth(http.HandlerFunc(handlers.HomeHandler)))
+	r.Handle("/home", middleware.RequireFullAuth(middleware.RequireMFACompliance(http.HandlerFunc(handlers.HomeHandler))))
 
 	// 2FA routes
 	r.HandleFunc("/verify-2fa", handlers.Verify2FAHandler) // No auth middleware as this is part of auth flow
-	r.Handle("/setup-2fa", middleware.RequireAuth(http.HandlerFunc(handlers.Setup2FAHandler)))
+	r.Handle("/setup-2fa", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.Setup2FAHandler)))
 	r.HandleFunc("/qrcode", handlers.QRCodeHandler) // QR code image endpoint
 
 	// Face authentication routes
 	r.HandleFunc("/verify-face", handlers.VerifyFaceHandler) // No auth middleware as this is part of auth flow
-	r.Handle("/setup-face", middleware.RequireAuth(http.HandlerFunc(handlers.SetupFaceHandler)))
+	r.Handle("/setup-face", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.SetupFaceHandler)))
 	r.HandleFunc("/api/verify-face", handlers.APIVerifyFaceHandler) // API endpoint for face verification
 
+	// Security key (WebAuthn) routes
+	r.HandleFunc("/verify-webauthn", handlers.VerifyWebAuthnHandler) // No auth middleware as this is part of auth flow
+	r.HandleFunc("/api/webauthn/login/begin", handlers.WebAuthnLoginBeginHandler).Methods("POST")
+	r.HandleFunc("/api/webauthn/login/finish", handlers.WebAuthnLoginFinishHandler).Methods("POST")
+	r.Handle("/setup-webauthn", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.SetupWebAuthnHandler)))
+	r.Handle("/api/webauthn/register/begin", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.WebAuthnRegisterBeginHandler))).Methods("POST")
+	r.Handle("/api/webauthn/register/finish", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.WebAuthnRegisterFinishHandler))).Methods("POST")
+
 	// Keep old routes for backward compatibility
 	r.HandleFunc("/verify-mfa", handlers.Verify2FAHandler)
-	r.Handle("/setup-mfa", middleware.RequireAuth(http.HandlerFunc(handlers.Setup2FAHandler)))
+	r.Handle("/setup-mfa", middleware.RequireEnrollmentAccess(http.HandlerFunc(handlers.Setup2FAHandler)))
 
 	// Captcha route
 	r.HandleFunc("/captcha-image", handlers.CaptchaImageHandler)
 
 	// Admin routes - only user management
-	r.Handle("/admin/users", middleware.RequireAuth(http.HandlerFunc(handlers.AdminUsersHandler)))
+	r.Handle("/admin/users", middleware.RequireFullAuth(middleware.RequireMFACompliance(middleware.RequirePermission(models.PermissionViewUsers)(http.HandlerFunc(handlers.AdminUsersHandler)))))
+	r.Handle("/admin/mfa-policies", middleware.RequireFullAuth(middleware.RequireMFACompliance(middleware.RequirePermission(models.PermissionManageMFA)(http.HandlerFunc(handlers.AdminMFAPoliciesHandler)))))
+	r.Handle("/admin/audit", middleware.RequireFullAuth(middleware.RequireMFACompliance(middleware.RequirePermission(models.PermissionViewAudit)(http.HandlerFunc(handlers.AdminAuditHandler)))))
+	r.Handle("/admin/api-tokens", middleware.RequireFullAuth(middleware.RequireMFACompliance(middleware.RequirePermission(models.PermissionManageAPI)(http.HandlerFunc(handlers.AdminAPITokensHandler)))))
+	r.Handle("/admin/oidc-clients", middleware.RequireFullAuth(middleware.RequireMFACompliance(middleware.RequirePermission(models.PermissionManageOIDC)(http.HandlerFunc(handlers.AdminOIDCClientsHandler)))))
+
+	// User management API, authenticated with admin API tokens
+	r.Handle("/api/v1/users", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionViewUsers)(http.HandlerFunc(handlers.APIListUsersHandler)))).Methods("GET")
+	r.Handle("/api/v1/users", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionManageUsers)(http.HandlerFunc(handlers.APICreateUserHandler)))).Methods("POST")
+	r.Handle("/api/v1/users/{id:[0-9]+}", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionViewUsers)(http.HandlerFunc(handlers.APIGetUserHandler)))).Methods("GET")
+	r.Handle("/api/v1/users/{id:[0-9]+}", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionManageUsers)(http.HandlerFunc(handlers.APIUpdateUserHandler)))).Methods("PATCH")
+	r.Handle("/api/v1/users/{id:[0-9]+}", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionManageUsers)(http.HandlerFunc(handlers.APIDeleteUserHandler)))).Methods("DELETE")
+	r.Handle("/api/v1/users/{id:[0-9]+}/reset-2fa", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionManageUsers)(http.HandlerFunc(handlers.APIResetTwoFAHandler)))).Methods("POST")
+	r.Handle("/api/v1/users/{id:[0-9]+}/disable-face-auth", middleware.RequireAPIToken(middleware.RequireAPIPermission(models.PermissionManageUsers)(http.HandlerFunc(handlers.APIDisableFaceAuthHandler)))).Methods("POST")
+
+	// The signed-in user's own account, with a session or a personal access token
+	r.Handle("/api/v1/me", middleware.RequireBearerOrAuth(models.ScopeProfileRead)(http.HandlerFunc(handlers.APIMeHandler))).Methods("GET")
+	r.Handle("/api/v1/me/logins", middleware.RequireBearerOrAuth(models.ScopeHistoryRead)(http.HandlerFunc(handlers.APIMyLoginsHandler))).Methods("GET")
+
+	// OpenID Connect provider, so other apps can sign users in through this service
+	r.HandleFunc("/.well-known/openid-configuration", handlers.OIDCDiscoveryHandler).Methods("GET")
+	r.HandleFunc("/oauth2/jwks", handlers.OIDCJWKSHandler).Methods("GET")
+	r.HandleFunc("/oauth2/authorize", handlers.OIDCAuthorizeHandler).Methods("GET", "POST")
+	r.HandleFunc("/oauth2/token", handlers.OIDCTokenHandler).Methods("POST")
+	r.HandleFunc("/oauth2/userinfo", handlers.OIDCUserInfoHandler).Methods("GET", "POST")
 
 	// User settings route
-	r.Handle("/user/settings", middleware.RequireAuth(http.HandlerFunc(handlers.UserSettingsHandler)))
+	r.Handle("/user/settings", middleware.RequireFullAuth(middleware.RequireMFACompliance(http.HandlerFunc(handlers.UserSettingsHandler))))
+	r.Handle("/reauth", middleware.RequireFullAuth(http.HandlerFunc(handlers.ReauthHandler)))
 
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
 	if port == "" {
-		port = "8081"
+		port = utils.DefaultPort
 	}
 
 	// Start server
@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// apiContextKey is the type of the request context keys set by the API middleware
+type apiContextKey int
+
+const (
+	apiUserKey apiContextKey = iota
+	apiTokenKey
+	personalTokenKey
+)
+
+// RequireAPIToken middleware authenticates requests to the JSON API with an API
+// token sent as "Authorization: Bearer <token>". The request acts as the user
+// who created the token. Only tokens issued by an admin with api_tokens.manage
+// are accepted; personal access tokens are not, so the registry of API tokens
+// stays the one place to grant and revoke access.
+func RequireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := BearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			sendAPIError(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		apiToken, err := models.AuthenticateAPIToken(token)
+		if err == models.ErrInvalidAPIToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			sendAPIError(w, "Invalid or revoked API token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking API token: %v", err)
+			sendAPIError(w, "Failed to check API token", http.StatusInternalServerError)
+			return
+		}
+
+		// Always read the owner from the database so role changes apply immediately
+		user, err := models.GetUserByIDSafe(apiToken.UserID)
+		if err != nil {
+			log.Printf("API token %d belongs to missing user %d", apiToken.ID, apiToken.UserID)
+			sendAPIError(w, "Invalid or revoked API token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiUserKey, user)
+		ctx = context.WithValue(ctx, apiTokenKey, apiToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireBearerOrAuth middleware accepts a personal access token with the given
+// scope, sent as "Authorization: Bearer <token>", as an alternative to a signed-in
+// session. Requests without a bearer token go through RequireFullAuth.
+func RequireBearerOrAuth(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		sessionAuth := RequireFullAuth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				sessionAuth.ServeHTTP(w, r)
+				return
+			}
+
+			token := BearerToken(r)
+			if token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				sendAPIError(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			servePersonalToken(w, r, token, scope, next)
+		})
+	}
+}
+
+// servePersonalToken authenticates a request with a personal access token that
+// must have a scope, then passes it on as the token's owner
+func servePersonalToken(w http.ResponseWriter, r *http.Request, token, scope string, next http.Handler) {
+	pat, err := models.AuthenticatePersonalAccessToken(token, utils.ClientIP(r))
+	if err == models.ErrInvalidPersonalToken {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+		sendAPIError(w, "Invalid, expired or revoked token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking personal access token: %v", err)
+		sendAPIError(w, "Failed to check token", http.StatusInternalServerError)
+		return
+	}
+
+	if !pat.HasScope(scope) {
+		log.Printf("Personal access token %d of user %d was denied access to %s (requires scope %s)", pat.ID, pat.UserID, r.URL.Path, scope)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="insufficient_scope", scope="`+scope+`"`)
+		sendAPIError(w, "Forbidden - token is missing scope "+scope, http.StatusForbidden)
+		return
+	}
+
+	user, err := models.GetUserByIDSafe(pat.UserID)
+	if err != nil {
+		log.Printf("Personal access token %d belongs to missing user %d", pat.ID, pat.UserID)
+		sendAPIError(w, "Invalid, expired or revoked token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), apiUserKey, user)
+	ctx = context.WithValue(ctx, personalTokenKey, pat)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireAPIPermission middleware checks that the owner of the request's API
+// token has a permission. It must run after RequireAPIToken.
+func RequireAPIPermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := APIUser(r)
+			if user == nil {
+				sendAPIError(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			allowed, err := models.HasPermission(user.Role, permission)
+			if err != nil {
+				log.Printf("Error checking permission %s for user %d: %v", permission, user.ID, err)
+				sendAPIError(w, "Failed to check permissions", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				log.Printf("API token of user %d with role %s was denied access to %s (requires permission %s)", user.ID, user.Role, r.URL.Path, permission)
+				sendAPIError(w, "Forbidden - missing permission "+permission, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIUser returns the user an API request was authenticated as with a token, or nil
+func APIUser(r *http.Request) *models.User {
+	user, _ := r.Context().Value(apiUserKey).(*models.User)
+	return user
+}
+
+// APIToken returns the token an API request was authenticated with, or nil
+func APIToken(r *http.Request) *models.APIToken {
+	token, _ := r.Context().Value(apiTokenKey).(*models.APIToken)
+	return token
+}
+
+// PersonalToken returns the personal access token a request was authenticated with, or nil
+func PersonalToken(r *http.Request) *models.PersonalAccessToken {
+	token, _ := r.Context().Value(personalTokenKey).(*models.PersonalAccessToken)
+	return token
+}
+
+// BearerToken returns the token from a request's "Authorization: Bearer" header, if any
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[len("Bearer "):])
+}
+
+// sendAPIError writes an error in the same envelope as the JSON handlers use
+func sendAPIError(w http.ResponseWriter, errorMsg string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   errorMsg,
+	})
+}
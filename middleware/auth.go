@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/aungh/login-form/authflow"
+	"github.com/aungh/login-form/models"
 	"github.com/aungh/login-form/utils"
 )
 
@@ -29,73 +31,106 @@ func RequireAuth(next http.Handler) http.Handler {
 	})
 }
 
-// Require2FA middleware checks if a user has completed 2FA verification
+// Require2FA middleware checks that a user with 2FA enabled has completed the TOTP step
 func Require2FA(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := utils.GetSession(r)
-		if err != nil {
-			log.Printf("Error getting session in Require2FA middleware: %v", err)
-			http.Error(w, "Session error", http.StatusInternalServerError)
-			return
-		}
+	return requireFactor("2FA", func(user *models.User, state *utils.AuthState) (bool, error) {
+		return !user.TwoFAEnabled || state.HasTwoFactor(), nil
+	}, next)
+}
 
-		// First check if user is authenticated
-		auth, ok := session.Values["authenticated"].(bool)
-		if !ok || !auth {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+// RequireWebAuthn middleware checks that a user with security keys has verified one
+func RequireWebAuthn(next http.Handler) http.Handler {
+	return requireFactor("security key", func(user *models.User, state *utils.AuthState) (bool, error) {
+		return !user.WebAuthnEnabled || state.Has(utils.FactorWebAuthn), nil
+	}, next)
+}
+
+// RequireFaceAuth middleware checks that a user with face authentication has completed it
+func RequireFaceAuth(next http.Handler) http.Handler {
+	return requireFactor("face", func(user *models.User, state *utils.AuthState) (bool, error) {
+		return !user.FaceAuthEnabled || state.Has(utils.FactorFace), nil
+	}, next)
+}
+
+// RequireFullAuth middleware checks if a user has completed all required authentication steps.
+// The steps are the factors registered with the login flow engine. A policy
+// enforced after the user signed in doesn't sign them out; RequireMFACompliance
+// sends them to enroll instead.
+func RequireFullAuth(next http.Handler) http.Handler {
+	return RequireAuth(requireFactor("required", func(user *models.User, state *utils.AuthState) (bool, error) {
+		pending, err := authflow.Pending(user, state)
+		if err != nil {
+			return false, err
 		}
+		return pending == nil || pending.Name() == authflow.EnrollmentStep, nil
+	}, next))
+}
 
-		// Check if 2FA is enabled for this user
-		twoFAEnabled, ok := session.Values["twofa_enabled"].(bool)
-		if ok && twoFAEnabled {
-			// Check if 2FA is verified in this session
-			twoFAVerified, ok := session.Values["twofa_verified"].(bool)
-			if !ok || !twoFAVerified {
-				http.Redirect(w, r, "/verify-2fa", http.StatusSeeOther)
-				return
+// RequireEnrollmentAccess middleware lets through users whose login waits at the
+// MFA enrollment step, so they can set up a factor before they are signed in.
+// Everyone else must be fully authenticated.
+func RequireEnrollmentAccess(next http.Handler) http.Handler {
+	signedIn := RequireFullAuth(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := utils.GetSession(r)
+		if err == nil {
+			if flow, err := authflow.Current(session); err == nil {
+				if step, err := flow.Next(); err == nil && step != nil && step.Name() == authflow.EnrollmentStep {
+					next.ServeHTTP(w, r)
+					return
+				}
 			}
 		}
 
-		// 2FA check passed, proceed to the next handler
-		next.ServeHTTP(w, r)
+		signedIn.ServeHTTP(w, r)
 	})
 }
 
-// RequireFaceAuth middleware checks if a user has completed face authentication
-func RequireFaceAuth(next http.Handler) http.Handler {
+// requireFactor checks the session's authentication state against the factors
+// the user has enabled. A session that is missing a factor, for example because
+// it was enabled from another session, is signed out so the user logs in again
+// through the whole chain. A check that fails with an error stops the request.
+func requireFactor(name string, satisfied func(*models.User, *utils.AuthState) (bool, error), next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session, err := utils.GetSession(r)
 		if err != nil {
-			log.Printf("Error getting session in RequireFaceAuth middleware: %v", err)
+			log.Printf("Error getting session in %s middleware: %v", name, err)
 			http.Error(w, "Session error", http.StatusInternalServerError)
 			return
 		}
 
 		// First check if user is authenticated
 		auth, ok := session.Values["authenticated"].(bool)
-		if !ok || !auth {
+		userID, _ := session.Values["user_id"].(int)
+		if !ok || !auth || userID <= 0 {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
 
-		// Check if face auth is enabled for this user
-		faceAuthEnabled, ok := session.Values["face_auth_enabled"].(bool)
-		if ok && faceAuthEnabled {
-			// Check if face auth is verified in this session
-			faceAuthVerified, ok := session.Values["face_auth_verified"].(bool)
-			if !ok || !faceAuthVerified {
-				http.Redirect(w, r, "/verify-face", http.StatusSeeOther)
-				return
-			}
+		// Read the enabled factors from the database so changes apply immediately
+		user, err := models.GetUserByIDSafe(userID)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		state := utils.GetAuthState(session)
+		ok, err = satisfied(user, state)
+		if err != nil {
+			log.Printf("Error checking the %s factor for user %d: %v", name, user.ID, err)
+			http.Error(w, "Failed to check authentication", http.StatusInternalServerError)
+			return
+		}
+		if state.UserID != user.ID || !state.HasPrimaryFactor() || !ok {
+			log.Printf("Session of user %d has not completed the %s factor, signing out", user.ID, name)
+			session.Values["authenticated"] = false
+			delete(session.Values, "user_id")
+			utils.ClearAuthState(session)
+			session.Save(r, w)
+			http.Redirect(w, r, "/login?msg=reauth", http.StatusSeeOther)
+			return
 		}
 
-		// Face auth check passed, proceed to the next handler
 		next.ServeHTTP(w, r)
 	})
 }
-
-// RequireFullAuth middleware checks if a user has completed all required authentication steps
-func RequireFullAuth(next http.Handler) http.Handler {
-	return RequireAuth(Require2FA(RequireFaceAuth(next)))
-}
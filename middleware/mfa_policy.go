@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/aungh/login-form/models"
+)
+
+// RequireMFACompliance middleware sends users who don't meet an enforced MFA
+// policy to enroll a factor before they can use the page
+func RequireMFACompliance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := sessionUser(w, r)
+		if user == nil {
+			return
+		}
+
+		violation, err := models.CheckMFACompliance(user)
+		if err != nil {
+			log.Printf("Error checking MFA policies for user %d: %v", user.ID, err)
+			http.Error(w, "Failed to check MFA policies", http.StatusInternalServerError)
+			return
+		}
+		if violation != nil && violation.Enforced() {
+			log.Printf("User %d does not meet MFA policy %d (%s), redirecting to enrollment", user.ID, violation.Policy.ID, violation.Reason)
+			http.Redirect(w, r, "/setup-2fa", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/aungh/login-form/models"
+	"github.com/aungh/login-form/utils"
+)
+
+// RequireRole middleware checks that the authenticated user has one of the given roles
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := sessionUser(w, r)
+			if user == nil {
+				return
+			}
+
+			for _, role := range roles {
+				if user.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			log.Printf("User %d with role %s was denied access to %s (requires role %v)", user.ID, user.Role, r.URL.Path, roles)
+			http.Error(w, "Forbidden - insufficient role", http.StatusForbidden)
+		})
+	}
+}
+
+// RequirePermission middleware checks that the authenticated user's role grants a permission
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := sessionUser(w, r)
+			if user == nil {
+				return
+			}
+
+			allowed, err := models.HasPermission(user.Role, permission)
+			if err != nil {
+				log.Printf("Error checking permission %s for user %d: %v", permission, user.ID, err)
+				http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				log.Printf("User %d with role %s was denied access to %s (requires permission %s)", user.ID, user.Role, r.URL.Path, permission)
+				http.Error(w, "Forbidden - missing permission "+permission, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sessionUser loads the authenticated user from the session. It writes a
+// redirect or error response and returns nil if there is none.
+func sessionUser(w http.ResponseWriter, r *http.Request) *models.User {
+	session, err := utils.GetSession(r)
+	if err != nil {
+		log.Printf("Error getting session in role middleware: %v", err)
+		http.Error(w, "Session error", http.StatusInternalServerError)
+		return nil
+	}
+
+	auth, ok := session.Values["authenticated"].(bool)
+	if !ok || !auth {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	// Always read the role from the database so changes apply immediately
+	user, err := models.GetUserByIDSafe(userID)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+
+	return user
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// ErrInvalidAPIToken is returned for unknown or revoked API tokens
+var ErrInvalidAPIToken = errors.New("invalid or revoked API token")
+
+// ErrAPITokenNotFound is returned when a token to revoke does not exist
+var ErrAPITokenNotFound = errors.New("API token not found")
+
+// APIToken is a token for the JSON management API. Requests made with it act
+// with the permissions of the user who created it.
+type APIToken struct {
+	ID         int
+	Name       string
+	UserID     int
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// Revoked reports whether the token can no longer be used
+func (t *APIToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// CreateAPIToken issues a new API token for a user. The token itself is only
+// returned here; just its hash is stored.
+func CreateAPIToken(userID int, name string) (string, *APIToken, error) {
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiToken := &APIToken{Name: name, UserID: userID, CreatedAt: time.Now()}
+	result, err := database.DB.Exec(
+		`INSERT INTO api_tokens (name, token_hash, user_id, created_at) VALUES (?, ?, ?, ?)`,
+		name, utils.HashToken(token), userID, apiToken.CreatedAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	apiToken.ID = int(id)
+
+	return token, apiToken, nil
+}
+
+// AuthenticateAPIToken returns the active token matching a presented token and
+// records that it was used
+func AuthenticateAPIToken(token string) (*APIToken, error) {
+	apiToken := &APIToken{}
+	var lastUsedAt sql.NullTime
+	err := database.DB.QueryRow(
+		`SELECT id, name, user_id, created_at, last_used_at FROM api_tokens WHERE token_hash = ? AND revoked_at IS NULL`,
+		utils.HashToken(token),
+	).Scan(&apiToken.ID, &apiToken.Name, &apiToken.UserID, &apiToken.CreatedAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	apiToken.LastUsedAt = time.Now()
+	if _, err := database.DB.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, apiToken.LastUsedAt, apiToken.ID); err != nil {
+		return nil, err
+	}
+
+	return apiToken, nil
+}
+
+// GetAPITokens returns all API tokens, including revoked ones, newest first
+func GetAPITokens() ([]*APIToken, error) {
+	rows, err := database.DB.Query(
+		`SELECT id, name, user_id, created_at, last_used_at, revoked_at FROM api_tokens ORDER BY created_at DESC, id DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*APIToken, 0)
+	for rows.Next() {
+		token := &APIToken{}
+		var lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&token.ID, &token.Name, &token.UserID, &token.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = lastUsedAt.Time
+		token.RevokedAt = revokedAt.Time
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken stops a token from being used. Revoked tokens are kept so the
+// list still shows who had access.
+func RevokeAPIToken(id int) error {
+	result, err := database.DB.Exec(
+		`UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
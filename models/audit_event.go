@@ -0,0 +1,262 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+// Audit event types
+const (
+	AuditLogin                = "login"
+	AuditReauth               = "reauth"
+	AuditFactorEnrolled       = "factor_enrolled"
+	AuditFactorRemoved        = "factor_removed"
+	AuditPasswordChanged      = "password_changed"
+	AuditEmailChanged         = "email_changed"
+	AuditOAuthLinked          = "oauth_linked"
+	AuditRoleChanged          = "role_changed"
+	AuditUserDeleted          = "user_deleted"
+	AuditUserCreated          = "user_created"
+	AuditTwoFAReset           = "twofa_reset"
+	AuditAPITokenCreated      = "api_token_created"
+	AuditAPITokenRevoked      = "api_token_revoked"
+	AuditPersonalTokenCreated = "personal_token_created"
+	AuditPersonalTokenRevoked = "personal_token_revoked"
+	AuditOIDCAuthorized       = "oidc_authorized"
+	AuditOIDCClientCreated    = "oidc_client_created"
+	AuditOIDCClientUpdated    = "oidc_client_updated"
+	AuditOIDCClientDeleted    = "oidc_client_deleted"
+	AuditAccountUnlocked      = "account_unlocked"
+)
+
+// AuditEventTypes lists the event types in the order they are offered as filters
+var AuditEventTypes = []string{
+	AuditLogin,
+	AuditReauth,
+	AuditFactorEnrolled,
+	AuditFactorRemoved,
+	AuditPasswordChanged,
+	AuditEmailChanged,
+	AuditOAuthLinked,
+	AuditRoleChanged,
+	AuditUserDeleted,
+	AuditUserCreated,
+	AuditTwoFAReset,
+	AuditAPITokenCreated,
+	AuditAPITokenRevoked,
+	AuditPersonalTokenCreated,
+	AuditPersonalTokenRevoked,
+	AuditOIDCAuthorized,
+	AuditOIDCClientCreated,
+	AuditOIDCClientUpdated,
+	AuditOIDCClientDeleted,
+	AuditAccountUnlocked,
+}
+
+// Audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// maxAuditExport is the largest number of events returned by one query
+const maxAuditExport = 10000
+
+// AuditEvent is an entry in the security audit log
+type AuditEvent struct {
+	ID int64 `json:"id"`
+	// ActorUserID is the user who performed the action, or 0 if unknown
+	ActorUserID int `json:"actor_user_id"`
+	// TargetUserID is the account the action affected, or 0 if unknown
+	TargetUserID int                    `json:"target_user_id"`
+	EventType    string                 `json:"event_type"`
+	IPAddress    string                 `json:"ip"`
+	UserAgent    string                 `json:"user_agent"`
+	Outcome      string                 `json:"outcome"`
+	Details      map[string]interface{} `json:"details"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// DetailsJSON returns the details as a JSON object
+func (e *AuditEvent) DetailsJSON() string {
+	if len(e.Details) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(e.Details)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// LoginRecord is a successful login as shown in a user's login history
+type LoginRecord struct {
+	Time      time.Time `json:"time"`
+	IPAddress string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	// Method is the first factor, password or oauth
+	Method    string   `json:"method"`
+	Factors   []string `json:"factors"`
+	NewDevice bool     `json:"new_device"`
+}
+
+// AuditFilter selects events from the audit log. Zero values match everything.
+type AuditFilter struct {
+	EventType string
+	Outcome   string
+	// UserID matches events where the user is either the actor or the target
+	UserID    int
+	IPAddress string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+// RecordAuditEvent writes an event to the audit log
+func RecordAuditEvent(event *AuditEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	result, err := database.DB.Exec(`
+	INSERT INTO audit_events (created_at, actor_user_id, target_user_id, event_type, ip, user_agent, outcome, details)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.CreatedAt, nullableUserID(event.ActorUserID), nullableUserID(event.TargetUserID),
+		event.EventType, event.IPAddress, event.UserAgent, event.Outcome, event.DetailsJSON(),
+	)
+	if err != nil {
+		return err
+	}
+
+	event.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetAuditEvents returns the events matching a filter, newest first
+func GetAuditEvents(filter AuditFilter) ([]*AuditEvent, error) {
+	where, args := filter.where()
+
+	limit := filter.Limit
+	if limit <= 0 || limit > maxAuditExport {
+		limit = maxAuditExport
+	}
+	args = append(args, limit, filter.Offset)
+
+	rows, err := database.DB.Query(`
+	SELECT id, created_at, COALESCE(actor_user_id, 0), COALESCE(target_user_id, 0),
+		event_type, ip, user_agent, outcome, details
+	FROM audit_events`+where+`
+	ORDER BY created_at DESC, id DESC
+	LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		event := &AuditEvent{}
+		var details string
+		if err := rows.Scan(
+			&event.ID, &event.CreatedAt, &event.ActorUserID, &event.TargetUserID,
+			&event.EventType, &event.IPAddress, &event.UserAgent, &event.Outcome, &details,
+		); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(details), &event.Details); err != nil {
+			event.Details = map[string]interface{}{"raw": details}
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// CountAuditEvents returns the number of events matching a filter, ignoring its limit and offset
+func CountAuditEvents(filter AuditFilter) (int, error) {
+	where, args := filter.where()
+
+	var count int
+	err := database.DB.QueryRow("SELECT COUNT(*) FROM audit_events"+where, args...).Scan(&count)
+	return count, err
+}
+
+// GetLoginHistory returns a user's most recent successful logins, newest first
+func GetLoginHistory(userID, limit int) ([]LoginRecord, error) {
+	events, err := GetAuditEvents(AuditFilter{
+		EventType: AuditLogin,
+		Outcome:   AuditSuccess,
+		UserID:    userID,
+		Limit:     limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]LoginRecord, 0, len(events))
+	for _, event := range events {
+		record := LoginRecord{
+			Time:      event.CreatedAt,
+			IPAddress: event.IPAddress,
+			UserAgent: event.UserAgent,
+		}
+		record.Method, _ = event.Details["method"].(string)
+		record.NewDevice, _ = event.Details["new_device"].(bool)
+		if factors, ok := event.Details["factors"].([]interface{}); ok {
+			for _, factor := range factors {
+				if name, ok := factor.(string); ok {
+					record.Factors = append(record.Factors, name)
+				}
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// where builds the WHERE clause for a filter
+func (f AuditFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.EventType != "" {
+		conditions = append(conditions, "event_type = ?")
+		args = append(args, f.EventType)
+	}
+	if f.Outcome != "" {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, f.Outcome)
+	}
+	if f.UserID > 0 {
+		conditions = append(conditions, "(actor_user_id = ? OR target_user_id = ?)")
+		args = append(args, f.UserID, f.UserID)
+	}
+	if f.IPAddress != "" {
+		conditions = append(conditions, "ip = ?")
+		args = append(args, f.IPAddress)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// nullableUserID stores unknown users as NULL
+func nullableUserID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id > 0}
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetLoginHistory(t *testing.T) {
+	setupTestDB(t)
+
+	user := createTestUser(t, "user@example.com")
+	other := createTestUser(t, "other@example.com")
+	start := time.Now().UTC().Add(-time.Hour)
+
+	events := []*AuditEvent{
+		{EventType: AuditLogin, Outcome: AuditSuccess, Details: map[string]interface{}{"method": "password", "factors": []string{"password"}}},
+		{EventType: AuditLogin, Outcome: AuditFailure, Details: map[string]interface{}{"method": "password"}},
+		{EventType: AuditReauth, Outcome: AuditSuccess},
+		{EventType: AuditLogin, Outcome: AuditSuccess, Details: map[string]interface{}{"method": "oauth", "factors": []string{"oauth", "totp"}, "new_device": true}},
+	}
+	for i, event := range events {
+		event.ActorUserID = user.ID
+		event.TargetUserID = user.ID
+		event.IPAddress = "192.0.2.1"
+		event.UserAgent = "Mozilla/5.0"
+		event.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		if err := RecordAuditEvent(event); err != nil {
+			t.Fatalf("RecordAuditEvent: %v", err)
+		}
+	}
+	if err := RecordAuditEvent(&AuditEvent{
+		ActorUserID: other.ID, TargetUserID: other.ID, EventType: AuditLogin, Outcome: AuditSuccess,
+	}); err != nil {
+		t.Fatalf("RecordAuditEvent: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []LoginRecord
+	}{
+		{"successful logins, newest first", 10, []LoginRecord{
+			{Method: "oauth", Factors: []string{"oauth", "totp"}, NewDevice: true},
+			{Method: "password", Factors: []string{"password"}},
+		}},
+		{"limited", 1, []LoginRecord{
+			{Method: "oauth", Factors: []string{"oauth", "totp"}, NewDevice: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := GetLoginHistory(user.ID, tt.limit)
+			if err != nil {
+				t.Fatalf("GetLoginHistory: %v", err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, record := range records {
+				if record.IPAddress != "192.0.2.1" || record.UserAgent != "Mozilla/5.0" {
+					t.Errorf("record %d came from %q / %q", i, record.IPAddress, record.UserAgent)
+				}
+				if record.Method != tt.want[i].Method || record.NewDevice != tt.want[i].NewDevice ||
+					!reflect.DeepEqual(record.Factors, tt.want[i].Factors) {
+					t.Errorf("record %d = %+v, want %+v", i, record, tt.want[i])
+				}
+			}
+		})
+	}
+}
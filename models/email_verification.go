@@ -0,0 +1,54 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+const (
+	// verificationEmailCooldown is the minimum time between two verification emails for the same account
+	verificationEmailCooldown = time.Minute
+	// verificationEmailsPerAccount is how many verification emails an account can be sent in a day
+	verificationEmailsPerAccount = 5
+	// verificationEmailsPerIP is how many verification emails one IP address can request in an hour
+	verificationEmailsPerIP = 10
+)
+
+// ErrVerificationTooSoon is returned when a verification email was requested again too soon
+// or too often for the same account or IP address
+var ErrVerificationTooSoon = errors.New("verification email requested too recently")
+
+// RecordVerificationEmailRequest checks that another verification email may be sent
+// for the user from the given IP address and records the request
+func RecordVerificationEmailRequest(userID int, ip string) error {
+	now := time.Now()
+
+	// Don't let the form be used to flood a mailbox
+	var recent, today, fromIP int
+	err := database.DB.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN user_id = ? AND created_at > ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN user_id = ? AND created_at > ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN ip_address = ? AND created_at > ? THEN 1 ELSE 0 END), 0)
+		FROM email_verification_requests
+		WHERE created_at > ?
+	`, userID, now.Add(-verificationEmailCooldown),
+		userID, now.Add(-24*time.Hour),
+		ip, now.Add(-time.Hour),
+		now.Add(-24*time.Hour),
+	).Scan(&recent, &today, &fromIP)
+	if err != nil {
+		return err
+	}
+	if recent > 0 || today >= verificationEmailsPerAccount || fromIP >= verificationEmailsPerIP {
+		return ErrVerificationTooSoon
+	}
+
+	_, err = database.DB.Exec(
+		`INSERT INTO email_verification_requests (user_id, ip_address, created_at) VALUES (?, ?, ?)`,
+		userID, ip, now,
+	)
+	return err
+}
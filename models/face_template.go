@@ -0,0 +1,241 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// faceTemplateAAD binds a sealed face image to the user it was enrolled for
+func faceTemplateAAD(userID int) []byte {
+	return []byte(fmt.Sprintf("face_template:%d", userID))
+}
+
+// EnableFaceAuth stores the enrolled face image and enables face authentication
+// for the user in one transaction
+func EnableFaceAuth(user *User, faceImage []byte) error {
+	wrappedKey, ciphertext, err := utils.SealWithDataKey(faceImage, faceTemplateAAD(user.ID))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt face image: %v", err)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if err := saveFaceTemplate(tx, user.ID, wrappedKey, ciphertext, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET face_auth_enabled = 1, updated_at = ? WHERE id = ?", now, user.ID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.FaceAuthEnabled = true
+	user.UpdatedAt = now
+	return nil
+}
+
+// DisableFaceAuth disables face authentication for the user and deletes the enrolled face in one transaction
+func DisableFaceAuth(user *User) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec("DELETE FROM face_templates WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET face_auth_enabled = 0, updated_at = ? WHERE id = ?", now, user.ID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	user.FaceAuthEnabled = false
+	user.UpdatedAt = now
+	return nil
+}
+
+// GetFaceTemplate returns the decrypted face image enrolled for a user, or
+// utils.ErrNoFaceTemplate if there is none
+func GetFaceTemplate(userID int) ([]byte, error) {
+	var wrappedKey string
+	var ciphertext []byte
+	err := database.DB.QueryRow("SELECT wrapped_key, ciphertext FROM face_templates WHERE user_id = ?", userID).
+		Scan(&wrappedKey, &ciphertext)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, utils.ErrNoFaceTemplate
+		}
+		return nil, err
+	}
+
+	faceImage, err := utils.OpenWithDataKey(wrappedKey, ciphertext, faceTemplateAAD(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt face template for user %d: %v", userID, err)
+	}
+	return faceImage, nil
+}
+
+// RewrapFaceTemplateKeys re-encrypts the data keys of face templates that
+// aren't wrapped by the active key. It returns the number of rows it changed.
+func RewrapFaceTemplateKeys() (int, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT user_id, wrapped_key FROM face_templates")
+	if err != nil {
+		return 0, err
+	}
+
+	wrappedKeys := make(map[int]string)
+	for rows.Next() {
+		var userID int
+		var wrappedKey string
+		if err := rows.Scan(&userID, &wrappedKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		wrappedKeys[userID] = wrappedKey
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	active := utils.ActiveEncryptionKeyID()
+	for userID, wrappedKey := range wrappedKeys {
+		if utils.SecretKeyID(wrappedKey) == active {
+			continue
+		}
+
+		dataKey, err := utils.DecryptSecret(wrappedKey)
+		if err != nil {
+			return 0, fmt.Errorf("face template of user %d: %v", userID, err)
+		}
+		rewrapped, err := utils.EncryptSecret(dataKey)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE face_templates SET wrapped_key = ? WHERE user_id = ?", rewrapped, userID); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
+
+// ImportLegacyFaceData moves face images from the old JSON files into the
+// face_templates table and removes the files. A file that can't be read or
+// decoded is logged and left in place, so it doesn't stop the server from
+// starting. It returns the number of templates it imported.
+func ImportLegacyFaceData() (int, error) {
+	files, err := utils.ListLegacyFaceData()
+	if err != nil {
+		return 0, err
+	}
+
+	imported, skipped := 0, 0
+	for _, filename := range files {
+		faceData, err := utils.ReadLegacyFaceData(filename)
+		if err != nil {
+			log.Printf("Error: skipping face data file %s: %v", filename, err)
+			skipped++
+			continue
+		}
+		faceImage, err := utils.FaceImageBytes(faceData.FaceImage)
+		if err != nil {
+			log.Printf("Error: skipping face data file %s: %v", filename, err)
+			skipped++
+			continue
+		}
+
+		ok, err := importFaceData(faceData.UserID, faceImage)
+		if err != nil {
+			return imported, fmt.Errorf("%s: %v", filename, err)
+		}
+		if ok {
+			imported++
+		} else {
+			log.Printf("Discarding face data in %s: user %d has no face authentication enabled", filename, faceData.UserID)
+		}
+
+		// The image is in the database now, or belongs to nobody
+		if err := os.Remove(filename); err != nil {
+			return imported, fmt.Errorf("failed to remove %s: %v", filename, err)
+		}
+	}
+
+	if len(files) > 0 && skipped == 0 {
+		if err := utils.RemoveLegacyFaceDataDir(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return imported, nil
+}
+
+// importFaceData stores one legacy face image. It returns false if the user no
+// longer exists or doesn't have face authentication enabled.
+func importFaceData(userID int, faceImage []byte) (bool, error) {
+	var faceAuthEnabled bool
+	err := database.DB.QueryRow("SELECT face_auth_enabled FROM users WHERE id = ?", userID).Scan(&faceAuthEnabled)
+	if err == sql.ErrNoRows || (err == nil && !faceAuthEnabled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	wrappedKey, ciphertext, err := utils.SealWithDataKey(faceImage, faceTemplateAAD(userID))
+	if err != nil {
+		return false, fmt.Errorf("failed to encrypt face image: %v", err)
+	}
+
+	// Keep a template enrolled since the database took over
+	_, err = database.DB.Exec(`
+	INSERT INTO face_templates (user_id, wrapped_key, ciphertext, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO NOTHING`,
+		userID, wrappedKey, ciphertext, time.Now(), time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// saveFaceTemplate inserts or replaces the face template of a user
+func saveFaceTemplate(tx *sql.Tx, userID int, wrappedKey string, ciphertext []byte, now time.Time) error {
+	_, err := tx.Exec(`
+	INSERT INTO face_templates (user_id, wrapped_key, ciphertext, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		wrapped_key = excluded.wrapped_key,
+		ciphertext = excluded.ciphertext,
+		updated_at = excluded.updated_at`,
+		userID, wrappedKey, ciphertext, now, now,
+	)
+	return err
+}
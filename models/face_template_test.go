@@ -0,0 +1,86 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aungh/login-form/utils"
+)
+
+func TestImportLegacyFaceData(t *testing.T) {
+	setupTestDB(t)
+	t.Chdir(t.TempDir())
+
+	if err := os.MkdirAll(utils.LegacyFaceDataDir, 0o700); err != nil {
+		t.Fatalf("create face data directory: %v", err)
+	}
+	writeFaceFile := func(userID int, content string) string {
+		filename := filepath.Join(utils.LegacyFaceDataDir, "user_"+strconv.Itoa(userID)+".json")
+		if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", filename, err)
+		}
+		return filename
+	}
+
+	image := []byte("face image")
+	faceImage := base64.StdEncoding.EncodeToString(image)
+
+	enrolled := createTestUser(t, "enrolled@example.com")
+	enrolled.FaceAuthEnabled = true
+	if err := UpdateUser(enrolled); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	disabled := createTestUser(t, "disabled@example.com")
+
+	tests := []struct {
+		name       string
+		userID     int
+		content    string
+		wantKept   bool
+		wantStored bool
+	}{
+		{"imported", enrolled.ID, `{"user_id":` + strconv.Itoa(enrolled.ID) + `,"face_image":"` + faceImage + `"}`, false, true},
+		{"face authentication disabled", disabled.ID, `{"user_id":` + strconv.Itoa(disabled.ID) + `,"face_image":"` + faceImage + `"}`, false, false},
+		{"malformed JSON", 100, `{"user_id":`, true, false},
+		{"malformed image", 101, `{"user_id":101,"face_image":"not base64!"}`, true, false},
+	}
+
+	files := make([]string, len(tests))
+	for i, tt := range tests {
+		files[i] = writeFaceFile(tt.userID, tt.content)
+	}
+
+	imported, err := ImportLegacyFaceData()
+	if err != nil {
+		t.Fatalf("ImportLegacyFaceData: %v", err)
+	}
+	if imported != 1 {
+		t.Errorf("imported %d templates, want 1", imported)
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(files[i])
+			if kept := err == nil; kept != tt.wantKept {
+				t.Errorf("file kept = %v, want %v", kept, tt.wantKept)
+			}
+
+			stored, err := GetFaceTemplate(tt.userID)
+			if tt.wantStored && (err != nil || !bytes.Equal(stored, image)) {
+				t.Errorf("GetFaceTemplate = (%q, %v), want the imported image", stored, err)
+			}
+			if !tt.wantStored && err != utils.ErrNoFaceTemplate {
+				t.Errorf("GetFaceTemplate = (%q, %v), want %v", stored, err, utils.ErrNoFaceTemplate)
+			}
+		})
+	}
+
+	// The directory stays while files that need attention are left in it
+	if _, err := os.Stat(utils.LegacyFaceDataDir); err != nil {
+		t.Errorf("face data directory was removed: %v", err)
+	}
+}
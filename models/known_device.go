@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+// TouchKnownDevice records a login from a device and reports whether the
+// user had not signed in from it before
+func TouchKnownDevice(userID int, fingerprint, userAgent, ipAddress string) (bool, error) {
+	now := time.Now()
+
+	result, err := database.DB.Exec(
+		"UPDATE known_devices SET last_seen_at = ?, user_agent = ?, ip_address = ? WHERE user_id = ? AND fingerprint = ?",
+		now, userAgent, ipAddress, userID, fingerprint,
+	)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows > 0 {
+		return false, err
+	}
+
+	// A concurrent login from the same device may have inserted it already
+	result, err = database.DB.Exec(`
+	INSERT OR IGNORE INTO known_devices (user_id, fingerprint, user_agent, ip_address, first_seen_at, last_seen_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, fingerprint, userAgent, ipAddress, now, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// CountKnownDevices returns the number of devices a user has signed in from
+func CountKnownDevices(userID int) (int, error) {
+	var count int
+	err := database.DB.QueryRow("SELECT COUNT(*) FROM known_devices WHERE user_id = ?", userID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,37 @@
+package models
+
+import "testing"
+
+func TestTouchKnownDevice(t *testing.T) {
+	setupTestDB(t)
+
+	user := createTestUser(t, "user@example.com")
+	other := createTestUser(t, "other@example.com")
+
+	// The steps run in order against the same database
+	tests := []struct {
+		name        string
+		userID      int
+		fingerprint string
+		wantNew     bool
+		wantCount   int
+	}{
+		{"first device", user.ID, "laptop", true, 1},
+		{"same device again", user.ID, "laptop", false, 1},
+		{"second device", user.ID, "phone", true, 2},
+		{"same device, another user", other.ID, "laptop", true, 1},
+	}
+
+	for _, tt := range tests {
+		isNew, err := TouchKnownDevice(tt.userID, tt.fingerprint, "Mozilla/5.0", "192.0.2.1")
+		if err != nil {
+			t.Fatalf("%s: TouchKnownDevice: %v", tt.name, err)
+		}
+		if isNew != tt.wantNew {
+			t.Errorf("%s: new = %v, want %v", tt.name, isNew, tt.wantNew)
+		}
+		if count, err := CountKnownDevices(tt.userID); err != nil || count != tt.wantCount {
+			t.Errorf("%s: CountKnownDevices = (%d, %v), want %d", tt.name, count, err, tt.wantCount)
+		}
+	}
+}
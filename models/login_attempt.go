@@ -0,0 +1,288 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// Failure counter scopes
+const (
+	FailureScopeAccount = "account"
+	FailureScopeIP      = "ip"
+)
+
+// LoginThrottledError is returned when an attempt is refused because of too many failures
+type LoginThrottledError struct {
+	Locked   bool
+	RetryIn  time.Duration
+	ScopeKey string
+}
+
+func (e *LoginThrottledError) Error() string {
+	seconds := int(e.RetryIn.Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	if e.Locked {
+		return fmt.Sprintf("Too many failed attempts. Try again in %d minutes.", (seconds+59)/60)
+	}
+	return fmt.Sprintf("Too many failed attempts. Please wait %d seconds before trying again.", seconds)
+}
+
+// failureRecord is a row of the auth_failures table
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// normalizeAccountKey makes account keys case-insensitive
+func normalizeAccountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// getFailureRecord loads the failure counter for a scope and key
+func getFailureRecord(scope, key string) (*failureRecord, error) {
+	record := &failureRecord{}
+	var lastFailure, lockedUntil sql.NullTime
+
+	err := database.DB.QueryRow(
+		"SELECT failures, last_failure, locked_until FROM auth_failures WHERE scope = ? AND key = ?",
+		scope, key,
+	).Scan(&record.failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return record, nil
+		}
+		return nil, err
+	}
+
+	record.lastFailure = lastFailure.Time
+	record.lockedUntil = lockedUntil.Time
+	return record, nil
+}
+
+// checkFailureRecord returns an error if the scope and key may not attempt authentication yet
+func checkFailureRecord(scope, key string) error {
+	record, err := getFailureRecord(scope, key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if record.lockedUntil.After(now) {
+		return &LoginThrottledError{Locked: true, RetryIn: record.lockedUntil.Sub(now), ScopeKey: scope}
+	}
+
+	delay := utils.GetLockoutPolicy().Delay(record.failures)
+	if next := record.lastFailure.Add(delay); next.After(now) {
+		return &LoginThrottledError{RetryIn: next.Sub(now), ScopeKey: scope}
+	}
+
+	return nil
+}
+
+// CheckLoginAllowed returns a *LoginThrottledError if the account or IP address
+// must wait before another authentication attempt
+func CheckLoginAllowed(email, ip string) error {
+	if email != "" {
+		if err := checkFailureRecord(FailureScopeAccount, normalizeAccountKey(email)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := checkFailureRecord(FailureScopeIP, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveAttempt counts an attempt for a scope and key before it is verified,
+// unless the key is locked or still inside its progressive delay. The check
+// and the increment are a single statement, so concurrent attempts can't all
+// pass the check before any of them is counted. It returns false if the
+// attempt was refused.
+func reserveAttempt(scope, key string) (bool, error) {
+	policy := utils.GetLockoutPolicy()
+	now := time.Now()
+
+	// The delay depends on the stored count, so list the latest previous
+	// attempt allowed for each count until the delay reaches its maximum
+	args := []interface{}{scope, key, now}
+	steps := ""
+	for failures := 2; failures < 64 && policy.Delay(failures) < policy.MaxDelay; failures++ {
+		steps += " WHEN ? THEN ?"
+		args = append(args, failures, now.Add(-policy.Delay(failures)))
+	}
+	args = append(args, now.Add(-policy.MaxDelay))
+
+	// A lockout that has expired starts a fresh count
+	var failures int
+	err := database.DB.QueryRow(`
+	INSERT INTO auth_failures (scope, key, failures, last_failure, locked_until)
+	VALUES (?, ?, 1, ?, NULL)
+	ON CONFLICT(scope, key) DO UPDATE SET
+		failures = CASE WHEN locked_until IS NOT NULL AND locked_until <= excluded.last_failure THEN 1 ELSE failures + 1 END,
+		locked_until = CASE WHEN locked_until IS NOT NULL AND locked_until <= excluded.last_failure THEN NULL ELSE locked_until END,
+		last_failure = excluded.last_failure
+	WHERE (locked_until IS NULL OR locked_until <= excluded.last_failure)
+		AND (failures < 2 OR last_failure IS NULL OR last_failure <= CASE failures`+steps+` ELSE ? END)
+	RETURNING failures
+	`, args...).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// throttledError describes why an attempt for a scope and key was refused
+func throttledError(scope, key string) error {
+	if err := checkFailureRecord(scope, key); err != nil {
+		return err
+	}
+	// The wait ended between the refusal and this check
+	return &LoginThrottledError{RetryIn: utils.GetLockoutPolicy().BaseDelay, ScopeKey: scope}
+}
+
+// ReserveLoginAttempt counts an authentication attempt for an account and IP
+// address before the password or factor is verified, or returns a
+// *LoginThrottledError if either must wait. The attempt counts as a failure
+// until ReleaseLoginAttempt gives it back; RecordLoginFailure locks the
+// account or address once a failed attempt reaches the threshold.
+func ReserveLoginAttempt(email, ip string) error {
+	if email != "" {
+		key := normalizeAccountKey(email)
+		ok, err := reserveAttempt(FailureScopeAccount, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return throttledError(FailureScopeAccount, key)
+		}
+	}
+	if ip != "" {
+		ok, err := reserveAttempt(FailureScopeIP, ip)
+		if err == nil && !ok {
+			err = throttledError(FailureScopeIP, ip)
+		}
+		if err != nil {
+			// The account's attempt wasn't made after all
+			if email != "" {
+				releaseAttempt(FailureScopeAccount, normalizeAccountKey(email))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAttempt gives back an attempt counted by reserveAttempt
+func releaseAttempt(scope, key string) error {
+	_, err := database.DB.Exec(
+		"UPDATE auth_failures SET failures = failures - 1 WHERE scope = ? AND key = ? AND failures > 0",
+		scope, key,
+	)
+	return err
+}
+
+// ReleaseLoginAttempt gives back an attempt reserved with ReserveLoginAttempt
+// once the password or factor was verified
+func ReleaseLoginAttempt(email, ip string) error {
+	if email != "" {
+		if err := releaseAttempt(FailureScopeAccount, normalizeAccountKey(email)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := releaseAttempt(FailureScopeIP, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockIfOverThreshold locks a scope and key whose count has reached the threshold
+func lockIfOverThreshold(scope, key string, threshold int) error {
+	now := time.Now()
+	_, err := database.DB.Exec(`
+	UPDATE auth_failures SET locked_until = ?
+	WHERE scope = ? AND key = ? AND failures >= ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		now.Add(utils.GetLockoutPolicy().LockoutDuration), scope, key, threshold, now,
+	)
+	return err
+}
+
+// RecordLoginFailure records that an attempt reserved with ReserveLoginAttempt
+// failed. The attempt is already counted, so this locks the account or IP
+// address once its count reaches the threshold.
+func RecordLoginFailure(email, ip string) error {
+	policy := utils.GetLockoutPolicy()
+	if email != "" {
+		if err := lockIfOverThreshold(FailureScopeAccount, normalizeAccountKey(email), policy.AccountThreshold); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		if err := lockIfOverThreshold(FailureScopeIP, ip, policy.IPThreshold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetLoginFailures clears the failure counters for an account and IP address
+func ResetLoginFailures(email, ip string) error {
+	_, err := database.DB.Exec(
+		"DELETE FROM auth_failures WHERE (scope = ? AND key = ?) OR (scope = ? AND key = ?)",
+		FailureScopeAccount, normalizeAccountKey(email), FailureScopeIP, ip,
+	)
+	return err
+}
+
+// UnlockAccount clears the failure counter for an account
+func UnlockAccount(email string) error {
+	_, err := database.DB.Exec(
+		"DELETE FROM auth_failures WHERE scope = ? AND key = ?",
+		FailureScopeAccount, normalizeAccountKey(email),
+	)
+	return err
+}
+
+// GetLockedAccounts returns the accounts that are currently locked, keyed by email
+func GetLockedAccounts() (map[string]time.Time, error) {
+	rows, err := database.DB.Query(
+		"SELECT key, locked_until FROM auth_failures WHERE scope = ? AND locked_until IS NOT NULL",
+		FailureScopeAccount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	locked := make(map[string]time.Time)
+	for rows.Next() {
+		var key string
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&key, &lockedUntil); err != nil {
+			return nil, err
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			locked[key] = lockedUntil.Time
+		}
+	}
+
+	return locked, rows.Err()
+}
+
+// IsAccountLocked reports whether an account is currently locked
+func IsAccountLocked(locked map[string]time.Time, email string) bool {
+	_, ok := locked[normalizeAccountKey(email)]
+	return ok
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// backdateFailures moves the last failure back so the progressive delay has passed
+func backdateFailures(t *testing.T) {
+	t.Helper()
+	if _, err := database.DB.Exec(`UPDATE auth_failures SET last_failure = datetime('now', '-1 hour')`); err != nil {
+		t.Fatalf("backdate failures: %v", err)
+	}
+}
+
+// failLoginAttempts makes attempts that fail, waiting out the progressive delay before each
+func failLoginAttempts(t *testing.T, email, ip string, attempts int) {
+	t.Helper()
+	for i := 0; i < attempts; i++ {
+		backdateFailures(t)
+		if err := ReserveLoginAttempt(email, ip); err != nil {
+			t.Fatalf("ReserveLoginAttempt %d: %v", i+1, err)
+		}
+		if err := RecordLoginFailure(email, ip); err != nil {
+			t.Fatalf("RecordLoginFailure: %v", err)
+		}
+	}
+}
+
+func TestCheckLoginAllowed(t *testing.T) {
+	policy := utils.GetLockoutPolicy()
+
+	tests := []struct {
+		name        string
+		failures    int
+		backdate    bool
+		wantAllowed bool
+		wantLocked  bool
+	}{
+		{"no failures", 0, false, true, false},
+		{"one failure", 1, false, true, false},
+		{"second failure starts the delay", 2, false, false, false},
+		{"delay has passed", 2, true, true, false},
+		{"threshold reached", policy.AccountThreshold, false, false, true},
+		{"lockout outlasts the delay", policy.AccountThreshold, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+
+			failLoginAttempts(t, "User@Example.com", "", tt.failures)
+			if tt.backdate {
+				backdateFailures(t)
+			}
+
+			// Account keys are case-insensitive
+			err := CheckLoginAllowed("user@example.com", "")
+			if tt.wantAllowed {
+				if err != nil {
+					t.Fatalf("CheckLoginAllowed = %v, want nil", err)
+				}
+				return
+			}
+
+			var throttled *LoginThrottledError
+			if !errors.As(err, &throttled) {
+				t.Fatalf("CheckLoginAllowed = %v, want a *LoginThrottledError", err)
+			}
+			if throttled.Locked != tt.wantLocked {
+				t.Errorf("Locked = %v, want %v", throttled.Locked, tt.wantLocked)
+			}
+			if throttled.RetryIn <= 0 {
+				t.Errorf("RetryIn = %v, want a positive duration", throttled.RetryIn)
+			}
+		})
+	}
+}
+
+func TestLoginFailureScopes(t *testing.T) {
+	policy := utils.GetLockoutPolicy()
+
+	tests := []struct {
+		name      string
+		clear     func() error
+		wantEmail bool
+		wantIP    bool
+	}{
+		{"locked", func() error { return nil }, false, false},
+		{"unlocked account", func() error { return UnlockAccount("user@example.com") }, true, false},
+		{"reset after a successful login", func() error { return ResetLoginFailures("user@example.com", "192.0.2.1") }, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+
+			failLoginAttempts(t, "user@example.com", "192.0.2.1", policy.AccountThreshold)
+			failLoginAttempts(t, "", "192.0.2.1", policy.IPThreshold-policy.AccountThreshold)
+			if err := tt.clear(); err != nil {
+				t.Fatalf("clear failures: %v", err)
+			}
+
+			if allowed := CheckLoginAllowed("user@example.com", "") == nil; allowed != tt.wantEmail {
+				t.Errorf("account allowed = %v, want %v", allowed, tt.wantEmail)
+			}
+			if allowed := CheckLoginAllowed("", "192.0.2.1") == nil; allowed != tt.wantIP {
+				t.Errorf("IP allowed = %v, want %v", allowed, tt.wantIP)
+			}
+			if allowed := CheckLoginAllowed("other@example.com", "192.0.2.2") == nil; !allowed {
+				t.Error("unrelated account and IP were throttled")
+			}
+		})
+	}
+}
+
+func TestReserveLoginAttemptConcurrent(t *testing.T) {
+	setupTestDB(t)
+
+	// Only the attempts before the progressive delay starts may go ahead, however
+	// many arrive at once
+	const attempts = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ReserveLoginAttempt("", "192.0.2.1")
+			var throttled *LoginThrottledError
+			if err != nil && !errors.As(err, &throttled) {
+				t.Errorf("ReserveLoginAttempt: %v", err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 2 {
+		t.Errorf("%d concurrent attempts went ahead, want 2", allowed)
+	}
+	record, err := getFailureRecord(FailureScopeIP, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("getFailureRecord: %v", err)
+	}
+	if record.failures != allowed {
+		t.Errorf("failures = %d, want %d", record.failures, allowed)
+	}
+}
+
+func TestReleaseLoginAttempt(t *testing.T) {
+	setupTestDB(t)
+
+	// The steps run in order against the same counters
+	tests := []struct {
+		name        string
+		email       string
+		ip          string
+		succeed     bool
+		wantAllowed bool
+		wantAccount int
+		wantIP      int
+	}{
+		{"verified attempt is given back", "user@example.com", "192.0.2.1", true, true, 0, 0},
+		{"failed attempt stays counted", "user@example.com", "192.0.2.1", false, true, 1, 1},
+		{"another failure", "user@example.com", "192.0.2.1", false, true, 2, 2},
+		{"refused by the account's delay", "user@example.com", "192.0.2.1", false, false, 2, 2},
+		{"refused by the address's delay", "other@example.com", "192.0.2.1", false, false, 2, 2},
+	}
+
+	for _, tt := range tests {
+		err := ReserveLoginAttempt(tt.email, tt.ip)
+		if allowed := err == nil; allowed != tt.wantAllowed {
+			t.Fatalf("%s: ReserveLoginAttempt = %v, want allowed %v", tt.name, err, tt.wantAllowed)
+		}
+		if err == nil {
+			if tt.succeed {
+				err = ReleaseLoginAttempt(tt.email, tt.ip)
+			} else {
+				err = RecordLoginFailure(tt.email, tt.ip)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		account, _ := getFailureRecord(FailureScopeAccount, "user@example.com")
+		address, _ := getFailureRecord(FailureScopeIP, "192.0.2.1")
+		if account.failures != tt.wantAccount || address.failures != tt.wantIP {
+			t.Errorf("%s: account failures = %d, IP failures = %d, want %d and %d",
+				tt.name, account.failures, address.failures, tt.wantAccount, tt.wantIP)
+		}
+	}
+
+	// An attempt refused for the address doesn't count against the other account
+	if other, _ := getFailureRecord(FailureScopeAccount, "other@example.com"); other.failures != 0 {
+		t.Errorf("other account has %d failures, want 0", other.failures)
+	}
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+// ErrEmptyPolicy is returned when saving a policy that doesn't require anything
+var ErrEmptyPolicy = errors.New("policy must enforce at least one rule")
+
+// MFAPolicy is an admin-defined rule about the factors users must have enabled
+type MFAPolicy struct {
+	ID                  int
+	Role                string // Empty applies to every role
+	RequireSecondFactor bool   // TOTP or a security key; face counts unless FaceOnlyAsAddition
+	RequireTOTP         bool
+	FaceOnlyAsAddition  bool // Face authentication can't be a user's only second factor
+	GracePeriodDays     int
+	Enabled             bool
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+}
+
+// MFAViolation describes why a user does not comply with a policy
+type MFAViolation struct {
+	Policy   *MFAPolicy
+	Reason   string
+	Deadline time.Time
+}
+
+// Enforced reports whether the grace period of the violation is over
+func (v *MFAViolation) Enforced() bool {
+	return !time.Now().Before(v.Deadline)
+}
+
+// AppliesTo reports whether the policy covers a user
+func (p *MFAPolicy) AppliesTo(user *User) bool {
+	return p.Enabled && (p.Role == "" || p.Role == user.Role)
+}
+
+// Deadline returns when the policy is enforced for a user. The grace period
+// starts when the policy was created, or when the account was created if that is later.
+func (p *MFAPolicy) Deadline(user *User) time.Time {
+	start := p.CreatedAt
+	if user.CreatedAt.After(start) {
+		start = user.CreatedAt
+	}
+	return start.AddDate(0, 0, p.GracePeriodDays)
+}
+
+// Violation returns why the user's enabled factors don't meet the policy, or an empty string
+func (p *MFAPolicy) Violation(user *User) string {
+	strongFactor := user.TwoFAEnabled || user.WebAuthnEnabled
+
+	if p.RequireTOTP && (!user.TwoFAEnabled || user.TwoFAType != TwoFATypeTOTP) {
+		return "an authenticator app (TOTP) is required"
+	}
+	if p.RequireSecondFactor && !strongFactor && !(user.FaceAuthEnabled && !p.FaceOnlyAsAddition) {
+		return "a second factor is required"
+	}
+	if p.FaceOnlyAsAddition && user.FaceAuthEnabled && !strongFactor {
+		return "face authentication is only allowed in addition to an authenticator app or security key"
+	}
+	return ""
+}
+
+// CheckMFACompliance returns the first policy the user violates, or nil. The
+// violation may still be within its grace period; see MFAViolation.Enforced.
+func CheckMFACompliance(user *User) (*MFAViolation, error) {
+	policies, err := GetMFAPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	var first *MFAViolation
+	for _, policy := range policies {
+		if !policy.AppliesTo(user) {
+			continue
+		}
+		reason := policy.Violation(user)
+		if reason == "" {
+			continue
+		}
+
+		violation := &MFAViolation{Policy: policy, Reason: reason, Deadline: policy.Deadline(user)}
+		// Report the violation that is enforced soonest
+		if first == nil || violation.Deadline.Before(first.Deadline) {
+			first = violation
+		}
+	}
+
+	return first, nil
+}
+
+// GetMFAPolicies returns all policies, ordered by ID
+func GetMFAPolicies() ([]*MFAPolicy, error) {
+	rows, err := database.DB.Query(`
+	SELECT id, role, require_second_factor, require_totp, face_only_as_addition,
+		grace_period_days, enabled, created_at, updated_at
+	FROM mfa_policies ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make([]*MFAPolicy, 0)
+	for rows.Next() {
+		policy := &MFAPolicy{}
+		err := rows.Scan(&policy.ID, &policy.Role, &policy.RequireSecondFactor, &policy.RequireTOTP,
+			&policy.FaceOnlyAsAddition, &policy.GracePeriodDays, &policy.Enabled,
+			&policy.CreatedAt, &policy.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, rows.Err()
+}
+
+// CreateMFAPolicy stores a new policy
+func CreateMFAPolicy(policy *MFAPolicy) error {
+	if err := validateMFAPolicy(policy); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	result, err := database.DB.Exec(`
+	INSERT INTO mfa_policies (
+		role, require_second_factor, require_totp, face_only_as_addition,
+		grace_period_days, enabled, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		policy.Role, policy.RequireSecondFactor, policy.RequireTOTP, policy.FaceOnlyAsAddition,
+		policy.GracePeriodDays, policy.Enabled, now, now,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	policy.ID = int(id)
+	policy.CreatedAt = now
+	policy.UpdatedAt = now
+	return nil
+}
+
+// UpdateMFAPolicy saves changes to a policy. The grace period keeps counting from when it was created.
+func UpdateMFAPolicy(policy *MFAPolicy) error {
+	if err := validateMFAPolicy(policy); err != nil {
+		return err
+	}
+
+	policy.UpdatedAt = time.Now()
+	_, err := database.DB.Exec(`
+	UPDATE mfa_policies SET
+		role = ?, require_second_factor = ?, require_totp = ?, face_only_as_addition = ?,
+		grace_period_days = ?, enabled = ?, updated_at = ?
+	WHERE id = ?`,
+		policy.Role, policy.RequireSecondFactor, policy.RequireTOTP, policy.FaceOnlyAsAddition,
+		policy.GracePeriodDays, policy.Enabled, policy.UpdatedAt, policy.ID,
+	)
+	return err
+}
+
+// DeleteMFAPolicy removes a policy
+func DeleteMFAPolicy(id int) error {
+	_, err := database.DB.Exec(`DELETE FROM mfa_policies WHERE id = ?`, id)
+	return err
+}
+
+// validateMFAPolicy checks that a policy enforces something and targets a known role
+func validateMFAPolicy(policy *MFAPolicy) error {
+	if !policy.RequireSecondFactor && !policy.RequireTOTP && !policy.FaceOnlyAsAddition {
+		return ErrEmptyPolicy
+	}
+	if policy.GracePeriodDays < 0 {
+		policy.GracePeriodDays = 0
+	}
+	if policy.Role == "" {
+		return nil
+	}
+
+	exists, err := RoleExists(policy.Role)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownRole
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// ErrOIDCClientNotFound is returned for unknown client IDs
+var ErrOIDCClientNotFound = errors.New("OIDC client not found")
+
+// ErrNoRedirectURIs is returned when registering a client without a redirect URI
+var ErrNoRedirectURIs = errors.New("at least one redirect URI is required")
+
+// OIDCClient is an application that delegates login to this service
+type OIDCClient struct {
+	ID           int
+	ClientID     string
+	Name         string
+	RedirectURIs []string
+	// Public clients, such as single-page or mobile apps, can't keep a secret
+	// and authenticate with PKCE alone
+	Public     bool
+	CreatedAt  time.Time
+	secretHash string
+}
+
+// AllowsRedirect reports whether a redirect URI is registered for the client. URIs must match exactly.
+func (c *OIDCClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecret reports whether a client secret is correct. Public clients have no secret.
+func (c *OIDCClient) CheckSecret(secret string) bool {
+	if c.Public || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(utils.HashToken(secret)), []byte(c.secretHash)) == 1
+}
+
+// CreateOIDCClient registers a client. The secret of a confidential client is
+// only returned here; just its hash is stored.
+func CreateOIDCClient(name string, redirectURIs []string, public bool) (string, *OIDCClient, error) {
+	if len(redirectURIs) == 0 {
+		return "", nil, ErrNoRedirectURIs
+	}
+
+	clientID, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var secret, secretHash string
+	if !public {
+		secret, err = utils.GenerateSecureToken()
+		if err != nil {
+			return "", nil, err
+		}
+		secretHash = utils.HashToken(secret)
+	}
+
+	client := &OIDCClient{
+		ClientID:     clientID,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Public:       public,
+		CreatedAt:    time.Now(),
+		secretHash:   secretHash,
+	}
+	result, err := database.DB.Exec(`
+	INSERT INTO oidc_clients (client_id, client_secret_hash, name, redirect_uris, public, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		client.ClientID, secretHash, name, strings.Join(redirectURIs, "\n"), public, client.CreatedAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	client.ID = int(id)
+
+	return secret, client, nil
+}
+
+// GetOIDCClient returns the client with a client ID
+func GetOIDCClient(clientID string) (*OIDCClient, error) {
+	client := &OIDCClient{}
+	var redirectURIs string
+	err := database.DB.QueryRow(`
+	SELECT id, client_id, client_secret_hash, name, redirect_uris, public, created_at
+	FROM oidc_clients WHERE client_id = ?`, clientID,
+	).Scan(&client.ID, &client.ClientID, &client.secretHash, &client.Name, &redirectURIs, &client.Public, &client.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrOIDCClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	return client, nil
+}
+
+// GetOIDCClients returns all registered clients ordered by name
+func GetOIDCClients() ([]*OIDCClient, error) {
+	rows, err := database.DB.Query(`
+	SELECT id, client_id, client_secret_hash, name, redirect_uris, public, created_at
+	FROM oidc_clients ORDER BY name, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := make([]*OIDCClient, 0)
+	for rows.Next() {
+		client := &OIDCClient{}
+		var redirectURIs string
+		if err := rows.Scan(
+			&client.ID, &client.ClientID, &client.secretHash, &client.Name, &redirectURIs, &client.Public, &client.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		client.RedirectURIs = strings.Fields(redirectURIs)
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+// UpdateOIDCClientRedirectURIs replaces the redirect URIs registered for a client
+func UpdateOIDCClientRedirectURIs(id int, redirectURIs []string) error {
+	if len(redirectURIs) == 0 {
+		return ErrNoRedirectURIs
+	}
+
+	result, err := database.DB.Exec(
+		`UPDATE oidc_clients SET redirect_uris = ? WHERE id = ?`,
+		strings.Join(redirectURIs, "\n"), id,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrOIDCClientNotFound
+	}
+	return nil
+}
+
+// DeleteOIDCClient removes a client along with its outstanding codes and access tokens
+func DeleteOIDCClient(id int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var clientID string
+	err = tx.QueryRow(`SELECT client_id FROM oidc_clients WHERE id = ?`, id).Scan(&clientID)
+	if err == sql.ErrNoRows {
+		return ErrOIDCClientNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM oidc_auth_codes WHERE client_id = ?`,
+		`DELETE FROM oidc_access_tokens WHERE client_id = ?`,
+		`DELETE FROM oidc_clients WHERE client_id = ?`,
+	} {
+		if _, err := tx.Exec(query, clientID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// OIDCAuthCodeTTL is how long an authorization code can be exchanged for tokens
+const OIDCAuthCodeTTL = 5 * time.Minute
+
+// OIDCAccessTokenTTL is how long an access token works at the userinfo endpoint
+const OIDCAccessTokenTTL = time.Hour
+
+// ErrInvalidOIDCGrant is returned for unknown, expired or already used codes and tokens
+var ErrInvalidOIDCGrant = errors.New("invalid or expired authorization grant")
+
+// OIDCAuthCode is a login a client can exchange for tokens
+type OIDCAuthCode struct {
+	ClientID      string
+	UserID        int
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	// AMR lists the authentication methods the user passed, as RFC 8176 values
+	AMR      []string
+	AuthTime time.Time
+}
+
+// OIDCAccessToken is a token a client uses at the userinfo endpoint
+type OIDCAccessToken struct {
+	ClientID  string
+	UserID    int
+	Scope     string
+	ExpiresAt time.Time
+}
+
+// HasScope reports whether the access token was granted a scope
+func (t *OIDCAccessToken) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateOIDCAuthCode stores an authorization code and returns it. Only its hash is stored.
+func CreateOIDCAuthCode(code *OIDCAuthCode) (string, error) {
+	now := time.Now()
+
+	// Opportunistically drop codes and tokens nobody can use any more
+	if _, err := database.DB.Exec(`DELETE FROM oidc_auth_codes WHERE expires_at < ?`, now); err != nil {
+		log.Printf("Error cleaning up expired authorization codes: %v", err)
+	}
+	if _, err := database.DB.Exec(`DELETE FROM oidc_access_tokens WHERE expires_at < ?`, now); err != nil {
+		log.Printf("Error cleaning up expired access tokens: %v", err)
+	}
+
+	value, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.DB.Exec(`
+	INSERT INTO oidc_auth_codes (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, amr, auth_time, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		utils.HashToken(value), code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.Nonce,
+		code.CodeChallenge, strings.Join(code.AMR, " "), code.AuthTime, now.Add(OIDCAuthCodeTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// ConsumeOIDCAuthCode returns the login behind an authorization code issued to
+// a client and marks the code used, so it can only be exchanged once
+func ConsumeOIDCAuthCode(value, clientID string) (*OIDCAuthCode, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	codeHash := utils.HashToken(value)
+
+	// Claim the code first so two concurrent exchanges can't both succeed
+	result, err := tx.Exec(
+		`UPDATE oidc_auth_codes SET used_at = ? WHERE code_hash = ? AND client_id = ? AND used_at IS NULL AND expires_at > ?`,
+		now, codeHash, clientID, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, ErrInvalidOIDCGrant
+	}
+
+	code := &OIDCAuthCode{}
+	var amr string
+	err = tx.QueryRow(`
+	SELECT client_id, user_id, redirect_uri, scope, nonce, code_challenge, amr, auth_time
+	FROM oidc_auth_codes WHERE code_hash = ?`, codeHash,
+	).Scan(&code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.Nonce, &code.CodeChallenge, &amr, &code.AuthTime)
+	if err != nil {
+		return nil, err
+	}
+	code.AMR = strings.Fields(amr)
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// CreateOIDCAccessToken issues an access token and returns it. Only its hash is stored.
+func CreateOIDCAccessToken(clientID string, userID int, scope string) (string, *OIDCAccessToken, error) {
+	value, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := &OIDCAccessToken{
+		ClientID:  clientID,
+		UserID:    userID,
+		Scope:     scope,
+		ExpiresAt: time.Now().Add(OIDCAccessTokenTTL),
+	}
+	_, err = database.DB.Exec(
+		`INSERT INTO oidc_access_tokens (token_hash, client_id, user_id, scope, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		utils.HashToken(value), token.ClientID, token.UserID, token.Scope, token.ExpiresAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	return value, token, nil
+}
+
+// GetOIDCAccessToken returns the unexpired access token matching a presented token
+func GetOIDCAccessToken(value string) (*OIDCAccessToken, error) {
+	token := &OIDCAccessToken{}
+	err := database.DB.QueryRow(
+		`SELECT client_id, user_id, scope, expires_at FROM oidc_access_tokens WHERE token_hash = ? AND expires_at > ?`,
+		utils.HashToken(value), time.Now(),
+	).Scan(&token.ClientID, &token.UserID, &token.Scope, &token.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
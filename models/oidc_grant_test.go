@@ -0,0 +1,107 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+func TestConsumeOIDCAuthCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		expire   bool
+		consumes int
+		wantErr  bool
+	}{
+		{"first exchange", "client-a", false, 0, false},
+		{"second exchange", "client-a", false, 1, true},
+		{"another client", "client-b", false, 0, true},
+		{"expired code", "client-a", true, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com")
+
+			value, err := CreateOIDCAuthCode(&OIDCAuthCode{
+				ClientID:      "client-a",
+				UserID:        user.ID,
+				RedirectURI:   "https://app.example.com/callback",
+				Scope:         "openid email",
+				Nonce:         "nonce",
+				CodeChallenge: "challenge",
+				AMR:           []string{"pwd", "otp"},
+				AuthTime:      time.Now(),
+			})
+			if err != nil {
+				t.Fatalf("CreateOIDCAuthCode: %v", err)
+			}
+
+			if tt.expire {
+				if _, err := database.DB.Exec(`UPDATE oidc_auth_codes SET expires_at = ?`, time.Now().Add(-time.Minute)); err != nil {
+					t.Fatalf("expire code: %v", err)
+				}
+			}
+			for i := 0; i < tt.consumes; i++ {
+				if _, err := ConsumeOIDCAuthCode(value, "client-a"); err != nil {
+					t.Fatalf("ConsumeOIDCAuthCode: %v", err)
+				}
+			}
+
+			code, err := ConsumeOIDCAuthCode(value, tt.clientID)
+			if tt.wantErr {
+				if err != ErrInvalidOIDCGrant {
+					t.Errorf("ConsumeOIDCAuthCode error = %v, want %v", err, ErrInvalidOIDCGrant)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ConsumeOIDCAuthCode: %v", err)
+			}
+			if code.UserID != user.ID || code.Scope != "openid email" || code.Nonce != "nonce" || code.CodeChallenge != "challenge" {
+				t.Errorf("ConsumeOIDCAuthCode returned %+v", code)
+			}
+			if len(code.AMR) != 2 || code.AMR[0] != "pwd" || code.AMR[1] != "otp" {
+				t.Errorf("AMR = %v, want [pwd otp]", code.AMR)
+			}
+		})
+	}
+}
+
+func TestOIDCAccessTokenScope(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+
+	value, _, err := CreateOIDCAccessToken("client-a", user.ID, "openid email")
+	if err != nil {
+		t.Fatalf("CreateOIDCAccessToken: %v", err)
+	}
+	token, err := GetOIDCAccessToken(value)
+	if err != nil {
+		t.Fatalf("GetOIDCAccessToken: %v", err)
+	}
+
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"openid", true},
+		{"email", true},
+		{"profile", false},
+		{"open", false},
+		{"openid email", false},
+	}
+
+	for _, tt := range tests {
+		if got := token.HasScope(tt.scope); got != tt.want {
+			t.Errorf("HasScope(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+
+	if _, err := GetOIDCAccessToken("unknown"); err != ErrInvalidOIDCGrant {
+		t.Errorf("GetOIDCAccessToken(unknown) error = %v, want %v", err, ErrInvalidOIDCGrant)
+	}
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// oidcSigningKeyBits is the size of generated ID token signing keys
+const oidcSigningKeyBits = 2048
+
+// ErrNoOIDCSigningKey is returned when no ID token signing key has been created
+var ErrNoOIDCSigningKey = errors.New("no OIDC signing key")
+
+// OIDCSigningKey is an RSA key that signs ID tokens
+type OIDCSigningKey struct {
+	KID       string
+	Key       *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// EnsureOIDCSigningKey creates the ID token signing key if there is none yet.
+// It returns true if a key was created.
+func EnsureOIDCSigningKey() (bool, error) {
+	var count int
+	if err := database.DB.QueryRow(`SELECT COUNT(*) FROM oidc_signing_keys`).Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, oidcSigningKeyBits)
+	if err != nil {
+		return false, err
+	}
+	kid, err := utils.GenerateSecureToken()
+	if err != nil {
+		return false, err
+	}
+	kid = kid[:16]
+
+	stored, err := utils.EncryptSecret(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = database.DB.Exec(
+		`INSERT INTO oidc_signing_keys (kid, private_key, created_at) VALUES (?, ?, ?)`,
+		kid, stored, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetOIDCSigningKey returns the newest key, which signs new ID tokens
+func GetOIDCSigningKey() (*OIDCSigningKey, error) {
+	keys, err := GetOIDCSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoOIDCSigningKey
+	}
+	return keys[0], nil
+}
+
+// GetOIDCSigningKeys returns all signing keys, newest first. Older keys are
+// still published so tokens they signed can be verified.
+func GetOIDCSigningKeys() ([]*OIDCSigningKey, error) {
+	rows, err := database.DB.Query(`SELECT kid, private_key, created_at FROM oidc_signing_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*OIDCSigningKey, 0)
+	for rows.Next() {
+		key := &OIDCSigningKey{}
+		var stored string
+		if err := rows.Scan(&key.KID, &stored, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		key.Key, err = decodeOIDCSigningKey(stored)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %v", key.KID, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// ReencryptOIDCSigningKeys re-encrypts every signing key that isn't under the
+// active encryption key. It returns the number of keys it changed.
+func ReencryptOIDCSigningKeys() (int, error) {
+	active := utils.ActiveEncryptionKeyID()
+
+	rows, err := database.DB.Query(`SELECT kid, private_key FROM oidc_signing_keys`)
+	if err != nil {
+		return 0, err
+	}
+	stored := make(map[string]string)
+	for rows.Next() {
+		var kid, value string
+		if err := rows.Scan(&kid, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stored[kid] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for kid, value := range stored {
+		if utils.SecretKeyID(value) == active {
+			continue
+		}
+
+		plaintext, err := utils.DecryptSecret(value)
+		if err != nil {
+			return changed, fmt.Errorf("signing key %s: %v", kid, err)
+		}
+		encrypted, err := utils.EncryptSecret(plaintext)
+		if err != nil {
+			return changed, err
+		}
+		if _, err := database.DB.Exec(`UPDATE oidc_signing_keys SET private_key = ? WHERE kid = ?`, encrypted, kid); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
+// decodeOIDCSigningKey decrypts and parses a stored private key
+func decodeOIDCSigningKey(stored string) (*rsa.PrivateKey, error) {
+	plaintext, err := utils.DecryptSecret(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(plaintext))
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
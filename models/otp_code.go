@@ -0,0 +1,167 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// Purposes a one-time code is issued for
+const (
+	OTPPurposeLogin = "login"
+	OTPPurposeSetup = "setup"
+)
+
+// OTPCodeTTL is how long a delivered one-time code stays valid
+const OTPCodeTTL = 10 * time.Minute
+
+// MaxOTPAttempts is the number of wrong guesses after which a code stops working
+const MaxOTPAttempts = 5
+
+// otpResendCooldown is the minimum time between two codes for the same user and purpose
+const otpResendCooldown = 30 * time.Second
+
+// ErrOTPTooSoon is returned when a new code was requested within the cooldown
+var ErrOTPTooSoon = errors.New("a code was sent too recently")
+
+// ErrOTPAttemptsExhausted is returned when a new code was requested after the
+// wrong guesses allowed for the current one were used up
+var ErrOTPAttemptsExhausted = errors.New("too many wrong codes were entered")
+
+// CreateOTPCode issues a new one-time code for a user, replacing any earlier
+// one for the same purpose. Only the hash is stored; the code is returned so
+// it can be delivered. Wrong guesses at a code that hasn't expired carry over
+// to the new one, so resending doesn't grant more attempts.
+func CreateOTPCode(userID int, purpose string) (string, error) {
+	now := time.Now()
+
+	var attempts int
+	var createdAt, expiresAt time.Time
+	err := database.DB.QueryRow(
+		"SELECT attempts, created_at, expires_at FROM otp_codes WHERE user_id = ? AND purpose = ?", userID, purpose,
+	).Scan(&attempts, &createdAt, &expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	keepAttempts := err == nil && now.Before(expiresAt)
+
+	// Don't let the resend button be used to flood a mailbox or phone
+	if err == nil && now.Sub(createdAt) < otpResendCooldown {
+		return "", ErrOTPTooSoon
+	}
+	if keepAttempts && attempts >= MaxOTPAttempts {
+		return "", ErrOTPAttemptsExhausted
+	}
+
+	code, err := utils.GenerateOTPCode()
+	if err != nil {
+		return "", err
+	}
+	hash, err := utils.HashOTPCode(code)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.DB.Exec(`
+	INSERT INTO otp_codes (user_id, purpose, code_hash, attempts, created_at, expires_at)
+	VALUES (?, ?, ?, 0, ?, ?)
+	ON CONFLICT(user_id, purpose) DO UPDATE SET
+		code_hash = excluded.code_hash,
+		attempts = CASE WHEN ? THEN otp_codes.attempts ELSE 0 END,
+		created_at = excluded.created_at,
+		expires_at = excluded.expires_at`,
+		userID, purpose, hash, now, now.Add(OTPCodeTTL), keepAttempts,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// HasActiveOTPCode reports whether a user has a code for the purpose that can still be used
+func HasActiveOTPCode(userID int, purpose string) (bool, error) {
+	var attempts int
+	var expiresAt time.Time
+	err := database.DB.QueryRow(
+		"SELECT attempts, expires_at FROM otp_codes WHERE user_id = ? AND purpose = ?", userID, purpose,
+	).Scan(&attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return attempts < MaxOTPAttempts && time.Now().Before(expiresAt), nil
+}
+
+// VerifyOTPCode checks a one-time code for a user. Every check counts as an
+// attempt, and a matching code is deleted so it can only be used once.
+// db is database.DB, or a transaction the check is part of.
+func VerifyOTPCode(db database.Executor, userID int, purpose, code string) (bool, error) {
+	var hash string
+	var expiresAt time.Time
+	err := db.QueryRow(
+		"SELECT code_hash, expires_at FROM otp_codes WHERE user_id = ? AND purpose = ?", userID, purpose,
+	).Scan(&hash, &expiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !time.Now().Before(expiresAt) {
+		return false, deleteOTPCode(db, userID, purpose)
+	}
+
+	// Count the attempt before comparing, so parallel guesses can't exceed the limit
+	result, err := db.Exec(
+		"UPDATE otp_codes SET attempts = attempts + 1 WHERE user_id = ? AND purpose = ? AND attempts < ?",
+		userID, purpose, MaxOTPAttempts,
+	)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+
+	if !utils.CheckOTPCodeHash(code, hash) {
+		return false, nil
+	}
+
+	// Delete the code; only the request that deletes it may use it
+	result, err = db.Exec(
+		"DELETE FROM otp_codes WHERE user_id = ? AND purpose = ? AND code_hash = ?", userID, purpose, hash,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// DeleteOTPCode removes a user's code for a purpose
+func DeleteOTPCode(userID int, purpose string) error {
+	return deleteOTPCode(database.DB, userID, purpose)
+}
+
+// deleteOTPCode removes a user's code for a purpose, possibly inside a transaction
+func deleteOTPCode(db database.Executor, userID int, purpose string) error {
+	_, err := db.Exec("DELETE FROM otp_codes WHERE user_id = ? AND purpose = ?", userID, purpose)
+	return err
+}
+
+// DeleteOTPCodes removes all of a user's one-time codes
+func DeleteOTPCodes(userID int) error {
+	_, err := database.DB.Exec("DELETE FROM otp_codes WHERE user_id = ?", userID)
+	return err
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+// backdateOTPCode moves a code's send time back past the resend cooldown,
+// and its expiry back by the given amount
+func backdateOTPCode(t *testing.T, userID int, purpose string, expireBy time.Duration) {
+	t.Helper()
+
+	now := time.Now()
+	_, err := database.DB.Exec(
+		"UPDATE otp_codes SET created_at = ?, expires_at = ? WHERE user_id = ? AND purpose = ?",
+		now.Add(-otpResendCooldown-time.Second), now.Add(OTPCodeTTL-expireBy), userID, purpose,
+	)
+	if err != nil {
+		t.Fatalf("backdate one-time code: %v", err)
+	}
+}
+
+// guessOTPCode makes wrong guesses at a user's code
+func guessOTPCode(t *testing.T, userID int, purpose string, guesses int) {
+	t.Helper()
+
+	for i := 0; i < guesses; i++ {
+		if valid, err := VerifyOTPCode(database.DB, userID, purpose, "not-the-code"); err != nil || valid {
+			t.Fatalf("wrong guess %d = (%v, %v)", i+1, valid, err)
+		}
+	}
+}
+
+func TestCreateOTPCode(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+
+	first, err := CreateOTPCode(user.ID, OTPPurposeLogin)
+	if err != nil {
+		t.Fatalf("CreateOTPCode: %v", err)
+	}
+	if len(first) != 6 {
+		t.Errorf("code %q is not 6 digits", first)
+	}
+
+	// Codes for another purpose have their own cooldown
+	if _, err := CreateOTPCode(user.ID, OTPPurposeSetup); err != nil {
+		t.Errorf("CreateOTPCode for setup: %v", err)
+	}
+
+	if _, err := CreateOTPCode(user.ID, OTPPurposeLogin); err != ErrOTPTooSoon {
+		t.Fatalf("resend within the cooldown = %v, want %v", err, ErrOTPTooSoon)
+	}
+
+	// A resend replaces the earlier code
+	backdateOTPCode(t, user.ID, OTPPurposeLogin, 0)
+	second, err := CreateOTPCode(user.ID, OTPPurposeLogin)
+	if err != nil {
+		t.Fatalf("resend after the cooldown: %v", err)
+	}
+	if first != second {
+		if valid, _ := VerifyOTPCode(database.DB, user.ID, OTPPurposeLogin, first); valid {
+			t.Error("the replaced code still works")
+		}
+	}
+	if valid, err := VerifyOTPCode(database.DB, user.ID, OTPPurposeLogin, second); err != nil || !valid {
+		t.Errorf("the new code = (%v, %v), want valid", valid, err)
+	}
+}
+
+func TestVerifyOTPCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		purpose    string
+		wrongFirst int
+		expired    bool
+		wantValid  bool
+		wantActive bool
+	}{
+		{"correct code", OTPPurposeLogin, 0, false, true, false},
+		{"correct after some wrong guesses", OTPPurposeLogin, MaxOTPAttempts - 1, false, true, false},
+		{"correct after the limit", OTPPurposeLogin, MaxOTPAttempts, false, false, false},
+		{"expired", OTPPurposeLogin, 0, true, false, false},
+		{"issued for another purpose", OTPPurposeSetup, 0, false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			user := createTestUser(t, "user@example.com")
+
+			code, err := CreateOTPCode(user.ID, OTPPurposeLogin)
+			if err != nil {
+				t.Fatalf("CreateOTPCode: %v", err)
+			}
+			guessOTPCode(t, user.ID, OTPPurposeLogin, tt.wrongFirst)
+			if tt.expired {
+				backdateOTPCode(t, user.ID, OTPPurposeLogin, OTPCodeTTL+time.Minute)
+			}
+
+			valid, err := VerifyOTPCode(database.DB, user.ID, tt.purpose, code)
+			if err != nil || valid != tt.wantValid {
+				t.Errorf("VerifyOTPCode = (%v, %v), want %v", valid, err, tt.wantValid)
+			}
+
+			// A code works once at most
+			if valid, _ := VerifyOTPCode(database.DB, user.ID, tt.purpose, code); valid {
+				t.Error("the code worked twice")
+			}
+			if active, err := HasActiveOTPCode(user.ID, OTPPurposeLogin); err != nil || active != tt.wantActive {
+				t.Errorf("HasActiveOTPCode = (%v, %v), want %v", active, err, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestOTPAttemptsSurviveResend(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+
+	if _, err := CreateOTPCode(user.ID, OTPPurposeLogin); err != nil {
+		t.Fatalf("CreateOTPCode: %v", err)
+	}
+	guessOTPCode(t, user.ID, OTPPurposeLogin, MaxOTPAttempts-1)
+
+	// The new code only gets the guesses the old one had left
+	backdateOTPCode(t, user.ID, OTPPurposeLogin, 0)
+	code, err := CreateOTPCode(user.ID, OTPPurposeLogin)
+	if err != nil {
+		t.Fatalf("resend: %v", err)
+	}
+	guessOTPCode(t, user.ID, OTPPurposeLogin, 1)
+	if valid, err := VerifyOTPCode(database.DB, user.ID, OTPPurposeLogin, code); err != nil || valid {
+		t.Fatalf("code after the limit across a resend = (%v, %v), want invalid", valid, err)
+	}
+
+	// No more codes are sent until the used-up one expires
+	backdateOTPCode(t, user.ID, OTPPurposeLogin, 0)
+	if _, err := CreateOTPCode(user.ID, OTPPurposeLogin); err != ErrOTPAttemptsExhausted {
+		t.Fatalf("resend after the limit = %v, want %v", err, ErrOTPAttemptsExhausted)
+	}
+
+	// Then the count starts over
+	backdateOTPCode(t, user.ID, OTPPurposeLogin, OTPCodeTTL+time.Minute)
+	code, err = CreateOTPCode(user.ID, OTPPurposeLogin)
+	if err != nil {
+		t.Fatalf("resend after expiry: %v", err)
+	}
+	guessOTPCode(t, user.ID, OTPPurposeLogin, MaxOTPAttempts-1)
+	if valid, err := VerifyOTPCode(database.DB, user.ID, OTPPurposeLogin, code); err != nil || !valid {
+		t.Errorf("code after expiry = (%v, %v), want valid", valid, err)
+	}
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// PasswordResetTokenTTL is how long a password reset link stays valid
+const PasswordResetTokenTTL = time.Hour
+
+// passwordResetCooldown is the minimum time between two reset emails for the same account
+const passwordResetCooldown = time.Minute
+
+// ErrInvalidResetToken is returned for unknown, expired or already used reset tokens
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// ErrResetTooSoon is returned when a reset was requested again within the cooldown
+var ErrResetTooSoon = errors.New("password reset requested too recently")
+
+// CreatePasswordResetToken issues a new reset token for a user and invalidates
+// any earlier unused ones. Only the hash of the token is stored.
+func CreatePasswordResetToken(userID int) (string, error) {
+	now := time.Now()
+
+	// Don't let the form be used to flood a mailbox
+	var recent int
+	err := database.DB.QueryRow(
+		`SELECT COUNT(*) FROM password_reset_tokens WHERE user_id = ? AND created_at > ?`,
+		userID, now.Add(-passwordResetCooldown),
+	).Scan(&recent)
+	if err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", ErrResetTooSoon
+	}
+
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Only the most recent link works
+	_, err = tx.Exec(
+		`UPDATE password_reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL`,
+		now, userID,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		userID, utils.HashToken(token), now, now.Add(PasswordResetTokenTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ValidatePasswordResetToken returns the user a reset token belongs to without using it up
+func ValidatePasswordResetToken(token string) (int, error) {
+	var userID int
+	err := database.DB.QueryRow(
+		`SELECT user_id FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		utils.HashToken(token), time.Now(),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, err
+}
+
+// ConsumePasswordResetToken marks a reset token as used and returns its user.
+// A token can only be consumed once, even by concurrent requests.
+func ConsumePasswordResetToken(token string) (int, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	hash := utils.HashToken(token)
+
+	var id, userID int
+	err = tx.QueryRow(
+		`SELECT id, user_id FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hash, now,
+	).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE password_reset_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`,
+		now, id,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return 0, ErrInvalidResetToken
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
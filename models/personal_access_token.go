@@ -0,0 +1,200 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// Scopes a personal access token can be granted
+const (
+	ScopeProfileRead = "profile:read"
+	ScopeHistoryRead = "history:read"
+)
+
+// TokenScope describes a scope offered when creating a personal access token
+type TokenScope struct {
+	Name        string
+	Description string
+}
+
+// PersonalTokenScopes lists the scopes in the order they are offered
+var PersonalTokenScopes = []TokenScope{
+	{ScopeProfileRead, "Read your profile"},
+	{ScopeHistoryRead, "Read your login history"},
+}
+
+// ErrInvalidPersonalToken is returned for unknown, expired or revoked personal access tokens
+var ErrInvalidPersonalToken = errors.New("invalid, expired or revoked personal access token")
+
+// ErrPersonalTokenNotFound is returned when a token to revoke does not exist
+var ErrPersonalTokenNotFound = errors.New("personal access token not found")
+
+// ErrUnknownScope is returned when creating a token with a scope that doesn't exist
+var ErrUnknownScope = errors.New("unknown scope")
+
+// PersonalAccessToken is a named, scoped and expiring token a user created to call the API
+type PersonalAccessToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	LastUsedIP string
+}
+
+// HasScope reports whether the token was granted a scope
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token can no longer be used because it expired
+func (t *PersonalAccessToken) Expired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// IsTokenScope checks whether a scope can be granted to a personal access token
+func IsTokenScope(scope string) bool {
+	for _, s := range PersonalTokenScopes {
+		if s.Name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePersonalAccessToken issues a token for a user that expires after ttl.
+// The token itself is only returned here; just its hash is stored.
+func CreatePersonalAccessToken(userID int, name string, scopes []string, ttl time.Duration) (string, *PersonalAccessToken, error) {
+	for _, scope := range scopes {
+		if !IsTokenScope(scope) {
+			return "", nil, ErrUnknownScope
+		}
+	}
+
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	pat := &PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	result, err := database.DB.Exec(`
+	INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, name, utils.HashToken(token), strings.Join(scopes, " "), pat.CreatedAt, pat.ExpiresAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	pat.ID = int(id)
+
+	return token, pat, nil
+}
+
+// AuthenticatePersonalAccessToken returns the active, unexpired token matching a
+// presented token and records when and from where it was used
+func AuthenticatePersonalAccessToken(token, ipAddress string) (*PersonalAccessToken, error) {
+	now := time.Now()
+
+	pat := &PersonalAccessToken{}
+	var scopes string
+	err := database.DB.QueryRow(`
+	SELECT id, user_id, name, scopes, created_at, expires_at
+	FROM personal_access_tokens
+	WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?`,
+		utils.HashToken(token), now,
+	).Scan(&pat.ID, &pat.UserID, &pat.Name, &scopes, &pat.CreatedAt, &pat.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidPersonalToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	pat.Scopes = strings.Fields(scopes)
+
+	pat.LastUsedAt = now
+	pat.LastUsedIP = ipAddress
+	_, err = database.DB.Exec(
+		`UPDATE personal_access_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ?`,
+		now, ipAddress, pat.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return pat, nil
+}
+
+// GetPersonalAccessTokens returns a user's tokens that haven't been revoked,
+// including expired ones, newest first
+func GetPersonalAccessTokens(userID int) ([]*PersonalAccessToken, error) {
+	rows, err := database.DB.Query(`
+	SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at, last_used_ip
+	FROM personal_access_tokens
+	WHERE user_id = ? AND revoked_at IS NULL
+	ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]*PersonalAccessToken, 0)
+	for rows.Next() {
+		pat := &PersonalAccessToken{}
+		var scopes string
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(
+			&pat.ID, &pat.UserID, &pat.Name, &scopes, &pat.CreatedAt, &pat.ExpiresAt, &lastUsedAt, &pat.LastUsedIP,
+		); err != nil {
+			return nil, err
+		}
+		pat.Scopes = strings.Fields(scopes)
+		pat.LastUsedAt = lastUsedAt.Time
+		tokens = append(tokens, pat)
+	}
+
+	return tokens, rows.Err()
+}
+
+// RevokePersonalAccessToken stops one of a user's tokens from being used
+func RevokePersonalAccessToken(userID, id int) error {
+	result, err := database.DB.Exec(
+		`UPDATE personal_access_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL`,
+		time.Now(), id, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrPersonalTokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// ReplaceRecoveryCodes generates a new set of recovery codes for a user,
+// replacing any existing ones. Only the hashes are stored; the plaintext
+// codes are returned so they can be shown to the user once.
+func ReplaceRecoveryCodes(userID int) ([]string, error) {
+	codes, err := utils.GenerateRecoveryCodes(utils.RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hash, err := utils.HashRecoveryCode(code)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, hash := range hashes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, hash, now,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode checks a recovery code for a user and marks it as used.
+// It returns false if the code does not match any unused code. db is
+// database.DB, or a transaction the check is part of.
+func UseRecoveryCode(db database.Executor, userID int, code string) (bool, error) {
+	rows, err := db.Query(
+		"SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	matchedID := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if utils.CheckRecoveryCodeHash(code, hash) {
+			matchedID = id
+			break
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if matchedID == 0 {
+		return false, nil
+	}
+
+	// Mark the code as used only if no concurrent request already did
+	result, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL",
+		time.Now(), matchedID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// CountUnusedRecoveryCodes returns the number of recovery codes a user has left
+func CountUnusedRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := database.DB.QueryRow(
+		"SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// DeleteRecoveryCodes removes all recovery codes for a user
+func DeleteRecoveryCodes(userID int) error {
+	_, err := database.DB.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	return err
+}
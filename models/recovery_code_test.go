@@ -0,0 +1,85 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/aungh/login-form/database"
+)
+
+func TestUseRecoveryCode(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+	other := createTestUser(t, "other@example.com")
+
+	codes, err := ReplaceRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+
+	// The steps run in order against the same set of codes
+	tests := []struct {
+		name      string
+		userID    int
+		code      string
+		want      bool
+		wantCount int
+	}{
+		{"unused code", user.ID, codes[0], true, len(codes) - 1},
+		{"same code again", user.ID, codes[0], false, len(codes) - 1},
+		{"code without the dash", user.ID, codes[1][:5] + codes[1][6:], true, len(codes) - 2},
+		{"unknown code", user.ID, "aaaaa-aaaaa", false, len(codes) - 2},
+		{"another user's code", other.ID, codes[2], false, len(codes) - 2},
+	}
+
+	for _, tt := range tests {
+		used, err := UseRecoveryCode(database.DB, tt.userID, tt.code)
+		if err != nil {
+			t.Fatalf("%s: UseRecoveryCode: %v", tt.name, err)
+		}
+		if used != tt.want {
+			t.Errorf("%s: UseRecoveryCode = %v, want %v", tt.name, used, tt.want)
+		}
+
+		count, err := CountUnusedRecoveryCodes(user.ID)
+		if err != nil {
+			t.Fatalf("%s: CountUnusedRecoveryCodes: %v", tt.name, err)
+		}
+		if count != tt.wantCount {
+			t.Errorf("%s: %d unused codes, want %d", tt.name, count, tt.wantCount)
+		}
+	}
+}
+
+func TestReplaceRecoveryCodes(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+
+	oldCodes, err := ReplaceRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if _, err := UseRecoveryCode(database.DB, user.ID, oldCodes[0]); err != nil {
+		t.Fatalf("UseRecoveryCode: %v", err)
+	}
+
+	newCodes, err := ReplaceRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+
+	count, err := CountUnusedRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("CountUnusedRecoveryCodes: %v", err)
+	}
+	if count != len(newCodes) {
+		t.Errorf("%d unused codes after replacing, want %d", count, len(newCodes))
+	}
+
+	// Codes from the old set stop working
+	if used, err := UseRecoveryCode(database.DB, user.ID, oldCodes[1]); err != nil || used {
+		t.Errorf("old code: UseRecoveryCode = (%v, %v), want (false, nil)", used, err)
+	}
+	if used, err := UseRecoveryCode(database.DB, user.ID, newCodes[0]); err != nil || !used {
+		t.Errorf("new code: UseRecoveryCode = (%v, %v), want (true, nil)", used, err)
+	}
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/aungh/login-form/database"
+)
+
+// Built-in roles
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Permissions checked by handlers and middleware
+const (
+	PermissionViewUsers   = "users.view"
+	PermissionManageUsers = "users.manage"
+	PermissionAssignRoles = "roles.assign"
+	PermissionManageMFA   = "mfa.manage"
+	PermissionViewAudit   = "audit.view"
+	PermissionManageAPI   = "api_tokens.manage"
+	PermissionManageOIDC  = "oidc.manage"
+)
+
+// ErrUnknownRole is returned when assigning a role that doesn't exist
+var ErrUnknownRole = errors.New("unknown role")
+
+// Role is a named set of permissions
+type Role struct {
+	ID          int
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// GetRoles returns all roles with their permissions, ordered by name
+func GetRoles() ([]*Role, error) {
+	rows, err := database.DB.Query(`SELECT id, name, description FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]*Role, 0)
+	for rows.Next() {
+		role := &Role{}
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		role.Permissions, err = GetRolePermissions(role.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return roles, nil
+}
+
+// RoleExists checks whether a role with the given name exists
+func RoleExists(name string) (bool, error) {
+	var count int
+	err := database.DB.QueryRow(`SELECT COUNT(*) FROM roles WHERE name = ?`, name).Scan(&count)
+	return count > 0, err
+}
+
+// GetRolePermissions returns the names of the permissions granted to a role
+func GetRolePermissions(roleName string) ([]string, error) {
+	query := `
+	SELECT permissions.name
+	FROM permissions
+	JOIN role_permissions ON role_permissions.permission_id = permissions.id
+	JOIN roles ON roles.id = role_permissions.role_id
+	WHERE roles.name = ?
+	ORDER BY permissions.name
+	`
+
+	rows, err := database.DB.Query(query, roleName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+
+	return permissions, rows.Err()
+}
+
+// HasPermission checks whether a role grants a permission
+func HasPermission(roleName, permission string) (bool, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM role_permissions
+	JOIN roles ON roles.id = role_permissions.role_id
+	JOIN permissions ON permissions.id = role_permissions.permission_id
+	WHERE roles.name = ? AND permissions.name = ?
+	`
+
+	var count int
+	err := database.DB.QueryRow(query, roleName, permission).Scan(&count)
+	return count > 0, err
+}
+
+// RoleExceeds reports whether a role grants a permission that another role doesn't
+func RoleExceeds(roleName, otherRole string) (bool, error) {
+	var count int
+	err := database.DB.QueryRow(`
+	SELECT COUNT(*)
+	FROM role_permissions
+	JOIN roles ON roles.id = role_permissions.role_id
+	WHERE roles.name = ? AND role_permissions.permission_id NOT IN (
+		SELECT role_permissions.permission_id
+		FROM role_permissions
+		JOIN roles ON roles.id = role_permissions.role_id
+		WHERE roles.name = ?
+	)`, roleName, otherRole).Scan(&count)
+	return count > 0, err
+}
+
+// AssignRole changes the role of a user
+func AssignRole(userID int, roleName string) error {
+	exists, err := RoleExists(roleName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUnknownRole
+	}
+
+	user, err := GetUserByIDSafe(userID)
+	if err != nil {
+		return err
+	}
+
+	user.Role = roleName
+	return UpdateUser(user)
+}
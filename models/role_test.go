@@ -0,0 +1,75 @@
+package models
+
+import "testing"
+
+func TestHasPermission(t *testing.T) {
+	setupTestDB(t)
+
+	allPermissions := []string{
+		PermissionViewUsers,
+		PermissionManageUsers,
+		PermissionAssignRoles,
+		PermissionManageMFA,
+		PermissionViewAudit,
+		PermissionManageAPI,
+		PermissionManageOIDC,
+	}
+
+	tests := []struct {
+		role string
+		want bool
+	}{
+		{RoleAdmin, true},
+		{RoleUser, false},
+		{"unknown", false},
+	}
+
+	for _, tt := range tests {
+		for _, permission := range allPermissions {
+			got, err := HasPermission(tt.role, permission)
+			if err != nil {
+				t.Fatalf("HasPermission(%q, %q): %v", tt.role, permission, err)
+			}
+			if got != tt.want {
+				t.Errorf("HasPermission(%q, %q) = %v, want %v", tt.role, permission, got, tt.want)
+			}
+		}
+	}
+
+	if got, err := HasPermission(RoleAdmin, "unknown.permission"); err != nil || got {
+		t.Errorf("HasPermission(admin, unknown.permission) = (%v, %v), want (false, nil)", got, err)
+	}
+}
+
+func TestAssignRole(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "user@example.com")
+
+	if user.Role != RoleUser {
+		t.Fatalf("new user has role %q, want %q", user.Role, RoleUser)
+	}
+
+	tests := []struct {
+		role     string
+		wantErr  error
+		wantRole string
+	}{
+		{RoleAdmin, nil, RoleAdmin},
+		{"superuser", ErrUnknownRole, RoleAdmin},
+		{RoleUser, nil, RoleUser},
+	}
+
+	for _, tt := range tests {
+		if err := AssignRole(user.ID, tt.role); err != tt.wantErr {
+			t.Fatalf("AssignRole(%q) = %v, want %v", tt.role, err, tt.wantErr)
+		}
+
+		stored, err := GetUserByID(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if stored.Role != tt.wantRole {
+			t.Errorf("after AssignRole(%q) role is %q, want %q", tt.role, stored.Role, tt.wantRole)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// twoFASecretContext binds an encrypted 2FA secret to the user it belongs to
+func twoFASecretContext(userID int) string {
+	return fmt.Sprintf("twofa_secret:%d", userID)
+}
+
+// encryptTwoFASecret encrypts a user's 2FA secret for storage
+func encryptTwoFASecret(userID int, secret string) (string, error) {
+	return utils.EncryptSecretFor(secret, twoFASecretContext(userID))
+}
+
+// decryptTwoFASecret replaces the stored 2FA secret of a loaded user with its plaintext
+func decryptTwoFASecret(user *User) error {
+	secret, err := utils.DecryptSecretFor(user.TwoFASecret, twoFASecretContext(user.ID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt 2FA secret for user %d: %v", user.ID, err)
+	}
+
+	user.TwoFASecret = secret
+	return nil
+}
+
+// EncryptTOTPSecrets encrypts 2FA secrets that are still stored in plaintext.
+// It runs once at startup; afterwards a plaintext secret is refused when read.
+// It returns the number of rows it encrypted.
+func EncryptTOTPSecrets() (int, error) {
+	return rewriteTOTPSecrets(func(stored string) bool {
+		return !utils.IsEncryptedSecret(stored)
+	})
+}
+
+// ReencryptTOTPSecrets re-encrypts every 2FA secret that isn't under the
+// active key. It returns the number of rows it changed.
+func ReencryptTOTPSecrets() (int, error) {
+	active := utils.ActiveEncryptionKeyID()
+	return rewriteTOTPSecrets(func(stored string) bool {
+		return utils.SecretKeyID(stored) != active
+	})
+}
+
+// rewriteTOTPSecrets encrypts the secrets selected by rewrite with the active
+// key in a single transaction. A secret that doesn't decrypt for its user, such
+// as one under an unknown key or copied from another user's row, is logged and
+// left as it is; that user can't sign in with 2FA until it is reset.
+func rewriteTOTPSecrets(rewrite func(stored string) bool) (int, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, twofa_secret FROM users WHERE COALESCE(twofa_secret, '') != ''`)
+	if err != nil {
+		return 0, err
+	}
+
+	secrets := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		secrets[id] = stored
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for id, stored := range secrets {
+		if !rewrite(stored) {
+			continue
+		}
+
+		// Secrets from before encryption are the only plaintext read
+		plaintext := stored
+		if utils.IsEncryptedSecret(stored) {
+			plaintext, err = utils.DecryptSecretFor(stored, twoFASecretContext(id))
+			if err != nil {
+				log.Printf("Error: skipping the 2FA secret of user %d, which doesn't decrypt: %v", id, err)
+				continue
+			}
+		}
+
+		encrypted, err := encryptTwoFASecret(id, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE users SET twofa_secret = ? WHERE id = ?", encrypted, id); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+)
+
+// storedTwoFASecret reads a user's 2FA secret as it is stored
+func storedTwoFASecret(t *testing.T, userID int) string {
+	t.Helper()
+
+	var stored string
+	if err := database.DB.QueryRow(`SELECT COALESCE(twofa_secret, '') FROM users WHERE id = ?`, userID).Scan(&stored); err != nil {
+		t.Fatalf("read twofa_secret: %v", err)
+	}
+	return stored
+}
+
+// setStoredTwoFASecret writes a user's 2FA secret without encrypting it
+func setStoredTwoFASecret(t *testing.T, userID int, stored string) {
+	t.Helper()
+
+	if _, err := database.DB.Exec(`UPDATE users SET twofa_secret = ? WHERE id = ?`, stored, userID); err != nil {
+		t.Fatalf("write twofa_secret: %v", err)
+	}
+}
+
+func TestEncryptTOTPSecrets(t *testing.T) {
+	setupTestDB(t)
+
+	plaintext := createTestUser(t, "plaintext@example.com")
+	setStoredTwoFASecret(t, plaintext.ID, "JBSWY3DPEHPK3PXP")
+
+	encrypted := createTestUser(t, "encrypted@example.com")
+	encrypted.TwoFASecret = "KRSXG5CTMVRXEZLU"
+	if err := UpdateUser(encrypted); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	encryptedStored := storedTwoFASecret(t, encrypted.ID)
+
+	// Encrypted without being bound to a user
+	unbound := createTestUser(t, "unbound@example.com")
+	unboundStored, err := utils.EncryptSecret("GEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatalf("EncryptSecret: %v", err)
+	}
+	setStoredTwoFASecret(t, unbound.ID, unboundStored)
+
+	// Copied from another user's row
+	copied := createTestUser(t, "copied@example.com")
+	setStoredTwoFASecret(t, copied.ID, encryptedStored)
+
+	// Under a key that is no longer configured
+	unknown := createTestUser(t, "unknown@example.com")
+	setStoredTwoFASecret(t, unknown.ID, "enc:gone:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+
+	// Reading a plaintext secret is refused before and after the migration
+	if _, err := GetUserByID(plaintext.ID); err == nil {
+		t.Error("GetUserByID returned a user with a plaintext 2FA secret")
+	}
+
+	count, err := EncryptTOTPSecrets()
+	if err != nil {
+		t.Fatalf("EncryptTOTPSecrets: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("EncryptTOTPSecrets encrypted %d secrets, want 1", count)
+	}
+
+	tests := []struct {
+		name       string
+		user       *User
+		wantStored string
+		wantSecret string
+	}{
+		{"plaintext is encrypted", plaintext, "", "JBSWY3DPEHPK3PXP"},
+		{"encrypted is left alone", encrypted, encryptedStored, "KRSXG5CTMVRXEZLU"},
+		{"unbound is not rebound", unbound, unboundStored, ""},
+		{"copied is not rebound", copied, encryptedStored, ""},
+		{"unknown key is skipped", unknown, "enc:gone:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := storedTwoFASecret(t, tt.user.ID)
+			if tt.wantStored != "" && stored != tt.wantStored {
+				t.Errorf("stored secret changed to %q", stored)
+			}
+			if !utils.IsEncryptedSecret(stored) {
+				t.Errorf("stored secret %q is not encrypted", stored)
+			}
+
+			user, err := GetUserByID(tt.user.ID)
+			if tt.wantSecret == "" {
+				if err == nil {
+					t.Errorf("GetUserByID decrypted a secret that isn't bound to the user: %q", user.TwoFASecret)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetUserByID: %v", err)
+			}
+			if user.TwoFASecret != tt.wantSecret {
+				t.Errorf("TwoFASecret = %q, want %q", user.TwoFASecret, tt.wantSecret)
+			}
+		})
+	}
+
+	// Running it again has nothing left to do
+	if count, err := EncryptTOTPSecrets(); err != nil || count != 0 {
+		t.Errorf("second EncryptTOTPSecrets = (%d, %v), want (0, nil)", count, err)
+	}
+}
+
+func TestReencryptTOTPSecrets(t *testing.T) {
+	setupTestDB(t)
+
+	user := createTestUser(t, "user@example.com")
+	user.TwoFASecret = "JBSWY3DPEHPK3PXP"
+	if err := UpdateUser(user); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+
+	// Put a new key in front of the test key
+	t.Setenv("ENCRYPTION_KEYS", "new:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=,test:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err := utils.InitEncryptionKeys(); err != nil {
+		t.Fatalf("InitEncryptionKeys: %v", err)
+	}
+
+	count, err := ReencryptTOTPSecrets()
+	if err != nil || count != 1 {
+		t.Fatalf("ReencryptTOTPSecrets = (%d, %v), want (1, nil)", count, err)
+	}
+	if kid := utils.SecretKeyID(storedTwoFASecret(t, user.ID)); kid != "new" {
+		t.Errorf("secret is under key %q after rotation, want new", kid)
+	}
+
+	// The old key can go once nothing uses it
+	t.Setenv("ENCRYPTION_KEYS", "new:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	if err := utils.InitEncryptionKeys(); err != nil {
+		t.Fatalf("InitEncryptionKeys: %v", err)
+	}
+	stored, err := GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID after rotation: %v", err)
+	}
+	if stored.TwoFASecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("TwoFASecret = %q after rotation", stored.TwoFASecret)
+	}
+}
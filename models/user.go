@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
 )
 
 // User represents a user in the system
@@ -20,17 +21,39 @@ type User struct {
 	GithubID          string
 	ProfileImage      string
 	TwoFASecret       string
+	TwoFAAlgorithm    string
+	TwoFADigits       int
+	TwoFAPeriod       int
+	TwoFAType         string // One of the TwoFAType constants
+	PhoneNumber       string
 	TwoFAEnabled      bool
 	FaceAuthEnabled   bool
+	WebAuthnEnabled   bool
+	EmailVerified     bool
+	PendingEmail      string
 	Role              string
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
 }
 
+// Second factor types a user can enroll
+const (
+	TwoFATypeTOTP  = "totp"
+	TwoFATypeHOTP  = "hotp"
+	TwoFATypeEmail = "email"
+	TwoFATypeSMS   = "sms"
+)
+
+// TOTPParams returns the parameters the user's authenticator app was enrolled with
+func (u *User) TOTPParams() utils.TOTPParams {
+	if u.TwoFAAlgorithm == "" {
+		return utils.LegacyTOTPParams
+	}
+	return utils.TOTPParams{Algorithm: u.TwoFAAlgorithm, Digits: u.TwoFADigits, Period: u.TwoFAPeriod}
+}
+
 // CreateUser creates a new user
 func CreateUser(user *User) error {
-	fmt.Printf("CreateUser called with: %+v\n", user)
-
 	if user.Email == "" {
 		fmt.Println("CreateUser error: email is required")
 		return errors.New("email is required")
@@ -54,6 +77,11 @@ func CreateUser(user *User) error {
 	user.UpdatedAt = time.Now()
 	fmt.Println("Set UpdatedAt timestamp")
 
+	// Users without a one-time password enrollment default to TOTP
+	if user.TwoFAType == "" {
+		user.TwoFAType = TwoFATypeTOTP
+	}
+
 	// Set default role if not specified
 	if user.Role == "" {
 		user.Role = "user"
@@ -64,9 +92,10 @@ func CreateUser(user *User) error {
 	query := `
 	INSERT INTO users (
 		username, nickname, email, password_hash, google_id, github_id, 
-		profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-		role, created_at, updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		profile_image, twofa_secret, twofa_algorithm, twofa_digits, twofa_period,
+		twofa_type, phone_number, twofa_enabled, face_auth_enabled, webauthn_enabled,
+		email_verified, pending_email, role, created_at, updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	fmt.Println("Executing SQL query to insert user:")
 	fmt.Println(query)
@@ -80,9 +109,17 @@ func CreateUser(user *User) error {
 		user.GoogleID,
 		user.GithubID,
 		user.ProfileImage,
-		user.TwoFASecret,
+		"",
+		user.TwoFAAlgorithm,
+		user.TwoFADigits,
+		user.TwoFAPeriod,
+		user.TwoFAType,
+		user.PhoneNumber,
 		user.TwoFAEnabled,
 		user.FaceAuthEnabled,
+		user.WebAuthnEnabled,
+		user.EmailVerified,
+		user.PendingEmail,
 		user.Role,
 		user.CreatedAt,
 		user.UpdatedAt,
@@ -102,6 +139,17 @@ func CreateUser(user *User) error {
 	// Update the user ID
 	user.ID = int(id)
 
+	// The 2FA secret is only stored encrypted, bound to the new user's ID
+	if user.TwoFASecret != "" {
+		twoFASecret, err := encryptTwoFASecret(user.ID, user.TwoFASecret)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt 2FA secret: %v", err)
+		}
+		if _, err := database.DB.Exec("UPDATE users SET twofa_secret = ? WHERE id = ?", twoFASecret, user.ID); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -109,8 +157,10 @@ func CreateUser(user *User) error {
 func GetUserByID(id int) (*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users WHERE id = ?
 	`
 
@@ -129,8 +179,16 @@ func GetUserByID(id int) (*User, error) {
 		&user.GithubID,
 		&user.ProfileImage,
 		&user.TwoFASecret,
+		&user.TwoFAAlgorithm,
+		&user.TwoFADigits,
+		&user.TwoFAPeriod,
+		&user.TwoFAType,
+		&user.PhoneNumber,
 		&user.TwoFAEnabled,
 		&user.FaceAuthEnabled,
+		&user.WebAuthnEnabled,
+		&user.EmailVerified,
+		&user.PendingEmail,
 		&user.Role,
 		&createdAt,
 		&updatedAt,
@@ -147,6 +205,10 @@ func GetUserByID(id int) (*User, error) {
 	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 	user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+	if err := decryptTwoFASecret(user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -154,8 +216,10 @@ func GetUserByID(id int) (*User, error) {
 func GetUserByEmail(email string) (*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users WHERE email = ?
 	`
 
@@ -174,8 +238,16 @@ func GetUserByEmail(email string) (*User, error) {
 		&user.GithubID,
 		&user.ProfileImage,
 		&user.TwoFASecret,
+		&user.TwoFAAlgorithm,
+		&user.TwoFADigits,
+		&user.TwoFAPeriod,
+		&user.TwoFAType,
+		&user.PhoneNumber,
 		&user.TwoFAEnabled,
 		&user.FaceAuthEnabled,
+		&user.WebAuthnEnabled,
+		&user.EmailVerified,
+		&user.PendingEmail,
 		&user.Role,
 		&createdAt,
 		&updatedAt,
@@ -192,6 +264,10 @@ func GetUserByEmail(email string) (*User, error) {
 	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 	user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+	if err := decryptTwoFASecret(user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -199,8 +275,10 @@ func GetUserByEmail(email string) (*User, error) {
 func GetAllUsers() ([]*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users ORDER BY id
 	`
 
@@ -225,8 +303,16 @@ func GetAllUsers() ([]*User, error) {
 			&user.GithubID,
 			&user.ProfileImage,
 			&user.TwoFASecret,
+			&user.TwoFAAlgorithm,
+			&user.TwoFADigits,
+			&user.TwoFAPeriod,
+			&user.TwoFAType,
+			&user.PhoneNumber,
 			&user.TwoFAEnabled,
 			&user.FaceAuthEnabled,
+			&user.WebAuthnEnabled,
+			&user.EmailVerified,
+			&user.PendingEmail,
 			&user.Role,
 			&createdAt,
 			&updatedAt,
@@ -240,6 +326,10 @@ func GetAllUsers() ([]*User, error) {
 		user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 		user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+		if err := decryptTwoFASecret(user); err != nil {
+			return nil, err
+		}
+
 		userList = append(userList, user)
 	}
 
@@ -273,6 +363,12 @@ func UpdateUser(user *User) error {
 	// Update timestamp
 	user.UpdatedAt = time.Now()
 
+	// The 2FA secret is only stored encrypted
+	twoFASecret, err := encryptTwoFASecret(user.ID, user.TwoFASecret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt 2FA secret: %v", err)
+	}
+
 	// Store updated user in database
 	query := `
 	UPDATE users SET 
@@ -284,8 +380,16 @@ func UpdateUser(user *User) error {
 		github_id = ?, 
 		profile_image = ?, 
 		twofa_secret = ?, 
+		twofa_algorithm = ?, 
+		twofa_digits = ?, 
+		twofa_period = ?, 
+		twofa_type = ?, 
+		phone_number = ?, 
 		twofa_enabled = ?, 
 		face_auth_enabled = ?, 
+		webauthn_enabled = ?, 
+		email_verified = ?, 
+		pending_email = ?, 
 		role = ?,
 		updated_at = ? 
 	WHERE id = ?
@@ -300,9 +404,17 @@ func UpdateUser(user *User) error {
 		user.GoogleID,
 		user.GithubID,
 		user.ProfileImage,
-		user.TwoFASecret,
+		twoFASecret,
+		user.TwoFAAlgorithm,
+		user.TwoFADigits,
+		user.TwoFAPeriod,
+		user.TwoFAType,
+		user.PhoneNumber,
 		user.TwoFAEnabled,
 		user.FaceAuthEnabled,
+		user.WebAuthnEnabled,
+		user.EmailVerified,
+		user.PendingEmail,
 		user.Role,
 		user.UpdatedAt,
 		user.ID,
@@ -311,28 +423,49 @@ func UpdateUser(user *User) error {
 	return err
 }
 
+// userDataTables are the tables with rows that belong to a user and are deleted
+// along with the account. Audit events are kept as history.
+var userDataTables = []string{
+	"recovery_codes",
+	"webauthn_credentials",
+	"sessions",
+	"password_reset_tokens",
+	"face_templates",
+	"otp_codes",
+	"known_devices",
+	"auth_flows",
+	"api_tokens",
+	"personal_access_tokens",
+	"oidc_auth_codes",
+	"oidc_access_tokens",
+	"email_verification_requests",
+}
+
 // DeleteUser deletes a user
 func DeleteUser(id int) error {
-	// Check if user exists and get user data
-	user, err := GetUserByIDSafe(id)
-	if err != nil {
+	// Check if user exists
+	if _, err := GetUserByIDSafe(id); err != nil {
 		return err
 	}
-	
-	// Delete user from database
-	query := "DELETE FROM users WHERE id = ?"
-	_, err = database.DB.Exec(query, id)
+
+	tx, err := database.DB.Begin()
 	if err != nil {
 		return err
 	}
-	
-	// Return a special flag if face auth was enabled
-	// This allows the caller to handle face data deletion
-	if user.FaceAuthEnabled {
-		return errors.New("face_auth_data_needs_deletion")
+	defer tx.Rollback()
+
+	// Delete everything that belongs to the user first, so the foreign keys
+	// allow the account itself to go, and either all of it goes or nothing does
+	for _, table := range userDataTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", table, err)
+		}
 	}
-	
-	return nil
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // EmailExists checks if an email already exists
@@ -345,3 +478,46 @@ func EmailExists(email string) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// GetTwoFALastStep returns the last TOTP time-step, or HOTP counter value, accepted for a user
+func GetTwoFALastStep(userID int) (int64, error) {
+	var lastStep sql.NullInt64
+	err := database.DB.QueryRow("SELECT twofa_last_step FROM users WHERE id = ?", userID).Scan(&lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errors.New("user not found")
+		}
+		return 0, err
+	}
+	return lastStep.Int64, nil
+}
+
+// ResetTwoFAStep records the TOTP time-step or HOTP counter value used to
+// enroll a new secret. Steps of an earlier enrollment may have had a different
+// period or type, so the last step is replaced rather than only moved forward.
+func ResetTwoFAStep(userID int, step int64) error {
+	_, err := database.DB.Exec("UPDATE users SET twofa_last_step = ? WHERE id = ?", step, userID)
+	return err
+}
+
+// ConsumeTwoFAStep records a TOTP time-step or HOTP counter value as used for a user.
+// It returns false if the same or a later step was already recorded,
+// which means the code is being replayed. db is database.DB, or a
+// transaction the check is part of.
+func ConsumeTwoFAStep(db database.Executor, userID int, step int64) (bool, error) {
+	query := `
+	UPDATE users SET twofa_last_step = ?
+	WHERE id = ? AND COALESCE(twofa_last_step, 0) < ?
+	`
+
+	result, err := db.Exec(query, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
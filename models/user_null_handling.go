@@ -12,8 +12,10 @@ import (
 func GetUserByIDSafe(id int) (*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users WHERE id = ?
 	`
 
@@ -33,8 +35,16 @@ func GetUserByIDSafe(id int) (*User, error) {
 		&githubID,
 		&profileImage,
 		&twoFASecret,
+		&user.TwoFAAlgorithm,
+		&user.TwoFADigits,
+		&user.TwoFAPeriod,
+		&user.TwoFAType,
+		&user.PhoneNumber,
 		&user.TwoFAEnabled,
 		&user.FaceAuthEnabled,
+		&user.WebAuthnEnabled,
+		&user.EmailVerified,
+		&user.PendingEmail,
 		&role,
 		&createdAt,
 		&updatedAt,
@@ -76,6 +86,10 @@ func GetUserByIDSafe(id int) (*User, error) {
 	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 	user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+	if err := decryptTwoFASecret(user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -83,8 +97,10 @@ func GetUserByIDSafe(id int) (*User, error) {
 func GetUserByEmailSafe(email string) (*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users WHERE email = ?
 	`
 
@@ -104,8 +120,16 @@ func GetUserByEmailSafe(email string) (*User, error) {
 		&githubID,
 		&profileImage,
 		&twoFASecret,
+		&user.TwoFAAlgorithm,
+		&user.TwoFADigits,
+		&user.TwoFAPeriod,
+		&user.TwoFAType,
+		&user.PhoneNumber,
 		&user.TwoFAEnabled,
 		&user.FaceAuthEnabled,
+		&user.WebAuthnEnabled,
+		&user.EmailVerified,
+		&user.PendingEmail,
 		&role,
 		&createdAt,
 		&updatedAt,
@@ -147,6 +171,10 @@ func GetUserByEmailSafe(email string) (*User, error) {
 	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 	user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+	if err := decryptTwoFASecret(user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
@@ -154,8 +182,10 @@ func GetUserByEmailSafe(email string) (*User, error) {
 func GetAllUsersSafe() ([]*User, error) {
 	query := `
 	SELECT id, username, nickname, email, password_hash, google_id, github_id, 
-	profile_image, twofa_secret, twofa_enabled, face_auth_enabled, 
-	role, created_at, updated_at 
+	profile_image, twofa_secret, COALESCE(twofa_algorithm, ''), COALESCE(twofa_digits, 0), 
+	COALESCE(twofa_period, 0), COALESCE(twofa_type, 'totp'), COALESCE(phone_number, ''), twofa_enabled, face_auth_enabled, 
+	webauthn_enabled, email_verified, COALESCE(pending_email, ''), role, 
+	created_at, updated_at 
 	FROM users ORDER BY id
 	`
 
@@ -181,8 +211,16 @@ func GetAllUsersSafe() ([]*User, error) {
 			&githubID,
 			&profileImage,
 			&twoFASecret,
+			&user.TwoFAAlgorithm,
+			&user.TwoFADigits,
+			&user.TwoFAPeriod,
+			&user.TwoFAType,
+			&user.PhoneNumber,
 			&user.TwoFAEnabled,
 			&user.FaceAuthEnabled,
+			&user.WebAuthnEnabled,
+			&user.EmailVerified,
+			&user.PendingEmail,
 			&role,
 			&createdAt,
 			&updatedAt,
@@ -221,6 +259,10 @@ func GetAllUsersSafe() ([]*User, error) {
 		user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 		user.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
 
+		if err := decryptTwoFASecret(user); err != nil {
+			return nil, err
+		}
+
 		userList = append(userList, user)
 	}
 
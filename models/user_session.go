@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/aungh/login-form/database"
+)
+
+// ErrSessionNotFound is returned when a session to revoke does not exist
+var ErrSessionNotFound = errors.New("session not found")
+
+// UserSession is a signed-in session as shown in the active sessions list
+type UserSession struct {
+	// Handle identifies the session in forms without exposing the session ID
+	Handle     string
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	Current    bool
+}
+
+// sessionHandle derives a public identifier from a session ID
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// GetActiveSessions returns the unexpired sessions of a user, most recently used first.
+// The session with currentSessionID is marked as current.
+func GetActiveSessions(userID int, currentSessionID string) ([]UserSession, error) {
+	query := `
+	SELECT id, COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at, last_seen_at, expires_at
+	FROM sessions
+	WHERE user_id = ? AND expires_at > ?
+	ORDER BY last_seen_at DESC
+	`
+
+	rows, err := database.DB.Query(query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []UserSession
+	for rows.Next() {
+		var id string
+		var session UserSession
+		if err := rows.Scan(&id, &session.IPAddress, &session.UserAgent, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		session.Handle = sessionHandle(id)
+		session.Current = id == currentSessionID
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession signs out the session of a user identified by its handle
+func RevokeSession(userID int, handle string) error {
+	rows, err := database.DB.Query(`SELECT id FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	var target string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if sessionHandle(id) == handle {
+			target = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if target == "" {
+		return ErrSessionNotFound
+	}
+
+	_, err = database.DB.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, target, userID)
+	return err
+}
+
+// RevokeUserSessions signs out every session of a user except exceptSessionID,
+// which may be empty to sign out all of them. It returns the number of sessions revoked.
+func RevokeUserSessions(userID int, exceptSessionID string) (int64, error) {
+	result, err := database.DB.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, exceptSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
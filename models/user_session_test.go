@@ -0,0 +1,86 @@
+package models
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aungh/login-form/utils"
+)
+
+// signInTestSession stores a signed-in session for a user and returns its ID
+func signInTestSession(t *testing.T, store *utils.SQLiteStore, userID int) string {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(r, "auth-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = userID
+	if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	return session.ID
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	setupTestDB(t)
+	store := utils.NewSQLiteStore([]byte("test-session-key"))
+
+	user := createTestUser(t, "user@example.com")
+	other := createTestUser(t, "other@example.com")
+
+	current := signInTestSession(t, store, user.ID)
+	signInTestSession(t, store, user.ID)
+	signInTestSession(t, store, user.ID)
+	otherSession := signInTestSession(t, store, other.ID)
+
+	// Signing out a single session by its handle
+	sessions, err := GetActiveSessions(user.ID, current)
+	if err != nil || len(sessions) != 3 {
+		t.Fatalf("GetActiveSessions = (%d sessions, %v), want 3", len(sessions), err)
+	}
+	var handle string
+	for _, session := range sessions {
+		if !session.Current {
+			handle = session.Handle
+		}
+	}
+	if err := RevokeSession(other.ID, handle); err != ErrSessionNotFound {
+		t.Errorf("RevokeSession of another user's session = %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := RevokeSession(user.ID, handle); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+
+	// Signing out everywhere else keeps the current session
+	revoked, err := RevokeUserSessions(user.ID, current)
+	if err != nil || revoked != 1 {
+		t.Fatalf("RevokeUserSessions = (%d, %v), want (1, nil)", revoked, err)
+	}
+
+	tests := []struct {
+		name      string
+		userID    int
+		current   string
+		wantCount int
+	}{
+		{"current session is kept", user.ID, current, 1},
+		{"other users are untouched", other.ID, otherSession, 1},
+	}
+	for _, tt := range tests {
+		sessions, err := GetActiveSessions(tt.userID, tt.current)
+		if err != nil || len(sessions) != tt.wantCount || !sessions[0].Current {
+			t.Errorf("%s: GetActiveSessions = (%+v, %v)", tt.name, sessions, err)
+		}
+	}
+
+	// Signing out everywhere, as after a password reset
+	if revoked, err := RevokeUserSessions(user.ID, ""); err != nil || revoked != 1 {
+		t.Errorf("RevokeUserSessions everywhere = (%d, %v), want (1, nil)", revoked, err)
+	}
+	if sessions, _ := GetActiveSessions(user.ID, ""); len(sessions) != 0 {
+		t.Errorf("%d sessions left after signing out everywhere", len(sessions))
+	}
+}
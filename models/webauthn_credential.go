@@ -0,0 +1,147 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/aungh/login-form/utils"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnCredential is a security key or passkey registered by a user
+type WebAuthnCredential struct {
+	ID         int
+	UserID     int
+	Name       string
+	Credential webauthn.Credential
+	SignCount  uint32
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// CreateWebAuthnCredential stores a newly registered credential
+func CreateWebAuthnCredential(userID int, name string, credential *webauthn.Credential) error {
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO webauthn_credentials (
+		user_id, credential_id, name, credential, sign_count, created_at
+	) VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err = database.DB.Exec(
+		query,
+		userID,
+		credential.ID,
+		name,
+		string(credentialJSON),
+		credential.Authenticator.SignCount,
+		time.Now(),
+	)
+	return err
+}
+
+// GetWebAuthnCredentialsByUserID returns all credentials registered by a user
+func GetWebAuthnCredentialsByUserID(userID int) ([]*WebAuthnCredential, error) {
+	query := `
+	SELECT id, user_id, name, credential, sign_count, created_at, last_used_at
+	FROM webauthn_credentials WHERE user_id = ? ORDER BY id
+	`
+
+	rows, err := database.DB.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := make([]*WebAuthnCredential, 0)
+	for rows.Next() {
+		credential := &WebAuthnCredential{}
+		var name sql.NullString
+		var credentialJSON string
+		var lastUsedAt sql.NullTime
+
+		err := rows.Scan(
+			&credential.ID,
+			&credential.UserID,
+			&name,
+			&credentialJSON,
+			&credential.SignCount,
+			&credential.CreatedAt,
+			&lastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(credentialJSON), &credential.Credential); err != nil {
+			return nil, err
+		}
+
+		credential.Name = name.String
+		credential.LastUsedAt = lastUsedAt.Time
+		credentials = append(credentials, credential)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// GetWebAuthnUser builds the WebAuthn view of a user with their credentials
+func GetWebAuthnUser(user *User) (*utils.WebAuthnUser, error) {
+	stored, err := GetWebAuthnCredentialsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]webauthn.Credential, 0, len(stored))
+	for _, credential := range stored {
+		credentials = append(credentials, credential.Credential)
+	}
+
+	return &utils.WebAuthnUser{
+		ID:          user.ID,
+		Name:        user.Email,
+		DisplayName: user.Username,
+		Credentials: credentials,
+	}, nil
+}
+
+// UpdateWebAuthnCredentialUsage records a successful assertion, storing the
+// new sign count and clone warning reported by the authenticator. db is
+// database.DB, or a transaction the update is part of.
+func UpdateWebAuthnCredentialUsage(db database.Executor, userID int, credential *webauthn.Credential) error {
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE webauthn_credentials SET credential = ?, sign_count = ?, last_used_at = ?
+	WHERE user_id = ? AND credential_id = ?
+	`
+
+	_, err = db.Exec(
+		query,
+		string(credentialJSON),
+		credential.Authenticator.SignCount,
+		time.Now(),
+		userID,
+		credential.ID,
+	)
+	return err
+}
+
+// DeleteWebAuthnCredentials removes all credentials registered by a user
+func DeleteWebAuthnCredentials(userID int) error {
+	_, err := database.DB.Exec("DELETE FROM webauthn_credentials WHERE user_id = ?", userID)
+	return err
+}
@@ -279,8 +279,8 @@ document.addEventListener('DOMContentLoaded', function() {
             if (!mfaCodeInput.value) {
                 mfaCodeError.textContent = 'MFA code is required';
                 isValid = false;
-            } else if (!/^\d{6}$/.test(mfaCodeInput.value)) {
-                mfaCodeError.textContent = 'MFA code must be 6 digits';
+            } else if (!/^\d{6}(\d{2})?$/.test(mfaCodeInput.value)) {
+                mfaCodeError.textContent = 'MFA code must be 6 or 8 digits';
                 isValid = false;
             } else {
                 mfaCodeError.textContent = '';
@@ -305,8 +305,8 @@ document.addEventListener('DOMContentLoaded', function() {
             if (!mfaCodeInput.value) {
                 mfaCodeError.textContent = 'MFA code is required';
                 isValid = false;
-            } else if (!/^\d{6}$/.test(mfaCodeInput.value)) {
-                mfaCodeError.textContent = 'MFA code must be 6 digits';
+            } else if (!/^\d{6}(\d{2})?$/.test(mfaCodeInput.value)) {
+                mfaCodeError.textContent = 'MFA code must be 6 or 8 digits';
                 isValid = false;
             } else {
                 mfaCodeError.textContent = '';
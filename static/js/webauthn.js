@@ -0,0 +1,141 @@
+// Security Key (WebAuthn) JavaScript
+document.addEventListener('DOMContentLoaded', function() {
+    const statusMessage = document.getElementById('status-message');
+    const registerBtn = document.getElementById('registerKeyBtn');
+    const verifyBtn = document.getElementById('verifyKeyBtn');
+    const keyNameInput = document.getElementById('keyName');
+
+    // Convert a base64url string to an ArrayBuffer
+    function base64urlToBuffer(value) {
+        const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+        const binary = atob(padded);
+        const bytes = new Uint8Array(binary.length);
+        for (let i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    // Convert an ArrayBuffer to a base64url string
+    function bufferToBase64url(buffer) {
+        const bytes = new Uint8Array(buffer);
+        let binary = '';
+        for (let i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function showStatus(message, isError) {
+        statusMessage.textContent = message;
+        statusMessage.style.color = isError ? 'var(--error-color)' : 'var(--success-color)';
+    }
+
+    async function postJSON(url, body) {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: body ? JSON.stringify(body) : null,
+        });
+
+        const result = await response.json();
+        if (!response.ok) {
+            throw new Error(result.error || 'Request failed');
+        }
+        return result;
+    }
+
+    // Register a new security key for the signed-in user
+    async function registerKey() {
+        registerBtn.disabled = true;
+        showStatus('Touch your security key...', false);
+
+        try {
+            const options = await postJSON('/api/webauthn/register/begin');
+            const publicKey = options.publicKey;
+            publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+            publicKey.user.id = base64urlToBuffer(publicKey.user.id);
+            if (publicKey.excludeCredentials) {
+                publicKey.excludeCredentials.forEach(function(credential) {
+                    credential.id = base64urlToBuffer(credential.id);
+                });
+            }
+
+            const credential = await navigator.credentials.create({ publicKey: publicKey });
+
+            const name = keyNameInput ? keyNameInput.value.trim() : '';
+            const result = await postJSON('/api/webauthn/register/finish?name=' + encodeURIComponent(name), {
+                id: credential.id,
+                rawId: bufferToBase64url(credential.rawId),
+                type: credential.type,
+                response: {
+                    attestationObject: bufferToBase64url(credential.response.attestationObject),
+                    clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                    transports: credential.response.getTransports ? credential.response.getTransports() : [],
+                },
+            });
+
+            showStatus('Security key registered! Redirecting...', false);
+            window.location.href = result.redirect || '/user/settings';
+        } catch (error) {
+            console.error('Error registering security key:', error);
+            showStatus(error.message || 'Security key registration failed', true);
+            registerBtn.disabled = false;
+        }
+    }
+
+    // Verify a registered security key during login
+    async function verifyKey() {
+        verifyBtn.disabled = true;
+        showStatus('Touch your security key...', false);
+
+        try {
+            const options = await postJSON('/api/webauthn/login/begin');
+            const publicKey = options.publicKey;
+            publicKey.challenge = base64urlToBuffer(publicKey.challenge);
+            if (publicKey.allowCredentials) {
+                publicKey.allowCredentials.forEach(function(credential) {
+                    credential.id = base64urlToBuffer(credential.id);
+                });
+            }
+
+            const assertion = await navigator.credentials.get({ publicKey: publicKey });
+
+            const result = await postJSON('/api/webauthn/login/finish', {
+                id: assertion.id,
+                rawId: bufferToBase64url(assertion.rawId),
+                type: assertion.type,
+                response: {
+                    authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+                    clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+                    signature: bufferToBase64url(assertion.response.signature),
+                    userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null,
+                },
+            });
+
+            showStatus('Security key verified! Redirecting...', false);
+            window.location.href = result.redirect || '/home';
+        } catch (error) {
+            console.error('Error verifying security key:', error);
+            showStatus(error.message || 'Security key verification failed', true);
+            verifyBtn.disabled = false;
+        }
+    }
+
+    if (!window.PublicKeyCredential) {
+        showStatus('This browser does not support security keys.', true);
+        if (registerBtn) registerBtn.disabled = true;
+        if (verifyBtn) verifyBtn.disabled = true;
+        return;
+    }
+
+    if (registerBtn) {
+        registerBtn.addEventListener('click', registerKey);
+    }
+    if (verifyBtn) {
+        verifyBtn.addEventListener('click', verifyKey);
+    }
+});
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Application environments selected with APP_ENV
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// DefaultPort is the port the server listens on when PORT is unset
+const DefaultPort = "8081"
+
+// DemoAdminEmail is the admin account seeded in development mode
+const DemoAdminEmail = "testing@sample.com"
+
+// DemoPassword is the password of the demo accounts
+const DemoPassword = "password"
+
+// AppEnv returns the application environment, defaulting to production
+func AppEnv() string {
+	env := strings.ToLower(strings.TrimSpace(os.Getenv("APP_ENV")))
+	if env == "" {
+		return EnvProduction
+	}
+	return env
+}
+
+// IsDevelopment reports whether demo behaviors are enabled
+func IsDevelopment() bool {
+	return AppEnv() == EnvDevelopment
+}
+
+// ValidateAppEnv returns an error if APP_ENV is not a known environment
+func ValidateAppEnv() error {
+	switch AppEnv() {
+	case EnvDevelopment, EnvProduction:
+		return nil
+	default:
+		return fmt.Errorf("unknown APP_ENV %q, expected %q or %q", os.Getenv("APP_ENV"), EnvDevelopment, EnvProduction)
+	}
+}
+
+// BaseURL returns the public URL of the app, used for links in emails and as
+// the OpenID Connect issuer. It comes from APP_BASE_URL, which production
+// requires; development falls back to localhost. It is never taken from
+// request headers, which a client controls.
+func BaseURL() string {
+	if base := strings.TrimSpace(os.Getenv("APP_BASE_URL")); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = DefaultPort
+	}
+	return "http://localhost:" + port
+}
+
+// ValidateBaseURL returns an error if APP_BASE_URL is set to anything but an
+// absolute http or https URL, or is missing outside development
+func ValidateBaseURL() error {
+	base := strings.TrimSpace(os.Getenv("APP_BASE_URL"))
+	if base == "" {
+		if IsDevelopment() {
+			return nil
+		}
+		return fmt.Errorf("APP_BASE_URL must be set to the public URL of the app")
+	}
+
+	parsed, err := url.Parse(base)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("APP_BASE_URL %q is not an absolute http or https URL", base)
+	}
+	return nil
+}
+
+// DemoBehaviors lists the insecure demo behaviors that are active in the current environment
+func DemoBehaviors() []string {
+	if !IsDevelopment() {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("logging in with password %q creates any missing account", DemoPassword),
+		fmt.Sprintf("%s can log in with password %q regardless of the stored hash", DemoAdminEmail, DemoPassword),
+		"/test-social-user creates a social login test user without authentication",
+		fmt.Sprintf("an admin account %s is seeded when the database is empty", DemoAdminEmail),
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// authStateKey is the session key holding the encoded AuthState
+const authStateKey = "auth_state"
+
+// Authentication factors recorded in an AuthState
+const (
+	FactorPassword     = "password"
+	FactorOAuth        = "oauth"
+	FactorTOTP         = "totp"
+	FactorHOTP         = "hotp"
+	FactorEmailOTP     = "email_otp"
+	FactorSMSOTP       = "sms_otp"
+	FactorRecoveryCode = "recovery_code"
+	FactorWebAuthn     = "webauthn"
+	FactorFace         = "face"
+)
+
+// AuthState records which authentication factors a session has satisfied and when
+type AuthState struct {
+	UserID  int                  `json:"user_id"`
+	Factors map[string]time.Time `json:"factors"`
+	// Enrolled holds factors set up during the session. They count as satisfied
+	// but are not a verification, so they don't make the session recent.
+	Enrolled map[string]time.Time `json:"enrolled,omitempty"`
+}
+
+// NewAuthState starts a new authentication state for a user after the first factor
+func NewAuthState(userID int, firstFactor string) *AuthState {
+	state := &AuthState{UserID: userID, Factors: make(map[string]time.Time)}
+	state.MarkFactor(firstFactor)
+	return state
+}
+
+// MarkFactor records that a factor was satisfied now
+func (s *AuthState) MarkFactor(factor string) {
+	if s.Factors == nil {
+		s.Factors = make(map[string]time.Time)
+	}
+	s.Factors[factor] = time.Now()
+}
+
+// MarkEnrolled records that a factor was set up now
+func (s *AuthState) MarkEnrolled(factor string) {
+	if s.Enrolled == nil {
+		s.Enrolled = make(map[string]time.Time)
+	}
+	s.Enrolled[factor] = time.Now()
+}
+
+// Has reports whether a factor was satisfied or set up
+func (s *AuthState) Has(factor string) bool {
+	if _, ok := s.Factors[factor]; ok {
+		return true
+	}
+	_, ok := s.Enrolled[factor]
+	return ok
+}
+
+// VerifiedAt returns when a factor was satisfied, or the zero time
+func (s *AuthState) VerifiedAt(factor string) time.Time {
+	return s.Factors[factor]
+}
+
+// HasPrimaryFactor reports whether the user proved who they are with a password or an OAuth provider
+func (s *AuthState) HasPrimaryFactor() bool {
+	return s.Has(FactorPassword) || s.Has(FactorOAuth)
+}
+
+// HasTwoFactor reports whether the one-time password step was satisfied, by a
+// TOTP, HOTP, email or SMS code or by a recovery code
+func (s *AuthState) HasTwoFactor() bool {
+	return s.Has(FactorTOTP) || s.Has(FactorHOTP) || s.Has(FactorEmailOTP) || s.Has(FactorSMSOTP) ||
+		s.Has(FactorRecoveryCode)
+}
+
+// LastVerifiedAt returns when the most recent factor was satisfied, or the
+// zero time. Enrolling a factor doesn't count.
+func (s *AuthState) LastVerifiedAt() time.Time {
+	var last time.Time
+	for _, at := range s.Factors {
+		if at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// StepUpWindow returns how long a verification counts as recent for sensitive changes
+func StepUpWindow() time.Duration {
+	return time.Duration(envInt("STEP_UP_WINDOW_MINUTES", 10)) * time.Minute
+}
+
+// RecentlyAuthenticated reports whether the session satisfied a factor within the step-up window
+func RecentlyAuthenticated(session *sessions.Session) bool {
+	last := GetAuthState(session).LastVerifiedAt()
+	return !last.IsZero() && time.Since(last) < StepUpWindow()
+}
+
+// GetAuthState returns the authentication state stored in a session, or an empty state
+func GetAuthState(session *sessions.Session) *AuthState {
+	state := &AuthState{Factors: make(map[string]time.Time)}
+
+	encoded, ok := session.Values[authStateKey].(string)
+	if !ok || encoded == "" {
+		return state
+	}
+	if err := json.Unmarshal([]byte(encoded), state); err != nil {
+		return &AuthState{Factors: make(map[string]time.Time)}
+	}
+	return state
+}
+
+// SaveAuthState stores the authentication state in a session. The session still has to be saved.
+func SaveAuthState(session *sessions.Session, state *AuthState) {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	session.Values[authStateKey] = string(encoded)
+}
+
+// MarkAuthFactor records a satisfied factor in the session's authentication state
+func MarkAuthFactor(session *sessions.Session, factor string) {
+	state := GetAuthState(session)
+	state.MarkFactor(factor)
+	SaveAuthState(session, state)
+}
+
+// MarkEnrolledFactor records a factor set up in the session's authentication
+// state, without refreshing when the session last verified a factor
+func MarkEnrolledFactor(session *sessions.Session, factor string) {
+	state := GetAuthState(session)
+	state.MarkEnrolled(factor)
+	SaveAuthState(session, state)
+}
+
+// ClearAuthState removes the authentication state from a session
+func ClearAuthState(session *sessions.Session) {
+	delete(session.Values, authStateKey)
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestRecentlyAuthenticated(t *testing.T) {
+	t.Setenv("STEP_UP_WINDOW_MINUTES", "10")
+
+	tests := []struct {
+		name       string
+		verified   map[string]time.Duration
+		enrolled   []string
+		wantRecent bool
+	}{
+		{"no factors", nil, nil, false},
+		{"password just now", map[string]time.Duration{FactorPassword: 0}, nil, true},
+		{"password inside the window", map[string]time.Duration{FactorPassword: 9 * time.Minute}, nil, true},
+		{"password past the window", map[string]time.Duration{FactorPassword: 11 * time.Minute}, nil, false},
+		{"most recent factor counts", map[string]time.Duration{FactorPassword: time.Hour, FactorTOTP: time.Minute}, nil, true},
+		{"enrolling TOTP is not a re-authentication", map[string]time.Duration{FactorPassword: time.Hour}, []string{FactorTOTP}, false},
+		{"enrolling a key is not a re-authentication", map[string]time.Duration{FactorPassword: time.Hour}, []string{FactorWebAuthn, FactorFace}, false},
+		{"enrolling without any verification", nil, []string{FactorTOTP}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := sessions.NewSession(nil, "test")
+
+			state := &AuthState{UserID: 1, Factors: make(map[string]time.Time)}
+			for factor, age := range tt.verified {
+				state.Factors[factor] = time.Now().Add(-age)
+			}
+			SaveAuthState(session, state)
+			for _, factor := range tt.enrolled {
+				MarkEnrolledFactor(session, factor)
+			}
+
+			if got := RecentlyAuthenticated(session); got != tt.wantRecent {
+				t.Errorf("RecentlyAuthenticated = %v, want %v", got, tt.wantRecent)
+			}
+
+			// Enrolled factors still satisfy the login
+			stored := GetAuthState(session)
+			for _, factor := range tt.enrolled {
+				if !stored.Has(factor) {
+					t.Errorf("enrolled factor %q is not satisfied", factor)
+				}
+			}
+		})
+	}
+}
+
+func TestMarkAuthFactorRefreshesRecency(t *testing.T) {
+	session := sessions.NewSession(nil, "test")
+	SaveAuthState(session, &AuthState{UserID: 1, Factors: map[string]time.Time{FactorPassword: time.Now().Add(-time.Hour)}})
+
+	if RecentlyAuthenticated(session) {
+		t.Fatal("session with an old password verification is recent")
+	}
+
+	// Re-authenticating is what grants step-up
+	MarkAuthFactor(session, FactorPassword)
+	if !RecentlyAuthenticated(session) {
+		t.Error("session is not recent after re-authenticating")
+	}
+}
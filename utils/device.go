@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// DeviceCookieName is the long-lived cookie that identifies a browser across sessions
+const DeviceCookieName = "device_id"
+
+// deviceCookieMaxAge is how long a browser keeps its device ID
+const deviceCookieMaxAge = 365 * 24 * time.Hour
+
+// EnsureDeviceID returns the device ID of the browser making the request,
+// issuing a new one in a cookie if it doesn't have one yet
+func EnsureDeviceID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(DeviceCookieName); err == nil && len(cookie.Value) == 32 {
+		if _, err := hex.DecodeString(cookie.Value); err == nil {
+			return cookie.Value, nil
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(deviceCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
+}
+
+// DeviceFingerprint identifies a device by its device ID and user agent, so
+// a copied cookie used from another browser still counts as a new device
+func DeviceFingerprint(deviceID, userAgent string) string {
+	sum := sha256.Sum256([]byte(deviceID + "\n" + userAgent))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EmailVerificationTTL is how long an email verification link stays valid
+const EmailVerificationTTL = 24 * time.Hour
+
+// ErrInvalidVerificationToken is returned for malformed, forged or expired verification links
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification link")
+
+// minEmailVerificationKeyLength is the shortest EMAIL_VERIFICATION_KEY accepted
+const minEmailVerificationKeyLength = 32
+
+// Signing key for verification links, loaded once
+var (
+	verificationKey     []byte
+	verificationKeyOnce sync.Once
+)
+
+// emailVerificationKey returns the HMAC key used to sign verification links,
+// from EMAIL_VERIFICATION_KEY. It is its own secret so that knowing the cookie
+// key doesn't let anyone forge links. In development an unset key is replaced
+// by a random one, so links stop working when the server restarts.
+func emailVerificationKey() []byte {
+	verificationKeyOnce.Do(func() {
+		if key := os.Getenv("EMAIL_VERIFICATION_KEY"); key != "" {
+			verificationKey = []byte(key)
+			return
+		}
+
+		log.Printf("Warning: EMAIL_VERIFICATION_KEY not set, signing verification links with a random key")
+		verificationKey = make([]byte, 32)
+		if _, err := rand.Read(verificationKey); err != nil {
+			log.Fatalf("Failed to generate an email verification key: %v", err)
+		}
+	})
+	return verificationKey
+}
+
+// ValidateEmailVerificationKey checks that verification links are signed with a
+// configured secret. It is required outside development.
+func ValidateEmailVerificationKey() error {
+	key := os.Getenv("EMAIL_VERIFICATION_KEY")
+	if key == "" {
+		if IsDevelopment() {
+			return nil
+		}
+		return errors.New("EMAIL_VERIFICATION_KEY must be set")
+	}
+	if len(key) < minEmailVerificationKeyLength {
+		return fmt.Errorf("EMAIL_VERIFICATION_KEY must be at least %d characters", minEmailVerificationKeyLength)
+	}
+	if key == os.Getenv("SESSION_KEY") {
+		return errors.New("EMAIL_VERIFICATION_KEY must differ from SESSION_KEY")
+	}
+	return nil
+}
+
+// RequireEmailVerification reports whether unverified accounts are blocked from logging in
+func RequireEmailVerification() bool {
+	return strings.EqualFold(os.Getenv("REQUIRE_EMAIL_VERIFICATION"), "true")
+}
+
+// SignEmailVerification creates a signed token confirming that userID owns email.
+// The signature also covers the account's current address, so the link stops
+// working once that address changes.
+func SignEmailVerification(userID int, currentEmail, email string) string {
+	expires := time.Now().Add(EmailVerificationTTL).Unix()
+	payload := fmt.Sprintf("%d:%d:%s", userID, expires, email)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(emailVerificationMAC([]byte(payload), currentEmail))
+}
+
+// EmailVerificationTokenUserID returns the user a verification token was issued for.
+// The token is not checked; use VerifyEmailVerificationToken with the user's current address.
+func EmailVerificationTokenUserID(token string) (int, error) {
+	payload, _, err := splitEmailVerificationToken(token)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.Atoi(strings.SplitN(string(payload), ":", 2)[0])
+	if err != nil {
+		return 0, ErrInvalidVerificationToken
+	}
+	return userID, nil
+}
+
+// VerifyEmailVerificationToken checks a signed token against the account's current
+// address and returns the email it confirms
+func VerifyEmailVerificationToken(token, currentEmail string) (string, error) {
+	payload, signature, err := splitEmailVerificationToken(token)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(signature, emailVerificationMAC(payload, currentEmail)) {
+		return "", ErrInvalidVerificationToken
+	}
+
+	// Payload is userID:expires:email
+	fields := strings.SplitN(string(payload), ":", 3)
+	if len(fields) != 3 {
+		return "", ErrInvalidVerificationToken
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrInvalidVerificationToken
+	}
+
+	return fields[2], nil
+}
+
+// splitEmailVerificationToken decodes the payload and signature of a verification token
+func splitEmailVerificationToken(token string) ([]byte, []byte, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrInvalidVerificationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, ErrInvalidVerificationToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidVerificationToken
+	}
+	return payload, signature, nil
+}
+
+// emailVerificationMAC signs a token payload together with the account's current address
+func emailVerificationMAC(payload []byte, currentEmail string) []byte {
+	mac := hmac.New(sha256.New, emailVerificationKey())
+	mac.Write(payload)
+	mac.Write([]byte{0})
+	mac.Write([]byte(strings.ToLower(currentEmail)))
+	return mac.Sum(nil)
+}
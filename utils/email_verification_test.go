@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestValidateEmailVerificationKey(t *testing.T) {
+	key := strings.Repeat("k", minEmailVerificationKeyLength)
+
+	tests := []struct {
+		name       string
+		env        string
+		key        string
+		sessionKey string
+		wantErr    bool
+	}{
+		{"unset in production", EnvProduction, "", "", true},
+		{"unset in development", EnvDevelopment, "", "", false},
+		{"too short", EnvProduction, "short", "", true},
+		{"same as the session key", EnvProduction, key, key, true},
+		{"dedicated key", EnvProduction, key, "session-key", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("APP_ENV", tt.env)
+			t.Setenv("EMAIL_VERIFICATION_KEY", tt.key)
+			t.Setenv("SESSION_KEY", tt.sessionKey)
+
+			if err := ValidateEmailVerificationKey(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateEmailVerificationKey() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyEmailVerificationToken(t *testing.T) {
+	token := SignEmailVerification(7, "old@example.com", "new@example.com")
+
+	// A link signed with a different key is rejected
+	forged := func() string {
+		saved := verificationKey
+		verificationKey = []byte(strings.Repeat("x", minEmailVerificationKeyLength))
+		defer func() { verificationKey = saved }()
+		return SignEmailVerification(7, "old@example.com", "evil@example.com")
+	}()
+
+	// The same signature on a different address
+	payload, signature, _ := strings.Cut(token, ".")
+	decoded, _ := base64.RawURLEncoding.DecodeString(payload)
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(decoded), "new@", "evil@", 1))) + "." + signature
+
+	tests := []struct {
+		name         string
+		token        string
+		currentEmail string
+		want         string
+		wantErr      bool
+	}{
+		{"valid link", token, "old@example.com", "new@example.com", false},
+		{"email changed since", token, "other@example.com", "", true},
+		{"tampered", tampered, "old@example.com", "", true},
+		{"signed with another key", forged, "old@example.com", "", true},
+		{"garbage", "not-a-token", "old@example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := VerifyEmailVerificationToken(tt.token, tt.currentEmail)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: VerifyEmailVerificationToken = (%q, %v), want (%q, wantErr %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks a value encrypted by EncryptSecret. The full format is
+// "enc:<key id>:<base64 of nonce and ciphertext>".
+const encryptedPrefix = "enc:"
+
+// developmentKeyID identifies the key derived from SESSION_KEY in development mode
+const developmentKeyID = "dev"
+
+// ErrUnknownEncryptionKey is returned when a value was encrypted with a key that is not configured
+var ErrUnknownEncryptionKey = errors.New("value was encrypted with an unknown key")
+
+// ErrMalformedCiphertext is returned when an encrypted value can't be parsed or authenticated
+var ErrMalformedCiphertext = errors.New("malformed encrypted value")
+
+// ErrPlaintextSecret is returned when a stored secret isn't encrypted
+var ErrPlaintextSecret = errors.New("secret is not encrypted")
+
+// encryptionKeys holds the configured AES-GCM keys by ID; activeKeyID encrypts new values
+var (
+	encryptionKeys map[string]cipher.AEAD
+	activeKeyID    string
+)
+
+// InitEncryptionKeys loads the keys used to encrypt secrets at rest from
+// ENCRYPTION_KEYS, a comma-separated list of "id:base64-key" entries. The first
+// key encrypts new values; the others are only used to decrypt, so a key can be
+// rotated by putting a new one in front and re-encrypting.
+func InitEncryptionKeys() error {
+	encryptionKeys = make(map[string]cipher.AEAD)
+	activeKeyID = ""
+
+	config := strings.TrimSpace(os.Getenv("ENCRYPTION_KEYS"))
+	if config == "" {
+		if !IsDevelopment() {
+			return errors.New("ENCRYPTION_KEYS must be set")
+		}
+		// Derive a stable key so development databases keep working
+		log.Printf("Warning: ENCRYPTION_KEYS not set, deriving a development key from SESSION_KEY")
+		key := sha256.Sum256([]byte("encryption:" + GetSessionKey()))
+		return addEncryptionKey(developmentKeyID, key[:])
+	}
+
+	for _, entry := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid ENCRYPTION_KEYS entry %q, expected id:base64-key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid key %q in ENCRYPTION_KEYS: %v", parts[0], err)
+		}
+		if _, exists := encryptionKeys[parts[0]]; exists {
+			return fmt.Errorf("duplicate key %q in ENCRYPTION_KEYS", parts[0])
+		}
+		if err := addEncryptionKey(parts[0], key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addEncryptionKey registers a key; the first one added becomes the active key
+func addEncryptionKey(id string, key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("key %q must be 32 bytes for AES-256, got %d", id, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	encryptionKeys[id] = aead
+	if activeKeyID == "" {
+		activeKeyID = id
+	}
+	return nil
+}
+
+// ActiveEncryptionKeyID returns the ID of the key that encrypts new values
+func ActiveEncryptionKeyID() string {
+	return activeKeyID
+}
+
+// EncryptSecret encrypts a value with the active key. Empty values stay empty.
+func EncryptSecret(plaintext string) (string, error) {
+	return EncryptSecretFor(plaintext, "")
+}
+
+// EncryptSecretFor encrypts a value like EncryptSecret and binds it to a
+// context, such as the ID of the user it belongs to. It only decrypts with the
+// same context, so a value copied into another user's row is rejected.
+func EncryptSecretFor(plaintext, context string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	aead, ok := encryptionKeys[activeKeyID]
+	if !ok {
+		return "", errors.New("encryption keys are not initialized")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), secretAAD(activeKeyID, context))
+
+	return encryptedPrefix + activeKeyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a value produced by EncryptSecret. Empty values stay
+// empty. Values stored before encryption was introduced are refused with
+// ErrPlaintextSecret; they are encrypted once at startup, so one found later
+// was not written by this application.
+func DecryptSecret(stored string) (string, error) {
+	return DecryptSecretFor(stored, "")
+}
+
+// DecryptSecretFor decrypts a value produced by EncryptSecretFor with the same context
+func DecryptSecretFor(stored, context string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	if !IsEncryptedSecret(stored) {
+		return "", ErrPlaintextSecret
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", ErrMalformedCiphertext
+	}
+
+	aead, ok := encryptionKeys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, parts[0])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrMalformedCiphertext
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], secretAAD(parts[0], context))
+	if err != nil {
+		return "", ErrMalformedCiphertext
+	}
+	return string(plaintext), nil
+}
+
+// secretAAD is the additional data a secret is sealed with: the key ID, plus
+// the context for bound secrets
+func secretAAD(keyID, context string) []byte {
+	if context == "" {
+		return []byte(keyID)
+	}
+	return []byte(keyID + "|" + context)
+}
+
+// SealWithDataKey encrypts data under a new random data key and returns the
+// data key wrapped by the active key alongside the ciphertext. Rotating keys
+// only needs the wrapped data key to be re-encrypted with EncryptSecret.
+func SealWithDataKey(plaintext, additionalData []byte) (string, []byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, err
+	}
+
+	aead, err := newDataKeyAEAD(dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	wrappedKey, err := EncryptSecret(base64.StdEncoding.EncodeToString(dataKey))
+	if err != nil {
+		return "", nil, err
+	}
+	return wrappedKey, aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// OpenWithDataKey decrypts data sealed by SealWithDataKey
+func OpenWithDataKey(wrappedKey string, sealed, additionalData []byte) ([]byte, error) {
+	if !IsEncryptedSecret(wrappedKey) {
+		return nil, ErrMalformedCiphertext
+	}
+	encodedKey, err := DecryptSecret(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, ErrMalformedCiphertext
+	}
+
+	aead, err := newDataKeyAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrMalformedCiphertext
+	}
+	return plaintext, nil
+}
+
+// newDataKeyAEAD returns an AES-GCM cipher for a data key
+func newDataKeyAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != 32 {
+		return nil, ErrMalformedCiphertext
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncryptedSecret reports whether a stored value was encrypted by EncryptSecret
+func IsEncryptedSecret(stored string) bool {
+	return strings.HasPrefix(stored, encryptedPrefix)
+}
+
+// SecretKeyID returns the ID of the key a stored value was encrypted with, or
+// an empty string if it isn't encrypted
+func SecretKeyID(stored string) string {
+	if !IsEncryptedSecret(stored) {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(stored, encryptedPrefix), ":", 2)[0]
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testKeyB = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+// setTestEncryptionKeys loads ENCRYPTION_KEYS for a test
+func setTestEncryptionKeys(t *testing.T, config string) {
+	t.Helper()
+
+	t.Setenv("ENCRYPTION_KEYS", config)
+	if err := InitEncryptionKeys(); err != nil {
+		t.Fatalf("InitEncryptionKeys(%q): %v", config, err)
+	}
+}
+
+func TestEncryptSecretFor(t *testing.T) {
+	setTestEncryptionKeys(t, "a:"+testKeyA)
+
+	encrypted, err := EncryptSecretFor("JBSWY3DPEHPK3PXP", "twofa_secret:1")
+	if err != nil {
+		t.Fatalf("EncryptSecretFor: %v", err)
+	}
+	if SecretKeyID(encrypted) != "a" || strings.Contains(encrypted, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("encrypted value %q is not sealed under key a", encrypted)
+	}
+
+	// The key ID is part of the additional data, so relabelling a value fails
+	relabelled := strings.Replace(encrypted, "enc:a:", "enc:b:", 1)
+	setTestEncryptionKeys(t, "a:"+testKeyA+",b:"+testKeyA)
+
+	tests := []struct {
+		name    string
+		stored  string
+		context string
+		want    string
+		wantErr error
+	}{
+		{"same context", encrypted, "twofa_secret:1", "JBSWY3DPEHPK3PXP", nil},
+		{"other user", encrypted, "twofa_secret:2", "", ErrMalformedCiphertext},
+		{"no context", encrypted, "", "", ErrMalformedCiphertext},
+		{"relabelled key ID", relabelled, "twofa_secret:1", "", ErrMalformedCiphertext},
+		{"truncated", encrypted[:len(encrypted)-4], "twofa_secret:1", "", ErrMalformedCiphertext},
+		{"unknown key", "enc:c:" + strings.SplitN(encrypted, ":", 3)[2], "twofa_secret:1", "", ErrUnknownEncryptionKey},
+		{"plaintext", "JBSWY3DPEHPK3PXP", "twofa_secret:1", "", ErrPlaintextSecret},
+		{"empty", "", "twofa_secret:1", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecryptSecretFor(tt.stored, tt.context)
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("DecryptSecretFor = (%q, %v), want (%q, %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	setTestEncryptionKeys(t, "old:"+testKeyA)
+	old, err := EncryptSecretFor("secret", "ctx")
+	if err != nil {
+		t.Fatalf("EncryptSecretFor: %v", err)
+	}
+
+	// A new key in front encrypts new values; the old one still decrypts
+	setTestEncryptionKeys(t, "new:"+testKeyB+",old:"+testKeyA)
+	if ActiveEncryptionKeyID() != "new" {
+		t.Fatalf("active key is %q, want new", ActiveEncryptionKeyID())
+	}
+	current, err := EncryptSecretFor("secret", "ctx")
+	if err != nil {
+		t.Fatalf("EncryptSecretFor: %v", err)
+	}
+	if SecretKeyID(current) != "new" {
+		t.Errorf("new value is under key %q, want new", SecretKeyID(current))
+	}
+	for _, stored := range []string{old, current} {
+		if got, err := DecryptSecretFor(stored, "ctx"); err != nil || got != "secret" {
+			t.Errorf("DecryptSecretFor(%s) = (%q, %v), want the secret", SecretKeyID(stored), got, err)
+		}
+	}
+
+	// Once the old key is removed, values under it no longer decrypt
+	setTestEncryptionKeys(t, "new:"+testKeyB)
+	if _, err := DecryptSecretFor(old, "ctx"); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("DecryptSecretFor under a removed key = %v, want %v", err, ErrUnknownEncryptionKey)
+	}
+
+	// A value under a kid that names a different key doesn't authenticate
+	setTestEncryptionKeys(t, "new:"+testKeyB+",old:"+testKeyB)
+	if _, err := DecryptSecretFor(old, "ctx"); !errors.Is(err, ErrMalformedCiphertext) {
+		t.Errorf("DecryptSecretFor with the wrong key material = %v, want %v", err, ErrMalformedCiphertext)
+	}
+}
+
+func TestInitEncryptionKeys(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr bool
+	}{
+		{"a:" + testKeyA, false},
+		{"a:" + testKeyA + ", b:" + testKeyB, false},
+		{"a:" + testKeyA + ",a:" + testKeyB, true},
+		{"a:c2hvcnQ=", true},
+		{"a:not base64", true},
+		{testKeyA, true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("ENCRYPTION_KEYS", tt.config)
+		if err := InitEncryptionKeys(); (err != nil) != tt.wantErr {
+			t.Errorf("InitEncryptionKeys(%q) = %v, wantErr %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Register JPEG decoder for webcam snapshots
+	_ "image/png"  // Register PNG decoder
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoFaceTemplate is returned when a user has no enrolled face image
+var ErrNoFaceTemplate = errors.New("no enrolled face template")
+
+// FaceMatcher compares an enrolled face image with a candidate image
+type FaceMatcher interface {
+	// Compare returns a similarity score between 0 (different) and 1 (identical)
+	Compare(enrolled, candidate image.Image) (float64, error)
+	// Threshold returns the minimum score required to accept a match
+	Threshold() float64
+}
+
+// defaultFaceMatchThreshold is used when FACE_MATCH_THRESHOLD is not set
+const defaultFaceMatchThreshold = 0.80
+
+// MaxFaceImageBytes is the largest face image accepted, before base64 encoding
+const MaxFaceImageBytes = 2 << 20
+
+// maxFaceImageDimension is the largest width or height of a face image. It is
+// checked before decoding, since a small file can describe a huge image.
+const maxFaceImageDimension = 4096
+
+// ErrFaceImageTooLarge is returned for face images over the size or dimension limits
+var ErrFaceImageTooLarge = errors.New("face image is too large")
+
+// Global face matcher
+var (
+	faceMatcher      FaceMatcher
+	faceMatcherMutex sync.RWMutex
+)
+
+// InitFaceMatcher initializes the global face matcher from the environment
+func InitFaceMatcher() {
+	threshold := defaultFaceMatchThreshold
+	if value := os.Getenv("FACE_MATCH_THRESHOLD"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			log.Printf("Warning: invalid FACE_MATCH_THRESHOLD %q, using default %.2f", value, defaultFaceMatchThreshold)
+		} else {
+			threshold = parsed
+		}
+	}
+
+	SetFaceMatcher(NewPerceptualHashMatcher(threshold))
+	log.Printf("Face matcher initialized with threshold %.2f", threshold)
+}
+
+// SetFaceMatcher replaces the global face matcher
+func SetFaceMatcher(matcher FaceMatcher) {
+	faceMatcherMutex.Lock()
+	defer faceMatcherMutex.Unlock()
+	faceMatcher = matcher
+}
+
+// GetFaceMatcher returns the global face matcher
+func GetFaceMatcher() FaceMatcher {
+	faceMatcherMutex.RLock()
+	matcher := faceMatcher
+	faceMatcherMutex.RUnlock()
+
+	if matcher == nil {
+		InitFaceMatcher()
+		return GetFaceMatcher()
+	}
+	return matcher
+}
+
+// FaceImageBytes decodes a base64 image, with or without a data URL prefix
+func FaceImageBytes(faceImageBase64 string) ([]byte, error) {
+	// Clean the base64 string if it contains data URL prefix
+	if strings.HasPrefix(faceImageBase64, "data:image") {
+		parts := strings.Split(faceImageBase64, ",")
+		if len(parts) == 2 {
+			faceImageBase64 = parts[1]
+		}
+	}
+
+	if len(faceImageBase64) > base64.StdEncoding.EncodedLen(MaxFaceImageBytes) {
+		return nil, ErrFaceImageTooLarge
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(faceImageBase64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode face image: %v", err)
+	}
+	return raw, nil
+}
+
+// DecodeFaceImage decodes a base64 image, with or without a data URL prefix
+func DecodeFaceImage(faceImageBase64 string) (image.Image, error) {
+	raw, err := FaceImageBytes(faceImageBase64)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFaceImageBytes(raw)
+}
+
+// decodeFaceImageBytes decodes a PNG or JPEG image within the size limits
+func decodeFaceImageBytes(raw []byte) (image.Image, error) {
+	if len(raw) > MaxFaceImageBytes {
+		return nil, ErrFaceImageTooLarge
+	}
+
+	// Read the dimensions from the header before allocating the image
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode face image: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, fmt.Errorf("failed to decode face image: empty image")
+	}
+	if config.Width > maxFaceImageDimension || config.Height > maxFaceImageDimension {
+		return nil, ErrFaceImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode face image: %v", err)
+	}
+
+	return img, nil
+}
+
+// VerifyFace compares a submitted face image with a user's enrolled image.
+// It returns the similarity score and whether it meets the matcher threshold.
+func VerifyFace(enrolledImage []byte, faceImageBase64 string) (float64, bool, error) {
+	if len(enrolledImage) == 0 {
+		return 0, false, ErrNoFaceTemplate
+	}
+
+	enrolled, err := decodeFaceImageBytes(enrolledImage)
+	if err != nil {
+		return 0, false, err
+	}
+
+	candidate, err := DecodeFaceImage(faceImageBase64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	matcher := GetFaceMatcher()
+	score, err := matcher.Compare(enrolled, candidate)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return score, score >= matcher.Threshold(), nil
+}
+
+// PerceptualHashMatcher is a pure-Go baseline matcher that compares the
+// DCT perceptual hashes of two images. It is not a biometric model, but it
+// rejects images that are clearly different from the enrolled snapshot.
+type PerceptualHashMatcher struct {
+	threshold float64
+}
+
+// NewPerceptualHashMatcher creates a perceptual hash matcher with the given accept threshold
+func NewPerceptualHashMatcher(threshold float64) *PerceptualHashMatcher {
+	return &PerceptualHashMatcher{threshold: threshold}
+}
+
+// Threshold returns the minimum score required to accept a match
+func (m *PerceptualHashMatcher) Threshold() float64 {
+	return m.threshold
+}
+
+// Compare returns the fraction of matching bits between the two image hashes
+func (m *PerceptualHashMatcher) Compare(enrolled, candidate image.Image) (float64, error) {
+	if enrolled == nil || candidate == nil {
+		return 0, errors.New("both images are required")
+	}
+
+	distance := bits.OnesCount64(perceptualHash(enrolled) ^ perceptualHash(candidate))
+	return 1 - float64(distance)/64, nil
+}
+
+// phashSize is the side of the grayscale image the DCT is computed over
+const phashSize = 32
+
+// perceptualHash computes a 64-bit DCT hash of an image
+func perceptualHash(img image.Image) uint64 {
+	pixels := grayscaleThumbnail(img, phashSize)
+
+	// Compute the 2D DCT and keep the low 8x8 frequencies
+	coefficients := make([]float64, 0, 64)
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for x := 0; x < phashSize; x++ {
+				for y := 0; y < phashSize; y++ {
+					sum += pixels[x][y] *
+						math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*phashSize)) *
+						math.Cos(float64(2*y+1)*float64(v)*math.Pi/(2*phashSize))
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	// Use the median of the AC coefficients as the bit threshold
+	sorted := make([]float64, len(coefficients)-1)
+	copy(sorted, coefficients[1:])
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// grayscaleThumbnail downscales an image to size x size luminance values using box sampling
+func grayscaleThumbnail(img image.Image, size int) [][]float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	pixels := make([][]float64, size)
+	for x := 0; x < size; x++ {
+		pixels[x] = make([]float64, size)
+		x0 := bounds.Min.X + x*width/size
+		x1 := bounds.Min.X + (x+1)*width/size
+		if x1 <= x0 {
+			x1 = x0 + 1
+		}
+
+		for y := 0; y < size; y++ {
+			y0 := bounds.Min.Y + y*height/size
+			y1 := bounds.Min.Y + (y+1)*height/size
+			if y1 <= y0 {
+				y1 = y0 + 1
+			}
+
+			sum, count := 0.0, 0
+			for px := x0; px < x1; px++ {
+				for py := y0; py < y1; py++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					count++
+				}
+			}
+			pixels[x][y] = sum / float64(count)
+		}
+	}
+	return pixels
+}
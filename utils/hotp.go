@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+// HOTPLookAhead returns how many counter values past the last used one a code
+// is accepted for, from HOTP_LOOK_AHEAD. Tokens drift ahead when their button
+// is pressed without the code being used.
+func HOTPLookAhead() int {
+	return envInt("HOTP_LOOK_AHEAD", 10)
+}
+
+// HOTPResyncWindow returns how far ahead two consecutive codes are searched for
+// when resynchronising a token, from HOTP_RESYNC_WINDOW
+func HOTPResyncWindow() int {
+	return envInt("HOTP_RESYNC_WINDOW", 100)
+}
+
+// HOTPURI returns the otpauth:// URI for a counter-based token starting at counter
+func HOTPURI(config TOTPConfig, secret, accountName string, counter uint64) string {
+	query := url.Values{}
+	query.Set("counter", strconv.FormatUint(counter, 10))
+	return otpauthURI("hotp", config, secret, accountName, query)
+}
+
+// ValidateHOTP checks a code against the counter values after lastCounter,
+// up to window values ahead. It returns the counter the code matched, which
+// must be stored so the code and the ones before it can't be used again.
+func ValidateHOTP(params TOTPParams, secret, code string, lastCounter int64, window int) (int64, bool, error) {
+	code = strings.ReplaceAll(code, " ", "")
+
+	for counter := lastCounter + 1; counter <= lastCounter+int64(window); counter++ {
+		valid, err := validateHOTPCounter(params, secret, code, counter)
+		if err != nil {
+			return 0, false, err
+		}
+		if valid {
+			return counter, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// ResyncHOTP finds two consecutive codes within window counter values after
+// lastCounter, for a token that drifted past the look-ahead window. It returns
+// the counter the second code matched.
+func ResyncHOTP(params TOTPParams, secret, firstCode, secondCode string, lastCounter int64, window int) (int64, bool, error) {
+	firstCode = strings.ReplaceAll(firstCode, " ", "")
+	secondCode = strings.ReplaceAll(secondCode, " ", "")
+
+	for counter := lastCounter + 1; counter <= lastCounter+int64(window); counter++ {
+		valid, err := validateHOTPCounter(params, secret, firstCode, counter)
+		if err != nil {
+			return 0, false, err
+		}
+		if !valid {
+			continue
+		}
+
+		valid, err = validateHOTPCounter(params, secret, secondCode, counter+1)
+		if err != nil {
+			return 0, false, err
+		}
+		if valid {
+			return counter + 1, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// validateHOTPCounter checks a code for a single counter value
+func validateHOTPCounter(params TOTPParams, secret, code string, counter int64) (bool, error) {
+	if counter < 0 {
+		return false, nil
+	}
+
+	algorithm, err := params.algorithm()
+	if err != nil {
+		return false, err
+	}
+
+	return hotp.ValidateCustom(code, uint64(counter), secret, hotp.ValidateOpts{
+		Digits:    otp.Digits(params.Digits),
+		Algorithm: algorithm,
+	})
+}
@@ -0,0 +1,72 @@
+package utils
+
+import "testing"
+
+func TestValidateHOTP(t *testing.T) {
+	params := LegacyTOTPParams
+
+	tests := []struct {
+		name        string
+		counter     int64
+		lastCounter int64
+		window      int
+		want        int64
+		wantValid   bool
+	}{
+		{"next counter", 1, 0, 10, 1, true},
+		{"within look-ahead", 10, 0, 10, 10, true},
+		{"past look-ahead", 11, 0, 10, 0, false},
+		{"already used counter", 5, 5, 10, 0, false},
+		{"counter before the last used one", 3, 5, 10, 0, false},
+		{"look-ahead from the last used counter", 12, 5, 10, 12, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := otpCode(t, params, testTOTPSecret, tt.counter)
+
+			counter, valid, err := ValidateHOTP(params, testTOTPSecret, code, tt.lastCounter, tt.window)
+			if err != nil {
+				t.Fatalf("ValidateHOTP: %v", err)
+			}
+			if valid != tt.wantValid || counter != tt.want {
+				t.Errorf("ValidateHOTP = (%d, %v), want (%d, %v)", counter, valid, tt.want, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestResyncHOTP(t *testing.T) {
+	params := LegacyTOTPParams
+
+	tests := []struct {
+		name          string
+		first, second int64
+		lastCounter   int64
+		window        int
+		want          int64
+		wantValid     bool
+	}{
+		{"consecutive codes past look-ahead", 50, 51, 0, 100, 51, true},
+		{"consecutive codes at the window edge", 100, 101, 0, 100, 101, true},
+		{"codes out of order", 51, 50, 0, 100, 0, false},
+		{"codes with a gap", 50, 52, 0, 100, 0, false},
+		{"codes past the window", 101, 102, 0, 100, 0, false},
+		{"codes before the last used counter", 40, 41, 45, 100, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := otpCode(t, params, testTOTPSecret, tt.first)
+			second := otpCode(t, params, testTOTPSecret, tt.second)
+
+			counter, valid, err := ResyncHOTP(params, testTOTPSecret, first, second, tt.lastCounter, tt.window)
+			if err != nil {
+				t.Fatalf("ResyncHOTP: %v", err)
+			}
+			if valid != tt.wantValid || counter != tt.want {
+				t.Errorf("ResyncHOTP = (%d, %v), want (%d, %v)", counter, valid, tt.want, tt.wantValid)
+			}
+		})
+	}
+}
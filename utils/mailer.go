@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Global mailer
+var (
+	mailer      Mailer
+	mailerMutex sync.RWMutex
+)
+
+// InitMailer initializes the global mailer from the environment.
+// MAIL_DRIVER selects "smtp", "file" (MAIL_FILE_PATH) or "log" (the default).
+func InitMailer() {
+	driver := strings.ToLower(os.Getenv("MAIL_DRIVER"))
+
+	switch driver {
+	case "smtp":
+		SetMailer(&SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     envInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     mailFrom(),
+		})
+		log.Printf("Mailer initialized with SMTP server %s", os.Getenv("SMTP_HOST"))
+	case "file":
+		path := os.Getenv("MAIL_FILE_PATH")
+		if path == "" {
+			path = "data/mail.log"
+		}
+		SetMailer(&FileMailer{Path: path, From: mailFrom()})
+		log.Printf("Mailer initialized, writing messages to %s", path)
+	default:
+		if driver != "" && driver != "log" {
+			log.Printf("Warning: unknown MAIL_DRIVER %q, logging messages instead", driver)
+		}
+		SetMailer(&FileMailer{From: mailFrom()})
+		log.Printf("Mailer initialized, writing messages to the log")
+	}
+}
+
+// ValidateMailDriver returns an error unless MAIL_DRIVER is set to a driver
+// that delivers mail. Outside development the log driver is refused, since
+// reset and verification links would end up in the application log.
+func ValidateMailDriver() error {
+	driver := strings.ToLower(os.Getenv("MAIL_DRIVER"))
+	switch driver {
+	case "smtp":
+		if os.Getenv("SMTP_HOST") == "" {
+			return fmt.Errorf("SMTP_HOST must be set when MAIL_DRIVER is smtp")
+		}
+		return nil
+	case "file":
+		return nil
+	case "log":
+		if IsDevelopment() {
+			return nil
+		}
+		return fmt.Errorf("MAIL_DRIVER=log writes reset and verification links to the log; use smtp or file outside development")
+	case "":
+		if IsDevelopment() {
+			return nil
+		}
+		return fmt.Errorf("MAIL_DRIVER must be set to smtp or file")
+	default:
+		return fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+}
+
+// SetMailer replaces the global mailer
+func SetMailer(m Mailer) {
+	mailerMutex.Lock()
+	defer mailerMutex.Unlock()
+	mailer = m
+}
+
+// GetMailer returns the global mailer
+func GetMailer() Mailer {
+	mailerMutex.RLock()
+	m := mailer
+	mailerMutex.RUnlock()
+
+	if m == nil {
+		InitMailer()
+		return GetMailer()
+	}
+	return m
+}
+
+// SendMail sends a message with the global mailer
+func SendMail(msg Message) error {
+	return GetMailer().Send(msg)
+}
+
+// mailFrom returns the sender address from the environment
+func mailFrom() string {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	return from
+}
+
+// formatMessage renders a message in RFC 5322 format
+func formatMessage(from string, msg Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.String()
+}
+
+// validateHeaders rejects header values that could inject extra headers
+func validateHeaders(values ...string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid characters in mail header")
+		}
+	}
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers a message through the SMTP server
+func (m *SMTPMailer) Send(msg Message) error {
+	if m.Host == "" {
+		return fmt.Errorf("SMTP_HOST is not set")
+	}
+	if err := validateHeaders(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, []byte(formatMessage(m.From, msg)))
+}
+
+// FileMailer appends messages to a file instead of sending them, or writes
+// them to the log when Path is empty. It is meant for development and tests.
+type FileMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+// Send writes the message to the file or the log
+func (m *FileMailer) Send(msg Message) error {
+	if err := validateHeaders(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	formatted := formatMessage(m.From, msg)
+	if m.Path == "" {
+		log.Printf("Email message:\n%s", formatted)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\r\n\r\n", formatted)
+	return err
+}
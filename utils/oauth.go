@@ -195,8 +195,6 @@ func CustomCompleteUserAuth(w http.ResponseWriter, r *http.Request, provider str
 
 // InitGothOAuth initializes OAuth configurations using Goth
 func InitGothOAuth() {
-	// Make sure the session store is initialized first
-	InitSessionStore()
 	// Print environment variables for debugging
 	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
 	googleClientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
@@ -238,8 +236,6 @@ func InitGothOAuth() {
 			log.Printf("Error getting session in GetProviderName: %v", err)
 		}
 		
-		log.Printf("Session values in GetProviderName: %+v", session.Values)
-		
 		if provider, ok := session.Values["oauth_provider"].(string); ok && provider != "" {
 			log.Printf("Provider detected from session: %s", provider)
 			return provider, nil
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"math/big"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// amrValues maps authentication factors to the RFC 8176 "amr" values reported
+// in ID tokens. Sign-in through an OAuth provider has no standard value but
+// still counts towards "mfa".
+var amrValues = map[string][]string{
+	FactorPassword:     {"pwd"},
+	FactorOAuth:        {},
+	FactorTOTP:         {"otp"},
+	FactorHOTP:         {"otp"},
+	FactorEmailOTP:     {"otp"},
+	FactorSMSOTP:       {"otp", "sms"},
+	FactorRecoveryCode: {"otp"},
+	FactorWebAuthn:     {"hwk"},
+	FactorFace:         {"face"},
+}
+
+// AMR returns the authentication methods a session passed as RFC 8176 values,
+// adding "mfa" when more than one kind of factor was used
+func AMR(state *AuthState) []string {
+	seen := make(map[string]bool)
+	kinds := make(map[string]bool)
+	for factor := range state.Factors {
+		values, ok := amrValues[factor]
+		if !ok {
+			continue
+		}
+
+		// Codes from an app, a token, a message or the recovery list are all one kind of factor
+		kind := factor
+		if len(values) > 0 {
+			kind = values[0]
+		}
+		kinds[kind] = true
+
+		for _, value := range values {
+			seen[value] = true
+		}
+	}
+
+	if len(kinds) > 1 {
+		seen["mfa"] = true
+	}
+
+	amr := make([]string, 0, len(seen))
+	for value := range seen {
+		amr = append(amr, value)
+	}
+	sort.Strings(amr)
+	return amr
+}
+
+// VerifyPKCE checks a PKCE code verifier against the S256 code challenge sent when the code was requested
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// SignIDToken signs ID token claims with RS256, naming the key in the header
+func SignIDToken(key *rsa.PrivateKey, kid string, claims map[string]interface{}) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(claims))
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// PublicJWK returns the public part of a signing key as a JSON Web Key
+func PublicJWK(key *rsa.PublicKey, kid string) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// The example from RFC 7636 appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"matching verifier", verifier, challenge, true},
+		{"different verifier", strings.Replace(verifier, "d", "e", 1), challenge, false},
+		{"plain challenge", verifier, verifier, false},
+		{"missing verifier", "", challenge, false},
+		{"missing challenge", verifier, "", false},
+		{"verifier too short", verifier[:42], challenge, false},
+		{"verifier too long", strings.Repeat("a", 129), challenge, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPKCE(tt.verifier, tt.challenge); got != tt.want {
+				t.Errorf("VerifyPKCE = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMR(t *testing.T) {
+	tests := []struct {
+		name    string
+		factors []string
+		want    []string
+	}{
+		{"password", []string{FactorPassword}, []string{"pwd"}},
+		{"password and TOTP", []string{FactorPassword, FactorTOTP}, []string{"mfa", "otp", "pwd"}},
+		{"password and SMS", []string{FactorPassword, FactorSMSOTP}, []string{"mfa", "otp", "pwd", "sms"}},
+		{"OAuth and security key", []string{FactorOAuth, FactorWebAuthn}, []string{"hwk", "mfa"}},
+		{"OAuth only", []string{FactorOAuth}, []string{}},
+		{"two kinds of code", []string{FactorTOTP, FactorRecoveryCode}, []string{"otp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &AuthState{}
+			for _, factor := range tt.factors {
+				state.MarkFactor(factor)
+			}
+
+			if got := AMR(state); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AMR = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Channels one-time codes can be delivered through
+const (
+	OTPChannelEmail = "email"
+	OTPChannelSMS   = "sms"
+)
+
+// otpCodeDigits is the length of a delivered one-time code
+const otpCodeDigits = 6
+
+// Sender delivers a one-time code to an email address or phone number
+type Sender interface {
+	SendCode(to, code string) error
+}
+
+// Global senders by channel
+var (
+	otpSenders      = make(map[string]Sender)
+	otpSendersMutex sync.RWMutex
+)
+
+// InitOTPSenders initializes the senders for one-time codes from the environment.
+// Email codes go through the mailer. SMS codes are posted to SMS_WEBHOOK_URL,
+// or only kept in memory and logged when it is not set.
+func InitOTPSenders() {
+	SetOTPSender(OTPChannelEmail, &EmailSender{})
+
+	if url := os.Getenv("SMS_WEBHOOK_URL"); url != "" {
+		SetOTPSender(OTPChannelSMS, &WebhookSMSSender{
+			URL:    url,
+			Token:  os.Getenv("SMS_WEBHOOK_TOKEN"),
+			Client: &http.Client{Timeout: 10 * time.Second},
+		})
+		log.Printf("SMS codes will be sent through the webhook")
+	} else {
+		SetOTPSender(OTPChannelSMS, &MemorySender{Log: true})
+		log.Printf("SMS_WEBHOOK_URL not set, SMS codes will be written to the log")
+	}
+}
+
+// SetOTPSender replaces the sender for a channel
+func SetOTPSender(channel string, sender Sender) {
+	otpSendersMutex.Lock()
+	defer otpSendersMutex.Unlock()
+	otpSenders[channel] = sender
+}
+
+// GetOTPSender returns the sender for a channel
+func GetOTPSender(channel string) (Sender, error) {
+	otpSendersMutex.RLock()
+	sender, ok := otpSenders[channel]
+	otpSendersMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no sender configured for %q codes", channel)
+	}
+	return sender, nil
+}
+
+// GenerateOTPCode returns a random numeric one-time code
+func GenerateOTPCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < otpCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", otpCodeDigits, n), nil
+}
+
+// phoneNumberPattern matches a phone number in E.164 format
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizePhoneNumber removes spaces and punctuation from a phone number and
+// checks that it is in international format, such as +15551234567
+func NormalizePhoneNumber(phone string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+
+	if !phoneNumberPattern.MatchString(phone) {
+		return "", fmt.Errorf("invalid phone number %q", phone)
+	}
+	return phone, nil
+}
+
+// HashOTPCode hashes a one-time code. Codes are short, so they get bcrypt like recovery codes.
+func HashOTPCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), recoveryCodeCost)
+	return string(hash), err
+}
+
+// CheckOTPCodeHash compares a one-time code with a hash
+func CheckOTPCodeHash(code, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil
+}
+
+// EmailSender emails one-time codes with the global mailer
+type EmailSender struct{}
+
+// SendCode emails a code
+func (s *EmailSender) SendCode(to, code string) error {
+	return SendMail(Message{
+		To:      to,
+		Subject: "Your sign-in code",
+		Body: fmt.Sprintf("Your sign-in code is %s\n\n"+
+			"It expires in a few minutes. If you didn't try to sign in, change your password.\n", code),
+	})
+}
+
+// WebhookSMSSender posts one-time codes as JSON to an SMS gateway webhook:
+// {"to": "+15551234567", "message": "..."}. Token is sent as a bearer token when set.
+type WebhookSMSSender struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// SendCode posts a code to the webhook
+func (s *WebhookSMSSender) SendCode(to, code string) error {
+	body, err := json.Marshal(map[string]string{
+		"to":      to,
+		"message": fmt.Sprintf("Your sign-in code is %s", code),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call SMS webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SentCode is a code delivered by a MemorySender
+type SentCode struct {
+	To   string
+	Code string
+}
+
+// MemorySender keeps delivered codes in memory instead of sending them, and
+// writes them to the log when Log is set. It is meant for development and tests.
+type MemorySender struct {
+	Log  bool
+	mu   sync.Mutex
+	sent []SentCode
+}
+
+// SendCode records a code
+func (s *MemorySender) SendCode(to, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, SentCode{To: to, Code: code})
+	if s.Log {
+		log.Printf("One-time code for %s: %s", to, code)
+	}
+	return nil
+}
+
+// LastCode returns the most recent code sent to a destination, or an empty string
+func (s *MemorySender) LastCode(to string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.sent) - 1; i >= 0; i-- {
+		if s.sent[i].To == to {
+			return s.sent[i].Code
+		}
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RecoveryCodeCount is the number of recovery codes issued to a user at once
+const RecoveryCodeCount = 10
+
+// recoveryCodeCost is the bcrypt cost used for recovery codes. It is lower than
+// the password cost because a login attempt may compare against every code.
+const recoveryCodeCost = bcrypt.DefaultCost
+
+// GenerateRecoveryCodes generates a set of random single-use recovery codes
+func GenerateRecoveryCodes(count int) ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+
+		// Format as two groups of five characters, e.g. "abcde-fghij"
+		code := strings.ToLower(encoding.EncodeToString(raw))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, nil
+}
+
+// NormalizeRecoveryCode strips spaces and dashes and lowercases a recovery code
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// HashRecoveryCode hashes a recovery code using bcrypt
+func HashRecoveryCode(code string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(NormalizeRecoveryCode(code)), recoveryCodeCost)
+	return string(bytes), err
+}
+
+// CheckRecoveryCodeHash compares a recovery code with a hash
+func CheckRecoveryCodeHash(code, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(NormalizeRecoveryCode(code)))
+	return err == nil
+}
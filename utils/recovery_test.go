@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q does not match the xxxxx-xxxxx format", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestCheckRecoveryCodeHash(t *testing.T) {
+	hash, err := HashRecoveryCode("abcde-fghij")
+	if err != nil {
+		t.Fatalf("HashRecoveryCode: %v", err)
+	}
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"abcde-fghij", true},
+		{"abcdefghij", true},
+		{"ABCDE-FGHIJ", true},
+		{" abcde fghij ", true},
+		{"abcde-fghik", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := CheckRecoveryCodeHash(tt.code, hash); got != tt.want {
+			t.Errorf("CheckRecoveryCodeHash(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
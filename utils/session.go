@@ -4,47 +4,48 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
 
 // Global session store
-var sessionStore *sessions.CookieStore
+var (
+	sessionStore     *SQLiteStore
+	sessionStoreOnce sync.Once
+)
 
-// InitSessionStore initializes the global session store
+// InitSessionStore initializes the global session store. Only the first call
+// has any effect, so there is never more than one store or cleanup goroutine.
 func InitSessionStore() {
-	key := os.Getenv("SESSION_KEY")
-	if key == "" {
-		key = "login-form-session-key-please-change-in-production"
-		log.Printf("Warning: SESSION_KEY not set, using default key")
-	}
-	
-	sessionStore = sessions.NewCookieStore([]byte(key))
-	sessionStore.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
-		HttpOnly: true,
-	}
-	
-	log.Printf("Session store initialized")
+	sessionStoreOnce.Do(func() {
+		sessionStore = NewSQLiteStore([]byte(GetSessionKey()))
+
+		// Expired sessions are removed in the background
+		go sessionStore.cleanupLoop(time.Hour)
+
+		log.Printf("Session store initialized")
+	})
+}
+
+// Helper function to start a fresh session that uses the store's cookie options
+func newEmptySession(r *http.Request) *sessions.Session {
+	session, _ := sessionStore.New(r, "auth-session")
+	session.ID = ""
+	session.IsNew = true
+	session.Values = make(map[interface{}]interface{})
+	return session
 }
 
 // GetSession returns a session for the given request
 func GetSession(r *http.Request) (*sessions.Session, error) {
-	if sessionStore == nil {
-		InitSessionStore()
-	}
+	InitSessionStore()
 	session, err := sessionStore.Get(r, "auth-session")
 	if err != nil {
 		log.Printf("Error getting session: %v", err)
 		// Try to recover by creating a new session
-		session = sessions.NewSession(sessionStore, "auth-session")
-		session.Options = &sessions.Options{
-			Path:     "/",
-			MaxAge:   86400 * 7, // 7 days
-			HttpOnly: true,
-		}
-		return session, nil
+		return newEmptySession(r), nil
 	}
 	return session, nil
 }
@@ -60,9 +61,7 @@ func SaveSession(session *sessions.Session, w http.ResponseWriter, r *http.Reque
 
 // GetSessionStore returns the global session store
 func GetSessionStore() sessions.Store {
-	if sessionStore == nil {
-		InitSessionStore()
-	}
+	InitSessionStore()
 	return sessionStore
 }
 
@@ -83,12 +82,7 @@ func FixSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, erro
 	if err != nil {
 		log.Printf("Error getting session in FixSession: %v, creating new session", err)
 		// Create a new session
-		session = sessions.NewSession(sessionStore, "auth-session")
-		session.Options = &sessions.Options{
-			Path:     "/",
-			MaxAge:   86400 * 7, // 7 days
-			HttpOnly: true,
-		}
+		session = newEmptySession(r)
 	}
 	
 	// Save the session to ensure it's valid
@@ -98,6 +92,6 @@ func FixSession(w http.ResponseWriter, r *http.Request) (*sessions.Session, erro
 		return session, err
 	}
 	
-	log.Printf("Session fixed successfully, values: %+v", session.Values)
+	log.Printf("Session fixed successfully")
 	return session, nil
 }
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aungh/login-form/database"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionTouchInterval limits how often last_seen_at is written for a busy session
+const sessionTouchInterval = time.Minute
+
+// maxUserAgentLength caps the stored User-Agent header
+const maxUserAgentLength = 255
+
+// SQLiteStore is a sessions.Store that keeps session data in the sessions
+// table. The cookie only carries the signed session ID, so sessions can be
+// listed and revoked on the server.
+type SQLiteStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// NewSQLiteStore creates a SQLite session store whose cookies are signed with
+// the given key pairs. Cookies are only sent over HTTPS when the app is served
+// over HTTPS, and not on cross-site subrequests.
+func NewSQLiteStore(keyPairs ...[]byte) *SQLiteStore {
+	return &SQLiteStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 7, // 7 days
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(BaseURL(), "https://"),
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+// Get returns a cached session for the request, loading it on first use
+func (s *SQLiteStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named in the request cookie, or returns a new one
+// when the cookie is missing, invalid, expired or revoked
+func (s *SQLiteStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		// Cookies from the old cookie store or a different key are simply replaced
+		return session, nil
+	}
+
+	found, err := s.load(session, id)
+	if err != nil {
+		return session, err
+	}
+	if found {
+		session.ID = id
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+// Save persists the session and writes the session cookie. A session without
+// values, such as a visitor's who only viewed a page, is not stored.
+func (s *SQLiteStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// A negative MaxAge deletes the session
+	if session.Options.MaxAge < 0 {
+		return s.delete(w, session)
+	}
+
+	userID := sessionUserID(session)
+
+	if session.ID != "" {
+		var storedUserID sql.NullInt64
+		err := database.DB.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, session.ID).Scan(&storedUserID)
+		switch {
+		case err == sql.ErrNoRows:
+			// The session was revoked while this request was in flight, so
+			// its values must not bring it back to life
+			session.ID = ""
+			session.Values = make(map[interface{}]interface{})
+			userID = nil
+		case err != nil:
+			return err
+		case userID != nil && (!storedUserID.Valid || storedUserID.Int64 != int64(*userID)):
+			// Issue a fresh ID whenever a user signs in to prevent session fixation
+			if _, err := database.DB.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID); err != nil {
+				return err
+			}
+			session.ID = ""
+		}
+	}
+
+	if len(session.Values) == 0 {
+		if session.ID == "" {
+			return nil
+		}
+		return s.delete(w, session)
+	}
+
+	if session.ID == "" {
+		session.ID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(session.Options.MaxAge) * time.Second)
+
+	_, err = database.DB.Exec(`
+	INSERT INTO sessions (id, user_id, data, ip_address, user_agent, created_at, last_seen_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		user_id = excluded.user_id,
+		data = excluded.data,
+		ip_address = excluded.ip_address,
+		user_agent = excluded.user_agent,
+		last_seen_at = excluded.last_seen_at,
+		expires_at = excluded.expires_at
+	`, session.ID, userID, data, ClientIP(r), userAgent, now, now, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// delete removes a stored session and expires its cookie
+func (s *SQLiteStore) delete(w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID != "" {
+		if _, err := database.DB.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+
+	options := *session.Options
+	options.MaxAge = -1
+	http.SetCookie(w, sessions.NewCookie(session.Name(), "", &options))
+	return nil
+}
+
+// load reads a stored session into the given session, reporting whether it was found
+func (s *SQLiteStore) load(session *sessions.Session, id string) (bool, error) {
+	var data []byte
+	var expiresAt, lastSeenAt time.Time
+	err := database.DB.QueryRow(
+		`SELECT data, expires_at, last_seen_at FROM sessions WHERE id = ?`, id,
+	).Scan(&data, &expiresAt, &lastSeenAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if now.After(expiresAt) {
+		database.DB.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+		return false, nil
+	}
+
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return false, err
+	}
+
+	// Record activity for the active sessions list without writing on every request
+	if now.Sub(lastSeenAt) > sessionTouchInterval {
+		database.DB.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, now, id)
+	}
+
+	return true, nil
+}
+
+// Cleanup deletes expired sessions
+func (s *SQLiteStore) Cleanup() error {
+	_, err := database.DB.Exec(`DELETE FROM sessions WHERE expires_at < ?`, time.Now())
+	return err
+}
+
+// cleanupLoop periodically deletes expired sessions
+func (s *SQLiteStore) cleanupLoop(interval time.Duration) {
+	for {
+		if err := s.Cleanup(); err != nil {
+			log.Printf("Error cleaning up expired sessions: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sessionUserID returns the ID of the authenticated user of a session, or nil
+func sessionUserID(session *sessions.Session) *int {
+	auth, _ := session.Values["authenticated"].(bool)
+	if !auth {
+		return nil
+	}
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID <= 0 {
+		return nil
+	}
+	return &userID
+}
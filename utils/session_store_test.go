@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aungh/login-form/database"
+	"github.com/gorilla/sessions"
+)
+
+// setupSessionStore opens and migrates an empty database and returns a store using it
+func setupSessionStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+
+	if err := database.OpenDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+	if err := database.MigrateDB(); err != nil {
+		t.Fatalf("MigrateDB: %v", err)
+	}
+
+	for _, email := range []string{"one@example.com", "two@example.com"} {
+		if _, err := database.DB.Exec(`INSERT INTO users (email, password_hash) VALUES (?, '')`, email); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+	}
+
+	return NewSQLiteStore([]byte("test-session-key"))
+}
+
+// saveTestSession saves a session and returns the cookie it set, if any
+func saveTestSession(t *testing.T, store *SQLiteStore, session *sessions.Session) *http.Cookie {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), rec, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == session.Name() {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// loadTestSession loads the session a cookie refers to
+func loadTestSession(t *testing.T, store *SQLiteStore, cookie *http.Cookie) *sessions.Session {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	session, err := store.New(r, "auth-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return session
+}
+
+// countSessions returns the number of stored sessions
+func countSessions(t *testing.T) int {
+	t.Helper()
+
+	var count int
+	if err := database.DB.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&count); err != nil {
+		t.Fatalf("count sessions: %v", err)
+	}
+	return count
+}
+
+func TestSQLiteStoreEmptySessions(t *testing.T) {
+	store := setupSessionStore(t)
+
+	// A visitor who only views a page leaves nothing behind
+	session := loadTestSession(t, store, nil)
+	if cookie := saveTestSession(t, store, session); cookie != nil || countSessions(t) != 0 {
+		t.Fatalf("empty session was stored: cookie %v, %d rows", cookie, countSessions(t))
+	}
+
+	session.Values["flash"] = "hello"
+	cookie := saveTestSession(t, store, session)
+	if cookie == nil || countSessions(t) != 1 {
+		t.Fatalf("session with values was not stored: cookie %v, %d rows", cookie, countSessions(t))
+	}
+
+	// Clearing every value deletes the row and the cookie
+	session = loadTestSession(t, store, cookie)
+	delete(session.Values, "flash")
+	cookie = saveTestSession(t, store, session)
+	if cookie == nil || cookie.MaxAge >= 0 || countSessions(t) != 0 {
+		t.Errorf("emptied session was kept: cookie %v, %d rows", cookie, countSessions(t))
+	}
+}
+
+func TestSQLiteStoreCookieOptions(t *testing.T) {
+	tests := []struct {
+		baseURL    string
+		wantSecure bool
+	}{
+		{"https://login.example.com", true},
+		{"http://localhost:8081", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("APP_BASE_URL", tt.baseURL)
+		store := setupSessionStore(t)
+
+		session := loadTestSession(t, store, nil)
+		session.Values["flash"] = "hello"
+		cookie := saveTestSession(t, store, session)
+		if cookie == nil {
+			t.Fatalf("%q: no cookie set", tt.baseURL)
+		}
+		if cookie.Secure != tt.wantSecure || cookie.SameSite != http.SameSiteLaxMode || !cookie.HttpOnly {
+			t.Errorf("%q: cookie Secure=%v SameSite=%v HttpOnly=%v, want Secure=%v, Lax, HttpOnly",
+				tt.baseURL, cookie.Secure, cookie.SameSite, cookie.HttpOnly, tt.wantSecure)
+		}
+	}
+}
+
+func TestSQLiteStoreRegeneratesIDOnLogin(t *testing.T) {
+	store := setupSessionStore(t)
+
+	session := loadTestSession(t, store, nil)
+	session.Values["flash"] = "hello"
+	anonymous := saveTestSession(t, store, session)
+	anonymousID := session.ID
+
+	// The steps run in order against the same session
+	tests := []struct {
+		name    string
+		userID  int
+		wantNew bool
+	}{
+		{"signing in", 1, true},
+		{"saving again", 1, false},
+		{"switching user", 2, true},
+	}
+
+	cookie := anonymous
+	for _, tt := range tests {
+		session := loadTestSession(t, store, cookie)
+		before := session.ID
+		session.Values["authenticated"] = true
+		session.Values["user_id"] = tt.userID
+		cookie = saveTestSession(t, store, session)
+
+		if (session.ID != before) != tt.wantNew {
+			t.Errorf("%s: ID changed = %v, want %v", tt.name, session.ID != before, tt.wantNew)
+		}
+		if tt.wantNew && loadTestSession(t, store, cookie).ID != session.ID {
+			t.Errorf("%s: the new cookie doesn't load the session", tt.name)
+		}
+	}
+
+	// The ID the visitor had before signing in no longer leads anywhere
+	if old := loadTestSession(t, store, anonymous); !old.IsNew || old.ID == anonymousID {
+		t.Errorf("pre-login session %q still loads", anonymousID)
+	}
+	if countSessions(t) != 1 {
+		t.Errorf("%d sessions stored, want 1", countSessions(t))
+	}
+}
+
+func TestSQLiteStoreRevocation(t *testing.T) {
+	store := setupSessionStore(t)
+
+	session := loadTestSession(t, store, nil)
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = 1
+	cookie := saveTestSession(t, store, session)
+
+	// A request loads the session before it is revoked elsewhere
+	inFlight := loadTestSession(t, store, cookie)
+	if inFlight.IsNew {
+		t.Fatal("stored session didn't load")
+	}
+	if _, err := database.DB.Exec(`DELETE FROM sessions WHERE user_id = 1`); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	if revoked := loadTestSession(t, store, cookie); !revoked.IsNew || len(revoked.Values) != 0 {
+		t.Errorf("revoked session still loads with values %v", revoked.Values)
+	}
+
+	// Saving the in-flight request doesn't bring the session back
+	inFlight.Values["flash"] = "saved late"
+	saveTestSession(t, store, inFlight)
+	if countSessions(t) != 0 {
+		t.Errorf("revoked session was stored again")
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy describes how failed authentication attempts are throttled
+type LockoutPolicy struct {
+	// AccountThreshold is the number of failures after which an account is locked
+	AccountThreshold int
+	// IPThreshold is the number of failures after which an IP address is locked
+	IPThreshold int
+	// LockoutDuration is how long a lockout lasts
+	LockoutDuration time.Duration
+	// BaseDelay is the wait enforced after the second failure; it doubles with each further failure
+	BaseDelay time.Duration
+	// MaxDelay caps the progressive delay
+	MaxDelay time.Duration
+}
+
+// Global lockout policy, loaded once
+var (
+	lockoutPolicy     LockoutPolicy
+	lockoutPolicyOnce sync.Once
+)
+
+// GetLockoutPolicy returns the lockout policy, loading it from the environment on first use
+func GetLockoutPolicy() LockoutPolicy {
+	lockoutPolicyOnce.Do(func() {
+		lockoutPolicy = LockoutPolicy{
+			AccountThreshold: envInt("LOCKOUT_ACCOUNT_THRESHOLD", 5),
+			IPThreshold:      envInt("LOCKOUT_IP_THRESHOLD", 20),
+			LockoutDuration:  time.Duration(envInt("LOCKOUT_DURATION_MINUTES", 15)) * time.Minute,
+			BaseDelay:        time.Second,
+			MaxDelay:         30 * time.Second,
+		}
+	})
+	return lockoutPolicy
+}
+
+// Delay returns how long a client must wait before the next attempt after the given number of failures
+func (p LockoutPolicy) Delay(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := 2; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// ClientIP returns the IP address of the client making the request.
+// X-Forwarded-For is only honoured when TRUST_PROXY_HEADERS is "true".
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// envInt reads a positive integer from the environment, falling back to a default
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Warning: invalid %s %q, using default %d", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := LockoutPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{6, 16 * time.Second},
+		{7, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"remote address", "", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted forwarded header", "", "192.0.2.1:1234", "203.0.113.9", "192.0.2.1"},
+		{"trusted forwarded header", "true", "192.0.2.1:1234", "203.0.113.9, 10.0.0.1", "203.0.113.9"},
+		{"trusted proxy without header", "true", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"address without port", "", "192.0.2.1", "", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUST_PROXY_HEADERS", tt.trustProxy)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
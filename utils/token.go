@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// secureTokenBytes is the amount of randomness in a generated token
+const secureTokenBytes = 32
+
+// GenerateSecureToken returns a random URL-safe token
+func GenerateSecureToken() (string, error) {
+	raw := make([]byte, secureTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// HashToken returns the SHA-256 hash of a token for storage. Unlike passwords,
+// generated tokens are high-entropy, so a fast hash that can be looked up is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,86 +2,253 @@ package utils
 
 import (
 	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
 	"github.com/pquerna/otp/totp"
 	"github.com/skip2/go-qrcode"
 )
 
+// TOTPParams are the parameters an authenticator app was enrolled with. They
+// are stored with each user's secret, since codes only validate with the same ones.
+type TOTPParams struct {
+	// Algorithm is SHA1, SHA256 or SHA512
+	Algorithm string
+	// Digits is 6 or 8
+	Digits int
+	// Period is the number of seconds each code is valid for
+	Period int
+}
+
+// LegacyTOTPParams are the parameters used for enrollments made before they were configurable
+var LegacyTOTPParams = TOTPParams{Algorithm: "SHA1", Digits: 6, Period: 30}
+
+// TOTPConfig describes how new TOTP enrollments are created and how codes are checked
+type TOTPConfig struct {
+	TOTPParams
+	// Issuer is the name authenticator apps show for the account
+	Issuer string
+	// Skew is the number of periods before and after the current one that are accepted
+	Skew int
+}
+
+// Global TOTP configuration, loaded once
+var (
+	totpConfig     TOTPConfig
+	totpConfigOnce sync.Once
+)
+
+// GetTOTPConfig returns the TOTP configuration, loading it from the environment on first use
+func GetTOTPConfig() TOTPConfig {
+	totpConfigOnce.Do(func() {
+		totpConfig = loadTOTPConfig()
+	})
+	return totpConfig
+}
+
+// loadTOTPConfig reads the TOTP configuration from the environment
+func loadTOTPConfig() TOTPConfig {
+	config := TOTPConfig{
+		TOTPParams: TOTPParams{
+			Algorithm: strings.ToUpper(os.Getenv("TOTP_ALGORITHM")),
+			Digits:    envInt("TOTP_DIGITS", LegacyTOTPParams.Digits),
+			Period:    envInt("TOTP_PERIOD", LegacyTOTPParams.Period),
+		},
+		Issuer: os.Getenv("TOTP_ISSUER"),
+		Skew:   1,
+	}
+	if config.Algorithm == "" {
+		config.Algorithm = LegacyTOTPParams.Algorithm
+	}
+	if config.Issuer == "" {
+		config.Issuer = "Login Form App"
+	}
+	if value := os.Getenv("TOTP_SKEW"); value != "" {
+		skew, err := strconv.Atoi(value)
+		if err != nil || skew < 0 {
+			log.Printf("Warning: invalid TOTP_SKEW %q, using default %d", value, config.Skew)
+		} else {
+			config.Skew = skew
+		}
+	}
+	if err := config.Validate(); err != nil {
+		log.Printf("Warning: %v, using default TOTP parameters", err)
+		config.TOTPParams = LegacyTOTPParams
+	}
+	return config
+}
+
+// Validate checks that the parameters are supported by authenticator apps
+func (p TOTPParams) Validate() error {
+	if _, err := p.algorithm(); err != nil {
+		return err
+	}
+	if p.Digits != 6 && p.Digits != 8 {
+		return fmt.Errorf("unsupported TOTP digits %d", p.Digits)
+	}
+	if p.Period <= 0 {
+		return fmt.Errorf("invalid TOTP period %d", p.Period)
+	}
+	return nil
+}
+
+// algorithm returns the otp package constant for the algorithm name
+func (p TOTPParams) algorithm() (otp.Algorithm, error) {
+	switch p.Algorithm {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported TOTP algorithm %q", p.Algorithm)
+	}
+}
+
+// secretSize returns the secret length in bytes recommended for the algorithm
+func (p TOTPParams) secretSize() uint {
+	switch p.Algorithm {
+	case "SHA256":
+		return 32
+	case "SHA512":
+		return 64
+	default:
+		return 20
+	}
+}
+
 // Generate2FASecret generates a new TOTP secret for 2FA
-func Generate2FASecret() (string, error) {
+func Generate2FASecret(config TOTPConfig) (string, error) {
+	algorithm, err := config.algorithm()
+	if err != nil {
+		return "", err
+	}
+
 	// Use the library's built-in key generation which is more reliable
 	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Login Form App",
-		AccountName: "user", // This will be replaced in the QR code generation
-		SecretSize:  20,
-		Algorithm:   otp.AlgorithmSHA1,
-		Digits:      otp.DigitsSix,
-		Period:      30,
+		Issuer:      config.Issuer,
+		AccountName: "user", // The account name only matters for the otpauth URI
+		SecretSize:  config.secretSize(),
+		Algorithm:   algorithm,
+		Digits:      otp.Digits(config.Digits),
+		Period:      uint(config.Period),
 	})
 	if err != nil {
 		return "", err
 	}
-	
+
 	// Return the secret in base32 encoding
 	return key.Secret(), nil
 }
 
+// TOTPURI returns the otpauth:// URI authenticator apps enroll from
+func TOTPURI(config TOTPConfig, secret, accountName string) string {
+	query := url.Values{}
+	query.Set("period", strconv.Itoa(config.Period))
+	return otpauthURI("totp", config, secret, accountName, query)
+}
+
+// otpauthURI builds an otpauth:// URI of the given type with the common parameters added to query
+func otpauthURI(otpType string, config TOTPConfig, secret, accountName string, query url.Values) string {
+	query.Set("secret", secret)
+	query.Set("issuer", config.Issuer)
+	query.Set("algorithm", config.Algorithm)
+	query.Set("digits", strconv.Itoa(config.Digits))
+
+	// The label is "issuer:account", so a colon inside either part must be escaped too
+	label := escapeTOTPLabel(config.Issuer) + ":" + escapeTOTPLabel(accountName)
+
+	// Some authenticator apps don't decode "+" as a space
+	return "otpauth://" + otpType + "/" + label + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// escapeTOTPLabel escapes one part of an otpauth URI label
+func escapeTOTPLabel(value string) string {
+	return strings.ReplaceAll(url.PathEscape(value), ":", "%3A")
+}
+
 // GenerateQRCodePNG generates a QR code as PNG bytes for 2FA setup
-func GenerateQRCodePNG(secret, email string) ([]byte, error) {
-	// Create the proper TOTP URL with the provided secret
-	otpURL := "otpauth://totp/" + 
-		"Login%20Form%20App:" + email + 
-		"?secret=" + secret + 
-		"&issuer=Login%20Form%20App" + 
-		"&algorithm=SHA1" + 
-		"&digits=6" + 
-		"&period=30"
-	
-	// Generate QR code image from the URL directly to PNG bytes
-	pngBytes, err := qrcode.Encode(otpURL, qrcode.Medium, 200)
+func GenerateQRCodePNG(config TOTPConfig, secret, accountName string) ([]byte, error) {
+	return QRCodePNG(TOTPURI(config, secret, accountName))
+}
+
+// QRCodePNG encodes an otpauth:// URI as a QR code in PNG format
+func QRCodePNG(uri string) ([]byte, error) {
+	// Generate QR code image from the URI directly to PNG bytes
+	pngBytes, err := qrcode.Encode(uri, qrcode.Medium, 200)
 	if err != nil {
 		return nil, err
 	}
-	
+
 	return pngBytes, nil
 }
 
 // Generate2FAQRCode generates a QR code for 2FA setup as a data URL
-func Generate2FAQRCode(secret, email string) (string, error) {
+func Generate2FAQRCode(config TOTPConfig, secret, accountName string) (string, error) {
 	// Get the PNG bytes
-	pngBytes, err := GenerateQRCodePNG(secret, email)
+	pngBytes, err := GenerateQRCodePNG(config, secret, accountName)
 	if err != nil {
 		return "", err
 	}
-	
+
 	// Convert to base64
 	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngBytes), nil
 }
 
-// Validate2FA validates a 2FA code
-func Validate2FA(secret, code string) (bool, error) {
+// Validate2FA validates a 2FA code enrolled with the given parameters
+func Validate2FA(params TOTPParams, secret, code string) (bool, error) {
+	_, valid, err := Validate2FAStep(params, secret, code, 0)
+	return valid, err
+}
+
+// Validate2FAStep validates a 2FA code and returns the time-step it matched.
+// Only steps strictly greater than lastStep are accepted, so a code that was
+// already used cannot be replayed while it is still inside the skew window.
+func Validate2FAStep(params TOTPParams, secret, code string, lastStep int64) (int64, bool, error) {
+	algorithm, err := params.algorithm()
+	if err != nil {
+		return 0, false, err
+	}
+	if params.Period <= 0 {
+		return 0, false, fmt.Errorf("invalid TOTP period %d", params.Period)
+	}
+
 	// Remove spaces from code
 	code = strings.ReplaceAll(code, " ", "")
-	
-	// Validate code using proper TOTP validation with more options
-	valid, err := totp.ValidateCustom(
-		code,
-		secret,
-		time.Now(),
-		totp.ValidateOpts{
-			Period:    30,
-			Skew:      1,       // Allow 1 period skew to account for time drift
-			Digits:    otp.DigitsSix,
-			Algorithm: otp.AlgorithmSHA1,
-		},
-	)
-	
-	if err != nil {
-		return false, err
+
+	current := time.Now().Unix() / int64(params.Period)
+
+	// Check the current step first, then the neighbouring ones
+	steps := []int64{current}
+	for i := int64(1); i <= int64(GetTOTPConfig().Skew); i++ {
+		steps = append(steps, current-i, current+i)
 	}
-	
-	return valid, nil
+
+	for _, step := range steps {
+		if step <= lastStep || step < 0 {
+			continue
+		}
+
+		valid, err := hotp.ValidateCustom(code, uint64(step), secret, hotp.ValidateOpts{
+			Digits:    otp.Digits(params.Digits),
+			Algorithm: algorithm,
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		if valid {
+			return step, true, nil
+		}
+	}
+
+	return 0, false, nil
 }
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// otpCode generates the code for a counter or time-step
+func otpCode(t *testing.T, params TOTPParams, secret string, counter int64) string {
+	t.Helper()
+	algorithm, err := params.algorithm()
+	if err != nil {
+		t.Fatalf("algorithm: %v", err)
+	}
+	code, err := hotp.GenerateCodeCustom(secret, uint64(counter), hotp.ValidateOpts{
+		Digits:    otp.Digits(params.Digits),
+		Algorithm: algorithm,
+	})
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+func TestValidate2FAStep(t *testing.T) {
+	// A long period keeps the current step from changing while the test runs
+	params := TOTPParams{Algorithm: "SHA256", Digits: 8, Period: 1 << 28}
+	current := time.Now().Unix() / int64(params.Period)
+	skew := int64(GetTOTPConfig().Skew)
+
+	tests := []struct {
+		name      string
+		step      int64
+		lastStep  int64
+		wantValid bool
+	}{
+		{"current step", current, 0, true},
+		{"previous step within skew", current - skew, 0, true},
+		{"next step within skew", current + skew, 0, true},
+		{"step outside skew", current + skew + 1, 0, false},
+		{"replayed step", current, current, false},
+		{"step before the last used one", current - skew, current, false},
+		{"step after the last used one", current + skew, current, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := otpCode(t, params, testTOTPSecret, tt.step)
+
+			step, valid, err := Validate2FAStep(params, testTOTPSecret, code, tt.lastStep)
+			if err != nil {
+				t.Fatalf("Validate2FAStep: %v", err)
+			}
+			if valid != tt.wantValid {
+				t.Fatalf("valid = %v, want %v", valid, tt.wantValid)
+			}
+			if valid && step != tt.step {
+				t.Errorf("matched step %d, want %d", step, tt.step)
+			}
+		})
+	}
+}
+
+func TestValidate2FAStepParams(t *testing.T) {
+	code := otpCode(t, LegacyTOTPParams, testTOTPSecret, time.Now().Unix()/30)
+	wrongCode := code[:5] + string('0'+(code[5]-'0'+1)%10)
+
+	tests := []struct {
+		name    string
+		params  TOTPParams
+		code    string
+		want    bool
+		wantErr bool
+	}{
+		{"enrolled parameters", LegacyTOTPParams, code, true, false},
+		{"code with spaces", LegacyTOTPParams, code[:3] + " " + code[3:], true, false},
+		{"different algorithm", TOTPParams{Algorithm: "SHA512", Digits: 6, Period: 30}, code, false, false},
+		{"wrong code", LegacyTOTPParams, wrongCode, false, false},
+		{"unsupported algorithm", TOTPParams{Algorithm: "MD5", Digits: 6, Period: 30}, code, false, true},
+		{"invalid period", TOTPParams{Algorithm: "SHA1", Digits: 6}, code, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := Validate2FA(tt.params, testTOTPSecret, tt.code)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate2FA error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if valid != tt.want {
+				t.Errorf("Validate2FA = %v, want %v", valid, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPParamsValidate(t *testing.T) {
+	tests := []struct {
+		params  TOTPParams
+		wantErr bool
+	}{
+		{LegacyTOTPParams, false},
+		{TOTPParams{Algorithm: "SHA512", Digits: 8, Period: 60}, false},
+		{TOTPParams{Algorithm: "SHA1", Digits: 7, Period: 30}, true},
+		{TOTPParams{Algorithm: "sha1", Digits: 6, Period: 30}, true},
+		{TOTPParams{Algorithm: "SHA1", Digits: 6, Period: 0}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.params.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.Validate() error = %v, wantErr %v", tt.params, err, tt.wantErr)
+		}
+	}
+}
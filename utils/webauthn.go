@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Global WebAuthn relying party
+var webAuthn *webauthn.WebAuthn
+
+// InitWebAuthn initializes the WebAuthn relying party from the environment
+func InitWebAuthn() error {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+
+	origin := os.Getenv("WEBAUTHN_RP_ORIGIN")
+	if origin == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8081"
+		}
+		origin = "http://localhost:" + port
+	}
+
+	var err error
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: "Login Form App",
+		RPID:          rpID,
+		RPOrigins:     []string{origin},
+		// Attestation is not verified, so don't ask authenticators for it
+		AttestationPreference: protocol.PreferNoAttestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("WebAuthn initialized for RP ID %s, origin %s", rpID, origin)
+	return nil
+}
+
+// GetWebAuthn returns the global WebAuthn relying party
+func GetWebAuthn() *webauthn.WebAuthn {
+	if webAuthn == nil {
+		if err := InitWebAuthn(); err != nil {
+			log.Printf("Error initializing WebAuthn: %v", err)
+		}
+	}
+	return webAuthn
+}
+
+// WebAuthnUser adapts an application user to the webauthn.User interface
+type WebAuthnUser struct {
+	ID          int
+	Name        string
+	DisplayName string
+	Credentials []webauthn.Credential
+}
+
+// WebAuthnID returns the user handle, which is the user ID as 8 big-endian bytes
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(u.ID))
+	return handle
+}
+
+// WebAuthnName returns the account name shown by the authenticator
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.Name
+}
+
+// WebAuthnDisplayName returns the human-friendly name shown by the authenticator
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	if u.DisplayName == "" {
+		return u.Name
+	}
+	return u.DisplayName
+}
+
+// WebAuthnCredentials returns the credentials registered by the user
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}